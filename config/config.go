@@ -23,6 +23,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"time"
 
 	"github.com/sgotti/gomailsync/log"
@@ -42,6 +43,45 @@ type SyncgroupConfig struct {
 	Concurrentsyncs uint8
 	SyncInterval    duration
 	Deletemode      string
+
+	// The operations propagated from the first store to the second one
+	// (Ops1to2) and from the second to the first one (Ops2to1). Any of
+	// "create" (folders), "new" (messages), "delete", "flags" or one of "all"
+	// and "none". Empty is "all".
+	Ops1to2 []string
+	Ops2to1 []string
+
+	// Folder names mapping from the first store to the second one. Pairs
+	// of folder names and pairs of regexps rewriting the matching names
+	// (see the mailsync folder mapping)
+	Folderpairs [][]string
+	Folderrules [][]string
+
+	// Mass deletion guard: the sync of a folder fails if more than
+	// maxdeletecount messages or more than maxdeletepercent percent of the
+	// synced messages would be deleted from a store. 0 disables the check.
+	Maxdeletecount   uint
+	Maxdeletepercent uint8
+
+	// Copy the expunged messages in the metadatadir and remove them after
+	// quarantineretention (0 to keep them forever). The moved messages and
+	// the removed Gmail labels aren't quarantined
+	Quarantine          bool
+	Quarantineretention duration
+
+	// Propagate the folder subscriptions between the stores (IMAP and
+	// Maildir ones)
+	Syncsubscriptions bool
+
+	// Detect the messages moved between folders of a store and move them
+	// also on the other store instead of deleting and transferring them
+	// again (deletemode expunge only)
+	Detectmoves bool
+
+	// Where the syncstatus is saved: "sqlite" or "file" (pure Go). Empty
+	// is the backend already used by the syncgroup, else sqlite if
+	// available in the build
+	Syncstatusbackend string
 }
 
 type StoreConfig struct {
@@ -54,6 +94,14 @@ type StoreConfig struct {
 	// !/pattern/
 	RegexpPatterns []string
 
+	// Fsync messages, metadata files and their directories after writing
+	// them. Disabling it is faster but data can be lost on a crash.
+	Fsync bool
+
+	// Sync only the subscribed folders (IMAP and Maildir stores). INBOX is
+	// always synced.
+	Subscribedonly bool
+
 	// Imap specific config options
 	Host               string
 	Port               uint16
@@ -63,10 +111,67 @@ type StoreConfig struct {
 	Tls                bool
 	Validateservercert bool
 	Expunge            bool
+	// Gmail labels mode (needs the X-GM-EXT-1 extension): a message with
+	// multiple labels is transferred only once and hardlinked by the
+	// Maildir stores, adding it to a label folder adds the label
+	Gmail bool
+	// List the folders of these NAMESPACE kinds ("personal", "other",
+	// "shared") instead of everything from the empty reference, optionally
+	// only the namespaces with one of Namespaceprefixes. The personal
+	// namespace prefix is removed from the folder names with
+	// Stripnamespaceprefix.
+	Namespaces           []string
+	Namespaceprefixes    []string
+	Stripnamespaceprefix bool
+
+	// POP3 specific config options (with the IMAP connection ones). Use
+	// APOP instead of USER/PASS authentication
+	Apop bool
+	// Delete the messages from the server once they are added to the
+	// other store and recorded in the syncstatus
+	Deleteafterdownload bool
+
+	// JMAP specific config options. Username and Password are used for
+	// basic authentication when Token (a bearer token) is empty.
+	SessionURL string
+	Token      string
 
 	// Maildir specific config options
 	Maildir string
 
+	// Special-use roles of the folders: pairs of a folder name (with "/"
+	// as separator) and a role like "\\Sent"
+	Folderroles [][]string
+
+	// Character between the unique part and the info (flags) part of
+	// maildir filenames. One of ":", ";" or "!"
+	InfoSeparator string
+
+	// Where to place delivered messages: "cur", "new" or "auto" (messages
+	// without flags in new, the others in cur)
+	NewMessageSubdir string
+
+	// Compress delivered messages: "gzip" or "zstd". Empty to disable
+	Compress string
+
+	// Keep a notmuch database updated with the synced messages and import
+	// the notmuch tag changes as flag changes
+	Notmuch bool
+	// notmuch executable (default "notmuch") and its config file (default
+	// the notmuch one)
+	NotmuchCommand string
+	NotmuchConfig  string
+
+	// Escape in folder names also the characters rejected by non POSIX
+	// filesystems (like exFAT, SMB shares)
+	PortableFolderNames bool
+
+	// Mbox specific config options
+	Mboxdir string
+
+	// MH specific config options
+	MHdir string
+
 	// INBOX Path
 	InboxPath string
 
@@ -90,11 +195,13 @@ func ParseConfig(conffilepath string) (conf *Config, err error) {
 	logger := log.GetLogger(fmt.Sprintf("config"), "debug")
 	logger.Debugf("ParseConfig")
 
-	defaultStoreConfig := StoreConfig{Validateservercert: true, UIDMapping: "files", Separator: os.PathSeparator, InboxPath: "./INBOX"}
+	defaultStoreConfig := StoreConfig{Validateservercert: true, UIDMapping: "files", Separator: os.PathSeparator, InboxPath: "./INBOX", InfoSeparator: ":", NewMessageSubdir: "cur", Fsync: true}
 
 	var syncinterval duration
 	syncinterval.Duration, _ = time.ParseDuration("10m")
-	defaultSyncgroupConfig := SyncgroupConfig{Concurrentsyncs: 1, SyncInterval: syncinterval, Deletemode: "expunge"}
+	var quarantineretention duration
+	quarantineretention.Duration, _ = time.ParseDuration("720h")
+	defaultSyncgroupConfig := SyncgroupConfig{Concurrentsyncs: 1, SyncInterval: syncinterval, Deletemode: "expunge", Quarantineretention: quarantineretention}
 
 	var configfile map[string]interface{}
 	_, err = toml.DecodeFile(conffilepath, &configfile)
@@ -161,12 +268,18 @@ func VerifyStoreConfig(globalconfig *Config, config *StoreConfig) (err error) {
 		return fmt.Errorf("Store name is empty")
 	}
 	errprefix := fmt.Sprintf("[Store: %s] ", config.Name)
-	validstoretypes := []string{"IMAP", "Maildir"}
+	validstoretypes := []string{"IMAP", "JMAP", "POP3", "Maildir", "mbox", "MH", "Memory"}
 	if !StringInSlice(config.StoreType, validstoretypes) {
 		return fmt.Errorf(errprefix+"Wrong store type: \"%s\". Valid types are: %s", config.StoreType, validstoretypes)
 	}
+	if config.Subscribedonly && config.StoreType != "IMAP" && config.StoreType != "Maildir" && config.StoreType != "Memory" {
+		return fmt.Errorf(errprefix + "subscribedonly option is valid only for IMAP and Maildir stores")
+	}
+	if err := verifyNamespaces(config); err != nil {
+		return fmt.Errorf(errprefix+"%s", err)
+	}
 	switch config.StoreType {
-	case "IMAP":
+	case "IMAP", "POP3":
 		if config.Host == "" {
 			return fmt.Errorf(errprefix + "host option is empty")
 		}
@@ -179,6 +292,19 @@ func VerifyStoreConfig(globalconfig *Config, config *StoreConfig) (err error) {
 		if config.Tls && config.Starttls {
 			return fmt.Errorf(errprefix + "Both tls and starttls enabled. Only one of them is permitted.")
 		}
+		if config.Gmail && config.StoreType != "IMAP" {
+			return fmt.Errorf(errprefix + "gmail option is valid only for IMAP stores")
+		}
+		if config.Deleteafterdownload && config.StoreType != "POP3" {
+			return fmt.Errorf(errprefix + "deleteafterdownload option is valid only for POP3 stores")
+		}
+	case "JMAP":
+		if config.SessionURL == "" {
+			return fmt.Errorf(errprefix + "sessionurl option is empty")
+		}
+		if config.Token == "" && (config.Username == "" || config.Password == "") {
+			return fmt.Errorf(errprefix + "token or username and password options are required")
+		}
 	case "Maildir":
 		if config.Maildir == "" {
 			return fmt.Errorf(errprefix + "maildir option is empty")
@@ -196,7 +322,56 @@ func VerifyStoreConfig(globalconfig *Config, config *StoreConfig) (err error) {
 
 		validseparators := []rune{'.', '/'}
 		if !RuneInSlice(config.Separator, validseparators) {
-			return fmt.Errorf(errprefix+"Wrong uidmapping: \"%s\". Valid uidmappings are: %s", config.UIDMapping, validuidmappings)
+			return fmt.Errorf(errprefix+"Wrong separator: \"%c\". Valid separators are: %q", config.Separator, validseparators)
+		}
+
+		validnewmessagesubdirs := []string{"cur", "new", "auto"}
+		if !StringInSlice(config.NewMessageSubdir, validnewmessagesubdirs) {
+			return fmt.Errorf(errprefix+"Wrong newmessagesubdir: \"%s\". Valid values are: %s", config.NewMessageSubdir, validnewmessagesubdirs)
+		}
+
+		validcompressions := []string{"", "gzip", "zstd"}
+		if !StringInSlice(config.Compress, validcompressions) {
+			return fmt.Errorf(errprefix+"Wrong compress: \"%s\". Valid values are: %q", config.Compress, validcompressions)
+		}
+
+		validroles := []string{`\Sent`, `\Drafts`, `\Trash`, `\Junk`, `\Archive`, `\All`, `\Flagged`}
+		roles := make(map[string]bool)
+		for _, folderrole := range config.Folderroles {
+			if len(folderrole) != 2 {
+				return fmt.Errorf(errprefix+"Wrong folderroles entry: %q. It must be a pair of a folder name and a role", folderrole)
+			}
+			if !StringInSlice(folderrole[1], validroles) {
+				return fmt.Errorf(errprefix+"Wrong folder role: \"%s\". Valid roles are: %s", folderrole[1], validroles)
+			}
+			if roles[folderrole[1]] {
+				return fmt.Errorf(errprefix+"Folder role %s used by multiple folders", folderrole[1])
+			}
+			roles[folderrole[1]] = true
+		}
+
+		validinfoseparators := []string{":", ";", "!"}
+		if !StringInSlice(config.InfoSeparator, validinfoseparators) {
+			return fmt.Errorf(errprefix+"Wrong infoseparator: \"%s\". Valid infoseparators are: %s", config.InfoSeparator, validinfoseparators)
+		}
+	case "mbox":
+		if config.Mboxdir == "" {
+			return fmt.Errorf(errprefix + "mboxdir option is empty")
+		}
+
+		validseparators := []rune{'.', '/'}
+		if !RuneInSlice(config.Separator, validseparators) {
+			return fmt.Errorf(errprefix+"Wrong separator: \"%c\". Valid separators are: %q", config.Separator, validseparators)
+		}
+	case "MH":
+		if config.MHdir == "" {
+			return fmt.Errorf(errprefix + "mhdir option is empty")
+		}
+
+		// MH subfolders are always subdirectories
+		validseparators := []rune{'/'}
+		if !RuneInSlice(config.Separator, validseparators) {
+			return fmt.Errorf(errprefix+"Wrong separator: \"%c\". Valid separators are: %q", config.Separator, validseparators)
 		}
 
 	}
@@ -226,13 +401,118 @@ func VerifySyncGroupConfig(globalconfig *Config, config *SyncgroupConfig) (err e
 		return fmt.Errorf(errprefix + "deletemode of type \"trash\" not yet implemented")
 	}
 
+	if err = verifyFolderMapping(config.Folderpairs, config.Folderrules); err != nil {
+		return fmt.Errorf(errprefix+"%s", err)
+	}
+
+	for _, ops := range [][]string{config.Ops1to2, config.Ops2to1} {
+		if err = verifySyncOps(ops, config.Deletemode); err != nil {
+			return fmt.Errorf(errprefix+"%s", err)
+		}
+	}
+	if StringInSlice("none", config.Ops1to2) && StringInSlice("none", config.Ops2to1) {
+		return fmt.Errorf(errprefix + "ops1to2 and ops2to1 are both \"none\". Nothing to sync.")
+	}
+
+	if config.Detectmoves && config.Deletemode != "expunge" {
+		return fmt.Errorf(errprefix + "detectmoves requires deletemode \"expunge\"")
+	}
+
+	if config.Maxdeletepercent > 100 {
+		return fmt.Errorf(errprefix + "maxdeletepercent must be between 0 and 100.")
+	}
+
+	validsyncstatusbackends := []string{"sqlite", "file"}
+	if config.Syncstatusbackend != "" && !StringInSlice(config.Syncstatusbackend, validsyncstatusbackends) {
+		return fmt.Errorf(errprefix+"Wrong syncstatusbackend: \"%s\". Valid backends are: %s", config.Syncstatusbackend, validsyncstatusbackends)
+	}
+
 	// verify duration
 	if int64(config.SyncInterval.Duration) < 0 {
 		return fmt.Errorf(errprefix + "syncinterval must be positive.")
 	}
+	if int64(config.Quarantineretention.Duration) < 0 {
+		return fmt.Errorf(errprefix + "quarantineretention must be positive.")
+	}
 	return
 }
 
+func verifyNamespaces(config *StoreConfig) error {
+	if len(config.Namespaces) == 0 {
+		if len(config.Namespaceprefixes) > 0 || config.Stripnamespaceprefix {
+			return fmt.Errorf("namespaceprefixes and stripnamespaceprefix options require the namespaces option")
+		}
+		return nil
+	}
+	if config.StoreType != "IMAP" {
+		return fmt.Errorf("namespaces option is valid only for IMAP stores")
+	}
+	validnamespaces := []string{"personal", "other", "shared"}
+	for i, ns := range config.Namespaces {
+		if !StringInSlice(ns, validnamespaces) {
+			return fmt.Errorf("Wrong namespace: \"%s\". Valid namespaces are: %s", ns, validnamespaces)
+		}
+		if StringInSlice(ns, config.Namespaces[:i]) {
+			return fmt.Errorf("Duplicated namespace: \"%s\"", ns)
+		}
+	}
+	return nil
+}
+
+func verifyFolderMapping(pairs [][]string, rules [][]string) error {
+	names := [2]map[string]bool{make(map[string]bool), make(map[string]bool)}
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return fmt.Errorf("Wrong folderpairs entry: %q. It must be a pair of folder names", pair)
+		}
+		for i, name := range pair {
+			if name == "" {
+				return fmt.Errorf("Empty folder name in folderpairs entry: %q", pair)
+			}
+			if names[i][name] {
+				return fmt.Errorf("Folder %s used in multiple folderpairs entries", name)
+			}
+			names[i][name] = true
+		}
+	}
+	for _, rule := range rules {
+		if len(rule) != 2 {
+			return fmt.Errorf("Wrong folderrules entry: %q. It must be a pair of regexps", rule)
+		}
+		var groups [2]int
+		for i, expr := range rule {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("Wrong folderrules regexp %q: %s", expr, err)
+			}
+			groups[i] = re.NumSubexp()
+		}
+		if groups[0] != groups[1] {
+			return fmt.Errorf("Folderrules entry %q regexps have a different number of groups", rule)
+		}
+	}
+	return nil
+}
+
+func verifySyncOps(ops []string, deletemode string) error {
+	validsyncops := []string{"all", "none", "create", "new", "delete", "flags"}
+	for i, op := range ops {
+		if !StringInSlice(op, validsyncops) {
+			return fmt.Errorf("Wrong sync operation: \"%s\". Valid operations are: %s", op, validsyncops)
+		}
+		if StringInSlice(op, ops[:i]) {
+			return fmt.Errorf("Duplicated sync operation: \"%s\"", op)
+		}
+		if (op == "all" || op == "none") && len(ops) > 1 {
+			return fmt.Errorf("Sync operation \"%s\" cannot be used with other operations", op)
+		}
+	}
+	if StringInSlice("delete", ops) && deletemode == "none" {
+		return fmt.Errorf("Sync operation \"delete\" with deletemode \"none\"")
+	}
+	return nil
+}
+
 func StringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -27,3 +27,48 @@ func TestParseConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestVerifySyncOps(t *testing.T) {
+	tests := []struct {
+		ops        []string
+		deletemode string
+		ok         bool
+	}{
+		{nil, "expunge", true},
+		{[]string{"all"}, "expunge", true},
+		{[]string{"none"}, "expunge", true},
+		{[]string{"create", "new", "flags"}, "none", true},
+		{[]string{"delete"}, "expunge", true},
+		{[]string{"delete"}, "none", false},
+		{[]string{"new", "new"}, "expunge", false},
+		{[]string{"all", "new"}, "expunge", false},
+		{[]string{"expunge"}, "expunge", false},
+	}
+	for _, tt := range tests {
+		err := verifySyncOps(tt.ops, tt.deletemode)
+		if (err == nil) != tt.ok {
+			t.Errorf("ops %v with deletemode %s: unexpected result: %v", tt.ops, tt.deletemode, err)
+		}
+	}
+}
+
+func TestVerifyNamespaces(t *testing.T) {
+	tests := []struct {
+		config StoreConfig
+		ok     bool
+	}{
+		{StoreConfig{StoreType: "IMAP"}, true},
+		{StoreConfig{StoreType: "IMAP", Namespaces: []string{"personal", "shared"}, Stripnamespaceprefix: true}, true},
+		{StoreConfig{StoreType: "IMAP", Namespaces: []string{"other"}, Namespaceprefixes: []string{"Other Users/"}}, true},
+		{StoreConfig{StoreType: "IMAP", Namespaces: []string{"public"}}, false},
+		{StoreConfig{StoreType: "IMAP", Namespaces: []string{"shared", "shared"}}, false},
+		{StoreConfig{StoreType: "IMAP", Stripnamespaceprefix: true}, false},
+		{StoreConfig{StoreType: "Maildir", Namespaces: []string{"personal"}}, false},
+	}
+	for _, tt := range tests {
+		err := verifyNamespaces(&tt.config)
+		if (err == nil) != tt.ok {
+			t.Errorf("config %+v: unexpected result: %v", tt.config, err)
+		}
+	}
+}
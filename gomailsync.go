@@ -18,36 +18,33 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/sgotti/gomailsync/config"
 	"github.com/sgotti/gomailsync/log"
 	"github.com/sgotti/gomailsync/mailsync"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"time"
 )
 
 var opts struct {
-	Configfile    string   `short:"c" long:"config" description:"Config file location. Default: ~/.gomailsyncrc"`
-	Debug         bool     `short:"d" long:"debug" description:"Enable full debug logs. Overrides log levels in configuration file"`
-	DryRun        bool     `short:"n" long:"dryrun" description:"Do not execute sync actions but just log what will be done"`
-	List          bool     `short:"l" long:"list" description:"List stores infos and then exit"`
-	SyncgroupList []string `short:"s" long:"syncgroup" description:"Limit the syncgroups to the specified. Use this option multiple times to specify multiple syncgroups."`
+	Configfile      string   `short:"c" long:"config" description:"Config file location. Default: ~/.gomailsyncrc"`
+	Debug           bool     `short:"d" long:"debug" description:"Enable full debug logs. Overrides log levels in configuration file"`
+	DryRun          bool     `short:"n" long:"dryrun" description:"Do not change the stores and the metadata but print every action that will be done"`
+	AllowMassDelete bool     `long:"allow-mass-delete" description:"Do the deletions exceeding the syncgroups maxdeletecount and maxdeletepercent"`
+	List            bool     `short:"l" long:"list" description:"List stores infos and then exit"`
+	SyncgroupList   []string `short:"s" long:"syncgroup" description:"Limit the syncgroups to the specified. Use this option multiple times to specify multiple syncgroups."`
 }
 
-func main() {
-	logger := log.GetLogger(fmt.Sprintf("%s", "main"), "info")
+// loadConfig parses and verifies the config file and prepares the metadata dir
+func loadConfig() (*config.Config, error) {
 	u, err := user.Current()
 	if err != nil {
-		logger.Errorf("Cannot determine current user")
-		os.Exit(1)
-	}
-
-	var parser = flags.NewParser(&opts, flags.Default)
-
-	if _, err := parser.Parse(); err != nil {
-		os.Exit(1)
+		return nil, fmt.Errorf("Cannot determine current user")
 	}
 
 	if opts.Configfile == "" {
@@ -56,14 +53,12 @@ func main() {
 
 	globalconfig, err := config.ParseConfig(opts.Configfile)
 	if err != nil {
-		logger.Errorf("Error parsing config file: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error parsing config file: %s", err)
 	}
 
 	err = config.VerifyConfig(globalconfig)
 	if err != nil {
-		logger.Errorf("Error parsing config file: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error parsing config file: %s", err)
 	}
 
 	if opts.Debug {
@@ -72,41 +67,348 @@ func main() {
 	}
 
 	if _, err := log.LogLevelToPriority(globalconfig.LogLevel); err != nil {
-		logger.Errorf("Error: %s", err)
+		return nil, err
+	}
+
+	if !opts.DryRun {
+		err = mailsync.MkdirIfNotExists(globalconfig.Metadatadir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return globalconfig, nil
+}
+
+func getStoreConfig(globalconfig *config.Config, name string) (*config.StoreConfig, error) {
+	for _, storeconf := range globalconfig.Stores {
+		if storeconf.Name == name {
+			return storeconf, nil
+		}
+	}
+	return nil, fmt.Errorf("Missing store definition for: %s", name)
+}
+
+type compressCommand struct {
+	Store   string   `long:"store" required:"true" description:"The Maildir store to compress. Its compress option defines the compression to use"`
+	Folders []string `short:"f" long:"folder" description:"Compress only the specified folder (use \"/\" as separator). Use this option multiple times to specify multiple folders. Default: all folders"`
+}
+
+func (c *compressCommand) Execute(args []string) error {
+	logger := log.GetLogger("compress", "info")
+	globalconfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	storeconf, err := getStoreConfig(globalconfig, c.Store)
+	if err != nil {
+		return err
+	}
+	if storeconf.StoreType != "Maildir" {
+		return fmt.Errorf("Store %s isn't a Maildir store", c.Store)
+	}
+
+	basemetadatadir := filepath.Join(globalconfig.Metadatadir, "stores")
+	store, err := mailsync.NewMaildirStore(globalconfig, storeconf, basemetadatadir, false)
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range store.GetFolders() {
+		if len(c.Folders) > 0 && !mailsync.StringInSlice(folder.String(), c.Folders) {
+			continue
+		}
+		count, err := store.CompressFolder(folder.Name)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Folder %s: compressed %d messages", folder, count)
+	}
+	return nil
+}
+
+// syncgroupSelected reports if a syncgroup was selected with the syncgroup
+// option
+func syncgroupSelected(name string) bool {
+	if opts.SyncgroupList == nil {
+		return true
+	}
+	return mailsync.StringInSlice(name, opts.SyncgroupList)
+}
+
+type planCommand struct {
+	Output string `short:"o" long:"output" required:"true" description:"The file where the plan is saved"`
+}
+
+func (c *planCommand) Execute(args []string) error {
+	logger := log.GetLogger("plan", "info")
+	opts.DryRun = true
+	globalconfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	plan := &mailsync.SyncPlan{Folders: make([]*mailsync.FolderPlan, 0)}
+	for _, syncgroupconf := range globalconfig.Syncgroups {
+		if !syncgroupSelected(syncgroupconf.Name) {
+			continue
+		}
+		// A dry run syncgroup doesn't change the stores
+		syncgroup, err := mailsync.NewSyncgroup(globalconfig, syncgroupconf, true)
+		if err != nil {
+			return fmt.Errorf("Error creating syncgroup \"%s\": %s", syncgroupconf.Name, err)
+		}
+		folderplans, err := syncgroup.Plan()
+		if err != nil {
+			return err
+		}
+		plan.Folders = append(plan.Folders, folderplans...)
+	}
+
+	data, err := json.MarshalIndent(plan, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(c.Output, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	for _, folderplan := range plan.Folders {
+		logger.Infof("Syncgroup %s folder %s: %d actions", folderplan.Syncgroup, mailsync.FolderToStorePath(folderplan.Folder, '/'), len(folderplan.Actions))
+	}
+	return nil
+}
+
+type applyCommand struct{}
+
+func (c *applyCommand) Execute(args []string) error {
+	logger := log.GetLogger("apply", "info")
+	if len(args) != 1 {
+		return fmt.Errorf("A plan file is required")
+	}
+	globalconfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	plan := &mailsync.SyncPlan{}
+	if err = json.Unmarshal(data, plan); err != nil {
+		return fmt.Errorf("Error parsing plan file: %s", err)
+	}
+
+	syncgroups := make(map[string]*mailsync.Syncgroup)
+	defer func() {
+		for _, syncgroup := range syncgroups {
+			syncgroup.Close()
+		}
+	}()
+	folderplans := make([]*mailsync.FolderPlan, 0, len(plan.Folders))
+	for _, folderplan := range plan.Folders {
+		if !syncgroupSelected(folderplan.Syncgroup) {
+			continue
+		}
+		if _, ok := syncgroups[folderplan.Syncgroup]; !ok {
+			var syncgroupconf *config.SyncgroupConfig
+			for _, sc := range globalconfig.Syncgroups {
+				if sc.Name == folderplan.Syncgroup {
+					syncgroupconf = sc
+				}
+			}
+			if syncgroupconf == nil {
+				return fmt.Errorf("Missing syncgroup definition for: %s", folderplan.Syncgroup)
+			}
+			syncgroup, err := mailsync.NewSyncgroup(globalconfig, syncgroupconf, opts.DryRun)
+			if err != nil {
+				return fmt.Errorf("Error creating syncgroup \"%s\": %s", syncgroupconf.Name, err)
+			}
+			syncgroup.SetAllowMassDelete(opts.AllowMassDelete)
+			syncgroups[folderplan.Syncgroup] = syncgroup
+		}
+		folderplans = append(folderplans, folderplan)
+	}
+
+	// A stale plan is refused before changing any folder
+	for _, folderplan := range folderplans {
+		if err = syncgroups[folderplan.Syncgroup].CheckFolderPlan(folderplan); err != nil {
+			return fmt.Errorf("Refusing to apply the plan, nothing was changed: %s", err)
+		}
+	}
+
+	for _, folderplan := range folderplans {
+		if err = syncgroups[folderplan.Syncgroup].ApplyFolderPlan(folderplan); err != nil {
+			return err
+		}
+		logger.Infof("Syncgroup %s folder %s: applied %d actions", folderplan.Syncgroup, mailsync.FolderToStorePath(folderplan.Folder, '/'), len(folderplan.Actions))
+	}
+	return nil
+}
+
+type verifyCommand struct{}
+
+func (c *verifyCommand) Execute(args []string) error {
+	logger := log.GetLogger("verify", "info")
+	opts.DryRun = true
+	globalconfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, syncgroupconf := range globalconfig.Syncgroups {
+		if !syncgroupSelected(syncgroupconf.Name) {
+			continue
+		}
+		// A dry run syncgroup doesn't change the stores
+		syncgroup, err := mailsync.NewSyncgroup(globalconfig, syncgroupconf, true)
+		if err != nil {
+			return fmt.Errorf("Error creating syncgroup \"%s\": %s", syncgroupconf.Name, err)
+		}
+		problems, verified, err := syncgroup.Verify()
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s\t%s\t%s\tuid: %d\t%s\n", syncgroupconf.Name, problem.Store, mailsync.FolderToStorePath(problem.Folder, '/'), problem.UID, problem.Problem)
+		}
+		logger.Infof("Syncgroup %s: verified %d messages, %d problems", syncgroupconf.Name, verified, len(problems))
+		count += len(problems)
+	}
+	if count > 0 {
+		return fmt.Errorf("Found %d syncstatus problems", count)
+	}
+	return nil
+}
+
+type convertSyncstatusCommand struct {
+	To string `long:"to" required:"true" description:"The syncstatus backend to convert to (sqlite or file)"`
+}
+
+func (c *convertSyncstatusCommand) Execute(args []string) error {
+	logger := log.GetLogger("convert-syncstatus", "info")
+	globalconfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, syncgroupconf := range globalconfig.Syncgroups {
+		if !syncgroupSelected(syncgroupconf.Name) {
+			continue
+		}
+		folders, err := mailsync.ConvertSyncstatus(globalconfig, syncgroupconf, c.To)
+		if err != nil {
+			return fmt.Errorf("Error converting the syncstatus of syncgroup \"%s\": %s", syncgroupconf.Name, err)
+		}
+		logger.Infof("Syncgroup %s: converted the syncstatus of %d folders to the %s backend", syncgroupconf.Name, folders, c.To)
+	}
+	return nil
+}
+
+type restoreCommand struct{}
+
+func (c *restoreCommand) Execute(args []string) error {
+	logger := log.GetLogger("restore", "info")
+	globalconfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	restored := make(map[string]bool)
+	for _, syncgroupconf := range globalconfig.Syncgroups {
+		if !syncgroupSelected(syncgroupconf.Name) {
+			continue
+		}
+		syncgroup, err := mailsync.NewSyncgroup(globalconfig, syncgroupconf, opts.DryRun)
+		if err != nil {
+			return fmt.Errorf("Error creating syncgroup \"%s\": %s", syncgroupconf.Name, err)
+		}
+		defer syncgroup.Close()
+		entries, err := syncgroup.Quarantined()
+		if err != nil {
+			return err
+		}
+
+		// Without arguments list the quarantined messages
+		if len(args) == 0 {
+			for _, entry := range entries {
+				fmt.Printf("%s\t%s\t%s\t%s\tuid: %d\tflags: %q\t%s\n", entry.ID, entry.Syncgroup, entry.Store, mailsync.FolderToStorePath(entry.Folder, '/'), entry.UID, entry.Flags, entry.Time.Format(time.RFC3339))
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			if !mailsync.StringInSlice(entry.ID, args) {
+				continue
+			}
+			if err = syncgroup.Restore(entry.ID); err != nil {
+				return err
+			}
+			logger.Infof("Restored message %s", entry.ID)
+			restored[entry.ID] = true
+		}
+	}
+
+	for _, id := range args {
+		if !restored[id] {
+			return fmt.Errorf("Cannot find quarantined message %s", id)
+		}
+	}
+	return nil
+}
+
+func main() {
+	logger := log.GetLogger(fmt.Sprintf("%s", "main"), "info")
+
+	var parser = flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("compress", "Compress Maildir messages", "Compress in place the messages of a Maildir store (Dovecot zlib plugin compatible)", &compressCommand{})
+	parser.AddCommand("plan", "Save the sync plan", "Save the actions of the sync of the folders without changing the stores", &planCommand{})
+	parser.AddCommand("apply", "Apply a sync plan", "Apply a plan saved by the plan command. The folders changed after the plan are refused", &applyCommand{})
+	parser.AddCommand("verify", "Verify the syncstatus", "Read the synced messages and compare them with the Message-ID, size and hash recorded in the syncstatus", &verifyCommand{})
+	parser.AddCommand("convert-syncstatus", "Convert the syncstatus", "Copy the syncstatus of the syncgroups to another backend. Set the syncgroup syncstatusbackend accordingly", &convertSyncstatusCommand{})
+	parser.AddCommand("restore", "Restore quarantined messages", "Without arguments list the quarantined messages, else put the messages with the given ids back in their folders", &restoreCommand{})
+
+	if _, err := parser.Parse(); err != nil {
 		os.Exit(1)
 	}
 
-	err = mailsync.MkdirIfNotExists(globalconfig.Metadatadir)
+	// A command was executed
+	if parser.Active != nil {
+		return
+	}
+
+	globalconfig, err := loadConfig()
 	if err != nil {
 		logger.Errorf("Error: %s", err)
 		os.Exit(1)
 	}
 
+	// A dry run prints the actions of a single sync
+	interactions := -1
+	if opts.DryRun {
+		interactions = 1
+	}
+
 	var count int = 0
 	c := make(chan error)
 	for _, syncgroupconf := range globalconfig.Syncgroups {
-		if opts.SyncgroupList != nil {
-			ok := false
-			for _, s := range opts.SyncgroupList {
-				if syncgroupconf.Name == s {
-					ok = true
-					break
-				}
-			}
-			if !ok {
-				continue
-			}
+		if !syncgroupSelected(syncgroupconf.Name) {
+			continue
 		}
 		syncgroup, err := mailsync.NewSyncgroup(globalconfig, syncgroupconf, opts.DryRun)
 		if err != nil {
 			logger.Errorf("Error creating syncgroup \"%s\": %s", syncgroupconf.Name, err)
 			continue
 		}
+		syncgroup.SetAllowMassDelete(opts.AllowMassDelete)
 
 		if opts.List {
 			syncgroup.List()
 		} else {
-			go syncgroup.SyncWrapper(-1, c)
+			go syncgroup.SyncWrapper(interactions, c)
 			count++
 		}
 
@@ -0,0 +1,299 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A dry run executes the normal sync with the stores and the syncstatus
+// wrapped by the types of this file. Reads are done on the real stores,
+// every change is only simulated in memory and printed.
+
+// dryrunPlan prints the actions of a dry run
+type dryrunPlan struct {
+	sync.Mutex
+	w      io.Writer
+	prefix string
+}
+
+func newDryrunPlan(w io.Writer, prefix string) *dryrunPlan {
+	return &dryrunPlan{w: w, prefix: prefix}
+}
+
+func (p *dryrunPlan) Printf(store string, folder foldername, format string, args ...interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	fmt.Fprintf(p.w, "%s: %s: %s: %s\n", p.prefix, store, FolderToStorePath(folder, '/'), fmt.Sprintf(format, args...))
+}
+
+// dryrunStore simulates the folder creation on a StoreManager
+type dryrunStore struct {
+	StoreManager
+	plan    *dryrunPlan
+	created []*Mailfolder
+	sync.Mutex
+}
+
+func newDryrunStore(store StoreManager, plan *dryrunPlan) *dryrunStore {
+	return &dryrunStore{
+		StoreManager: store,
+		plan:         plan,
+		created:      make([]*Mailfolder, 0),
+	}
+}
+
+func (m *dryrunStore) getCreatedFolder(name foldername) *Mailfolder {
+	for _, f := range m.created {
+		if StrsEquals(name, f.Name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *dryrunStore) CreateFolder(name foldername) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.createFolder(name)
+}
+
+func (m *dryrunStore) createFolder(name foldername) error {
+	if m.StoreManager.HasFolder(name) || m.getCreatedFolder(name) != nil {
+		return nil
+	}
+	m.plan.Printf(m.Name(), name, "create folder")
+	m.created = append(m.created, &Mailfolder{Name: name, Excluded: false})
+	return nil
+}
+
+func (m *dryrunStore) SetFolderExcluded(name foldername, excluded bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if f := m.getCreatedFolder(name); f != nil {
+		f.Excluded = excluded
+		return nil
+	}
+	return m.StoreManager.SetFolderExcluded(name, excluded)
+}
+
+func (m *dryrunStore) HasFolder(name foldername) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.StoreManager.HasFolder(name) || m.getCreatedFolder(name) != nil
+}
+
+func (m *dryrunStore) GetFolders() []Mailfolder {
+	m.Lock()
+	defer m.Unlock()
+	folders := m.StoreManager.GetFolders()
+	for _, f := range m.created {
+		folders = append(folders, *f)
+	}
+	return folders
+}
+
+func (m *dryrunStore) GetMailfolderManager(name foldername) (MailfolderManager, error) {
+	m.Lock()
+	defer m.Unlock()
+	if !m.StoreManager.HasFolder(name) {
+		// Like the stores, create a missing folder
+		if err := m.createFolder(name); err != nil {
+			return nil, err
+		}
+		return newDryrunFolder(m, name, nil), nil
+	}
+	folder, err := m.StoreManager.GetMailfolderManager(name)
+	if err != nil {
+		return nil, err
+	}
+	return newDryrunFolder(m, name, folder), nil
+}
+
+func (m *dryrunStore) DownloadOnly() bool {
+	if d, ok := m.StoreManager.(DownloadOnlyStore); ok {
+		return d.DownloadOnly()
+	}
+	return false
+}
+
+// dryrunFolder keeps a copy of the messages of a MailfolderManager (nil for
+// a folder created by the dry run) and records the changes on it. Without a
+// store the changes aren't printed (used to plan the sync).
+type dryrunFolder struct {
+	store    *dryrunStore
+	name     foldername
+	folder   MailfolderManager
+	messages map[uint32]*MessageInfo
+	uidnext  uint32
+}
+
+func newDryrunFolder(store *dryrunStore, name foldername, folder MailfolderManager) *dryrunFolder {
+	return &dryrunFolder{
+		store:    store,
+		name:     name,
+		folder:   folder,
+		messages: make(map[uint32]*MessageInfo),
+		uidnext:  1,
+	}
+}
+
+func (m *dryrunFolder) printf(format string, args ...interface{}) {
+	if m.store != nil {
+		m.store.plan.Printf(m.store.Name(), m.name, format, args...)
+	}
+}
+
+func (m *dryrunFolder) UpdateMessageList() error {
+	if m.folder != nil {
+		if err := m.folder.UpdateMessageList(); err != nil {
+			return err
+		}
+	}
+	m.load()
+	return nil
+}
+
+// load copies the messages of the wrapped MailfolderManager
+func (m *dryrunFolder) load() {
+	m.messages = make(map[uint32]*MessageInfo)
+	m.uidnext = 1
+	if m.folder == nil {
+		return
+	}
+	for uid, message := range m.folder.GetMessages() {
+		messagecopy := *message
+		m.messages[uid] = &messagecopy
+		if uid >= m.uidnext {
+			m.uidnext = uid + 1
+		}
+	}
+}
+
+func (m *dryrunFolder) HasUID(uid uint32) bool {
+	_, ok := m.messages[uid]
+	return ok
+}
+
+func (m *dryrunFolder) IsIgnored(uid uint32) bool {
+	if message, ok := m.messages[uid]; ok {
+		return message.Ignore
+	}
+	return false
+}
+
+func (m *dryrunFolder) GetFlags(uid uint32) (string, error) {
+	if message, ok := m.messages[uid]; ok {
+		return message.Flags, nil
+	}
+	return "", fmt.Errorf("Cannot find message with uid: %d", uid)
+}
+
+func (m *dryrunFolder) SetFlags(uid uint32, flags string) error {
+	message, ok := m.messages[uid]
+	if !ok {
+		return fmt.Errorf("Cannot find message with uid: %d", uid)
+	}
+	m.printf("set flags of message with uid %d: %q -> %q", uid, message.Flags, flags)
+	message.Flags = flags
+	return nil
+}
+
+func (m *dryrunFolder) ReadMessage(uid uint32) ([]byte, error) {
+	if m.folder == nil || !m.folder.HasUID(uid) {
+		return nil, fmt.Errorf("Message with uid %d only exists in the dry run", uid)
+	}
+	return m.folder.ReadMessage(uid)
+}
+
+// AddMessage gives the new message an uid after the existing ones, it's
+// only used inside the dry run
+func (m *dryrunFolder) AddMessage(srcuid uint32, flags string, body []byte) (uint32, error) {
+	uid := m.uidnext
+	m.uidnext++
+	m.printf("add message with srcuid %d (%d bytes) and flags %q", srcuid, len(body), flags)
+	m.messages[uid] = &MessageInfo{uid, flags, false}
+	return uid, nil
+}
+
+func (m *dryrunFolder) DeleteMessage(uid uint32) error {
+	message, ok := m.messages[uid]
+	if !ok {
+		return fmt.Errorf("Cannot find message with uid: %d", uid)
+	}
+	m.printf("delete message with uid %d and flags %q", uid, message.Flags)
+	delete(m.messages, uid)
+	return nil
+}
+
+// MoveMessage simulates the move of a message to another folder of the
+// store if the wrapped MailfolderManager can move it
+func (m *dryrunFolder) MoveMessage(uid uint32, dst MailfolderManager) (uint32, bool, error) {
+	dstfolder, ok := dst.(*dryrunFolder)
+	if _, canmove := m.folder.(MessageMover); !ok || !canmove || m.store == nil || dstfolder.store != m.store {
+		return 0, false, nil
+	}
+	message, ok := m.messages[uid]
+	if !ok {
+		return 0, false, fmt.Errorf("Cannot find message with uid: %d", uid)
+	}
+	m.printf("move message with uid %d to folder %s", uid, FolderToStorePath(dstfolder.name, '/'))
+	delete(m.messages, uid)
+	newuid := dstfolder.uidnext
+	dstfolder.uidnext++
+	dstfolder.messages[newuid] = &MessageInfo{newuid, message.Flags, false}
+	return newuid, true, nil
+}
+
+func (m *dryrunFolder) Update(srcuid uint32) (uint32, error) {
+	return srcuid, nil
+}
+
+func (m *dryrunFolder) GetMessages() map[uint32]*MessageInfo {
+	messages := make(map[uint32]*MessageInfo, len(m.messages))
+	for uid, message := range m.messages {
+		messages[uid] = message
+	}
+	return messages
+}
+
+func (m *dryrunFolder) GetIgnoredMessages() []uint32 {
+	messages := make([]uint32, 0)
+	for _, message := range m.messages {
+		if message.Ignore {
+			messages = append(messages, message.UID)
+		}
+	}
+	return messages
+}
+
+func (m *dryrunFolder) FolderID() string {
+	if f, ok := m.folder.(FolderIdentifier); ok {
+		return f.FolderID()
+	}
+	return ""
+}
+
+func (m *dryrunFolder) Close() error {
+	if m.folder == nil {
+		return nil
+	}
+	return m.folder.Close()
+}
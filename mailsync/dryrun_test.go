@@ -0,0 +1,120 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestDryrunSyncgroup(t *testing.T, syncgroup *Syncgroup) (*Syncgroup, *bytes.Buffer) {
+	dryrunsyncgroup, err := NewSyncgroup(syncgroup.globalconfig, syncgroup.config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	dryrunsyncgroup.plan.w = &buf
+	return dryrunsyncgroup, &buf
+}
+
+func checkPlan(t *testing.T, buf *bytes.Buffer, expected []string) {
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Wrong plan:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestDryrun(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	os.RemoveAll(syncgroup.metadatadir)
+	uid1 := backend1.AddMessage(memoryTestFolder.Name, "S", []byte("Subject: 1\r\n\r\n"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 2\r\n\r\n"))
+	backend1.AddMessage(foldername{"work"}, "F", []byte("Subject: 3\r\n\r\n"))
+
+	dryrunsyncgroup, buf := newTestDryrunSyncgroup(t, syncgroup)
+	if err := dryrunsyncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	if err := dryrunsyncgroup.SyncFolder(Mailfolder{Name: foldername{"work"}}); err != nil {
+		t.Fatal(err)
+	}
+	checkPlan(t, buf, []string{
+		`syncgroup1: store2: INBOX: add message with srcuid 1 (14 bytes) and flags "S"`,
+		`syncgroup1: store2: INBOX: add message with srcuid 2 (14 bytes) and flags ""`,
+		`syncgroup1: store2: work: create folder`,
+		`syncgroup1: store2: work: add message with srcuid 1 (14 bytes) and flags "F"`,
+	})
+
+	// Nothing changed
+	if len(backend2.Messages(memoryTestFolder.Name)) != 0 || len(backend2.Messages(foldername{"work"})) != 0 {
+		t.Fatalf("The dry run changed the store")
+	}
+	if _, err := os.Stat(syncgroup.metadatadir); !os.IsNotExist(err) {
+		t.Fatalf("The dry run created the syncgroup metadatadir")
+	}
+
+	if err := os.MkdirAll(syncgroup.metadatadir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plan uses the existing syncstatus
+	backend1.SetFlags(memoryTestFolder.Name, uid1, "FS")
+	var uid2 uint32
+	for uid, flags := range backend2.Messages(memoryTestFolder.Name) {
+		if flags == "" {
+			uid2 = uid
+		}
+	}
+	backend2.DeleteMessage(memoryTestFolder.Name, uid2)
+
+	dryrunsyncgroup, buf = newTestDryrunSyncgroup(t, syncgroup)
+	if err := dryrunsyncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	checkPlan(t, buf, []string{
+		`syncgroup1: store2: INBOX: set flags of message with uid 1: "S" -> "FS"`,
+		`syncgroup1: store1: INBOX: delete message with uid 2 and flags ""`,
+	})
+	if len(backend1.Messages(memoryTestFolder.Name)) != 2 {
+		t.Fatalf("The dry run changed the store")
+	}
+
+	// The real sync does what the plan said
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	dryrunsyncgroup, buf = newTestDryrunSyncgroup(t, syncgroup)
+	if err := dryrunsyncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Expected an empty plan, found:\n%s", buf.String())
+	}
+	verifyMemorySync(t, backend1, backend2)
+
+	if _, err := os.Stat(filepath.Join(syncgroup.metadatadir, "uidmapsyncstatus", "work")); !os.IsNotExist(err) {
+		t.Fatalf("The dry run created the work syncstatus")
+	}
+}
@@ -0,0 +1,99 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	dotlockSuffix = ".lock"
+
+	// How long to wait for a lock held by someone else
+	fileLockTimeout = 60 * time.Second
+	// A dotlock older than this is considered stale (as done by procmail
+	// and mutt)
+	dotlockStaleAge = 5 * time.Minute
+)
+
+// fileLock holds the locks of a mail file (a mbox or the MH sequences
+// file). Like the MDAs and MUAs do, the file is locked with both a fcntl
+// lock and a dotlock (a "<file>.lock" file created next to it).
+type fileLock struct {
+	file    *os.File
+	dotlock string
+}
+
+func lockFile(f *os.File, path string, write bool) (l *fileLock, err error) {
+	l = &fileLock{file: f}
+
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		err = fcntlLock(f, write)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Cannot fcntl lock %s: %s", path, err)
+		}
+		time.Sleep(time.Second)
+	}
+
+	// Reading doesn't need a dotlock, the fcntl read lock is enough to
+	// not see messages appended by cooperating writers
+	if !write {
+		return l, nil
+	}
+
+	dotlock := path + dotlockSuffix
+	for {
+		var lf *os.File
+		lf, err = os.OpenFile(dotlock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(lf, "%d\n", os.Getpid())
+			lf.Close()
+			l.dotlock = dotlock
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			break
+		}
+		if fi, serr := os.Stat(dotlock); serr == nil && time.Since(fi.ModTime()) > dotlockStaleAge {
+			os.Remove(dotlock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	fcntlUnlock(f)
+	return nil, fmt.Errorf("Cannot create dotlock %s: %s", dotlock, err)
+}
+
+func (l *fileLock) Unlock() error {
+	if l.dotlock != "" {
+		if err := os.Remove(l.dotlock); err != nil {
+			return err
+		}
+	}
+	return fcntlUnlock(l.file)
+}
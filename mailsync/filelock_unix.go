@@ -0,0 +1,39 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package mailsync
+
+import (
+	"os"
+	"syscall"
+)
+
+func fcntlLock(f *os.File, write bool) error {
+	lk := syscall.Flock_t{Type: syscall.F_RDLCK}
+	if write {
+		lk.Type = syscall.F_WRLCK
+	}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
+
+func fcntlUnlock(f *os.File) error {
+	lk := syscall.Flock_t{Type: syscall.F_UNLCK}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
@@ -0,0 +1,758 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/sgotti/gomailsync/config"
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+const (
+	// The format version of the file syncstatus snapshot
+	fileSyncstatusVersion = 1
+	// The journal is compacted in the snapshot after this number of
+	// transactions
+	fileSyncstatusCompactRecords = 10000
+)
+
+// FileSyncstatusBackend is a pure Go syncstatus backend saving the entries
+// of all the folders of a syncgroup in a snapshot file and a journal of the
+// committed transactions. Every commit appends a record to the journal and
+// fsyncs it, so a transaction is durable or (if the record was partially
+// written) ignored when the journal is replayed. The journal is compacted
+// in a new snapshot (with the sequence number of its last record) when it
+// grows and when the backend is closed. The entries are kept in memory,
+// indexed by the uids of both the stores (see fileSyncstatusFolder).
+type FileSyncstatusBackend struct {
+	globalconfig *config.Config
+	config       *config.SyncgroupConfig
+	dir          string
+	journal      *os.File
+	// Writes to the journal (replaced by the tests to inject errors)
+	write func([]byte) (int, error)
+	// The size of the journal with the committed records
+	size int64
+	// The sequence number of the last committed transaction
+	seq uint64
+	// The journal records after the snapshot
+	records int
+	folders map[string]*fileSyncstatusFolder
+	// Guards the folders and the journal
+	lock   sync.RWMutex
+	closed bool
+	// The journal couldn't be restored after a failed commit: the
+	// following commits are refused
+	failed error
+	logger *log.Logger
+	e      *errors.Error
+}
+
+// fileSyncstatusSnapshot is the content of the snapshot file
+type fileSyncstatusSnapshot struct {
+	Version int                               `json:"version"`
+	Seq     uint64                            `json:"seq"`
+	Folders map[string][]*fileSyncstatusEntry `json:"folders"`
+}
+
+type fileSyncstatusEntry struct {
+	UIDs  [2]uint32 `json:"uids"`
+	Flags string    `json:"flags"`
+	fileSyncstatusIdentity
+}
+
+type fileSyncstatusIdentity struct {
+	MessageID string `json:"messageid,omitempty"`
+	Size      int    `json:"size,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Synctime  int64  `json:"synctime,omitempty"`
+}
+
+// fileSyncstatusRecord is a journal line: the operations of a transaction
+// on the syncstatus of a folder
+type fileSyncstatusRecord struct {
+	Seq    uint64              `json:"seq"`
+	Folder string              `json:"folder"`
+	Ops    []*fileSyncstatusOp `json:"ops"`
+}
+
+// fileSyncstatusOp is a call of the Update, Delete or SetMessageIdentity
+// Syncstatus methods
+type fileSyncstatusOp struct {
+	Op       string                  `json:"op"`
+	Src      Storenumber             `json:"src"`
+	SrcUID   uint32                  `json:"srcuid"`
+	DstUID   uint32                  `json:"dstuid,omitempty"`
+	Flags    string                  `json:"flags,omitempty"`
+	Identity *fileSyncstatusIdentity `json:"identity,omitempty"`
+}
+
+// fileSyncstatusFolder are the entries of a folder indexed by their uids
+// in both the stores
+type fileSyncstatusFolder struct {
+	entries map[[2]uint32]*syncstatusEntry
+	// The entries by uid of a store, in insertion order
+	uids [2]map[uint32][]*syncstatusEntry
+}
+
+func newFileSyncstatusFolder(entries []syncstatusEntry) *fileSyncstatusFolder {
+	f := &fileSyncstatusFolder{
+		entries: make(map[[2]uint32]*syncstatusEntry, len(entries)),
+		uids:    [2]map[uint32][]*syncstatusEntry{make(map[uint32][]*syncstatusEntry, len(entries)), make(map[uint32][]*syncstatusEntry, len(entries))},
+	}
+	for _, entry := range entries {
+		f.add(entry)
+	}
+	return f
+}
+
+func (f *fileSyncstatusFolder) add(entry syncstatusEntry) {
+	if e, ok := f.entries[entry.uids]; ok {
+		*e = entry
+		return
+	}
+	e := &entry
+	f.entries[entry.uids] = e
+	for i := range f.uids {
+		f.uids[i][entry.uids[i]] = append(f.uids[i][entry.uids[i]], e)
+	}
+}
+
+// lookup returns the entries with uid in the src store
+func (f *fileSyncstatusFolder) lookup(src Storenumber, uid uint32) []*syncstatusEntry {
+	return f.uids[src][uid]
+}
+
+func (f *fileSyncstatusFolder) update(src Storenumber, srcuid uint32, dstuid uint32, flags string) {
+	var uids [2]uint32
+	uids[src] = srcuid
+	uids[1-src] = dstuid
+	if e, ok := f.entries[uids]; ok {
+		e.flags = flags
+		return
+	}
+	f.add(syncstatusEntry{uids: uids, flags: flags})
+}
+
+func (f *fileSyncstatusFolder) delete(src Storenumber, uid uint32) {
+	dst := 1 - src
+	for _, e := range f.uids[src][uid] {
+		delete(f.entries, e.uids)
+		dstentries := f.uids[dst][e.uids[dst]]
+		for i, de := range dstentries {
+			if de == e {
+				dstentries = append(dstentries[:i], dstentries[i+1:]...)
+				break
+			}
+		}
+		if len(dstentries) == 0 {
+			delete(f.uids[dst], e.uids[dst])
+		} else {
+			f.uids[dst][e.uids[dst]] = dstentries
+		}
+	}
+	delete(f.uids[src], uid)
+}
+
+func (f *fileSyncstatusFolder) setMessageIdentity(src Storenumber, srcuid uint32, identity messageIdentity) {
+	for _, e := range f.uids[src][srcuid] {
+		e.messageIdentity = identity
+	}
+}
+
+// getEntries returns a copy of the entries sorted by uids
+func (f *fileSyncstatusFolder) getEntries() []syncstatusEntry {
+	entries := make([]syncstatusEntry, 0, len(f.entries))
+	for _, e := range f.entries {
+		entries = append(entries, *e)
+	}
+	sort.Sort(syncstatusEntrySlice(entries))
+	return entries
+}
+
+type syncstatusEntrySlice []syncstatusEntry
+
+func (s syncstatusEntrySlice) Len() int      { return len(s) }
+func (s syncstatusEntrySlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s syncstatusEntrySlice) Less(i, j int) bool {
+	if s[i].uids[0] != s[j].uids[0] {
+		return s[i].uids[0] < s[j].uids[0]
+	}
+	return s[i].uids[1] < s[j].uids[1]
+}
+
+// The dirs of the file syncstatus opened by this process. The journal lock
+// only excludes the other processes.
+var openFileSyncstatus = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+func init() {
+	registerSyncstatusBackend("file", &syncstatusBackendType{
+		open: func(globalconfig *config.Config, config *config.SyncgroupConfig, metadatadir string) (SyncstatusBackend, error) {
+			return OpenFileSyncstatusBackend(globalconfig, config, metadatadir)
+		},
+		read: readFileSyncstatus,
+	})
+}
+
+func fileSyncstatusDir(metadatadir string) string {
+	return filepath.Join(metadatadir, "filesyncstatus")
+}
+
+func newFileSyncstatusIdentity(identity messageIdentity) fileSyncstatusIdentity {
+	return fileSyncstatusIdentity{
+		MessageID: identity.messageid,
+		Size:      identity.size,
+		Hash:      identity.hash,
+		Synctime:  identity.synctime,
+	}
+}
+
+func (fi fileSyncstatusIdentity) identity() messageIdentity {
+	return messageIdentity{messageid: fi.MessageID, size: fi.Size, hash: fi.Hash, synctime: fi.Synctime}
+}
+
+func newFileSyncstatusEntry(entry syncstatusEntry) *fileSyncstatusEntry {
+	return &fileSyncstatusEntry{
+		UIDs:                   entry.uids,
+		Flags:                  entry.flags,
+		fileSyncstatusIdentity: newFileSyncstatusIdentity(entry.messageIdentity),
+	}
+}
+
+func (fe *fileSyncstatusEntry) entry() syncstatusEntry {
+	return syncstatusEntry{
+		uids:            fe.UIDs,
+		flags:           fe.Flags,
+		messageIdentity: fe.identity(),
+	}
+}
+
+// check returns an error if a record operation cannot be applied
+func (r *fileSyncstatusRecord) check() error {
+	for _, op := range r.Ops {
+		if op.Src != Store1 && op.Src != Store2 {
+			return fmt.Errorf("Wrong source store %d in record %d", op.Src, r.Seq)
+		}
+		switch op.Op {
+		case "update", "delete":
+		case "identity":
+			if op.Identity == nil {
+				return fmt.Errorf("Missing identity in record %d", r.Seq)
+			}
+		default:
+			return fmt.Errorf("Wrong operation %q in record %d", op.Op, r.Seq)
+		}
+	}
+	return nil
+}
+
+// apply applies the operations of a record to the folder syncstatus
+func (r *fileSyncstatusRecord) apply(folder *fileSyncstatusFolder) error {
+	if err := r.check(); err != nil {
+		return err
+	}
+	for _, op := range r.Ops {
+		switch op.Op {
+		case "update":
+			folder.update(op.Src, op.SrcUID, op.DstUID, op.Flags)
+		case "delete":
+			folder.delete(op.Src, op.SrcUID)
+		case "identity":
+			folder.setMessageIdentity(op.Src, op.SrcUID, op.Identity.identity())
+		}
+	}
+	return nil
+}
+
+// readFileSyncstatusState reads the snapshot in dir and replays the journal
+// content. It returns the folders, the last sequence number, the number of
+// replayed records and the size of the valid journal: a partially written
+// last record is ignored. The journal has to be read before the snapshot,
+// so a compaction in the meantime leaves only records already in the
+// snapshot.
+func readFileSyncstatusState(dir string, journal []byte) (folders map[string]*fileSyncstatusFolder, seq uint64, records int, size int64, err error) {
+	folders = make(map[string]*fileSyncstatusFolder)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "snapshot.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, 0, 0, err
+	}
+	if err == nil {
+		var snapshot fileSyncstatusSnapshot
+		if err = json.Unmarshal(data, &snapshot); err != nil {
+			return nil, 0, 0, 0, fmt.Errorf("Cannot read the syncstatus snapshot: %s", err)
+		}
+		if snapshot.Version > fileSyncstatusVersion {
+			return nil, 0, 0, 0, fmt.Errorf("The syncstatus snapshot has version %d but the latest supported version is %d: it was written by a newer gomailsync", snapshot.Version, fileSyncstatusVersion)
+		}
+		seq = snapshot.Seq
+		for key, fentries := range snapshot.Folders {
+			entries := make([]syncstatusEntry, len(fentries))
+			for i, fe := range fentries {
+				entries[i] = fe.entry()
+			}
+			folders[key] = newFileSyncstatusFolder(entries)
+		}
+	}
+
+	r := bufio.NewReader(bytes.NewReader(journal))
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if rerr == io.EOF {
+			// An incomplete record, written by an interrupted
+			// commit, is ignored
+			return folders, seq, records, size, nil
+		}
+		if rerr != nil {
+			return nil, 0, 0, 0, rerr
+		}
+		var record fileSyncstatusRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return nil, 0, 0, 0, fmt.Errorf("Corrupted syncstatus journal at offset %d: %s", size, err)
+		}
+		size += int64(len(line))
+		// Already in the snapshot
+		if record.Seq <= seq {
+			continue
+		}
+		folder, ok := folders[record.Folder]
+		if !ok {
+			folder = newFileSyncstatusFolder(nil)
+			folders[record.Folder] = folder
+		}
+		if err = record.apply(folder); err != nil {
+			return nil, 0, 0, 0, err
+		}
+		seq = record.Seq
+		records++
+	}
+}
+
+// OpenFileSyncstatusBackend opens (creating it) the file syncstatus of a
+// syncgroup. The journal is locked, so it cannot be used by another
+// process.
+func OpenFileSyncstatusBackend(globalconfig *config.Config, config *config.SyncgroupConfig, metadatadir string) (b *FileSyncstatusBackend, err error) {
+	logprefix := fmt.Sprintf("%s %s", "filesyncstatus", config.Name)
+	errprefix := logprefix
+	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	dir := fileSyncstatusDir(metadatadir)
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return nil, e.E(err)
+	}
+
+	openFileSyncstatus.Lock()
+	defer openFileSyncstatus.Unlock()
+	if openFileSyncstatus.dirs[dir] {
+		return nil, e.E(fmt.Errorf("The syncstatus is already open"))
+	}
+
+	journalpath := filepath.Join(dir, "journal")
+	journal, err := os.OpenFile(journalpath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, e.E(err)
+	}
+	defer func() {
+		if err != nil {
+			journal.Close()
+		}
+	}()
+	if err = fcntlLock(journal, true); err != nil {
+		return nil, e.E(fmt.Errorf("The syncstatus is used by another process: %s", err))
+	}
+
+	data, err := ioutil.ReadAll(journal)
+	if err != nil {
+		return nil, e.E(err)
+	}
+	folders, seq, records, size, err := readFileSyncstatusState(dir, data)
+	if err != nil {
+		return nil, e.E(err)
+	}
+	if int64(len(data)) > size {
+		logger.Infof("removing a partially written record from the journal")
+		if err = journal.Truncate(size); err != nil {
+			return nil, e.E(err)
+		}
+	}
+	if _, err = journal.Seek(size, io.SeekStart); err != nil {
+		return nil, e.E(err)
+	}
+
+	openFileSyncstatus.dirs[dir] = true
+	b = &FileSyncstatusBackend{
+		globalconfig: globalconfig,
+		config:       config,
+		dir:          dir,
+		journal:      journal,
+		write:        journal.Write,
+		size:         size,
+		seq:          seq,
+		records:      records,
+		folders:      folders,
+		logger:       logger,
+		e:            e,
+	}
+	return b, nil
+}
+
+// readFileSyncstatus reads the syncstatus of a folder without locking or
+// changing the file syncstatus
+func readFileSyncstatus(metadatadir string, fname foldername) ([]syncstatusEntry, error) {
+	dir := fileSyncstatusDir(metadatadir)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "journal"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	folders, _, _, _, err := readFileSyncstatusState(dir, data)
+	if err != nil {
+		return nil, err
+	}
+	if folder, ok := folders[syncstatusFolderKey(fname)]; ok {
+		return folder.getEntries(), nil
+	}
+	return make([]syncstatusEntry, 0), nil
+}
+
+func (b *FileSyncstatusBackend) OpenFolder(fname foldername) (Syncstatus, error) {
+	key := syncstatusFolderKey(fname)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, b.e.E(fmt.Errorf("The syncstatus is closed"))
+	}
+	if _, ok := b.folders[key]; !ok {
+		b.folders[key] = newFileSyncstatusFolder(nil)
+	}
+	return &fileSyncstatus{backend: b, key: key}, nil
+}
+
+func (b *FileSyncstatusBackend) Folders() ([]foldername, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	keys := make([]string, 0, len(b.folders))
+	for key := range b.folders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	folders := make([]foldername, len(keys))
+	for i, key := range keys {
+		folders[i] = EscapedStorePathToFolder(key, '/')
+	}
+	return folders, nil
+}
+
+// commit appends the operations on a folder to the journal and then applies
+// them
+func (b *FileSyncstatusBackend) commit(key string, ops []*fileSyncstatusOp) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return fmt.Errorf("The syncstatus is closed")
+	}
+	if b.failed != nil {
+		return fmt.Errorf("The syncstatus journal is broken by a failed commit: %s", b.failed)
+	}
+
+	// The record is checked before writing it: once durable it must be
+	// applied
+	record := &fileSyncstatusRecord{Seq: b.seq + 1, Folder: key, Ops: ops}
+	if err := record.check(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = b.write(data)
+	if err == nil {
+		err = b.journal.Sync()
+	}
+	if err != nil {
+		// Remove the record, or a part of it, so the next record
+		// doesn't reuse its seq or follow a partial line
+		if terr := b.truncateJournal(); terr != nil {
+			b.failed = terr
+			b.logger.Errorf("cannot remove the failed record from the journal: %s", terr)
+		}
+		return err
+	}
+	b.size += int64(len(data))
+	b.seq = record.Seq
+	b.records++
+
+	record.apply(b.folders[key])
+	if b.records >= fileSyncstatusCompactRecords {
+		return b.compact()
+	}
+	return nil
+}
+
+// truncateJournal truncates the journal to its committed records
+func (b *FileSyncstatusBackend) truncateJournal() error {
+	if err := b.journal.Truncate(b.size); err != nil {
+		return err
+	}
+	if _, err := b.journal.Seek(b.size, io.SeekStart); err != nil {
+		return err
+	}
+	return b.journal.Sync()
+}
+
+// compact writes a snapshot with all the entries and empties the journal.
+// The snapshot is written atomically and has the sequence number of the
+// last record, so a crash before the journal is emptied only leaves records
+// ignored by the next replay.
+func (b *FileSyncstatusBackend) compact() error {
+	snapshot := &fileSyncstatusSnapshot{
+		Version: fileSyncstatusVersion,
+		Seq:     b.seq,
+		Folders: make(map[string][]*fileSyncstatusEntry),
+	}
+	for key, folder := range b.folders {
+		entries := folder.getEntries()
+		fentries := make([]*fileSyncstatusEntry, len(entries))
+		for i, entry := range entries {
+			fentries[i] = newFileSyncstatusEntry(entry)
+		}
+		snapshot.Folders[key] = fentries
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(b.dir, "snapshot.json"), data, true); err != nil {
+		return err
+	}
+	if err = b.journal.Truncate(0); err != nil {
+		return err
+	}
+	b.size = 0
+	if _, err = b.journal.Seek(0, io.SeekStart); err != nil {
+		b.failed = err
+		return err
+	}
+	b.records = 0
+	return nil
+}
+
+// Close compacts the journal and releases the lock
+func (b *FileSyncstatusBackend) Close() (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.records > 0 {
+		err = b.compact()
+	}
+	fcntlUnlock(b.journal)
+	if cerr := b.journal.Close(); err == nil {
+		err = cerr
+	}
+	openFileSyncstatus.Lock()
+	delete(openFileSyncstatus.dirs, b.dir)
+	openFileSyncstatus.Unlock()
+	return b.e.E(err)
+}
+
+// fileSyncstatus is the syncstatus of a folder of a FileSyncstatusBackend.
+// The reads see the committed entries, the operations of a transaction are
+// saved and committed together.
+type fileSyncstatus struct {
+	backend  *FileSyncstatusBackend
+	key      string
+	srcstore Storenumber
+	// The operations of the active transaction
+	ops  []*fileSyncstatusOp
+	intx bool
+}
+
+// folder returns the committed entries of the folder. It must be called
+// with the backend lock held.
+func (u *fileSyncstatus) folder() *fileSyncstatusFolder {
+	return u.backend.folders[u.key]
+}
+
+func (u *fileSyncstatus) getEntries() ([]syncstatusEntry, error) {
+	u.backend.lock.RLock()
+	defer u.backend.lock.RUnlock()
+	return u.folder().getEntries(), nil
+}
+
+func (u *fileSyncstatus) SetSrcstore(store Storenumber) {
+	u.srcstore = store
+}
+
+func (u *fileSyncstatus) GetSrcstoreCol() (string, error) {
+	return (&memorySyncstatus{srcstore: u.srcstore}).GetSrcstoreCol()
+}
+
+func (u *fileSyncstatus) GetDststoreCol() (string, error) {
+	return (&memorySyncstatus{srcstore: u.srcstore}).GetDststoreCol()
+}
+
+func (u *fileSyncstatus) GetDststoreUID(srcuid uint32) (uint32, error) {
+	u.backend.lock.RLock()
+	defer u.backend.lock.RUnlock()
+	entries := u.folder().lookup(u.srcstore, srcuid)
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	return entries[0].uids[1-u.srcstore], nil
+}
+
+func (u *fileSyncstatus) HasUID(uid uint32) (bool, error) {
+	u.backend.lock.RLock()
+	defer u.backend.lock.RUnlock()
+	return len(u.folder().lookup(u.srcstore, uid)) > 0, nil
+}
+
+func (u *fileSyncstatus) UpdateSyncstatus() error {
+	return nil
+}
+
+func (u *fileSyncstatus) BeginTx() error {
+	if u.intx {
+		return fmt.Errorf("A transaction is already active")
+	}
+	u.intx = true
+	u.ops = nil
+	return nil
+}
+
+func (u *fileSyncstatus) Commit() error {
+	if !u.intx {
+		return fmt.Errorf("No active transaction")
+	}
+	ops := u.ops
+	u.intx = false
+	u.ops = nil
+	if len(ops) == 0 {
+		return nil
+	}
+	return u.backend.commit(u.key, ops)
+}
+
+func (u *fileSyncstatus) Rollback() error {
+	if !u.intx {
+		return fmt.Errorf("No active transaction")
+	}
+	u.intx = false
+	u.ops = nil
+	return nil
+}
+
+func (u *fileSyncstatus) addOp(op *fileSyncstatusOp) error {
+	if !u.intx {
+		return fmt.Errorf("No active transaction")
+	}
+	op.Src = u.srcstore
+	u.ops = append(u.ops, op)
+	return nil
+}
+
+func (u *fileSyncstatus) Update(srcuid uint32, dstuid uint32, flags string) error {
+	return u.addOp(&fileSyncstatusOp{Op: "update", SrcUID: srcuid, DstUID: dstuid, Flags: flags})
+}
+
+func (u *fileSyncstatus) Delete(uid uint32) error {
+	return u.addOp(&fileSyncstatusOp{Op: "delete", SrcUID: uid})
+}
+
+func (u *fileSyncstatus) SetMessageIdentity(srcuid uint32, identity messageIdentity) error {
+	fi := newFileSyncstatusIdentity(identity)
+	return u.addOp(&fileSyncstatusOp{Op: "identity", SrcUID: srcuid, Identity: &fi})
+}
+
+func (u *fileSyncstatus) GetNewMessages(folder MailfolderManager) ([]uint32, error) {
+	u.backend.lock.RLock()
+	defer u.backend.lock.RUnlock()
+	messages := folder.GetMessages()
+	for uid := range u.folder().uids[u.srcstore] {
+		delete(messages, uid)
+	}
+
+	newMessages := make([]uint32, 0)
+	for uid := range messages {
+		newMessages = append(newMessages, uid)
+	}
+	sort.Sort(Uint32Slice(newMessages))
+	return newMessages, nil
+}
+
+func (u *fileSyncstatus) GetDeletedMessages(folder MailfolderManager) ([]uint32, error) {
+	u.backend.lock.RLock()
+	defer u.backend.lock.RUnlock()
+	deletedMessages := make([]uint32, 0)
+	for uid := range u.folder().uids[u.srcstore] {
+		if !folder.HasUID(uid) {
+			deletedMessages = append(deletedMessages, uid)
+		}
+	}
+	sort.Sort(Uint32Slice(deletedMessages))
+	return deletedMessages, nil
+}
+
+func (u *fileSyncstatus) GetChangedMessages(folder MailfolderManager) ([]uint32, error) {
+	u.backend.lock.RLock()
+	defer u.backend.lock.RUnlock()
+	changedMessages := make([]uint32, 0)
+	for uid, entries := range u.folder().uids[u.srcstore] {
+		if !folder.HasUID(uid) {
+			continue
+		}
+		flags, err := folder.GetFlags(uid)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if flags != entry.flags {
+				changedMessages = append(changedMessages, uid)
+				break
+			}
+		}
+	}
+	sort.Sort(Uint32Slice(changedMessages))
+	return changedMessages, nil
+}
+
+// Close rollbacks the active transaction
+func (u *fileSyncstatus) Close() error {
+	u.intx = false
+	u.ops = nil
+	return nil
+}
@@ -0,0 +1,174 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSyncstatusJournal(t *testing.T) {
+	globalconfig, syncgroupconf, metadatadir := newTestSyncstatusConfig("file")
+	defer os.RemoveAll(metadatadir)
+	dir := fileSyncstatusDir(metadatadir)
+
+	backend, err := OpenFileSyncstatusBackend(globalconfig, syncgroupconf, metadatadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenFileSyncstatusBackend(globalconfig, syncgroupconf, metadatadir); err == nil {
+		t.Fatal("The file syncstatus was opened twice")
+	}
+	syncstatus, _ := backend.OpenFolder(memoryTestFolder.Name)
+	syncstatus.SetSrcstore(Store1)
+	for uid := uint32(1); uid <= 2; uid++ {
+		syncstatus.BeginTx()
+		syncstatus.Update(uid, uid*10, "")
+		if err = syncstatus.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A crash while committing the third transaction leaves a partial
+	// record, ignored and removed by the next open
+	journal, err := ioutil.ReadFile(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncstatus.Close()
+	backend.Close()
+	os.Remove(filepath.Join(dir, "snapshot.json"))
+	if err = ioutil.WriteFile(filepath.Join(dir, "journal"), append(journal, `{"seq":3,"folder":"INBOX","ops":[{"op":"upd`...), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err = OpenFileSyncstatusBackend(globalconfig, syncgroupconf, metadatadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "journal"))
+	if err != nil || info.Size() != int64(len(journal)) {
+		t.Fatalf("The partial record wasn't removed: %v", err)
+	}
+	syncstatus, _ = backend.OpenFolder(memoryTestFolder.Name)
+	testSyncstatusEntries(t, "file", syncstatus, []syncstatusEntry{{uids: [2]uint32{1, 10}}, {uids: [2]uint32{2, 20}}})
+
+	// Closing compacts the journal in the snapshot
+	backend.Close()
+	if info, err = os.Stat(filepath.Join(dir, "journal")); err != nil || info.Size() != 0 {
+		t.Fatalf("The journal wasn't compacted: %v", err)
+	}
+	entries, err := readFileSyncstatus(metadatadir, memoryTestFolder.Name)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Wrong compacted entries %v: %v", entries, err)
+	}
+
+	// A snapshot written by a newer version
+	if err = ioutil.WriteFile(filepath.Join(dir, "snapshot.json"), []byte(`{"version":99,"seq":0,"folders":{}}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenFileSyncstatusBackend(globalconfig, syncgroupconf, metadatadir); err == nil {
+		t.Fatal("A snapshot with a newer version was opened")
+	}
+}
+
+func TestFileSyncstatusJournalWriteError(t *testing.T) {
+	globalconfig, syncgroupconf, metadatadir := newTestSyncstatusConfig("file")
+	defer os.RemoveAll(metadatadir)
+	dir := fileSyncstatusDir(metadatadir)
+
+	backend, err := OpenFileSyncstatusBackend(globalconfig, syncgroupconf, metadatadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncstatus, _ := backend.OpenFolder(memoryTestFolder.Name)
+	syncstatus.SetSrcstore(Store1)
+	commit := func(uid uint32) error {
+		syncstatus.BeginTx()
+		syncstatus.Update(uid, uid*10, "")
+		return syncstatus.Commit()
+	}
+
+	// A failed write leaves a partial record or a whole one (like when the
+	// fsync fails): both are removed and the next commits are replayed
+	write := backend.write
+	for i, written := range []func([]byte) int{
+		func(data []byte) int { return len(data) / 2 },
+		func(data []byte) int { return len(data) },
+	} {
+		written := written
+		backend.write = func(data []byte) (int, error) {
+			n, _ := write(data[:written(data)])
+			return n, fmt.Errorf("injected write error")
+		}
+		if err = commit(uint32(i*2 + 1)); err == nil {
+			t.Fatal("Expected a commit error")
+		}
+		backend.write = write
+		if err = commit(uint32(i*2 + 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []syncstatusEntry{{uids: [2]uint32{2, 20}}, {uids: [2]uint32{4, 40}}}
+	testSyncstatusEntries(t, "file", syncstatus, expected)
+
+	// Replay the journal without the snapshot written by Close
+	journal, err := ioutil.ReadFile(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncstatus.Close()
+	backend.Close()
+	os.Remove(filepath.Join(dir, "snapshot.json"))
+	if err = ioutil.WriteFile(filepath.Join(dir, "journal"), journal, 0666); err != nil {
+		t.Fatal(err)
+	}
+	backend, err = OpenFileSyncstatusBackend(globalconfig, syncgroupconf, metadatadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	syncstatus, _ = backend.OpenFolder(memoryTestFolder.Name)
+	testSyncstatusEntries(t, "file", syncstatus, expected)
+}
+
+func TestFileSyncstatusFolder(t *testing.T) {
+	f := newFileSyncstatusFolder([]syncstatusEntry{
+		{uids: [2]uint32{1, 10}},
+		{uids: [2]uint32{2, 20}},
+		{uids: [2]uint32{3, 10}},
+	})
+
+	// The indexes of both the stores are updated
+	f.delete(Store1, 1)
+	if entries := f.lookup(Store2, 10); len(entries) != 1 || entries[0].uids != [2]uint32{3, 10} {
+		t.Fatalf("Wrong entries for store2 uid 10: %v", entries)
+	}
+	f.update(Store2, 20, 2, "F")
+	f.delete(Store2, 10)
+	if entries := f.lookup(Store1, 3); len(entries) != 0 {
+		t.Fatalf("Deleted entries for store1 uid 3: %v", entries)
+	}
+	entries := f.getEntries()
+	if len(entries) != 1 || entries[0].uids != [2]uint32{2, 20} || entries[0].flags != "F" {
+		t.Fatalf("Wrong entries: %v", entries)
+	}
+}
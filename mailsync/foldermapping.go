@@ -0,0 +1,227 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// A syncgroup folder is named like the folder of the first store. The
+// folder mapping gives the name of the folder of the second store: the
+// first matching pair or rule is used, without one the name is the same.
+// The folders with the same special-use role in the two stores are paired
+// too (after the configured pairs, before the rules).
+//
+// A rule is made of two regexps, one for every store, with the same number
+// of groups. Outside the groups they can only contain literals, so a name
+// matching one of them is rewritten to the other one replacing its groups
+// with the matched ones. For example the rule ["Archive/(.*)", "Old/(.*)"]
+// maps "Archive/2014" to "Old/2014" and back.
+
+type folderRule struct {
+	regexps   [2]*regexp.Regexp
+	templates [2]string
+}
+
+type folderMapping struct {
+	pairs     [][2]string
+	rolepairs [][2]string
+	rules     []*folderRule
+}
+
+// regexpTemplate converts a regexp to an Expand template with its groups
+// replaced by the matched ones
+func regexpTemplate(expr string) (string, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var template string
+	var walk func(re *syntax.Regexp) error
+	walk = func(re *syntax.Regexp) error {
+		switch re.Op {
+		case syntax.OpConcat:
+			for _, sub := range re.Sub {
+				if err := walk(sub); err != nil {
+					return err
+				}
+			}
+		case syntax.OpLiteral:
+			if re.Flags&syntax.FoldCase != 0 {
+				return fmt.Errorf("case insensitive literals are not allowed")
+			}
+			template += strings.Replace(string(re.Rune), "$", "$$", -1)
+		case syntax.OpCapture:
+			if re.Sub[0].MaxCap() > 0 {
+				return fmt.Errorf("nested groups are not allowed")
+			}
+			template += fmt.Sprintf("${%d}", re.Cap)
+		case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpEmptyMatch:
+		default:
+			return fmt.Errorf("only literals are allowed outside the groups")
+		}
+		return nil
+	}
+	if err = walk(re); err != nil {
+		return "", fmt.Errorf("Wrong folder rule regexp %q: %s", expr, err)
+	}
+	return template, nil
+}
+
+func newFolderMapping(pairs [][]string, rules [][]string) (*folderMapping, error) {
+	m := &folderMapping{
+		pairs: make([][2]string, 0, len(pairs)),
+		rules: make([]*folderRule, 0, len(rules)),
+	}
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Wrong folder pair: %q", pair)
+		}
+		m.pairs = append(m.pairs, [2]string{pair[0], pair[1]})
+	}
+	for _, exprs := range rules {
+		if len(exprs) != 2 {
+			return nil, fmt.Errorf("Wrong folder rule: %q", exprs)
+		}
+		rule := &folderRule{}
+		for i, expr := range exprs {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Wrong folder rule regexp %q: %s", expr, err)
+			}
+			rule.regexps[i] = re
+			rule.templates[i], err = regexpTemplate(expr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rule.regexps[0].NumSubexp() != rule.regexps[1].NumSubexp() {
+			return nil, fmt.Errorf("Folder rule regexps with a different number of groups: %q", exprs)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+// withRoles returns a copy of the mapping pairing the folders of the stores
+// with the same role. A role of multiple folders of a store, or a folder
+// already in a pair, is ignored.
+func (m *folderMapping) withRoles(folders [2][]Mailfolder) *folderMapping {
+	rm := &folderMapping{pairs: m.pairs, rules: m.rules, rolepairs: make([][2]string, 0)}
+
+	var roles [2]map[string]string
+	for i := Store1; i <= Store2; i++ {
+		roles[i] = make(map[string]string)
+		count := make(map[string]int)
+		for _, f := range folders[i] {
+			if f.Role == "" {
+				continue
+			}
+			count[f.Role]++
+			roles[i][f.Role] = FolderToStorePath(f.Name, '/')
+		}
+		for role, c := range count {
+			if c > 1 {
+				delete(roles[i], role)
+			}
+		}
+	}
+
+next:
+	for _, role := range folderRoles {
+		pair := [2]string{roles[Store1][role], roles[Store2][role]}
+		if pair[0] == "" || pair[1] == "" || pair[0] == pair[1] {
+			continue
+		}
+		for _, p := range m.pairs {
+			if p[0] == pair[0] || p[1] == pair[1] {
+				continue next
+			}
+		}
+		rm.rolepairs = append(rm.rolepairs, pair)
+	}
+	return rm
+}
+
+// mapName maps the folder name of a store to the one of the other store
+func (m *folderMapping) mapName(name string, from Storenumber) string {
+	to := 1 - from
+	for _, pairs := range [][][2]string{m.pairs, m.rolepairs} {
+		for _, pair := range pairs {
+			if pair[from] == name {
+				return pair[to]
+			}
+		}
+	}
+	for _, rule := range m.rules {
+		match := rule.regexps[from].FindStringSubmatchIndex(name)
+		if match != nil {
+			return string(rule.regexps[from].ExpandString(nil, rule.templates[to], name, match))
+		}
+	}
+	return name
+}
+
+// storeFolderName returns the name in a store of a syncgroup folder
+func (m *folderMapping) storeFolderName(name foldername, store Storenumber) foldername {
+	if store == Store1 {
+		return name
+	}
+	return foldername(strings.Split(m.mapName(FolderToStorePath(name, '/'), Store1), "/"))
+}
+
+// syncFolderName returns the syncgroup folder name of a store folder
+func (m *folderMapping) syncFolderName(name foldername, store Storenumber) foldername {
+	if store == Store1 {
+		return name
+	}
+	return foldername(strings.Split(m.mapName(FolderToStorePath(name, '/'), Store2), "/"))
+}
+
+// mapFolders returns the folders of the stores with their syncgroup name. It
+// fails if the mapping of the folders isn't bijective.
+func (m *folderMapping) mapFolders(folders [2][]Mailfolder) ([2][]Mailfolder, error) {
+	var mapped [2][]Mailfolder
+	for i := Store1; i <= Store2; i++ {
+		mapped[i] = make([]Mailfolder, 0, len(folders[i]))
+		names := make(map[string]string)
+		for _, f := range folders[i] {
+			name := m.syncFolderName(f.Name, i)
+			if !StrsEquals(m.storeFolderName(name, i), f.Name) {
+				return mapped, fmt.Errorf("Folder mapping isn't bijective: folder %s is mapped to %s and back to %s", f, FolderToStorePath(name, '/'), FolderToStorePath(m.storeFolderName(name, i), '/'))
+			}
+			key := FolderToStorePath(name, '/')
+			if other, ok := names[key]; ok {
+				return mapped, fmt.Errorf("Folder mapping isn't bijective: folders %s and %s are both mapped to %s", other, f, key)
+			}
+			names[key] = f.String()
+			mapped[i] = append(mapped[i], Mailfolder{Name: name, Excluded: f.Excluded, Role: f.Role})
+		}
+	}
+	// A folder of the first store mapped to another one must map back to it
+	for _, f := range folders[Store1] {
+		name := m.storeFolderName(f.Name, Store2)
+		if back := m.syncFolderName(name, Store2); !StrsEquals(back, f.Name) {
+			return mapped, fmt.Errorf("Folder mapping isn't bijective: folder %s is mapped to %s and back to %s", f, FolderToStorePath(name, '/'), FolderToStorePath(back, '/'))
+		}
+	}
+	return mapped, nil
+}
@@ -0,0 +1,159 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"testing"
+)
+
+func TestFolderMapping(t *testing.T) {
+	m, err := newFolderMapping(
+		[][]string{{"Sent", "[Gmail]/Sent Mail"}, {"Trash", "Deleted Items"}},
+		[][]string{{"Archive/([0-9]+)/(.*)", `Old\.\$/([0-9]+)/(.*)`}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name1 string
+		name2 string
+	}{
+		{"INBOX", "INBOX"},
+		{"Sent", "[Gmail]/Sent Mail"},
+		{"Trash", "Deleted Items"},
+		{"Archive/2014/work", "Old.$/2014/work"},
+		{"Archive/old/work", "Archive/old/work"},
+	}
+	for _, tt := range tests {
+		if name := m.mapName(tt.name1, Store1); name != tt.name2 {
+			t.Errorf("%s: expected %s, got %s", tt.name1, tt.name2, name)
+		}
+		if name := m.mapName(tt.name2, Store2); name != tt.name1 {
+			t.Errorf("%s: expected %s, got %s", tt.name2, tt.name1, name)
+		}
+	}
+
+	for _, rule := range [][]string{{"x|(.*)", "(.*)"}, {"a(.*)", "(b(.*))"}, {"(.*)", "x.(.*)"}, {"(?i)x(.*)", "y(.*)"}, {"(.*)", "(.*)/(.*)"}} {
+		if _, err := newFolderMapping(nil, [][]string{rule}); err == nil {
+			t.Errorf("Expected an error with rule %q", rule)
+		}
+	}
+}
+
+func TestFolderMappingBijective(t *testing.T) {
+	m, err := newFolderMapping([][]string{{"Sent", "[Gmail]/Sent Mail"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders := [2][]Mailfolder{
+		{{Name: foldername{"INBOX"}}, {Name: foldername{"Sent"}}},
+		{{Name: foldername{"INBOX"}}, {Name: foldername{"[Gmail]", "Sent Mail"}}},
+	}
+	mapped, err := m.mapFolders(folders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !StrsEquals(mapped[Store2][1].Name, foldername{"Sent"}) {
+		t.Fatalf("Wrong mapped folder: %s", mapped[Store2][1])
+	}
+
+	// The store2 Sent folder and [Gmail]/Sent Mail are both mapped to Sent
+	folders[Store2] = append(folders[Store2], Mailfolder{Name: foldername{"Sent"}})
+	if _, err = m.mapFolders(folders); err == nil {
+		t.Fatalf("Expected a not bijective mapping error")
+	}
+
+	// The store1 [Gmail]/Sent Mail is mapped to store2 [Gmail]/Sent Mail,
+	// that is mapped back to Sent
+	folders[Store2] = folders[Store2][:2]
+	folders[Store1] = append(folders[Store1], Mailfolder{Name: foldername{"[Gmail]", "Sent Mail"}})
+	if _, err = m.mapFolders(folders); err == nil {
+		t.Fatalf("Expected a not bijective mapping error")
+	}
+}
+
+func TestFolderMappingSync(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	var err error
+	syncgroup.mapping, err = newFolderMapping([][]string{{"Sent", "[Gmail]/Sent Mail"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend1.AddMessage(foldername{"Sent"}, "S", []byte("Subject: 1\r\n\r\n"))
+	backend2.AddMessage(foldername{"[Gmail]", "Sent Mail"}, "S", []byte("Subject: 2\r\n\r\n"))
+	for _, store := range syncgroup.stores {
+		if err = store.UpdateFolderList(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	folders, err := syncgroup.getSyncFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 2 {
+		t.Fatalf("Expected 2 folders, found: %v", folders)
+	}
+	if err = syncgroup.SyncFolder(Mailfolder{Name: foldername{"Sent"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend1.Messages(foldername{"Sent"})) != 2 || len(backend2.Messages(foldername{"[Gmail]", "Sent Mail"})) != 2 {
+		t.Fatalf("Folders not synced")
+	}
+	if syncgroup.stores[1].HasFolder(foldername{"Sent"}) {
+		t.Fatalf("Unmapped folder created")
+	}
+}
+
+func TestFolderMappingRoles(t *testing.T) {
+	m, err := newFolderMapping([][]string{{"Bin", "Deleted Items"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders := [2][]Mailfolder{
+		{{Name: foldername{"INBOX"}}, {Name: foldername{"Sent"}, Role: `\Sent`}, {Name: foldername{"Trash"}, Role: `\Trash`}, {Name: foldername{"Junk"}, Role: `\Junk`}, {Name: foldername{"Spam"}, Role: `\Junk`}},
+		{{Name: foldername{"INBOX"}}, {Name: foldername{"[Gmail]", "Sent Mail"}, Role: `\Sent`}, {Name: foldername{"Deleted Items"}, Role: `\Trash`}, {Name: foldername{"[Gmail]", "Spam"}, Role: `\Junk`}},
+	}
+	rm := m.withRoles(folders)
+	tests := []struct {
+		name1 string
+		name2 string
+	}{
+		{"INBOX", "INBOX"},
+		{"Sent", "[Gmail]/Sent Mail"},
+		// Already in a pair
+		{"Bin", "Deleted Items"},
+		{"Trash", "Trash"},
+		// Multiple store1 folders with the role
+		{"Junk", "Junk"},
+	}
+	for _, tt := range tests {
+		if name := rm.mapName(tt.name1, Store1); name != tt.name2 {
+			t.Errorf("%s: expected %s, got %s", tt.name1, tt.name2, name)
+		}
+	}
+
+	mapped, err := rm.mapFolders(folders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !StrsEquals(mapped[Store2][1].Name, foldername{"Sent"}) || mapped[Store2][1].Role != `\Sent` {
+		t.Fatalf("Wrong mapped folder: %v", mapped[Store2][1])
+	}
+}
@@ -47,10 +47,16 @@ type ImapFolder struct {
 	logger      *log.Logger
 	e           *errors.Error
 	dryrun      bool
+
+	// Gmail labels mode and the client selected on the All Mail folder
+	gmail         bool
+	allmailclient *imap.Client
 }
 
 type ImapMessageInfo struct {
 	MessageInfo
+	// X-GM-MSGID in Gmail labels mode
+	GmailMsgID string
 }
 
 var (
@@ -115,12 +121,7 @@ func NewImapFolder(folder *Mailfolder, metadatadir string, store *ImapStore, uid
 	logger := log.GetLogger(logprefix, store.globalconfig.LogLevel)
 	e := errors.New(errprefix)
 
-	separator, err := store.Separator()
-	if err != nil {
-		return nil, e.E(err)
-	}
-
-	imappath := FolderToStorePath(folder.Name, separator)
+	imappath := store.imapPath(folder.Name)
 	m = &ImapFolder{
 		folder:      folder,
 		store:       store,
@@ -133,6 +134,7 @@ func NewImapFolder(folder *Mailfolder, metadatadir string, store *ImapStore, uid
 		logger:      logger,
 		e:           e,
 		dryrun:      dryrun,
+		gmail:       store.config.Gmail,
 	}
 
 	_, err = m.getImapClient()
@@ -165,7 +167,11 @@ func (m *ImapFolder) UpdateMessageList() error {
 		return m.e.E(err)
 	}
 
-	cmd, err := client.Send("UID FETCH", set, "(UID FLAGS)")
+	items := "(UID FLAGS)"
+	if m.gmail {
+		items = "(UID FLAGS X-GM-MSGID)"
+	}
+	cmd, err := client.Send("UID FETCH", set, items)
 	if err != nil {
 		return m.e.E(err)
 	}
@@ -185,7 +191,10 @@ func (m *ImapFolder) UpdateMessageList() error {
 			flags := ImapFlagsToString(imap.AsFlagSet(rsp.MessageInfo().Attrs["FLAGS"]))
 
 			//m.log.Debugf("uid: %d, flags: %s", uid, flags)
-			m.messages[uid] = &ImapMessageInfo{MessageInfo{uid, flags, false}}
+			m.messages[uid] = &ImapMessageInfo{
+				MessageInfo: MessageInfo{uid, flags, false},
+				GmailMsgID:  gmailMsgID(rsp.MessageInfo().Attrs["X-GM-MSGID"]),
+			}
 		}
 		cmd.Data = nil
 
@@ -346,7 +355,7 @@ func (m *ImapFolder) AddMessage(uid uint32, flags string, body []byte) (newuid u
 		return 0, m.e.E(err)
 	}
 
-	messageinfo := ImapMessageInfo{MessageInfo{newuid, flags, false}}
+	messageinfo := ImapMessageInfo{MessageInfo: MessageInfo{newuid, flags, false}}
 	m.messages[newuid] = &messageinfo
 	m.logger.Debugf("Registering message. uid: %d, messageinfo: %v", newuid, messageinfo)
 	return
@@ -394,6 +403,90 @@ func (m *ImapFolder) GetIgnoredMessages() []uint32 {
 
 }
 
+// copyUID returns the uid of a copied message from the COPYUID response
+// code (RFC 4315): OK [COPYUID uidvalidity srcuids dstuids]
+func copyUID(rsp *imap.Response) (uint32, error) {
+	if len(rsp.Fields) < 4 || imap.AsAtom(rsp.Fields[0]) != "COPYUID" {
+		return 0, fmt.Errorf("Missing COPYUID in the copy response")
+	}
+	uid := imap.AsNumber(rsp.Fields[3])
+	if uid == 0 {
+		return 0, fmt.Errorf("Wrong COPYUID response: %v", rsp.Fields)
+	}
+	return uid, nil
+}
+
+// MoveMessage moves a message to another folder of the store with UID MOVE
+// (RFC 6851) or, without the MOVE capability, copying it and deleting the
+// original one
+func (m *ImapFolder) MoveMessage(uid uint32, dst MailfolderManager) (uint32, bool, error) {
+	dstfolder, ok := dst.(*ImapFolder)
+	if !ok || dstfolder.store != m.store {
+		return 0, false, nil
+	}
+	message, ok := m.messages[uid]
+	if !ok {
+		return 0, false, m.e.E(fmt.Errorf("Cannot find message with uid: %d", uid))
+	}
+
+	client, err := m.getImapClient()
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+
+	set, _ := imap.NewSeqSet(strconv.FormatUint(uint64(uid), 10))
+	move := client.Caps["MOVE"]
+	var cmd *imap.Command
+	if move {
+		if _, ok := client.CommandConfig["UID MOVE"]; !ok {
+			// The COPYUID is sent in an untagged OK response
+			client.CommandConfig["UID MOVE"] = &imap.CommandConfig{States: imap.Selected, Filter: imap.LabelFilter("COPYUID")}
+		}
+		cmd, err = imap.Wait(client.Send("UID MOVE", set, client.Quote(imap.UTF7Encode(dstfolder.imappath))))
+	} else {
+		cmd, err = imap.Wait(client.UIDCopy(set, dstfolder.imappath))
+	}
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+
+	// Process unilateral server data (the EXPUNGE of the moved message)
+	for _, rsp := range client.Data {
+		m.logger.Debug("Server data: ", rsp)
+	}
+	client.Data = nil
+
+	rsp, err := cmd.Result(imap.OK)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	if len(cmd.Data) > 0 {
+		rsp = cmd.Data[0]
+	}
+	newuid, err := copyUID(rsp)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+
+	if move {
+		delete(m.messages, uid)
+	} else if err = m.DeleteMessage(uid); err != nil {
+		return 0, false, m.e.E(err)
+	}
+
+	dstfolder.messages[newuid] = &ImapMessageInfo{
+		MessageInfo: MessageInfo{newuid, message.Flags, false},
+		GmailMsgID:  message.GmailMsgID,
+	}
+	m.logger.Debugf("Moved message with uid %d to folder %s. uid: %d", uid, dstfolder.imappath, newuid)
+	return newuid, true, nil
+}
+
+// FolderID returns the folder UIDVALIDITY
+func (m *ImapFolder) FolderID() string {
+	return strconv.FormatUint(uint64(m.uidvalidity), 10)
+}
+
 func (m *ImapFolder) Close() (err error) {
 	if m.client == nil {
 		return
@@ -402,5 +495,9 @@ func (m *ImapFolder) Close() (err error) {
 	m.client.Close(m.expunge)
 	m.client.Logout(10)
 
+	if m.allmailclient != nil {
+		m.allmailclient.Logout(10)
+	}
+
 	return
 }
@@ -118,7 +118,7 @@ func SetupImapFolderTest(t *testing.T) {
 	conn := <-ch
 	imapfoldertest.conn = conn
 
-	folder := Mailfolder{[]string{"INBOX"}, false}
+	folder := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
 
 	conn.Script(
 		`C: TAG0 EXAMINE "INBOX"`,
@@ -188,7 +188,7 @@ func TestImapFolderUIDValidity(t *testing.T) {
 	}
 	connfm.Check()
 
-	folder := Mailfolder{[]string{"INBOX"}, false}
+	folder := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
 
 	conn.Script(
 		`C: TAG0 EXAMINE "INBOX"`,
@@ -365,3 +365,217 @@ func TestImapFolderStringToImapFlags(t *testing.T) {
 	}
 
 }
+
+func TestImapFolderGmail(t *testing.T) {
+	server := imapmock.NewMockImapServer(t, "* PREAUTH [CAPABILITY IMAP4rev1 UNSELECT UIDPLUS X-GM-EXT-1] Server ready")
+	saddr := server.GetServerAddress()
+	shost, sportstr, _ := net.SplitHostPort(saddr.String())
+	sport, _ := strconv.ParseUint(sportstr, 10, 16)
+
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	storeconf := config.StoreConfig{
+		Name:      "store1",
+		StoreType: "IMAP",
+		Host:      shost,
+		Port:      uint16(sport),
+		Gmail:     true,
+	}
+	globalconfig := config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{&storeconf},
+		LogLevel:    "debug",
+		DebugImap:   true,
+	}
+
+	ch := make(chan *imapmock.Connection, 1)
+	go func() {
+		conn, _ := server.WaitConnection()
+		conn.Script(
+			`C: TAG0 LIST "" "*"`,
+			`S: * LIST (\HasNoChildren) "/" INBOX`,
+			`S: * LIST (\HasNoChildren \All) "/" "[Gmail]/All Mail"`,
+			`S: * LIST (\HasNoChildren) "/" Work`,
+			`S: TAG0 OK LIST completed`,
+		)
+		conn.Check()
+		ch <- conn
+	}()
+	s, err := newStore(&globalconfig, &storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-ch
+
+	conn.Script(
+		`C: TAG0 EXAMINE "Work"`,
+		`S: * OK [UIDVALIDITY 2] UIDs valid.`,
+		`S: * 1 EXISTS`,
+		`S: TAG0 OK [READ-ONLY] Work selected. (Success)`,
+		`C: TAG1 UNSELECT`,
+		`S: TAG1 OK Returned to authenticated state. (Success)`,
+	)
+	go func() {
+		conn, _ := server.WaitConnection()
+		conn.Script(
+			`C: TAG0 SELECT "Work"`,
+			`S: * OK [UIDVALIDITY 2] UIDs valid.`,
+			`S: * 1 EXISTS`,
+			`S: TAG0 OK [READ-WRITE] Work selected. (Success)`,
+		)
+		ch <- conn
+	}()
+	fm, err := s.GetMailfolderManager(foldername{"Work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Check()
+	connfm := <-ch
+
+	connfm.Script(`C: TAG0 UID FETCH 1:* (UID FLAGS X-GM-MSGID)`,
+		`S: * 1 FETCH (UID 3 FLAGS (\Seen) X-GM-MSGID 1278455344230334865)`,
+		`S: TAG0 OK Fetch completed.`,
+	)
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	connfm.Check()
+	if id := fm.(GlobalMessageIDer).GlobalMessageID(3); id != "1278455344230334865" {
+		t.Fatalf("Wrong X-GM-MSGID: %q", id)
+	}
+
+	// Adding the label of the folder to a message in All Mail
+	go func() {
+		conn, _ := server.WaitConnection()
+		conn.Script(
+			`C: TAG0 SELECT "[Gmail]/All Mail"`,
+			`S: * OK [UIDVALIDITY 11] UIDs valid.`,
+			`S: * 40 EXISTS`,
+			`S: TAG0 OK [READ-WRITE] [Gmail]/All Mail selected. (Success)`,
+			`C: TAG1 UID SEARCH CHARSET UTF-8 X-GM-MSGID 1278455344230334866`,
+			`S: * SEARCH 42`,
+			`S: TAG1 OK SEARCH completed (Success)`,
+			`C: TAG2 UID STORE 42 FLAGS (\Flagged)`,
+			`S: * 40 FETCH (UID 42 FLAGS (\Flagged))`,
+			`S: TAG2 OK Success`,
+			`C: TAG3 UID COPY 42 "Work"`,
+			`S: TAG3 OK [COPYUID 2 42 7] (Success)`,
+		)
+		ch <- conn
+	}()
+	uid, linked, err := fm.(MessageLinker).LinkMessage(0, "F", "1278455344230334866")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connallmail := <-ch
+	connallmail.Check()
+	if !linked || uid != 7 {
+		t.Fatalf("Wrong linked message: %t, uid %d", linked, uid)
+	}
+	if flags, _ := fm.GetFlags(7); flags != "F" {
+		t.Fatalf("Wrong linked message flags: %q", flags)
+	}
+}
+
+func TestImapFolderMoveMessage(t *testing.T) {
+	server := imapmock.NewMockImapServer(t, "* PREAUTH [CAPABILITY IMAP4rev1 UNSELECT UIDPLUS MOVE] Server ready")
+	saddr := server.GetServerAddress()
+	shost, sportstr, _ := net.SplitHostPort(saddr.String())
+	sport, _ := strconv.ParseUint(sportstr, 10, 16)
+
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	storeconf := config.StoreConfig{
+		Name:      "store1",
+		StoreType: "IMAP",
+		Host:      shost,
+		Port:      uint16(sport),
+	}
+	globalconfig := config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{&storeconf},
+		LogLevel:    "debug",
+		DebugImap:   true,
+	}
+
+	ch := make(chan *imapmock.Connection, 1)
+	go func() {
+		conn, _ := server.WaitConnection()
+		conn.Script(
+			`C: TAG0 LIST "" "*"`,
+			`S: * LIST (\HasNoChildren) "/" INBOX`,
+			`S: * LIST (\HasNoChildren) "/" Work`,
+			`S: * LIST (\HasNoChildren \Archive) "/" Archive`,
+			`S: TAG0 OK LIST completed`,
+		)
+		conn.Check()
+		ch <- conn
+	}()
+	s, err := newStore(&globalconfig, &storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-ch
+
+	getFolder := func(name string, uidvalidity string) (MailfolderManager, *imapmock.Connection) {
+		conn.Script(
+			`C: TAG0 EXAMINE "`+name+`"`,
+			`S: * OK [UIDVALIDITY `+uidvalidity+`] UIDs valid.`,
+			`S: * 1 EXISTS`,
+			`S: TAG0 OK [READ-ONLY] `+name+` selected. (Success)`,
+			`C: TAG1 UNSELECT`,
+			`S: TAG1 OK Returned to authenticated state. (Success)`,
+		)
+		go func() {
+			conn, _ := server.WaitConnection()
+			conn.Script(
+				`C: TAG0 SELECT "`+name+`"`,
+				`S: * OK [UIDVALIDITY `+uidvalidity+`] UIDs valid.`,
+				`S: * 1 EXISTS`,
+				`S: TAG0 OK [READ-WRITE] `+name+` selected. (Success)`,
+			)
+			ch <- conn
+		}()
+		fm, err := s.GetMailfolderManager(foldername{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Check()
+		return fm, <-ch
+	}
+	fm, connfm := getFolder("Work", "2")
+	archivefm, _ := getFolder("Archive", "5")
+
+	connfm.Script(`C: TAG0 UID FETCH 1:* (UID FLAGS)`,
+		`S: * 1 FETCH (UID 3 FLAGS (\Seen))`,
+		`S: TAG0 OK Fetch completed.`,
+	)
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	connfm.Check()
+
+	connfm.Script(`C: TAG0 UID MOVE 3 "Archive"`,
+		`S: * OK [COPYUID 5 3 9] Moved UIDs.`,
+		`S: * 1 EXPUNGE`,
+		`S: TAG0 OK Move completed.`,
+	)
+	uid, moved, err := fm.(MessageMover).MoveMessage(3, archivefm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connfm.Check()
+	if !moved || uid != 9 {
+		t.Fatalf("Wrong moved message: %t, uid %d", moved, uid)
+	}
+	if fm.HasUID(3) {
+		t.Fatalf("Moved message still in the source folder")
+	}
+	if flags, _ := archivefm.GetFlags(9); flags != "S" {
+		t.Fatalf("Wrong moved message flags: %q", flags)
+	}
+}
@@ -0,0 +1,139 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"strconv"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// In Gmail labels mode every label is a folder containing the messages
+// with the label and the All Mail folder contains all of them. The
+// X-GM-MSGID of a message is the same in all of them, so it's used as
+// global message id: a message already in the store is copied from All
+// Mail to a label folder (adding the label) instead of being appended
+// again, and deleting it from a label folder removes only the label.
+
+// gmailMsgID returns the X-GM-MSGID as a string. The imap package returns
+// the numbers not fitting an uint32 as atoms.
+func gmailMsgID(f imap.Field) string {
+	switch v := f.(type) {
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case string:
+		return imap.AsAtom(f)
+	}
+	return ""
+}
+
+// getAllMailClient returns a client with the All Mail folder selected or
+// nil if the store doesn't have it
+func (m *ImapFolder) getAllMailClient() (*imap.Client, error) {
+	if m.allmailclient != nil && m.allmailclient.State() != imap.Closed {
+		return m.allmailclient, nil
+	}
+
+	allmailpath := m.store.allMailPath()
+	if allmailpath == "" {
+		return nil, nil
+	}
+
+	client, err := m.store.newImapClient()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = client.Select(allmailpath, false); err != nil {
+		client.Logout(10)
+		return nil, err
+	}
+
+	m.allmailclient = client
+	return client, nil
+}
+
+// GlobalMessageID returns the X-GM-MSGID of the message in Gmail labels
+// mode
+func (m *ImapFolder) GlobalMessageID(uid uint32) string {
+	if message, ok := m.messages[uid]; ok {
+		return message.GmailMsgID
+	}
+	return ""
+}
+
+// LinkMessage adds the label of the folder to the message with the
+// X-GM-MSGID copying it from the All Mail folder
+func (m *ImapFolder) LinkMessage(srcuid uint32, flags string, id string) (uint32, bool, error) {
+	if !m.gmail || m.dryrun {
+		return 0, false, nil
+	}
+
+	client, err := m.getAllMailClient()
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	if client == nil {
+		m.logger.Debug("No All Mail folder, cannot link messages")
+		return 0, false, nil
+	}
+
+	cmd, err := imap.Wait(client.UIDSearch("X-GM-MSGID", id))
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	var uids []uint32
+	for _, rsp := range cmd.Data {
+		uids = append(uids, rsp.SearchResults()...)
+	}
+	if len(uids) == 0 {
+		return 0, false, nil
+	}
+
+	set, _ := imap.NewSeqSet(strconv.FormatUint(uint64(uids[0]), 10))
+	// The flags are shared by all the labels of the message
+	cmd, err = imap.Wait(client.UIDStore(set, "FLAGS", StringToImapFlags(flags).String()))
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	cmd, err = imap.Wait(client.UIDCopy(set, m.imappath))
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	rsp, err := cmd.Result(imap.OK)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+
+	newuid, err := copyUID(rsp)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+
+	m.messages[newuid] = &ImapMessageInfo{
+		MessageInfo: MessageInfo{newuid, flags, false},
+		GmailMsgID:  id,
+	}
+	m.logger.Debugf("Added label to message with X-GM-MSGID %s. uid: %d", id, newuid)
+	return newuid, true, nil
+}
+
+// SetGlobalMessageID does nothing: the server gives an X-GM-MSGID to the
+// appended messages
+func (m *ImapFolder) SetGlobalMessageID(uid uint32, id string) error {
+	return nil
+}
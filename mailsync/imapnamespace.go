@@ -0,0 +1,190 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// With the namespaces option the folders are listed from the chosen
+// namespaces of the NAMESPACE response (RFC 2342) instead of from the
+// empty reference. Every namespace has its own hierarchy delimiter: a
+// folder name is split with the delimiter of its namespace (the one with
+// the longest matching prefix) and, since the prefix components are kept
+// in the name, converted back with the same one. Only the personal
+// namespace prefix (like the "INBOX." of Courier and Cyrus) can be
+// stripped: the other namespaces prefixes keep their folders apart from
+// the personal ones.
+
+// Namespace kinds in the order of the NAMESPACE response
+var imapNamespaceKinds = []string{"personal", "other", "shared"}
+
+type imapNamespace struct {
+	kind   string
+	prefix string
+	delim  string
+	// Strip the prefix from the folder names
+	strip bool
+	// The prefix as folder name components (empty if stripped)
+	components foldername
+	// Listed by UpdateFolderList
+	selected bool
+}
+
+// parseNamespaces parses the NAMESPACE response. Every kind is NIL or a
+// list of (prefix delimiter [extensions]) lists.
+func parseNamespaces(rsp *imap.Response) ([]*imapNamespace, error) {
+	if len(rsp.Fields) < 4 {
+		return nil, fmt.Errorf("Wrong NAMESPACE response: %v", rsp.Fields)
+	}
+	namespaces := make([]*imapNamespace, 0)
+	for i, kind := range imapNamespaceKinds {
+		for _, f := range imap.AsList(rsp.Fields[i+1]) {
+			desc := imap.AsList(f)
+			if len(desc) < 2 {
+				return nil, fmt.Errorf("Wrong NAMESPACE response: %v", rsp.Fields)
+			}
+			namespaces = append(namespaces, &imapNamespace{
+				kind:   kind,
+				prefix: imap.AsMailbox(desc[0]),
+				delim:  imap.AsString(desc[1]),
+			})
+		}
+	}
+	return namespaces, nil
+}
+
+// splitMailbox splits a mailbox name with a delimiter (a NIL one means a
+// flat namespace)
+func splitMailbox(mailbox string, delim string) foldername {
+	if delim == "" {
+		return foldername{mailbox}
+	}
+	return strings.Split(mailbox, delim)
+}
+
+// getNamespaces queries the server namespaces and selects the ones of the
+// store config
+func (m *ImapStore) getNamespaces(client *imap.Client) ([]*imapNamespace, error) {
+	if !client.Caps["NAMESPACE"] {
+		return nil, fmt.Errorf("Server doesn't provide NAMESPACE capability required by the namespaces option")
+	}
+	if _, ok := client.CommandConfig["NAMESPACE"]; !ok {
+		client.CommandConfig["NAMESPACE"] = &imap.CommandConfig{States: imap.Auth | imap.Selected, Filter: imap.NameFilter}
+	}
+	cmd, err := imap.Wait(client.Send("NAMESPACE"))
+	if err != nil {
+		return nil, err
+	}
+	if len(cmd.Data) == 0 {
+		return nil, fmt.Errorf("Missing NAMESPACE response")
+	}
+	namespaces, err := parseNamespaces(cmd.Data[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ns := range namespaces {
+		m.logger.Debugf("Namespace %s: prefix %q, delimiter %q", ns.kind, ns.prefix, ns.delim)
+		ns.selected = StringInSlice(ns.kind, m.config.Namespaces) &&
+			(len(m.config.Namespaceprefixes) == 0 || StringInSlice(ns.prefix, m.config.Namespaceprefixes))
+		ns.strip = ns.kind == "personal" && m.config.Stripnamespaceprefix
+		if !ns.strip && ns.prefix != "" {
+			ns.components = splitMailbox(strings.TrimSuffix(ns.prefix, ns.delim), ns.delim)
+		}
+	}
+	return namespaces, nil
+}
+
+// namespaceOf returns the namespace of a mailbox: the one with the longest
+// matching prefix. INBOX is always in the personal namespace.
+func (m *ImapStore) namespaceOf(mailbox string) *imapNamespace {
+	var found *imapNamespace
+	for _, ns := range m.namespaces {
+		if mailbox == "INBOX" && ns.kind != "personal" {
+			continue
+		}
+		if (strings.HasPrefix(mailbox, ns.prefix) || mailbox+ns.delim == ns.prefix) && (found == nil || len(ns.prefix) > len(found.prefix)) {
+			found = ns
+		}
+	}
+	return found
+}
+
+// folderName returns the folder name of a mailbox
+func (m *ImapStore) folderName(mailbox string, delim string) foldername {
+	if m.namespaces == nil {
+		return splitMailbox(mailbox, delim)
+	}
+	ns := m.namespaceOf(mailbox)
+	if ns == nil {
+		return splitMailbox(mailbox, delim)
+	}
+	if ns.strip && mailbox != "INBOX" {
+		mailbox = strings.TrimPrefix(mailbox, ns.prefix)
+	}
+	return splitMailbox(mailbox, ns.delim)
+}
+
+// imapPath returns the mailbox name of a folder
+func (m *ImapStore) imapPath(name foldername) string {
+	if m.namespaces == nil {
+		return FolderToStorePath(name, m.separator)
+	}
+
+	var found *imapNamespace
+	for _, ns := range m.namespaces {
+		if len(ns.components) == 0 || len(ns.components) > len(name) || !StrsEquals(name[:len(ns.components)], ns.components) {
+			continue
+		}
+		if found == nil || len(ns.components) > len(found.components) {
+			found = ns
+		}
+	}
+	if found != nil {
+		return strings.Join(name, found.delim)
+	}
+
+	for _, ns := range m.namespaces {
+		if ns.kind != "personal" || len(ns.components) != 0 {
+			continue
+		}
+		if ns.strip && !(len(name) == 1 && name[0] == "INBOX") {
+			return ns.prefix + strings.Join(name, ns.delim)
+		}
+		return strings.Join(name, ns.delim)
+	}
+	return FolderToStorePath(name, m.separator)
+}
+
+// namespacesSeparator returns the delimiter of the personal namespace (of
+// the first one without it)
+func namespacesSeparator(namespaces []*imapNamespace) string {
+	for _, ns := range namespaces {
+		if ns.kind == "personal" {
+			return ns.delim
+		}
+	}
+	if len(namespaces) > 0 {
+		return namespaces[0].delim
+	}
+	return ""
+}
@@ -42,6 +42,7 @@ type ImapStore struct {
 	metadatadir  string
 	client       *imap.Client
 	separator    rune
+	namespaces   []*imapNamespace
 	folders      []*Mailfolder
 	logger       *log.Logger
 	e            *errors.Error
@@ -121,7 +122,7 @@ func (m *ImapStore) getImapClient() (*imap.Client, error) {
 
 func (m *ImapStore) getUIDValidity(folder *Mailfolder) (uidvalidity uint32, err error) {
 	// Get UIDValidity from the server
-	imappath := FolderToStorePath(folder.Name, m.separator)
+	imappath := m.imapPath(folder.Name)
 	client, err := m.getImapClient()
 	if err != nil {
 		return 0, m.e.E(err)
@@ -141,31 +142,15 @@ func (m *ImapStore) getUIDValidity(folder *Mailfolder) (uidvalidity uint32, err
 
 	// Verify that metadatadir has already an uidvalidity or create it from the server provided one
 	var mduidvalidity uint32
-	foldermetadatadir := filepath.Join(m.metadatadir, FolderToStorePath(folder.Name, os.PathSeparator))
+	foldermetadatadir := filepath.Join(m.metadatadir, folderMetadataPath(folder.Name))
 	uidvaliditypath := filepath.Join(foldermetadatadir, "uidvalidity")
 	f, err := os.Open(uidvaliditypath)
 	if err != nil {
-		fo, err := os.Create(uidvaliditypath)
-		if err != nil {
-			return 0, m.e.E(err)
-		}
-
-		defer func() {
-			if err := fo.Close(); err != nil {
-				m.logger.Errorf("file close error")
+		if !m.dryrun {
+			err = writeFileAtomic(uidvaliditypath, []byte(strconv.FormatUint(uint64(serveruidvalidity), 10)), m.config.Fsync)
+			if err != nil {
+				return 0, m.e.E(err)
 			}
-		}()
-
-		w := bufio.NewWriter(fo)
-
-		if _, err := w.WriteString(strconv.FormatUint(uint64(serveruidvalidity), 10)); err != nil {
-			return 0, m.e.E(err)
-		}
-		if err = w.Flush(); err != nil {
-			return 0, m.e.E(err)
-		}
-		if err = fo.Sync(); err != nil {
-			return 0, m.e.E(err)
 		}
 
 		mduidvalidity = serveruidvalidity
@@ -177,7 +162,7 @@ func (m *ImapStore) getUIDValidity(folder *Mailfolder) (uidvalidity uint32, err
 		uidvaliditystr := scanner.Text()
 
 		if len(uidvaliditystr) == 0 {
-			err := fmt.Errorf("Wrong uidvalidity %s. Something strange happened", uidvalidity)
+			err := fmt.Errorf("Wrong uidvalidity %s. Something strange happened", uidvaliditystr)
 			return 0, m.e.E(err)
 		}
 
@@ -207,9 +192,15 @@ func NewImapStore(globalconfig *config.Config, config *config.StoreConfig, basem
 
 	metadatadir := filepath.Join(basemetadatadir, name)
 
-	err = os.MkdirAll(metadatadir, 0777)
-	if err != nil {
-		return nil, err
+	if !dryrun {
+		err = os.MkdirAll(metadatadir, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = escapeMetadataNames(metadatadir, dryrun); err != nil {
+		return nil, e.E(err)
 	}
 
 	m = &ImapStore{
@@ -235,6 +226,11 @@ func NewImapStore(globalconfig *config.Config, config *config.StoreConfig, basem
 		return
 	}
 
+	if m.config.Gmail && !m.client.Caps["X-GM-EXT-1"] {
+		err = m.e.E(fmt.Errorf("Server doesn't provide X-GM-EXT-1 capability required by the gmail option"))
+		return
+	}
+
 	err = m.UpdateFolderList()
 	return
 }
@@ -245,7 +241,7 @@ func (m *ImapStore) CreateFolder(name foldername) (err error) {
 		return m.e.E(err)
 	}
 
-	_, err = imap.Wait(client.Create(FolderToStorePath(name, m.separator)))
+	_, err = imap.Wait(client.Create(m.imapPath(name)))
 	if err != nil {
 		return m.e.E(err)
 	}
@@ -273,6 +269,17 @@ func (m *ImapStore) getFolder(name foldername) *Mailfolder {
 	return nil
 }
 
+// allMailPath returns the path of the folder with the \All role (the Gmail
+// "All Mail" one) or an empty string
+func (m *ImapStore) allMailPath() string {
+	for _, f := range m.folders {
+		if f.Role == `\All` {
+			return m.imapPath(f.Name)
+		}
+	}
+	return ""
+}
+
 func (m *ImapStore) HasFolder(name foldername) bool {
 	if f := m.getFolder(name); f != nil {
 		return true
@@ -280,6 +287,43 @@ func (m *ImapStore) HasFolder(name foldername) bool {
 	return false
 }
 
+// Gmail XLIST attributes with a different special-use name
+var xlistRoles = map[string]string{
+	`\AllMail`: `\All`,
+	`\Spam`:    `\Junk`,
+	`\Starred`: `\Flagged`,
+}
+
+// xlistMailboxInfo decodes a XLIST response like a LIST one
+func xlistMailboxInfo(rsp *imap.Response) *imap.MailboxInfo {
+	info := &imap.MailboxInfo{
+		Attrs: imap.AsFlagSet(rsp.Fields[1]),
+		Delim: imap.AsString(rsp.Fields[2]),
+		Name:  imap.AsMailbox(rsp.Fields[3]),
+	}
+	for attr := range info.Attrs {
+		for xattr, role := range xlistRoles {
+			if strings.EqualFold(attr, xattr) {
+				info.Attrs[role] = true
+			}
+		}
+	}
+	return info
+}
+
+// imapFolderRole returns the special-use role in the mailbox attributes
+// (the imap package changes their case)
+func imapFolderRole(attrs imap.FlagSet) string {
+	for _, role := range folderRoles {
+		for attr := range attrs {
+			if strings.EqualFold(attr, role) {
+				return role
+			}
+		}
+	}
+	return ""
+}
+
 func (m *ImapStore) UpdateFolderList() error {
 	m.folders = make([]*Mailfolder, 0)
 
@@ -288,37 +332,89 @@ func (m *ImapStore) UpdateFolderList() error {
 		return m.e.E(err)
 	}
 
-	var cmd *imap.Command
-	var rsp *imap.Response
-
 	var separator rune
 
-	cmd, err = imap.Wait(client.List("", "*"))
-	if err != nil {
-		return m.e.E(err)
+	// Without namespaces everything is listed from the empty reference
+	m.namespaces = nil
+	patterns := []*imapNamespace{nil}
+	if len(m.config.Namespaces) > 0 {
+		m.namespaces, err = m.getNamespaces(client)
+		if err != nil {
+			return m.e.E(err)
+		}
+		patterns = patterns[:0]
+		for _, ns := range m.namespaces {
+			if ns.selected {
+				patterns = append(patterns, ns)
+			}
+		}
+		separator, _ = utf8.DecodeRuneInString(namespacesSeparator(m.namespaces))
 	}
 
-	// Print mailbox information
-	m.logger.Debug("Folders:")
-	for _, rsp = range cmd.Data {
-		name := strings.Split(rsp.MailboxInfo().Name, string(rsp.MailboxInfo().Delim))
-		if separator == 0 {
-			separator, _ = utf8.DecodeRuneInString(rsp.MailboxInfo().Delim)
+	// The SPECIAL-USE servers return the folder roles in the LIST
+	// responses, the older Gmail ones only in the XLIST ones
+	xlist := client.Caps["XLIST"] && !client.Caps["SPECIAL-USE"]
+	if xlist {
+		if _, ok := client.CommandConfig["XLIST"]; !ok {
+			client.CommandConfig["XLIST"] = &imap.CommandConfig{States: imap.Auth | imap.Selected, Filter: imap.NameFilter}
 		}
-		// Ignore \Noselect folders
-		if _, ok := rsp.MailboxInfo().Attrs[`\Noselect`]; ok {
-			continue
+	}
+
+	for _, ns := range patterns {
+		pattern := "*"
+		if ns != nil {
+			pattern = imap.UTF7Encode(ns.prefix) + "*"
 		}
-		folder := &Mailfolder{
-			Name:     name,
-			Excluded: false,
+
+		var cmd *imap.Command
+		if xlist {
+			cmd, err = imap.Wait(client.Send("XLIST", client.Quote(""), client.Quote(pattern)))
+		} else {
+			cmd, err = imap.Wait(client.List("", pattern))
+		}
+		if err != nil {
+			return m.e.E(err)
+		}
+
+		// Print mailbox information
+		m.logger.Debug("Folders:")
+		for _, rsp := range cmd.Data {
+			info := rsp.MailboxInfo()
+			if xlist {
+				info = xlistMailboxInfo(rsp)
+			}
+			// A mailbox of a nested namespace is listed with it
+			if ns != nil && m.namespaceOf(info.Name) != ns {
+				continue
+			}
+			name := m.folderName(info.Name, info.Delim)
+			if separator == 0 {
+				separator, _ = utf8.DecodeRuneInString(info.Delim)
+			}
+			// Ignore \Noselect folders
+			if _, ok := info.Attrs[`\Noselect`]; ok {
+				continue
+			}
+			folder := &Mailfolder{
+				Name:     name,
+				Excluded: false,
+				Role:     imapFolderRole(info.Attrs),
+			}
+			m.folders = append(m.folders, folder)
+			m.logger.Debugf("%v", info)
 		}
-		m.folders = append(m.folders, folder)
-		m.logger.Debugf("%v", rsp.MailboxInfo())
 	}
 
 	m.separator = separator
 
+	if m.config.Subscribedonly {
+		subscribed, err := m.SubscribedFolders()
+		if err != nil {
+			return err
+		}
+		applySubscriptions(m, m.folders, subscribed)
+	}
+
 	err = applyRegExpPatterns(m, m.folders)
 	if err != nil {
 		return m.e.E(err)
@@ -327,6 +423,54 @@ func (m *ImapStore) UpdateFolderList() error {
 	return nil
 }
 
+// SubscribedFolders returns the folders of the LSUB response (of LIST
+// (SUBSCRIBED) with the LIST-EXTENDED extension)
+func (m *ImapStore) SubscribedFolders() ([]foldername, error) {
+	client, err := m.getImapClient()
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+
+	var cmd *imap.Command
+	if client.Caps["LIST-EXTENDED"] {
+		cmd, err = imap.Wait(client.Send("LIST", []imap.Field{"SUBSCRIBED"}, client.Quote(""), client.Quote("*")))
+	} else {
+		cmd, err = imap.Wait(client.LSub("", "*"))
+	}
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+
+	names := make([]foldername, 0, len(cmd.Data))
+	for _, rsp := range cmd.Data {
+		info := rsp.MailboxInfo()
+		if info == nil {
+			continue
+		}
+		names = append(names, m.folderName(info.Name, info.Delim))
+	}
+	return names, nil
+}
+
+// SetFolderSubscribed subscribes or unsubscribes a folder
+func (m *ImapStore) SetFolderSubscribed(name foldername, subscribed bool) (err error) {
+	client, err := m.getImapClient()
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	imappath := m.imapPath(name)
+	if subscribed {
+		_, err = imap.Wait(client.Subscribe(imappath))
+	} else {
+		_, err = imap.Wait(client.Unsubscribe(imappath))
+	}
+	if err != nil {
+		return m.e.E(err)
+	}
+	return nil
+}
+
 func (m *ImapStore) Separator() (rune, error) {
 	return m.separator, nil
 }
@@ -343,17 +487,19 @@ func (m *ImapStore) GetMailfolderManager(name foldername) (manager MailfolderMan
 	m.Lock()
 	defer m.Unlock()
 
-	if !m.HasFolder(name) {
+	if !m.HasFolder(name) && !m.dryrun {
 		err = m.CreateFolder(name)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	foldermetadatadir := filepath.Join(m.metadatadir, FolderToStorePath(name, os.PathSeparator))
-	err = os.MkdirAll(foldermetadatadir, 0777)
-	if err != nil {
-		return nil, m.e.E(err)
+	foldermetadatadir := filepath.Join(m.metadatadir, folderMetadataPath(name))
+	if !m.dryrun {
+		err = os.MkdirAll(foldermetadatadir, 0777)
+		if err != nil {
+			return nil, m.e.E(err)
+		}
 	}
 
 	folder := m.getFolder(name)
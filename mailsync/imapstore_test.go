@@ -131,7 +131,7 @@ func TestImapStoreUpdateFolder(t *testing.T) {
 		t.Fatalf("Expected %d folders, found %d", expected, len(folders))
 	}
 
-	NoSelectFolder := Mailfolder{[]string{"dir01"}, false}
+	NoSelectFolder := Mailfolder{Name: []string{"dir01"}, Excluded: false}
 	if containsFolder(t, folders, NoSelectFolder, false) {
 		t.Fatalf("Folder %s, should be ignored as is of type \\Noselect", NoSelectFolder)
 	}
@@ -146,3 +146,225 @@ func containsFolder(t *testing.T, folders []Mailfolder, folder Mailfolder, check
 	}
 	return false
 }
+
+func TestImapStoreFolderRoles(t *testing.T) {
+	SetupImapStoreTest(t)
+
+	expected := map[string]string{"Trash": `\Trash`, "Drafts": `\Drafts`, "Sent": `\Sent`, "INBOX": ""}
+	for _, f := range imapstoretest.s1.GetFolders() {
+		if role, ok := expected[f.String()]; ok && f.Role != role {
+			t.Fatalf("Folder %s: expected role %q, found %q", f, role, f.Role)
+		}
+	}
+}
+
+func TestImapStoreXlist(t *testing.T) {
+	server := imapmock.NewMockImapServer(t, "* PREAUTH [CAPABILITY IMAP4rev1 UIDPLUS XLIST] Server ready")
+	saddr := server.GetServerAddress()
+	shost, sportstr, _ := net.SplitHostPort(saddr.String())
+	sport, _ := strconv.ParseUint(sportstr, 10, 16)
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	storeconf := config.StoreConfig{
+		Name:           "store1",
+		StoreType:      "IMAP",
+		Host:           shost,
+		Port:           uint16(sport),
+		RegexpPatterns: []string{`!\All`},
+	}
+	globalconfig := config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{&storeconf},
+		LogLevel:    "debug",
+		DebugImap:   true,
+	}
+
+	ch := make(chan *imapmock.Connection, 1)
+	go func() {
+		conn, _ := server.WaitConnection()
+		conn.Script(
+			`C: TAG0 XLIST "" "*"`,
+			`S: * XLIST (\HasNoChildren \Inbox) "/" INBOX`,
+			`S: * XLIST (\HasChildren \Noselect) "/" "[Gmail]"`,
+			`S: * XLIST (\HasNoChildren \AllMail) "/" "[Gmail]/All Mail"`,
+			`S: * XLIST (\HasNoChildren \Sent) "/" "[Gmail]/Sent Mail"`,
+			`S: * XLIST (\HasNoChildren \Spam) "/" "[Gmail]/Spam"`,
+			`S: TAG0 OK XLIST completed`,
+		)
+		conn.Check()
+		ch <- conn
+	}()
+
+	s, err := newStore(&globalconfig, &storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+
+	expected := map[string]string{"INBOX": "", "[Gmail]/All Mail": `\All`, "[Gmail]/Sent Mail": `\Sent`, "[Gmail]/Spam": `\Junk`}
+	folders := s.GetFolders()
+	if len(folders) != len(expected) {
+		t.Fatalf("Expected %d folders, found %d", len(expected), len(folders))
+	}
+	for _, f := range folders {
+		if role, ok := expected[f.String()]; !ok || f.Role != role {
+			t.Fatalf("Folder %s: expected role %q, found %q", f, role, f.Role)
+		}
+		if f.Excluded != (f.Role == `\All`) {
+			t.Fatalf("Folder %s: wrong excluded %t", f, f.Excluded)
+		}
+	}
+}
+
+func TestImapStoreSubscribedOnly(t *testing.T) {
+	server := imapmock.NewMockImapServer(t, "* PREAUTH [CAPABILITY IMAP4rev1 UIDPLUS] Server ready")
+	saddr := server.GetServerAddress()
+	shost, sportstr, _ := net.SplitHostPort(saddr.String())
+	sport, _ := strconv.ParseUint(sportstr, 10, 16)
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	storeconf := config.StoreConfig{
+		Name:           "store1",
+		StoreType:      "IMAP",
+		Host:           shost,
+		Port:           uint16(sport),
+		Subscribedonly: true,
+	}
+	globalconfig := config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{&storeconf},
+		LogLevel:    "debug",
+		DebugImap:   true,
+	}
+
+	ch := make(chan *imapmock.Connection, 1)
+	go func() {
+		conn, _ := server.WaitConnection()
+		conn.Script(
+			`C: TAG0 LIST "" "*"`,
+			`S: * LIST (\HasNoChildren) "." INBOX`,
+			`S: * LIST (\HasChildren) "." work`,
+			`S: * LIST (\HasNoChildren) "." work.2014`,
+			`S: * LIST (\HasNoChildren) "." later`,
+			`S: TAG0 OK LIST completed`,
+			`C: TAG1 LSUB "" "*"`,
+			`S: * LSUB () "." work.2014`,
+			`S: * LSUB () "." old`,
+			`S: TAG1 OK LSUB completed`,
+			`C: TAG2 SUBSCRIBE "later"`,
+			`S: TAG2 OK SUBSCRIBE completed`,
+		)
+		ch <- conn
+	}()
+
+	s, err := newStore(&globalconfig, &storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{"INBOX": false, "work": true, "work/2014": false, "later": true}
+	for _, f := range s.GetFolders() {
+		if excluded, ok := expected[f.String()]; !ok || f.Excluded != excluded {
+			t.Fatalf("Folder %s: wrong excluded %t", f, f.Excluded)
+		}
+	}
+
+	if err = s.(FolderSubscriber).SetFolderSubscribed(foldername{"later"}, true); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-ch
+	conn.Check()
+}
+
+func TestImapStoreNamespaces(t *testing.T) {
+	server := imapmock.NewMockImapServer(t, "* PREAUTH [CAPABILITY IMAP4rev1 UIDPLUS NAMESPACE] Server ready")
+	saddr := server.GetServerAddress()
+	shost, sportstr, _ := net.SplitHostPort(saddr.String())
+	sport, _ := strconv.ParseUint(sportstr, 10, 16)
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	storeconf := config.StoreConfig{
+		Name:                 "store1",
+		StoreType:            "IMAP",
+		Host:                 shost,
+		Port:                 uint16(sport),
+		Namespaces:           []string{"personal", "shared"},
+		Stripnamespaceprefix: true,
+		RegexpPatterns:       []string{`!/^#shared\.team\.spam$/`},
+	}
+	globalconfig := config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{&storeconf},
+		LogLevel:    "debug",
+		DebugImap:   true,
+	}
+
+	ch := make(chan *imapmock.Connection, 1)
+	go func() {
+		conn, _ := server.WaitConnection()
+		conn.Script(
+			`C: TAG0 NAMESPACE`,
+			`S: * NAMESPACE (("INBOX." ".")) (("user." ".")) (("#shared/" "/"))`,
+			`S: TAG0 OK NAMESPACE completed`,
+			`C: TAG1 LIST "" "INBOX.*"`,
+			`S: * LIST (\HasChildren) "." INBOX.work`,
+			`S: * LIST (\HasNoChildren) "." INBOX.work.2014`,
+			`S: * LIST (\HasNoChildren \Sent) "." INBOX.Sent`,
+			`S: TAG1 OK LIST completed`,
+			`C: TAG2 LIST "" "#shared/*"`,
+			`S: * LIST (\HasChildren) "/" #shared/team`,
+			`S: * LIST (\HasNoChildren) "/" #shared/team/spam`,
+			`S: * LIST (\HasNoChildren) "/" #shared/team/a.b`,
+			`S: TAG2 OK LIST completed`,
+		)
+		conn.Check()
+		ch <- conn
+	}()
+
+	s, err := newStore(&globalconfig, &storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+
+	// The folders with their mailbox name
+	expected := map[string]string{
+		"work":               "INBOX.work",
+		"work.2014":          "INBOX.work.2014",
+		"Sent":               "INBOX.Sent",
+		"#shared.team":       "#shared/team",
+		"#shared.team.spam":  "#shared/team/spam",
+		"#shared.team.a%2Eb": "#shared/team/a.b",
+		"INBOX":              "INBOX",
+	}
+	imapstore := s.(*ImapStore)
+	folders := s.GetFolders()
+	if len(folders) != len(expected)-1 {
+		t.Fatalf("Wrong folders: %v", folders)
+	}
+	for _, f := range folders {
+		key := FolderToEscapedStorePath(f.Name, '.', false)
+		mailbox, ok := expected[key]
+		if !ok {
+			t.Fatalf("Unexpected folder %v", f.Name)
+		}
+		if path := imapstore.imapPath(f.Name); path != mailbox {
+			t.Fatalf("Folder %v: expected mailbox %s, found %s", f.Name, mailbox, path)
+		}
+		if f.Excluded != (key == "#shared.team.spam") {
+			t.Fatalf("Folder %s: wrong excluded %t", f, f.Excluded)
+		}
+	}
+	if path := imapstore.imapPath(foldername{"INBOX"}); path != "INBOX" {
+		t.Fatalf("Wrong INBOX mailbox: %s", path)
+	}
+	if sep, _ := s.Separator(); sep != '.' {
+		t.Fatalf("Wrong separator: %c", sep)
+	}
+}
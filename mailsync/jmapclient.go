@@ -0,0 +1,258 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	jmapCoreCapability = "urn:ietf:params:jmap:core"
+	jmapMailCapability = "urn:ietf:params:jmap:mail"
+
+	// Used when the server doesn't report its maxObjectsInGet
+	jmapDefaultMaxObjectsInGet = 256
+)
+
+type jmapSession struct {
+	APIURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+	UploadURL       string                     `json:"uploadUrl"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+}
+
+// jmapMethodError is a JMAP method level error (like "cannotCalculateChanges")
+type jmapMethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *jmapMethodError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("JMAP error: %s: %s", e.Type, e.Description)
+	}
+	return fmt.Sprintf("JMAP error: %s", e.Type)
+}
+
+// jmapSetError is the error of a single object in a */set or */import
+// response
+type jmapSetError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	ExistingID  string `json:"existingId"`
+}
+
+func (e *jmapSetError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("JMAP set error: %s: %s", e.Type, e.Description)
+	}
+	return fmt.Sprintf("JMAP set error: %s", e.Type)
+}
+
+// jmapClient is a minimal JMAP client doing one method call per request
+type jmapClient struct {
+	sessionURL string
+	username   string
+	password   string
+	token      string
+	client     *http.Client
+
+	session         *jmapSession
+	accountID       string
+	maxObjectsInGet int
+}
+
+func newJMAPClient(sessionURL string, username string, password string, token string, validateservercert bool) *jmapClient {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: !validateservercert},
+	}
+	return &jmapClient{
+		sessionURL: sessionURL,
+		username:   username,
+		password:   password,
+		token:      token,
+		client:     &http.Client{Transport: transport, Timeout: 5 * time.Minute},
+	}
+}
+
+func (c *jmapClient) do(req *http.Request) ([]byte, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// Connect fetches the JMAP session resource
+func (c *jmapClient) Connect() error {
+	req, err := http.NewRequest("GET", c.sessionURL, nil)
+	if err != nil {
+		return err
+	}
+	data, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	session := &jmapSession{}
+	if err = json.Unmarshal(data, session); err != nil {
+		return fmt.Errorf("Wrong JMAP session: %s", err)
+	}
+	if _, ok := session.Capabilities[jmapMailCapability]; !ok {
+		return fmt.Errorf("Server doesn't provide %s capability", jmapMailCapability)
+	}
+	accountID, ok := session.PrimaryAccounts[jmapMailCapability]
+	if !ok {
+		return fmt.Errorf("No primary account for %s", jmapMailCapability)
+	}
+
+	c.maxObjectsInGet = jmapDefaultMaxObjectsInGet
+	var core struct {
+		MaxObjectsInGet int `json:"maxObjectsInGet"`
+	}
+	if err := json.Unmarshal(session.Capabilities[jmapCoreCapability], &core); err == nil && core.MaxObjectsInGet > 0 {
+		c.maxObjectsInGet = core.MaxObjectsInGet
+	}
+
+	// The session urls can be relative to the session resource host
+	base, err := url.Parse(c.sessionURL)
+	if err != nil {
+		return err
+	}
+	for _, u := range []*string{&session.APIURL, &session.DownloadURL, &session.UploadURL} {
+		if strings.HasPrefix(*u, "/") {
+			*u = base.Scheme + "://" + base.Host + *u
+		}
+	}
+
+	c.session = session
+	c.accountID = accountID
+	return nil
+}
+
+// Call executes a single JMAP method. The accountId is added to args and
+// the method response arguments are decoded in result.
+func (c *jmapClient) Call(method string, args map[string]interface{}, result interface{}) error {
+	args["accountId"] = c.accountID
+	request := map[string]interface{}{
+		"using":       []string{jmapCoreCapability, jmapMailCapability},
+		"methodCalls": []interface{}{[]interface{}{method, args, "0"}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.session.APIURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	data, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err = json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("Wrong JMAP response: %s", err)
+	}
+	if len(response.MethodResponses) != 1 || len(response.MethodResponses[0]) != 3 {
+		return fmt.Errorf("Wrong JMAP response: %s", data)
+	}
+	var name string
+	if err = json.Unmarshal(response.MethodResponses[0][0], &name); err != nil {
+		return fmt.Errorf("Wrong JMAP response: %s", err)
+	}
+	if name == "error" {
+		merr := &jmapMethodError{}
+		if err = json.Unmarshal(response.MethodResponses[0][1], merr); err != nil {
+			return fmt.Errorf("Wrong JMAP response: %s", err)
+		}
+		return merr
+	}
+	if name != method {
+		return fmt.Errorf("Wrong JMAP response: expected %s, got %s", method, name)
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.Unmarshal(response.MethodResponses[0][1], result); err != nil {
+		return fmt.Errorf("Wrong %s response: %s", method, err)
+	}
+	return nil
+}
+
+// Upload uploads data and returns its blob id
+func (c *jmapClient) Upload(data []byte) (string, error) {
+	u := strings.Replace(c.session.UploadURL, "{accountId}", url.PathEscape(c.accountID), -1)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	out, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		BlobID string `json:"blobId"`
+	}
+	if err = json.Unmarshal(out, &result); err != nil || result.BlobID == "" {
+		return "", fmt.Errorf("Wrong JMAP upload response: %s", out)
+	}
+	return result.BlobID, nil
+}
+
+// Download returns the content of a blob
+func (c *jmapClient) Download(blobID string) ([]byte, error) {
+	u := strings.NewReplacer(
+		"{accountId}", url.PathEscape(c.accountID),
+		"{blobId}", url.PathEscape(blobID),
+		"{type}", url.QueryEscape("message/rfc822"),
+		"{name}", "message.eml",
+	).Replace(c.session.DownloadURL)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
@@ -0,0 +1,631 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// JMAP email ids are strings, so every folder keeps a map between them and
+// uids in its metadatadir. The "messages" file contains the Email state of
+// the last UpdateMessageList, the next uid and a line with uid, email id and
+// flags for every message of the folder. The messages added or deleted
+// after it are appended to the "messages.journal" file.
+const (
+	jmapMessagesFile = "messages"
+	jmapJournalFile  = "messages.journal"
+)
+
+var (
+	JMAPFlagsMap = [][]string{
+		{"$seen", "S"},
+		{"$answered", "R"},
+		// JMAP has no deleted flag, use a keyword to keep it
+		{"$deleted", "T"},
+		{"$draft", "D"},
+		{"$flagged", "F"},
+	}
+)
+
+type JMAPFolder struct {
+	folder      *Mailfolder
+	store       *JMAPStore
+	metadatadir string
+	mailboxID   string
+	messages    map[uint32]*JMAPMessageInfo
+	uids        map[string]uint32
+	uidnext     uint32
+	state       string
+	logger      *log.Logger
+	e           *errors.Error
+	dryrun      bool
+}
+
+type JMAPMessageInfo struct {
+	MessageInfo
+
+	ID string
+}
+
+type jmapEmail struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+}
+
+func JMAPKeywordsToString(keywords map[string]bool) string {
+	var flags string
+
+	for _, v := range JMAPFlagsMap {
+		if keywords[v[0]] {
+			flags += v[1]
+		}
+	}
+	return CleanFlags(flags)
+}
+
+func StringToJMAPKeywords(flags string) map[string]bool {
+	keywords := make(map[string]bool)
+
+	for _, v := range JMAPFlagsMap {
+		if strings.Contains(flags, v[1]) {
+			keywords[v[0]] = true
+		}
+	}
+	return keywords
+}
+
+func NewJMAPFolder(folder *Mailfolder, metadatadir string, store *JMAPStore, mailboxID string, dryrun bool) (m *JMAPFolder, err error) {
+	logprefix := fmt.Sprintf("store: %s, jmapfolder: %s", store.Name(), folder)
+	errprefix := fmt.Sprintf("store: %s, jmapfolder: %s", store.Name(), folder)
+	logger := log.GetLogger(logprefix, store.globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	m = &JMAPFolder{
+		folder:      folder,
+		store:       store,
+		metadatadir: metadatadir,
+		mailboxID:   mailboxID,
+		messages:    make(map[uint32]*JMAPMessageInfo),
+		uids:        make(map[string]uint32),
+		uidnext:     1,
+		logger:      logger,
+		e:           e,
+		dryrun:      dryrun,
+	}
+
+	return m, nil
+}
+
+func (m *JMAPFolder) registerMessage(uid uint32, id string, flags string) {
+	m.messages[uid] = &JMAPMessageInfo{MessageInfo{uid, flags, false}, id}
+	m.uids[id] = uid
+	if uid >= m.uidnext {
+		m.uidnext = uid + 1
+	}
+}
+
+func (m *JMAPFolder) unregisterMessage(uid uint32) {
+	if message, ok := m.messages[uid]; ok {
+		delete(m.uids, message.ID)
+		delete(m.messages, uid)
+	}
+}
+
+// load reads the messages saved by the last UpdateMessageList and the ones
+// added after it
+func (m *JMAPFolder) load() error {
+	m.messages = make(map[uint32]*JMAPMessageInfo)
+	m.uids = make(map[string]uint32)
+	m.uidnext = 1
+	m.state = ""
+
+	for _, n := range []string{jmapMessagesFile, jmapJournalFile} {
+		f, err := os.Open(filepath.Join(m.metadatadir, n))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			switch {
+			case fields[0] == "state" && len(fields) == 2:
+				m.state = fields[1]
+			case fields[0] == "delete" && len(fields) == 2:
+				uid, err := strconv.ParseUint(fields[1], 10, 32)
+				if err != nil {
+					return fmt.Errorf("Wrong uid in %s: %s", f.Name(), fields[1])
+				}
+				m.unregisterMessage(uint32(uid))
+			case fields[0] == "uidnext" && len(fields) == 2:
+				uidnext, err := strconv.ParseUint(fields[1], 10, 32)
+				if err != nil {
+					return fmt.Errorf("Wrong uidnext in %s: %s", f.Name(), fields[1])
+				}
+				if uint32(uidnext) > m.uidnext {
+					m.uidnext = uint32(uidnext)
+				}
+			case len(fields) == 2 || len(fields) == 3:
+				uid, err := strconv.ParseUint(fields[0], 10, 32)
+				if err != nil || uid == 0 {
+					return fmt.Errorf("Wrong uid in %s: %s", f.Name(), fields[0])
+				}
+				flags := ""
+				if len(fields) == 3 {
+					flags = fields[2]
+				}
+				m.registerMessage(uint32(uid), fields[1], flags)
+			default:
+				return fmt.Errorf("Wrong line in %s: %q", f.Name(), scanner.Text())
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes the messages file and removes the journal
+func (m *JMAPFolder) save() error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "state %s\n", m.state)
+	fmt.Fprintf(&buf, "uidnext %d\n", m.uidnext)
+	for _, uid := range m.sortedUIDs() {
+		message := m.messages[uid]
+		fmt.Fprintf(&buf, "%d %s %s\n", uid, message.ID, message.Flags)
+	}
+	if err := writeFileAtomic(filepath.Join(m.metadatadir, jmapMessagesFile), buf.Bytes(), m.store.config.Fsync); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(m.metadatadir, jmapJournalFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *JMAPFolder) sortedUIDs() []uint32 {
+	uids := make([]uint32, 0, len(m.messages))
+	for uid := range m.messages {
+		uids = append(uids, uid)
+	}
+	sort.Sort(Uint32Slice(uids))
+	return uids
+}
+
+// journal saves the uid of an added message before returning it, so it
+// will be the same on the next UpdateMessageList also after a crash, and the
+// deleted messages, so their uids aren't reused if the email comes back.
+func (m *JMAPFolder) journal(line string) error {
+	f, err := os.OpenFile(filepath.Join(m.metadatadir, jmapJournalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	if m.store.config.Fsync {
+		if err = f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func (m *JMAPFolder) getEmails(ids []string, properties []string) (emails []*jmapEmail, notfound []string, err error) {
+	client := m.store.client
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > client.maxObjectsInGet {
+			n = client.maxObjectsInGet
+		}
+		var result struct {
+			List     []*jmapEmail `json:"list"`
+			NotFound []string     `json:"notFound"`
+		}
+		args := map[string]interface{}{
+			"ids":        ids[:n],
+			"properties": properties,
+		}
+		if err = client.Call("Email/get", args, &result); err != nil {
+			return nil, nil, err
+		}
+		emails = append(emails, result.List...)
+		notfound = append(notfound, result.NotFound...)
+		ids = ids[n:]
+	}
+	return
+}
+
+func (m *JMAPFolder) getEmail(uid uint32, properties []string) (*jmapEmail, error) {
+	message, ok := m.messages[uid]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find message with uid: %d", uid)
+	}
+	emails, _, err := m.getEmails([]string{message.ID}, properties)
+	if err != nil {
+		return nil, err
+	}
+	if len(emails) != 1 {
+		return nil, fmt.Errorf("Email %s of message with uid %d doesn't exist", message.ID, uid)
+	}
+	return emails[0], nil
+}
+
+// fullUpdate gets all the emails of the mailbox. The uids of the already
+// known emails are kept.
+func (m *JMAPFolder) fullUpdate() error {
+	client := m.store.client
+
+	// Get the current state before the query, the changes done meanwhile
+	// will be also returned by the next Email/changes
+	var stateresult struct {
+		State string `json:"state"`
+	}
+	if err := client.Call("Email/get", map[string]interface{}{"ids": []string{}}, &stateresult); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0)
+	for {
+		var result struct {
+			IDs []string `json:"ids"`
+		}
+		args := map[string]interface{}{
+			"filter":   map[string]interface{}{"inMailbox": m.mailboxID},
+			"position": len(ids),
+		}
+		if err := client.Call("Email/query", args, &result); err != nil {
+			return err
+		}
+		if len(result.IDs) == 0 {
+			break
+		}
+		ids = append(ids, result.IDs...)
+	}
+
+	emails, _, err := m.getEmails(ids, []string{"id", "mailboxIds", "keywords"})
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		if email.MailboxIDs[m.mailboxID] {
+			found[email.ID] = true
+			m.updateEmail(email)
+		}
+	}
+	for uid, message := range m.messages {
+		if !found[message.ID] {
+			m.unregisterMessage(uid)
+		}
+	}
+
+	m.state = stateresult.State
+	return nil
+}
+
+// changesUpdate applies the emails changes since the saved state
+func (m *JMAPFolder) changesUpdate() error {
+	client := m.store.client
+
+	changed := make([]string, 0)
+	destroyed := make([]string, 0)
+	state := m.state
+	for {
+		var result struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Created        []string `json:"created"`
+			Updated        []string `json:"updated"`
+			Destroyed      []string `json:"destroyed"`
+		}
+		if err := client.Call("Email/changes", map[string]interface{}{"sinceState": state}, &result); err != nil {
+			return err
+		}
+		changed = append(append(changed, result.Created...), result.Updated...)
+		destroyed = append(destroyed, result.Destroyed...)
+		state = result.NewState
+		if !result.HasMoreChanges {
+			break
+		}
+	}
+	m.logger.Debugf("Email changes: %d changed, %d destroyed", len(changed), len(destroyed))
+
+	for _, id := range destroyed {
+		if uid, ok := m.uids[id]; ok {
+			m.unregisterMessage(uid)
+		}
+	}
+
+	emails, notfound, err := m.getEmails(changed, []string{"id", "mailboxIds", "keywords"})
+	if err != nil {
+		return err
+	}
+	for _, email := range emails {
+		if email.MailboxIDs[m.mailboxID] {
+			m.updateEmail(email)
+		} else if uid, ok := m.uids[email.ID]; ok {
+			// Moved to another mailbox
+			m.unregisterMessage(uid)
+		}
+	}
+	for _, id := range notfound {
+		if uid, ok := m.uids[id]; ok {
+			m.unregisterMessage(uid)
+		}
+	}
+
+	m.state = state
+	return nil
+}
+
+func (m *JMAPFolder) updateEmail(email *jmapEmail) {
+	flags := JMAPKeywordsToString(email.Keywords)
+	if uid, ok := m.uids[email.ID]; ok {
+		m.messages[uid].Flags = flags
+		return
+	}
+	m.registerMessage(m.uidnext, email.ID, flags)
+}
+
+func (m *JMAPFolder) UpdateMessageList() error {
+	m.messages = make(map[uint32]*JMAPMessageInfo)
+	m.uids = make(map[string]uint32)
+
+	if m.dryrun && !m.store.HasFolder(m.folder.Name) {
+		return nil
+	}
+
+	if err := m.load(); err != nil {
+		return m.e.E(err)
+	}
+
+	if m.state != "" {
+		err := m.changesUpdate()
+		if merr, ok := err.(*jmapMethodError); ok && merr.Type == "cannotCalculateChanges" {
+			m.logger.Infof("Cannot get the changes since state %s. Getting all the folder messages", m.state)
+			err = m.fullUpdate()
+		}
+		if err != nil {
+			return m.e.E(err)
+		}
+	} else {
+		if err := m.fullUpdate(); err != nil {
+			return m.e.E(err)
+		}
+	}
+
+	if m.dryrun {
+		return nil
+	}
+	if err := m.save(); err != nil {
+		return m.e.E(err)
+	}
+	return nil
+}
+
+func (m *JMAPFolder) HasUID(uid uint32) bool {
+	if _, ok := m.messages[uid]; ok {
+		return true
+	}
+	return false
+}
+
+func (m *JMAPFolder) IsIgnored(uid uint32) bool {
+	if m, ok := m.messages[uid]; ok {
+		if m.Ignore {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *JMAPFolder) GetFlags(uid uint32) (flags string, err error) {
+	if message, ok := m.messages[uid]; ok {
+		return message.Flags, nil
+	}
+
+	err = fmt.Errorf("Cannot find message with uid: %d", uid)
+	return "", m.e.E(err)
+}
+
+func (m *JMAPFolder) updateEmailSet(id string, patch map[string]interface{}) error {
+	var result struct {
+		NotUpdated map[string]*jmapSetError `json:"notUpdated"`
+	}
+	args := map[string]interface{}{
+		"update": map[string]interface{}{id: patch},
+	}
+	if err := m.store.client.Call("Email/set", args, &result); err != nil {
+		return err
+	}
+	if serr, ok := result.NotUpdated[id]; ok {
+		return serr
+	}
+	return nil
+}
+
+func (m *JMAPFolder) SetFlags(uid uint32, flags string) (err error) {
+	message, ok := m.messages[uid]
+	if !ok {
+		err = fmt.Errorf("Cannot find message with uid: %d", uid)
+		return m.e.E(err)
+	}
+
+	// Patch only the keywords mapped to flags, keeping the other ones
+	patch := make(map[string]interface{})
+	keywords := StringToJMAPKeywords(flags)
+	for _, v := range JMAPFlagsMap {
+		if keywords[v[0]] {
+			patch["keywords/"+v[0]] = true
+		} else {
+			patch["keywords/"+v[0]] = nil
+		}
+	}
+	if err = m.updateEmailSet(message.ID, patch); err != nil {
+		return m.e.E(err)
+	}
+
+	message.Flags = flags
+	return
+}
+
+func (m *JMAPFolder) ReadMessage(uid uint32) ([]byte, error) {
+	email, err := m.getEmail(uid, []string{"id", "blobId"})
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	body, err := m.store.client.Download(email.BlobID)
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	return body, nil
+}
+
+func (m *JMAPFolder) AddMessage(srcuid uint32, flags string, body []byte) (uint32, error) {
+	client := m.store.client
+
+	blobID, err := client.Upload(body)
+	if err != nil {
+		return 0, m.e.E(err)
+	}
+
+	var result struct {
+		Created    map[string]jmapEmail     `json:"created"`
+		NotCreated map[string]*jmapSetError `json:"notCreated"`
+	}
+	args := map[string]interface{}{
+		"emails": map[string]interface{}{
+			"email": map[string]interface{}{
+				"blobId":     blobID,
+				"mailboxIds": map[string]bool{m.mailboxID: true},
+				"keywords":   StringToJMAPKeywords(flags),
+			},
+		},
+	}
+	if err = client.Call("Email/import", args, &result); err != nil {
+		return 0, m.e.E(err)
+	}
+	if serr, ok := result.NotCreated["email"]; ok {
+		return 0, m.e.E(serr)
+	}
+	email, ok := result.Created["email"]
+	if !ok {
+		return 0, m.e.E(fmt.Errorf("No created email in Email/import response"))
+	}
+	if uid, ok := m.uids[email.ID]; ok {
+		return 0, m.e.E(fmt.Errorf("Imported email %s is the already existing message with uid %d", email.ID, uid))
+	}
+
+	uid := m.uidnext
+	if err = m.journal(fmt.Sprintf("%d %s", uid, email.ID)); err != nil {
+		return 0, m.e.E(err)
+	}
+	m.registerMessage(uid, email.ID, flags)
+	m.logger.Debugf("Registering message. uid: %d, id: %s", uid, email.ID)
+
+	return uid, nil
+}
+
+func (m *JMAPFolder) DeleteMessage(uid uint32) error {
+	email, err := m.getEmail(uid, []string{"id", "mailboxIds"})
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	if len(email.MailboxIDs) > 1 {
+		// The email is also in other mailboxes, only remove it from this one
+		err = m.updateEmailSet(email.ID, map[string]interface{}{"mailboxIds/" + m.mailboxID: nil})
+		if err != nil {
+			return m.e.E(err)
+		}
+	} else {
+		var result struct {
+			NotDestroyed map[string]*jmapSetError `json:"notDestroyed"`
+		}
+		if err = m.store.client.Call("Email/set", map[string]interface{}{"destroy": []string{email.ID}}, &result); err != nil {
+			return m.e.E(err)
+		}
+		if serr, ok := result.NotDestroyed[email.ID]; ok {
+			return m.e.E(serr)
+		}
+	}
+
+	if err = m.journal(fmt.Sprintf("delete %d", uid)); err != nil {
+		return m.e.E(err)
+	}
+
+	m.unregisterMessage(uid)
+	return nil
+}
+
+func (m *JMAPFolder) Update(srcuid uint32) (uint32, error) {
+	return srcuid, nil
+}
+
+func (m *JMAPFolder) GetMessages() map[uint32]*MessageInfo {
+	messages := make(map[uint32]*MessageInfo, 0)
+
+	for uid, message := range m.messages {
+		messages[uid] = &message.MessageInfo
+	}
+
+	return messages
+}
+
+func (m *JMAPFolder) GetIgnoredMessages() []uint32 {
+	messages := make([]uint32, 0)
+
+	for _, message := range m.messages {
+		if message.Ignore {
+			messages = append(messages, message.UID)
+		}
+	}
+	return messages
+}
+
+// FolderID returns the mailbox id
+func (m *JMAPFolder) FolderID() string {
+	return m.mailboxID
+}
+
+func (m *JMAPFolder) Close() (err error) {
+	return
+}
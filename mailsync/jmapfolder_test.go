@@ -0,0 +1,429 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+type fakeJMAPEmail struct {
+	blobID     string
+	mailboxIDs map[string]bool
+	keywords   map[string]bool
+	changed    int
+}
+
+// fakeJMAPServer is a minimal in memory JMAP server implementing the
+// methods used by the JMAP store. The state is a counter incremented on
+// every change.
+type fakeJMAPServer struct {
+	sync.Mutex
+	*httptest.Server
+
+	state     int
+	minState  int
+	nextID    int
+	mailboxes []*jmapMailbox
+	emails    map[string]*fakeJMAPEmail
+	destroyed map[string]int
+	blobs     map[string][]byte
+}
+
+func newFakeJMAPServer() *fakeJMAPServer {
+	s := &fakeJMAPServer{
+		emails:    make(map[string]*fakeJMAPEmail),
+		destroyed: make(map[string]int),
+		blobs:     make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *fakeJMAPServer) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%d", prefix, s.nextID)
+}
+
+func (s *fakeJMAPServer) addMailbox(name string, parentID *string, role *string) string {
+	s.Lock()
+	defer s.Unlock()
+	id := s.newID("M")
+	s.mailboxes = append(s.mailboxes, &jmapMailbox{ID: id, Name: name, ParentID: parentID, Role: role})
+	return id
+}
+
+func (s *fakeJMAPServer) mailboxID(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	for _, mailbox := range s.mailboxes {
+		if mailbox.Name == name {
+			return mailbox.ID
+		}
+	}
+	return ""
+}
+
+func (s *fakeJMAPServer) addEmail(body []byte, mailboxIDs map[string]bool, keywords map[string]bool) string {
+	s.Lock()
+	defer s.Unlock()
+	blobID := s.newID("B")
+	s.blobs[blobID] = body
+	id := s.newID("E")
+	s.state++
+	s.emails[id] = &fakeJMAPEmail{blobID: blobID, mailboxIDs: mailboxIDs, keywords: keywords, changed: s.state}
+	return id
+}
+
+func (s *fakeJMAPServer) updateEmail(id string, update func(email *fakeJMAPEmail)) {
+	s.Lock()
+	defer s.Unlock()
+	s.state++
+	update(s.emails[id])
+	s.emails[id].changed = s.state
+}
+
+func (s *fakeJMAPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "session":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"apiUrl":          "/api",
+			"downloadUrl":     s.URL + "/download/{accountId}/{blobId}/{name}?type={type}",
+			"uploadUrl":       "/upload/{accountId}/",
+			"primaryAccounts": map[string]string{jmapMailCapability: "A1"},
+			"capabilities": map[string]interface{}{
+				jmapCoreCapability: map[string]interface{}{"maxObjectsInGet": 2},
+				jmapMailCapability: map[string]interface{}{},
+			},
+		})
+	case "upload":
+		data, _ := ioutil.ReadAll(r.Body)
+		blobID := s.newID("B")
+		s.blobs[blobID] = data
+		json.NewEncoder(w).Encode(map[string]interface{}{"accountId": parts[1], "blobId": blobID})
+	case "download":
+		data, ok := s.blobs[parts[2]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case "api":
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var method string
+		args := make(map[string]interface{})
+		json.Unmarshal(request.MethodCalls[0][0], &method)
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		name, result := s.call(method, args)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"methodResponses": []interface{}{[]interface{}{name, result, "0"}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeJMAPServer) sortedEmailIDs() []string {
+	ids := make([]string, 0, len(s.emails))
+	for id := range s.emails {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *fakeJMAPServer) call(method string, args map[string]interface{}) (string, interface{}) {
+	state := strconv.Itoa(s.state)
+	switch method {
+	case "Mailbox/get":
+		return method, map[string]interface{}{"state": state, "list": s.mailboxes}
+	case "Mailbox/set":
+		created := make(map[string]interface{})
+		for k, v := range args["create"].(map[string]interface{}) {
+			v := v.(map[string]interface{})
+			mailbox := &jmapMailbox{ID: s.newID("M"), Name: v["name"].(string)}
+			if parentID, ok := v["parentId"].(string); ok {
+				mailbox.ParentID = &parentID
+			}
+			s.mailboxes = append(s.mailboxes, mailbox)
+			created[k] = map[string]interface{}{"id": mailbox.ID}
+		}
+		return method, map[string]interface{}{"created": created}
+	case "Email/get":
+		list := make([]interface{}, 0)
+		notfound := make([]string, 0)
+		for _, id := range args["ids"].([]interface{}) {
+			id := id.(string)
+			email, ok := s.emails[id]
+			if !ok {
+				notfound = append(notfound, id)
+				continue
+			}
+			list = append(list, map[string]interface{}{"id": id, "blobId": email.blobID, "mailboxIds": email.mailboxIDs, "keywords": email.keywords})
+		}
+		return method, map[string]interface{}{"state": state, "list": list, "notFound": notfound}
+	case "Email/query":
+		mailboxID := args["filter"].(map[string]interface{})["inMailbox"].(string)
+		ids := make([]string, 0)
+		for _, id := range s.sortedEmailIDs() {
+			if s.emails[id].mailboxIDs[mailboxID] {
+				ids = append(ids, id)
+			}
+		}
+		// Return pages of 2 ids
+		position := int(args["position"].(float64))
+		if position > len(ids) {
+			position = len(ids)
+		}
+		end := position + 2
+		if end > len(ids) {
+			end = len(ids)
+		}
+		return method, map[string]interface{}{"ids": ids[position:end], "position": position}
+	case "Email/changes":
+		since, _ := strconv.Atoi(args["sinceState"].(string))
+		if since < s.minState {
+			return "error", map[string]interface{}{"type": "cannotCalculateChanges"}
+		}
+		updated := make([]string, 0)
+		for _, id := range s.sortedEmailIDs() {
+			if s.emails[id].changed > since {
+				updated = append(updated, id)
+			}
+		}
+		destroyed := make([]string, 0)
+		for id, changed := range s.destroyed {
+			if changed > since {
+				destroyed = append(destroyed, id)
+			}
+		}
+		return method, map[string]interface{}{"oldState": args["sinceState"], "newState": state, "hasMoreChanges": false, "created": []string{}, "updated": updated, "destroyed": destroyed}
+	case "Email/set":
+		s.state++
+		if update, ok := args["update"].(map[string]interface{}); ok {
+			for id, patch := range update {
+				email := s.emails[id]
+				for k, v := range patch.(map[string]interface{}) {
+					p := strings.SplitN(k, "/", 2)
+					m := email.keywords
+					if p[0] == "mailboxIds" {
+						m = email.mailboxIDs
+					}
+					if v == nil {
+						delete(m, p[1])
+					} else {
+						m[p[1]] = true
+					}
+				}
+				email.changed = s.state
+			}
+		}
+		if destroy, ok := args["destroy"].([]interface{}); ok {
+			for _, id := range destroy {
+				delete(s.emails, id.(string))
+				s.destroyed[id.(string)] = s.state
+			}
+		}
+		return method, map[string]interface{}{"newState": strconv.Itoa(s.state)}
+	case "Email/import":
+		s.state++
+		created := make(map[string]interface{})
+		for k, v := range args["emails"].(map[string]interface{}) {
+			v := v.(map[string]interface{})
+			email := &fakeJMAPEmail{blobID: v["blobId"].(string), mailboxIDs: make(map[string]bool), keywords: make(map[string]bool), changed: s.state}
+			for mailboxID := range v["mailboxIds"].(map[string]interface{}) {
+				email.mailboxIDs[mailboxID] = true
+			}
+			for keyword := range v["keywords"].(map[string]interface{}) {
+				email.keywords[keyword] = true
+			}
+			id := s.newID("E")
+			s.emails[id] = email
+			created[k] = map[string]interface{}{"id": id, "blobId": email.blobID}
+		}
+		return method, map[string]interface{}{"created": created}
+	}
+	return "error", map[string]interface{}{"type": "unknownMethod"}
+}
+
+func TestJMAPFolder(t *testing.T) {
+	server := newFakeJMAPServer()
+	defer server.Close()
+
+	inboxrole := "inbox"
+	inboxID := server.addMailbox("Inbox", nil, &inboxrole)
+	archiveID := server.addMailbox("Archive", nil, nil)
+	server.addMailbox("2014", &archiveID, nil)
+	server.addEmail([]byte("Subject: 1\r\n\r\n"), map[string]bool{inboxID: true}, map[string]bool{"$seen": true})
+	id2 := server.addEmail([]byte("Subject: 2\r\n\r\n"), map[string]bool{inboxID: true}, map[string]bool{"$answered": true, "$seen": true, "$junk": true})
+	id3 := server.addEmail([]byte("Subject: 3\r\n\r\n"), map[string]bool{inboxID: true, archiveID: true}, map[string]bool{})
+
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	storeconf := &config.StoreConfig{
+		Name:       "store1",
+		StoreType:  "JMAP",
+		SessionURL: server.URL + "/session",
+		Token:      "token",
+	}
+	globalconfig := &config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{storeconf},
+		LogLevel:    "debug",
+	}
+
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []foldername{{"INBOX"}, {"Archive"}, {"Archive", "2014"}} {
+		if !store.HasFolder(name) {
+			t.Fatalf("Expected folder %v, found folders: %v", name, store.GetFolders())
+		}
+	}
+
+	// Parent mailboxes are created
+	fm, err := store.GetMailfolderManager(foldername{"New", "Child"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Close()
+	if server.mailboxID("New") == "" || server.mailboxID("Child") == "" {
+		t.Fatalf("Mailboxes not created: %v", server.mailboxes)
+	}
+
+	name := foldername{"INBOX"}
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint32]string{1: "S", 2: "RS", 3: ""}
+	verifyJMAPMessages(t, fm, expected)
+
+	uid, err := fm.AddMessage(0, "F", []byte("Subject: 4\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != 4 {
+		t.Fatalf("Expected uid 4, found %d", uid)
+	}
+	body, err := fm.ReadMessage(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Subject: 4\r\n\r\n" {
+		t.Fatalf("Wrong message body: %q", body)
+	}
+	if err = fm.SetFlags(2, "S"); err != nil {
+		t.Fatal(err)
+	}
+	if !server.emails[id2].keywords["$junk"] || server.emails[id2].keywords["$answered"] {
+		t.Fatalf("Wrong keywords: %v", server.emails[id2].keywords)
+	}
+	if err = fm.DeleteMessage(1); err != nil {
+		t.Fatal(err)
+	}
+	// Only removed from the INBOX
+	if err = fm.DeleteMessage(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.emails[id3].mailboxIDs) != 1 {
+		t.Fatalf("Wrong mailboxes: %v", server.emails[id3].mailboxIDs)
+	}
+	fm.Close()
+
+	// Changes done by other clients
+	server.updateEmail(id2, func(email *fakeJMAPEmail) { email.keywords["$flagged"] = true })
+	server.updateEmail(id3, func(email *fakeJMAPEmail) { email.mailboxIDs[inboxID] = true })
+
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[uint32]string{2: "FS", 4: "F", 5: ""}
+	verifyJMAPMessages(t, fm, expected)
+	fm.Close()
+
+	// The uids don't change when all the messages are fetched again
+	server.Lock()
+	server.minState = server.state + 1
+	server.Unlock()
+	server.updateEmail(id2, func(email *fakeJMAPEmail) { delete(email.keywords, "$seen") })
+
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[uint32]string{2: "F", 4: "F", 5: ""}
+	verifyJMAPMessages(t, fm, expected)
+}
+
+func verifyJMAPMessages(t *testing.T, fm MailfolderManager, expected map[uint32]string) {
+	messages := fm.GetMessages()
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected messages %v, found %d messages", expected, len(messages))
+	}
+	for uid, flags := range expected {
+		found, err := fm.GetFlags(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != flags {
+			t.Fatalf("Message %d: expected flags \"%s\", found \"%s\"", uid, flags, found)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sgotti/gomailsync/config"
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// JMAPStore is a store on a JMAP server. Mailboxes are folders; the mailbox
+// with the inbox role is the INBOX.
+type JMAPStore struct {
+	globalconfig *config.Config
+	config       *config.StoreConfig
+	name         string
+	metadatadir  string
+	client       *jmapClient
+	folders      []*Mailfolder
+	mailboxIDs   map[string]string
+	logger       *log.Logger
+	e            *errors.Error
+	dryrun       bool
+	sync.Mutex
+}
+
+type jmapMailbox struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	ParentID *string `json:"parentId"`
+	Role     *string `json:"role"`
+}
+
+// JMAP has a real mailbox hierarchy so folder names aren't split on a
+// separator. This is only used to show and match them.
+const jmapSeparator = '/'
+
+func jmapFolderKey(name foldername) string {
+	return FolderToStorePath(name, 0)
+}
+
+func NewJMAPStore(globalconfig *config.Config, config *config.StoreConfig, basemetadatadir string, dryrun bool) (m *JMAPStore, err error) {
+	name := config.Name
+	logprefix := fmt.Sprintf("jmapstore: %s", name)
+	errprefix := fmt.Sprintf("jmapstore: %s", name)
+	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	metadatadir := filepath.Join(basemetadatadir, name)
+
+	if !dryrun {
+		err = os.MkdirAll(metadatadir, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m = &JMAPStore{
+		globalconfig: globalconfig,
+		config:       config,
+		name:         name,
+		metadatadir:  metadatadir,
+		client:       newJMAPClient(config.SessionURL, config.Username, config.Password, config.Token, config.Validateservercert),
+		folders:      make([]*Mailfolder, 0),
+		mailboxIDs:   make(map[string]string),
+		logger:       logger,
+		e:            e,
+		dryrun:       dryrun,
+	}
+
+	if err = m.client.Connect(); err != nil {
+		return nil, m.e.E(err)
+	}
+
+	err = m.UpdateFolderList()
+	return
+}
+
+func (m *JMAPStore) CreateFolder(name foldername) (err error) {
+	if StrsEquals(name, []string{"INBOX"}) {
+		return m.e.E(fmt.Errorf("No mailbox with the inbox role"))
+	}
+
+	// Create the missing parent mailboxes
+	var parentID interface{}
+	for i := 1; i <= len(name); i++ {
+		if id, ok := m.mailboxIDs[jmapFolderKey(name[:i])]; ok {
+			parentID = id
+			continue
+		}
+
+		var result struct {
+			Created    map[string]jmapMailbox   `json:"created"`
+			NotCreated map[string]*jmapSetError `json:"notCreated"`
+		}
+		args := map[string]interface{}{
+			"create": map[string]interface{}{
+				"mailbox": map[string]interface{}{"name": name[i-1], "parentId": parentID},
+			},
+		}
+		if err = m.client.Call("Mailbox/set", args, &result); err != nil {
+			return m.e.E(err)
+		}
+		if serr, ok := result.NotCreated["mailbox"]; ok {
+			return m.e.E(fmt.Errorf("Cannot create mailbox %s: %s", name[:i], serr))
+		}
+		mailbox, ok := result.Created["mailbox"]
+		if !ok {
+			return m.e.E(fmt.Errorf("Cannot create mailbox %s: no created mailbox in response", name[:i]))
+		}
+		m.mailboxIDs[jmapFolderKey(name[:i])] = mailbox.ID
+		parentID = mailbox.ID
+	}
+
+	err = os.MkdirAll(filepath.Join(m.metadatadir, folderMetadataPath(name)), 0777)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	// Add folder to the list
+	m.folders = append(m.folders, &Mailfolder{Name: name, Excluded: false})
+	return nil
+}
+
+func (m *JMAPStore) SetFolderExcluded(name foldername, excluded bool) error {
+	if f := m.getFolder(name); f != nil {
+		f.Excluded = excluded
+		return nil
+	}
+	return m.e.E(fmt.Errorf("Folder %s, doesn't exists", name))
+}
+
+func (m *JMAPStore) getFolder(name foldername) *Mailfolder {
+	for _, f := range m.folders {
+		if StrsEquals(name, f.Name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *JMAPStore) HasFolder(name foldername) bool {
+	if f := m.getFolder(name); f != nil {
+		return true
+	}
+	return false
+}
+
+func (m *JMAPStore) UpdateFolderList() error {
+	m.folders = make([]*Mailfolder, 0)
+	m.mailboxIDs = make(map[string]string)
+
+	var result struct {
+		List []*jmapMailbox `json:"list"`
+	}
+	args := map[string]interface{}{
+		"ids":        nil,
+		"properties": []string{"id", "name", "parentId", "role"},
+	}
+	if err := m.client.Call("Mailbox/get", args, &result); err != nil {
+		return m.e.E(err)
+	}
+
+	mailboxes := make(map[string]*jmapMailbox, len(result.List))
+	for _, mailbox := range result.List {
+		mailboxes[mailbox.ID] = mailbox
+	}
+
+	var mailboxName func(mailbox *jmapMailbox, depth int) (foldername, error)
+	mailboxName = func(mailbox *jmapMailbox, depth int) (foldername, error) {
+		if depth > len(mailboxes) {
+			return nil, fmt.Errorf("Loop in mailbox %s parents", mailbox.ID)
+		}
+		if mailbox.Role != nil && *mailbox.Role == "inbox" {
+			return foldername{"INBOX"}, nil
+		}
+		if mailbox.ParentID == nil {
+			return foldername{mailbox.Name}, nil
+		}
+		parent, ok := mailboxes[*mailbox.ParentID]
+		if !ok {
+			return nil, fmt.Errorf("Parent mailbox %s of mailbox %s doesn't exist", *mailbox.ParentID, mailbox.ID)
+		}
+		name, err := mailboxName(parent, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return append(append(foldername{}, name...), mailbox.Name), nil
+	}
+
+	m.logger.Debug("Folders:")
+	for _, mailbox := range result.List {
+		name, err := mailboxName(mailbox, 0)
+		if err != nil {
+			return m.e.E(err)
+		}
+		if _, ok := m.mailboxIDs[jmapFolderKey(name)]; ok {
+			m.logger.Warningf("Ignoring mailbox %s with duplicated name %s", mailbox.ID, name)
+			continue
+		}
+		m.mailboxIDs[jmapFolderKey(name)] = mailbox.ID
+		folder := &Mailfolder{
+			Name:     name,
+			Excluded: false,
+			Role:     jmapFolderRole(mailbox.Role),
+		}
+		m.folders = append(m.folders, folder)
+		m.logger.Debugf("%s: %s", mailbox.ID, folder)
+	}
+
+	err := applyRegExpPatterns(m, m.folders)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	return nil
+}
+
+// jmapFolderRole returns the special-use role of a mailbox role (they use
+// the same names in lower case)
+func jmapFolderRole(role *string) string {
+	if role == nil {
+		return ""
+	}
+	for _, r := range folderRoles {
+		if strings.EqualFold(r[1:], *role) {
+			return r
+		}
+	}
+	return ""
+}
+
+func (m *JMAPStore) Separator() (rune, error) {
+	return jmapSeparator, nil
+}
+
+func (m *JMAPStore) GetFolders() []Mailfolder {
+	folders := make([]Mailfolder, len(m.folders))
+	for i, f := range m.folders {
+		folders[i] = *f
+	}
+	return folders
+}
+
+// checkMailboxID verifies that the mailbox of a folder is the one used by
+// the previous syncs (like the IMAP uidvalidity): a mailbox deleted and
+// created again has different emails ids.
+func (m *JMAPStore) checkMailboxID(name foldername, mailboxID string) error {
+	mailboxidpath := filepath.Join(m.metadatadir, folderMetadataPath(name), "mailboxid")
+	f, err := os.Open(mailboxidpath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if m.dryrun {
+			return nil
+		}
+		return writeFileAtomic(mailboxidpath, []byte(mailboxID), m.config.Fsync)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	mdmailboxid := scanner.Text()
+
+	if mdmailboxid != mailboxID {
+		return fmt.Errorf("JMAP mailbox id %s doesn't match saved mailbox id %s", mailboxID, mdmailboxid)
+	}
+	return nil
+}
+
+func (m *JMAPStore) GetMailfolderManager(name foldername) (manager MailfolderManager, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.HasFolder(name) && !m.dryrun {
+		err = m.CreateFolder(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	folder := m.getFolder(name)
+	if folder == nil {
+		return nil, m.e.E(fmt.Errorf("Cannot get folder %s", name))
+	}
+
+	foldermetadatadir := filepath.Join(m.metadatadir, folderMetadataPath(name))
+	if !m.dryrun {
+		err = os.MkdirAll(foldermetadatadir, 0777)
+		if err != nil {
+			return nil, m.e.E(err)
+		}
+	}
+
+	mailboxID := m.mailboxIDs[jmapFolderKey(name)]
+	if err = m.checkMailboxID(name, mailboxID); err != nil {
+		return nil, m.e.E(err)
+	}
+
+	manager, err = NewJMAPFolder(folder, foldermetadatadir, m, mailboxID, m.dryrun)
+
+	return
+}
+
+func (m *JMAPStore) Name() string {
+	return m.name
+}
+
+func (m *JMAPStore) Config() *config.StoreConfig {
+	return m.config
+}
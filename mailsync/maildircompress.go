@@ -0,0 +1,157 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed maildir messages follow the Dovecot zlib plugin conventions:
+// the file contains the compressed message, the base filename has a
+// ",S=<size>" field with the uncompressed size and the info part contains
+// the "Z" flag. The "Z" flag isn't a message flag, it's never reported to
+// the sync algorithm and it's kept on flag changes.
+const compressedFlag = "Z"
+
+var (
+	maildirSizeRe = regexp.MustCompile(`,S=(\d+)`)
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zstdMagic)
+}
+
+func compressMessage(body []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(body, nil), nil
+	}
+	return nil, fmt.Errorf("Unknown compression: \"%s\"", compression)
+}
+
+// decompressMessage detects the compression from the magic bytes and
+// decompresses data. Not compressed data is returned as is.
+func decompressMessage(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case bytes.HasPrefix(data, zstdMagic):
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return r.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+// CompressMessages compresses in place all the messages of the folder that
+// aren't already compressed, using the store's compress option. It returns
+// the number of compressed messages.
+func (m *MaildirFolder) CompressMessages() (count int, err error) {
+	if m.compress == "" {
+		return 0, m.e.E(fmt.Errorf("compress option not set for store %s", m.store.Name()))
+	}
+	if err = m.UpdateMessageList(); err != nil {
+		return 0, m.e.E(err)
+	}
+
+	for _, message := range m.messages {
+		if message.Ignore || message.Compressed {
+			continue
+		}
+		srcfilepath, err := m.findFilepath(message)
+		if err != nil {
+			return count, m.e.E(err)
+		}
+		if srcfilepath == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(srcfilepath)
+		if err != nil {
+			return count, m.e.E(err)
+		}
+
+		if !isCompressed(data) {
+			compressed, err := compressMessage(data, m.compress)
+			if err != nil {
+				return count, m.e.E(err)
+			}
+			// Atomically replace the file content keeping its name, a
+			// crash before the following rename leaves a compressed
+			// message without the Z flag that will be fixed on the next
+			// run (ReadMessage detects the compression by its magic bytes)
+			tmpfilepath := filepath.Join(m.maildir, "tmp", filepath.Base(srcfilepath))
+			if err = m.writeMessageFile(tmpfilepath, srcfilepath, compressed); err != nil {
+				return count, m.e.E(err)
+			}
+			message.Filename = fmt.Sprintf("%s,S=%d", message.Filename, len(data))
+		}
+
+		message.Compressed = true
+		dstfilepath := filepath.Join(m.maildir, message.Subdir, m.fullFilename(message.Filename, message.Flags, message.Subdir, true))
+		if err = m.rename(srcfilepath, dstfilepath); err != nil {
+			return count, m.e.E(err)
+		}
+		m.logger.Debugf("Compressed message %s", dstfilepath)
+		count++
+	}
+	return count, nil
+}
+
+// CompressFolder compresses the not yet compressed messages of folder name
+func (m *MaildirStore) CompressFolder(name foldername) (int, error) {
+	manager, err := m.GetMailfolderManager(name)
+	if err != nil {
+		return 0, m.e.E(err)
+	}
+	defer manager.Close()
+
+	return manager.(*MaildirFolder).CompressMessages()
+}
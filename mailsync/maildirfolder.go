@@ -18,13 +18,13 @@
 package mailsync
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -45,17 +45,27 @@ type MaildirFolder struct {
 	lastTimeSeq   uint32
 	logger        *log.Logger
 	infoSeparator rune
+	newSubdir     string
+	compress      string
+	fsync         bool
 	e             *errors.Error
 	dryrun        bool
+
+	// Messages written or renamed since the last notmuch update
+	notmuchChanged map[*MaildirMessageInfo]bool
+
+	// Ids of the store message links by file (nil if not yet read)
+	messagelinks map[fileKey]string
 }
 
 type MaildirMessageInfo struct {
 	MessageInfo
 
 	// Filename without separator + flags
-	Filename  string
-	Subdir    string // cur or new
-	Temporary bool
+	Filename   string
+	Subdir     string // cur or new
+	Temporary  bool
+	Compressed bool
 }
 
 func (m *MaildirFolder) getTimeSeq() (int64, uint32) {
@@ -94,10 +104,60 @@ func (m *MaildirFolder) generateFilename(uid uint32) (string, error) {
 		m.logger.Debug("Error getting hostname")
 		return "", err
 	}
-	filename := fmt.Sprintf("%d_%d.%d.%s,u=%d,f=%s", time, timeseq, os.Getpid(), hostname, uid, m.folderUID)
+	filename := fmt.Sprintf("%d_%d.%d.%s,u=%d,f=%s", time, timeseq, os.Getpid(), m.escapeHostname(hostname), uid, m.folderUID)
 	return filename, nil
 }
 
+// escapeHostname replaces characters not permitted in the unique part of a
+// maildir filename, as suggested by the maildir specification ("/" becomes
+// "\057", ":" becomes "\072"), and the configured info separator
+func (m *MaildirFolder) escapeHostname(hostname string) string {
+	var out string
+	for _, r := range hostname {
+		if r == '/' || r == ':' || r == m.infoSeparator {
+			out += fmt.Sprintf("\\%03o", r)
+			continue
+		}
+		out += string(r)
+	}
+	return out
+}
+
+// messageSubdir returns the subdir where a message with flags, currently
+// in cursubdir (empty for a message not yet delivered), has to be placed
+// according to the newmessagesubdir option.
+//
+// cur: every message is placed in cur
+// new: delivered messages are placed in new and never moved
+// auto: messages without flags are placed in new and moved to cur when they
+// get some flags. A message is never moved back from cur to new.
+func (m *MaildirFolder) messageSubdir(cursubdir string, flags string) string {
+	switch m.newSubdir {
+	case "new":
+		if cursubdir == "" {
+			return "new"
+		}
+		return cursubdir
+	case "auto":
+		if flags == "" && cursubdir != "cur" {
+			return "new"
+		}
+	}
+	return "cur"
+}
+
+// fullFilename returns the filename with the info part. Messages without
+// flags in new are written without info like a MDA does.
+func (m *MaildirFolder) fullFilename(filename string, flags string, subdir string, compressed bool) string {
+	if compressed {
+		flags = CleanFlags(flags + compressedFlag)
+	}
+	if subdir == "new" && flags == "" {
+		return filename
+	}
+	return filename + string(m.infoSeparator) + "2," + flags
+}
+
 func (m *MaildirFolder) generateFullFilename(uid uint32, flags string) (string, error) {
 	filename, err := m.generateFilename(uid)
 	if err != nil {
@@ -114,12 +174,12 @@ func (m *MaildirFolder) splitFilename(fullfilename string) (string, string, erro
 		return r == m.infoSeparator
 	})
 	if len(split) != 2 {
-		err := fmt.Errorf("Wrong filename format:", fullfilename)
+		err := fmt.Errorf("Wrong filename format: %s", fullfilename)
 		return "", "", err
 	}
 
 	if !strings.HasPrefix(split[1], "2,") {
-		err := fmt.Errorf("Wrong filename format:", fullfilename)
+		err := fmt.Errorf("Wrong filename format: %s", fullfilename)
 		return "", "", err
 	}
 
@@ -128,8 +188,8 @@ func (m *MaildirFolder) splitFilename(fullfilename string) (string, string, erro
 	return split[0], outflags, nil
 }
 
-func (m *MaildirFolder) registerMessage(UID uint32, flags string, filename string, subdir string, temporary bool) {
-	messageinfo := MaildirMessageInfo{MessageInfo{UID, flags, false}, filename, subdir, temporary}
+func (m *MaildirFolder) registerMessage(UID uint32, flags string, filename string, subdir string, temporary bool, compressed bool) {
+	messageinfo := MaildirMessageInfo{MessageInfo{UID, flags, false}, filename, subdir, temporary, compressed}
 	m.messages[UID] = &messageinfo
 	m.logger.Debugf("Registering message. uid: %d, messageinfo: %v", UID, messageinfo)
 }
@@ -138,7 +198,12 @@ func (m *MaildirFolder) findFilepath(messageinfo *MaildirMessageInfo) (messagepa
 	var ok bool = false
 	var filename string
 	var dupfilenames []string
-	for _, d := range []string{"cur", "new"} {
+	// Look first in the subdir where the message was registered
+	subdirs := []string{"cur", "new"}
+	if messageinfo.Subdir == "new" {
+		subdirs = []string{"new", "cur"}
+	}
+	for _, d := range subdirs {
 		f, err := os.Open(filepath.Join(m.maildir, d))
 		if err != nil {
 			return "", err
@@ -174,6 +239,55 @@ func (m *MaildirFolder) findFilepath(messageinfo *MaildirMessageInfo) (messagepa
 	return
 }
 
+// writeMessageFile writes body to tmpfilepath and then moves it to
+// dstfilepath. With fsync enabled the file and the destination directory
+// are synced, so a delivered message is never seen truncated after a crash.
+func (m *MaildirFolder) writeMessageFile(tmpfilepath string, dstfilepath string, body []byte) (err error) {
+	fo, err := os.OpenFile(tmpfilepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmpfilepath)
+		}
+	}()
+
+	if _, err = fo.Write(body); err != nil {
+		fo.Close()
+		return err
+	}
+	if m.fsync {
+		if err = fo.Sync(); err != nil {
+			fo.Close()
+			return err
+		}
+	}
+	if err = fo.Close(); err != nil {
+		return err
+	}
+
+	return m.rename(tmpfilepath, dstfilepath)
+}
+
+// rename renames a message file and, with fsync enabled, syncs the
+// involved directories
+func (m *MaildirFolder) rename(srcfilepath string, dstfilepath string) (err error) {
+	if err = os.Rename(srcfilepath, dstfilepath); err != nil {
+		return err
+	}
+	if !m.fsync {
+		return nil
+	}
+	if err = syncDir(filepath.Dir(dstfilepath)); err != nil {
+		return err
+	}
+	if filepath.Dir(srcfilepath) != filepath.Dir(dstfilepath) {
+		return syncDir(filepath.Dir(srcfilepath))
+	}
+	return nil
+}
+
 func NewMaildirFolder(folder *Mailfolder, maildir string, metadatadir string, store *MaildirStore, folderUID string, dryrun bool) (m *MaildirFolder, err error) {
 	logprefix := fmt.Sprintf("store: %s, maildirfolder: %s", store.Name(), folder)
 	errprefix := logprefix
@@ -201,9 +315,14 @@ func NewMaildirFolder(folder *Mailfolder, maildir string, metadatadir string, st
 		lastTime:      0,
 		lastTimeSeq:   0,
 		logger:        logger,
-		infoSeparator: ':', // TODO At the moment I don't care for filesystems not accepting colon in filenames
+		infoSeparator: store.infoSeparator,
+		newSubdir:     store.config.NewMessageSubdir,
+		compress:      store.config.Compress,
+		fsync:         store.config.Fsync,
 		e:             e,
 		dryrun:        dryrun,
+
+		notmuchChanged: make(map[*MaildirMessageInfo]bool),
 	}
 
 	m.folderUID = folderUID
@@ -213,6 +332,7 @@ func NewMaildirFolder(folder *Mailfolder, maildir string, metadatadir string, st
 
 func (m *MaildirFolder) UpdateMessageList() error {
 	m.messages = make(map[uint32]*MaildirMessageInfo)
+	m.messagelinks = nil
 
 	if m.dryrun && !m.store.HasFolder(m.folder.Name) {
 		return nil
@@ -231,6 +351,8 @@ func (m *MaildirFolder) UpdateMessageList() error {
 			m.logger.Error("Error: ", err)
 			return m.e.E(err)
 		}
+		// Give the new messages always the same temporary uids
+		sort.Strings(filenames)
 
 		for _, n := range filenames {
 			filename, flags, err := m.splitFilename(n)
@@ -242,7 +364,7 @@ func (m *MaildirFolder) UpdateMessageList() error {
 				} else {
 					// Accept a file without flags if it doesn't contains InfoSeparator
 					if strings.Contains(n, string(m.infoSeparator)) {
-						m.logger.Debugf("Not accepting message filename %s in \"new\" folder without flags but with separator %s", n, m.infoSeparator)
+						m.logger.Debugf("Not accepting message filename %s in \"new\" folder without flags but with separator %c", n, m.infoSeparator)
 						continue
 					} else {
 						filename = n
@@ -250,11 +372,14 @@ func (m *MaildirFolder) UpdateMessageList() error {
 				}
 			}
 
+			compressed := strings.Contains(flags, compressedFlag)
+			flags = removeFlags(flags, compressedFlag)
+
 			match := re.FindStringSubmatch(filename)
 
 			if len(match) < 2 {
 				m.logger.Debugf("Assuming as new message: %s", filename)
-				m.registerMessage(m.getNextTempUID(), flags, filename, d, true)
+				m.registerMessage(m.getNextTempUID(), flags, filename, d, true, compressed)
 			} else {
 				if m.folderUID == match[2] {
 					uid, _ := strconv.ParseUint(match[1], 10, 32)
@@ -266,15 +391,21 @@ func (m *MaildirFolder) UpdateMessageList() error {
 						m.messages[uint32(uid)].Ignore = true
 						continue
 					}
-					m.registerMessage(uint32(uid), flags, filename, d, false)
+					m.registerMessage(uint32(uid), flags, filename, d, false, compressed)
 				} else {
 					m.logger.Debugf("Message folderuid: %s different from folderuid: %s. Assuming %s as new message", match[2], m.folderUID, filename)
-					m.registerMessage(m.getNextTempUID(), flags, filename, d, true)
+					m.registerMessage(m.getNextTempUID(), flags, filename, d, true, compressed)
 				}
 			}
 		}
 	}
 
+	if m.store.notmuch != nil && !m.dryrun {
+		if err := m.notmuchPull(); err != nil {
+			return m.e.E(err)
+		}
+	}
+
 	return nil
 }
 
@@ -316,15 +447,18 @@ func (m *MaildirFolder) SetFlags(uid uint32, flags string) (err error) {
 		return m.e.E(err)
 	}
 
-	dstfullfilename := srcfilename + string(m.infoSeparator) + "2," + flags
-	dstfilepath := filepath.Join(m.maildir, message.Subdir, dstfullfilename)
+	dstsubdir := m.messageSubdir(message.Subdir, flags)
+	dstfullfilename := m.fullFilename(srcfilename, flags, dstsubdir, message.Compressed)
+	dstfilepath := filepath.Join(m.maildir, dstsubdir, dstfullfilename)
 
-	err = os.Rename(srcfilepath, dstfilepath)
+	err = m.rename(srcfilepath, dstfilepath)
 	if err != nil {
 		return m.e.E(err)
 	}
 
 	message.Flags = flags
+	message.Subdir = dstsubdir
+	m.notmuchChanged[message] = true
 	return
 }
 
@@ -348,8 +482,16 @@ func (m *MaildirFolder) ReadMessage(uid uint32) ([]byte, error) {
 		return nil, m.e.E(err)
 	}
 
+	defer fi.Close()
+
 	buf, err := ioutil.ReadAll(fi)
+	if err != nil {
+		return nil, m.e.E(err)
+	}
 
+	// Compressed messages are detected by their magic bytes, so also
+	// messages compressed by others (without the Z flag) are readable
+	buf, err = decompressMessage(buf)
 	return buf, m.e.E(err)
 }
 
@@ -365,36 +507,29 @@ func (m *MaildirFolder) AddMessage(srcuid uint32, flags string, body []byte) (ui
 		return 0, m.e.E(err)
 	}
 
-	fullfilename := filename + string(m.infoSeparator) + "2," + flags
-
-	m.logger.Debug("filename:", filename)
-	tmpfilepath := filepath.Join(m.maildir, "tmp", fullfilename)
-	filepath := filepath.Join(m.maildir, "cur", fullfilename)
-
-	fo, err := os.Create(tmpfilepath)
-	if err != nil {
-		return 0, m.e.E(err)
+	compressed := m.compress != ""
+	if compressed {
+		// Dovecot zlib convention: add the uncompressed size to the filename
+		filename = fmt.Sprintf("%s,S=%d", filename, len(body))
+		body, err = compressMessage(body, m.compress)
+		if err != nil {
+			return 0, m.e.E(err)
+		}
 	}
 
-	defer func() {
-		if err := fo.Close(); err != nil {
-			m.logger.Error("file close error")
-		}
-	}()
+	subdir := m.messageSubdir("", flags)
+	fullfilename := m.fullFilename(filename, flags, subdir, compressed)
 
-	w := bufio.NewWriter(fo)
+	m.logger.Debug("filename:", filename)
+	tmpfilepath := filepath.Join(m.maildir, "tmp", fullfilename)
+	filepath := filepath.Join(m.maildir, subdir, fullfilename)
 
-	if _, err := w.Write(body); err != nil {
-		return 0, m.e.E(err)
-	}
-	if err = w.Flush(); err != nil {
-		return 0, m.e.E(err)
-	}
-	if err = os.Rename(tmpfilepath, filepath); err != nil {
+	if err = m.writeMessageFile(tmpfilepath, filepath, body); err != nil {
 		return 0, m.e.E(err)
 	}
 
-	m.registerMessage(uid, flags, filename, "cur", false)
+	m.registerMessage(uid, flags, filename, subdir, false, compressed)
+	m.notmuchChanged[m.messages[uid]] = true
 
 	return uint32(uid), nil
 }
@@ -406,17 +541,22 @@ func (m *MaildirFolder) DeleteMessage(uid uint32) (err error) {
 		return m.e.E(err)
 	}
 
-	filepath, err := m.findFilepath(message)
+	messagepath, err := m.findFilepath(message)
 	if err != nil {
 		return err
 	}
-	if filepath != "" {
-		rmerr := os.Remove(filepath)
+	if messagepath != "" {
+		rmerr := os.Remove(messagepath)
 		// Ignore if file does not exists
 		if rmerr != nil {
 			m.logger.Debugf("remove failed: %s. Ignoring ", rmerr)
+		} else if m.fsync {
+			if err = syncDir(filepath.Dir(messagepath)); err != nil {
+				return m.e.E(err)
+			}
 		}
 	}
+	delete(m.notmuchChanged, message)
 	delete(m.messages, uid)
 
 	return
@@ -445,23 +585,77 @@ func (m *MaildirFolder) Update(srcuid uint32) (outsrcuid uint32, err error) {
 		return 0, m.e.E(err)
 	}
 
-	dstfullfilename := dstfilename + string(m.infoSeparator) + "2," + message.Flags
-	// TODO A file with flags cannot live in folder "new" (also if mutt does this). Add an option to choose the desired behavior...
-	dstfilepath := filepath.Join(m.maildir, "cur", dstfullfilename)
+	// Keep the uncompressed size of compressed messages
+	if match := maildirSizeRe.FindStringSubmatch(message.Filename); message.Compressed && match != nil {
+		dstfilename += match[0]
+	}
+
+	dstsubdir := m.messageSubdir(message.Subdir, message.Flags)
+	dstfullfilename := m.fullFilename(dstfilename, message.Flags, dstsubdir, message.Compressed)
+	dstfilepath := filepath.Join(m.maildir, dstsubdir, dstfullfilename)
 
 	//m.logger.Debugf("srcfilepath: %s, dstfilepath: %s", srcfilepath, dstfilepath)
-	err = os.Rename(srcfilepath, dstfilepath)
+	err = m.rename(srcfilepath, dstfilepath)
 	if err != nil {
 		return 0, m.e.E(err)
 	}
 
 	message.UID = outsrcuid
-	message.Subdir = "cur"
+	message.Subdir = dstsubdir
 	message.Filename = dstfilename
 	message.Temporary = false
+	m.notmuchChanged[message] = true
 	return
 }
 
+// MoveMessage moves the message file to another folder of the store giving
+// it a new uid there
+func (m *MaildirFolder) MoveMessage(uid uint32, dst MailfolderManager) (uint32, bool, error) {
+	dstfolder, ok := dst.(*MaildirFolder)
+	if !ok || dstfolder.store != m.store {
+		return 0, false, nil
+	}
+	message, ok := m.messages[uid]
+	if !ok {
+		return 0, false, m.e.E(fmt.Errorf("Cannot find message with uid: %d", uid))
+	}
+
+	srcfilepath, err := m.findFilepath(message)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	if srcfilepath == "" {
+		return 0, false, m.e.E(fmt.Errorf("Cannot find file for message uid: %d on filesystem.", uid))
+	}
+
+	dstuid, err := dstfolder.getNextFreeUID()
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	dstfilename, err := dstfolder.generateFilename(dstuid)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	// Keep the uncompressed size of compressed messages
+	if match := maildirSizeRe.FindStringSubmatch(message.Filename); message.Compressed && match != nil {
+		dstfilename += match[0]
+	}
+
+	dstsubdir := dstfolder.messageSubdir(message.Subdir, message.Flags)
+	dstfullfilename := dstfolder.fullFilename(dstfilename, message.Flags, dstsubdir, message.Compressed)
+	dstfilepath := filepath.Join(dstfolder.maildir, dstsubdir, dstfullfilename)
+
+	if err = m.rename(srcfilepath, dstfilepath); err != nil {
+		return 0, false, m.e.E(err)
+	}
+
+	delete(m.notmuchChanged, message)
+	delete(m.messages, uid)
+	dstfolder.registerMessage(dstuid, message.Flags, dstfilename, dstsubdir, false, message.Compressed)
+	dstfolder.notmuchChanged[dstfolder.messages[dstuid]] = true
+	return dstuid, true, nil
+}
+
 func (m *MaildirFolder) GetMessages() map[uint32]*MessageInfo {
 	messages := make(map[uint32]*MessageInfo, 0)
 
@@ -483,6 +677,16 @@ func (m *MaildirFolder) GetIgnoredMessages() []uint32 {
 	return messages
 }
 
+// FolderID returns the folderUID
+func (m *MaildirFolder) FolderID() string {
+	return m.folderUID
+}
+
 func (m *MaildirFolder) Close() (err error) {
+	if m.store.notmuch != nil && !m.dryrun && len(m.notmuchChanged) > 0 {
+		if err = m.notmuchPush(); err != nil {
+			return m.e.E(err)
+		}
+	}
 	return
 }
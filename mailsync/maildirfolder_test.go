@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/sgotti/gomailsync/config"
@@ -51,6 +52,7 @@ func SetupMaildirFolderTest(t *testing.T) {
 		Maildir:    maildirstore1dir,
 		Separator:  os.PathSeparator,
 		UIDMapping: "files",
+		Fsync:      true,
 	}
 
 	store2conf := config.StoreConfig{
@@ -77,7 +79,7 @@ func SetupMaildirFolderTest(t *testing.T) {
 
 	store1, _ := newStore(&globalconfig, &store1conf)
 
-	folder := &Mailfolder{[]string{"INBOX"}, false}
+	folder := &Mailfolder{Name: []string{"INBOX"}, Excluded: false}
 	err := store1.CreateFolder(folder.Name)
 	if err != nil {
 		t.Fatal(err)
@@ -136,7 +138,7 @@ func TestUpdateMessageList(t *testing.T) {
 	SetupMaildirFolderTest(t)
 	fm1, _ := maildirfoldertest.fm1.(*MaildirFolder)
 
-	folder := Mailfolder{[]string{"INBOX"}, false}
+	folder := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
 
 	var startuid uint32 = 100000
 	expected := 10
@@ -205,7 +207,7 @@ func TestMaildirFolderDeleteMessage(t *testing.T) {
 	SetupMaildirFolderTest(t)
 	fm1 := maildirfoldertest.fm1
 
-	folder := Mailfolder{[]string{"INBOX"}, false}
+	folder := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
 
 	err := fm1.UpdateMessageList()
 	if err != nil {
@@ -232,7 +234,7 @@ func TestMaildirFolderAddMessages(t *testing.T) {
 	SetupMaildirFolderTest(t)
 	fm1 := maildirfoldertest.fm1
 
-	folder := Mailfolder{[]string{"INBOX"}, false}
+	folder := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
 
 	err := fm1.UpdateMessageList()
 	if err != nil {
@@ -251,11 +253,46 @@ func TestMaildirFolderAddMessages(t *testing.T) {
 	fm1.Close()
 }
 
+func TestMaildirFolderAddMessageContent(t *testing.T) {
+	SetupMaildirFolderTest(t)
+	fm1 := maildirfoldertest.fm1
+
+	err := fm1.UpdateMessageList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("Subject: test\r\n\r\nbody\r\n")
+	uid, err := fm1.AddMessage(uint32(0), "S", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := fm1.ReadMessage(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(data) {
+		t.Fatalf("Wrong message body: %q, expected: %q", body, data)
+	}
+
+	// Nothing should be left in tmp
+	tmpfiles, err := ioutil.ReadDir(filepath.Join(fm1.(*MaildirFolder).maildir, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpfiles) != 0 {
+		t.Fatalf("Expected empty tmp dir, found %d files", len(tmpfiles))
+	}
+
+	fm1.Close()
+}
+
 func TestMaildirFolderSetFlags(t *testing.T) {
 	SetupMaildirFolderTest(t)
 	fm1 := maildirfoldertest.fm1
 
-	folder := Mailfolder{[]string{"INBOX"}, false}
+	folder := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
 
 	err := fm1.UpdateMessageList()
 	if err != nil {
@@ -300,6 +337,131 @@ func newStore(globalconfig *config.Config, config *config.StoreConfig) (m StoreM
 		m, err = NewMaildirStore(globalconfig, config, basemetadatadir, false)
 	case "IMAP":
 		m, err = NewImapStore(globalconfig, config, basemetadatadir, false)
+	case "JMAP":
+		m, err = NewJMAPStore(globalconfig, config, basemetadatadir, false)
+	case "POP3":
+		m, err = NewPOP3Store(globalconfig, config, basemetadatadir, false)
+	case "mbox":
+		m, err = NewMboxStore(globalconfig, config, basemetadatadir, false)
+	case "MH":
+		m, err = NewMHStore(globalconfig, config, basemetadatadir, false)
+	case "Memory":
+		m, err = NewMemoryStore(globalconfig, config, basemetadatadir, false)
 	}
 	return m, err
 }
+
+func TestMaildirFolderNewMessageSubdir(t *testing.T) {
+	storeconf := &config.StoreConfig{
+		Separator:        '/',
+		NewMessageSubdir: "auto",
+	}
+	_, store := newTestMaildirStore(t, storeconf)
+
+	folder := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
+	if err := store.CreateFolder(folder.Name); err != nil {
+		t.Fatal(err)
+	}
+	fm, err := store.GetMailfolderManager(folder.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfm := fm.(*MaildirFolder)
+
+	unseenuid, err := fm.AddMessage(0, "", []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seenuid, err := fm.AddMessage(1, "S", []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSubdir := func(uid uint32, subdir string) {
+		if err := fm.UpdateMessageList(); err != nil {
+			t.Fatal(err)
+		}
+		message := mfm.messages[uid]
+		if message == nil || message.Subdir != subdir {
+			t.Fatalf("Expected message with uid %d in subdir %s, found: %#v", uid, subdir, message)
+		}
+		p, err := mfm.findFilepath(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(filepath.Dir(p)) != subdir {
+			t.Fatalf("Expected message with uid %d in subdir %s, found path: %s", uid, subdir, p)
+		}
+	}
+
+	checkSubdir(unseenuid, "new")
+	checkSubdir(seenuid, "cur")
+	countMessages(t, store, folder, 2)
+
+	// A message in new without flags doesn't have the info part
+	p, _ := mfm.findFilepath(mfm.messages[unseenuid])
+	if strings.ContainsRune(filepath.Base(p), mfm.infoSeparator) {
+		t.Fatalf("Unexpected info part in message filename: %s", p)
+	}
+
+	// Setting a flag moves the message to cur
+	if err := fm.SetFlags(unseenuid, "S"); err != nil {
+		t.Fatal(err)
+	}
+	checkSubdir(unseenuid, "cur")
+
+	// Removing all the flags doesn't move it back to new
+	if err := fm.SetFlags(unseenuid, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkSubdir(unseenuid, "cur")
+	countMessages(t, store, folder, 2)
+}
+
+func TestMaildirFolderMoveMessage(t *testing.T) {
+	_, store := newTestMaildirStore(t, &config.StoreConfig{Separator: '/'})
+
+	inbox := Mailfolder{Name: []string{"INBOX"}, Excluded: false}
+	archive := Mailfolder{Name: []string{"Archive"}, Excluded: false}
+	fms := make([]MailfolderManager, 0, 2)
+	for _, folder := range []Mailfolder{inbox, archive} {
+		if err := store.CreateFolder(folder.Name); err != nil {
+			t.Fatal(err)
+		}
+		fm, err := store.GetMailfolderManager(folder.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fms = append(fms, fm)
+	}
+	fm, archivefm := fms[0], fms[1]
+
+	uid, err := fm.AddMessage(0, "S", []byte("Subject: 1\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = archivefm.AddMessage(0, "", []byte("Subject: 2\n\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	newuid, moved, err := fm.(MessageMover).MoveMessage(uid, archivefm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !moved {
+		t.Fatal("Message not moved")
+	}
+	countMessages(t, store, inbox, 0)
+	countMessages(t, store, archive, 2)
+
+	// The moved message has an uid of its new folder
+	if err = archivefm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	if flags, err := archivefm.GetFlags(newuid); err != nil || flags != "S" {
+		t.Fatalf("Wrong moved message flags: %q, %v", flags, err)
+	}
+	if body, err := archivefm.ReadMessage(newuid); err != nil || string(body) != "Subject: 1\n\n" {
+		t.Fatalf("Wrong moved message: %q, %v", body, err)
+	}
+}
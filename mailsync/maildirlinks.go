@@ -0,0 +1,204 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Maildir store keeps a hard link of every message with a global id
+// (like the Gmail X-GM-MSGID) in the messagelinks dir of its metadatadir,
+// named like the id. A message with the same id added to another folder is
+// hard linked to it instead of being transferred again, and a message with
+// a known id moved by the user to another folder is found by its inode.
+// The links of the messages removed from all the folders are removed by
+// UpdateFolderList.
+//
+// Compressed stores don't link messages.
+
+const messageLinksDir = "messagelinks"
+
+// fileKey identifies a file (its device and inode)
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+func (m *MaildirStore) messageLinkPath(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("Wrong global message id: %q", id)
+	}
+	return filepath.Join(m.metadatadir, messageLinksDir, id), nil
+}
+
+// removeUnlinkedMessages removes the message links without any other link
+func (m *MaildirStore) removeUnlinkedMessages() error {
+	dir := filepath.Join(m.metadatadir, messageLinksDir)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range fis {
+		_, nlink, ok := fileLinkInfo(fi)
+		if !ok || nlink > 1 {
+			continue
+		}
+		m.logger.Debugf("Removing unlinked message %s", fi.Name())
+		if err = os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMessageLinks reads the ids of the message links
+func (m *MaildirFolder) loadMessageLinks() error {
+	m.messagelinks = make(map[fileKey]string)
+	fis, err := ioutil.ReadDir(filepath.Join(m.store.metadatadir, messageLinksDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range fis {
+		if key, _, ok := fileLinkInfo(fi); ok {
+			m.messagelinks[key] = fi.Name()
+		}
+	}
+	return nil
+}
+
+// GlobalMessageID returns the id of the message link with the same inode
+// of the message
+func (m *MaildirFolder) GlobalMessageID(uid uint32) string {
+	message, ok := m.messages[uid]
+	if !ok {
+		return ""
+	}
+	if m.messagelinks == nil {
+		if err := m.loadMessageLinks(); err != nil {
+			m.logger.Errorf("Error reading the message links: %s", err)
+			return ""
+		}
+	}
+	if len(m.messagelinks) == 0 {
+		return ""
+	}
+
+	messagepath, err := m.findFilepath(message)
+	if err != nil || messagepath == "" {
+		return ""
+	}
+	fi, err := os.Stat(messagepath)
+	if err != nil {
+		return ""
+	}
+	key, _, ok := fileLinkInfo(fi)
+	if !ok {
+		return ""
+	}
+	return m.messagelinks[key]
+}
+
+// LinkMessage hard links the message with the id in the folder
+func (m *MaildirFolder) LinkMessage(srcuid uint32, flags string, id string) (uint32, bool, error) {
+	if m.compress != "" || m.dryrun {
+		return 0, false, nil
+	}
+	linkpath, err := m.store.messageLinkPath(id)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	if _, err = os.Stat(linkpath); err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, m.e.E(err)
+	}
+
+	uid, err := m.getNextFreeUID()
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	filename, err := m.generateFilename(uid)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	subdir := m.messageSubdir("", flags)
+	messagepath := filepath.Join(m.maildir, subdir, m.fullFilename(filename, flags, subdir, false))
+
+	if err = os.Link(linkpath, messagepath); err != nil {
+		// Like on a different filesystem, the message will be copied
+		m.logger.Debugf("Cannot link message %s: %s", id, err)
+		return 0, false, nil
+	}
+	if m.fsync {
+		if err = syncDir(filepath.Dir(messagepath)); err != nil {
+			return 0, false, m.e.E(err)
+		}
+	}
+
+	m.registerMessage(uid, flags, filename, subdir, false, false)
+	m.notmuchChanged[m.messages[uid]] = true
+	return uid, true, nil
+}
+
+// SetGlobalMessageID adds a message link for the message
+func (m *MaildirFolder) SetGlobalMessageID(uid uint32, id string) error {
+	if m.compress != "" || m.dryrun {
+		return nil
+	}
+	message, ok := m.messages[uid]
+	if !ok {
+		return m.e.E(fmt.Errorf("Cannot find message with uid: %d", uid))
+	}
+	linkpath, err := m.store.messageLinkPath(id)
+	if err != nil {
+		return m.e.E(err)
+	}
+	messagepath, err := m.findFilepath(message)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	if err = MkdirIfNotExists(filepath.Dir(linkpath)); err != nil {
+		return m.e.E(err)
+	}
+	if err = os.Link(messagepath, linkpath); err != nil {
+		if !os.IsExist(err) {
+			m.logger.Debugf("Cannot link message %s: %s", id, err)
+		}
+		return nil
+	}
+	if m.messagelinks != nil {
+		if fi, err := os.Stat(linkpath); err == nil {
+			if key, _, ok := fileLinkInfo(fi); ok {
+				m.messagelinks[key] = id
+			}
+		}
+	}
+	return nil
+}
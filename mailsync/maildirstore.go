@@ -25,6 +25,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/sgotti/gomailsync/config"
 	"github.com/sgotti/gomailsync/errors"
@@ -32,16 +34,19 @@ import (
 )
 
 type MaildirStore struct {
-	globalconfig *config.Config
-	config       *config.StoreConfig
-	name         string
-	maildir      string
-	metadatadir  string
-	separator    rune
-	folders      []*Mailfolder
-	logger       *log.Logger
-	e            *errors.Error
-	dryrun       bool
+	globalconfig  *config.Config
+	config        *config.StoreConfig
+	name          string
+	maildir       string
+	metadatadir   string
+	separator     rune
+	infoSeparator rune
+	folders       []*Mailfolder
+	notmuch       *notmuchDB
+	escapedNames  bool
+	logger        *log.Logger
+	e             *errors.Error
+	dryrun        bool
 }
 
 func (m *MaildirStore) isInbox(relpath string) bool {
@@ -52,7 +57,7 @@ func (m *MaildirStore) isInbox(relpath string) bool {
 }
 
 func (m *MaildirStore) maildirPath(name foldername) string {
-	folderpath := FolderToStorePath(name, m.separator)
+	folderpath := FolderToEscapedStorePath(name, m.separator, m.config.PortableFolderNames)
 	if StrsEquals(name, []string{"INBOX"}) {
 		folderpath = filepath.Clean(m.config.InboxPath)
 	}
@@ -65,6 +70,7 @@ func (m *MaildirStore) readFolderUID(path string) (folderUID string, err error)
 		m.logger.Debugf("open failed")
 		return "", nil
 	}
+	defer f.Close()
 	scanner := bufio.NewScanner(f)
 	scanner.Scan()
 	folderUID = scanner.Text()
@@ -79,7 +85,7 @@ func (m *MaildirStore) readFolderUID(path string) (folderUID string, err error)
 
 func (m *MaildirStore) getFolderUID(name foldername) (folderUID string, err error) {
 	foldermaildir := filepath.Join(m.maildir, m.maildirPath(name))
-	foldermetadatadir := filepath.Join(m.metadatadir, FolderToStorePath(name, os.PathSeparator))
+	foldermetadatadir := filepath.Join(m.metadatadir, folderMetadataPath(name))
 
 	mddirfilepath := filepath.Join(foldermetadatadir, "folderuid")
 	maildirfilepath := filepath.Join(foldermaildir, ".gomailsync-folderuid")
@@ -103,30 +109,7 @@ func (m *MaildirStore) getFolderUID(name foldername) (folderUID string, err erro
 }
 
 func (m *MaildirStore) writeFolderUID(path string, folderUID string) (err error) {
-	fo, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err := fo.Close(); err != nil {
-			m.logger.Error("file close error")
-		}
-	}()
-
-	w := bufio.NewWriter(fo)
-
-	if _, err := w.WriteString(folderUID); err != nil {
-		return err
-	}
-	if err = w.Flush(); err != nil {
-		return err
-	}
-	if err = fo.Sync(); err != nil {
-		return err
-	}
-
-	return nil
+	return writeFileAtomic(path, []byte(folderUID), m.config.Fsync)
 }
 
 func generateFolderUID() (folderUID string, err error) {
@@ -154,34 +137,86 @@ func NewMaildirStore(globalconfig *config.Config, config *config.StoreConfig, ba
 	metadatadir := filepath.Join(basemetadatadir, name)
 	maildir := config.Maildir
 
-	err = os.MkdirAll(metadatadir, 0777)
-	if err != nil {
-		return nil, err
+	// A dry run doesn't create the store directories
+	if !dryrun {
+		err = os.MkdirAll(metadatadir, 0777)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(maildir, 0777)
+		if err != nil {
+			logger.Error("Error:", err)
+			return
+		}
 	}
 
-	err = os.MkdirAll(maildir, 0777)
-	if err != nil {
-		m.logger.Error("Error:", err)
-		return
+	infoseparator := ':'
+	if config.InfoSeparator != "" {
+		infoseparator, _ = utf8.DecodeRuneInString(config.InfoSeparator)
 	}
 
 	m = &MaildirStore{
-		globalconfig: globalconfig,
-		config:       config,
-		name:         name,
-		maildir:      maildir,
-		metadatadir:  metadatadir,
-		separator:    config.Separator,
-		folders:      make([]*Mailfolder, 0),
-		logger:       logger,
-		e:            e,
-		dryrun:       dryrun,
+		globalconfig:  globalconfig,
+		config:        config,
+		name:          name,
+		maildir:       maildir,
+		metadatadir:   metadatadir,
+		separator:     config.Separator,
+		infoSeparator: infoseparator,
+		folders:       make([]*Mailfolder, 0),
+		logger:        logger,
+		e:             e,
+		dryrun:        dryrun,
+	}
+
+	if config.Notmuch {
+		m.notmuch = newNotmuchDB(config.NotmuchCommand, config.NotmuchConfig)
 	}
 
 	err = m.UpdateFolderList()
+	if err != nil {
+		return
+	}
+
+	if !dryrun {
+		for _, f := range m.folders {
+			m.cleanTmpDir(filepath.Join(maildir, m.maildirPath(f.Name), "tmp"))
+		}
+	}
 	return
 }
 
+// Files in tmp older than this are leftovers of an interrupted delivery
+// (the same limit suggested by the maildir specification)
+const maildirTmpMaxAge = 36 * time.Hour
+
+// cleanTmpDir removes stale files left in a maildir tmp directory
+func (m *MaildirStore) cleanTmpDir(tmpdir string) {
+	f, err := os.Open(tmpdir)
+	if err != nil {
+		m.logger.Debugf("cannot open tmp dir %s: %s", tmpdir, err)
+		return
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		m.logger.Debugf("cannot read tmp dir %s: %s", tmpdir, err)
+		return
+	}
+
+	for _, fi := range fis {
+		if fi.IsDir() || time.Since(fi.ModTime()) < maildirTmpMaxAge {
+			continue
+		}
+		p := filepath.Join(tmpdir, fi.Name())
+		m.logger.Infof("Removing stale tmp file: %s", p)
+		if err := os.Remove(p); err != nil {
+			m.logger.Errorf("Error removing stale tmp file %s: %s", p, err)
+		}
+	}
+}
+
 func (m *MaildirStore) CreateFolder(name foldername) (err error) {
 	foldermaildir := filepath.Join(m.maildir, m.maildirPath(name))
 
@@ -191,8 +226,13 @@ func (m *MaildirStore) CreateFolder(name foldername) (err error) {
 			m.logger.Error("Error:", err)
 		}
 	}
+	if m.config.Fsync {
+		if err = syncDir(foldermaildir); err != nil {
+			return m.e.E(err)
+		}
+	}
 
-	foldermetadatadir := filepath.Join(m.metadatadir, FolderToStorePath(name, os.PathSeparator))
+	foldermetadatadir := filepath.Join(m.metadatadir, folderMetadataPath(name))
 
 	mddirfilepath := filepath.Join(foldermetadatadir, "folderuid")
 	maildirfilepath := filepath.Join(foldermaildir, ".gomailsync-folderuid")
@@ -218,7 +258,7 @@ func (m *MaildirStore) CreateFolder(name foldername) (err error) {
 		if err != nil {
 			return m.e.E(err)
 		}
-		m.writeFolderUID(maildirfilepath, folderUID)
+		err = m.writeFolderUID(maildirfilepath, folderUID)
 		if err != nil {
 			// Remove previous file
 			os.Remove(mddirfilepath)
@@ -259,7 +299,17 @@ func (m *MaildirStore) HasFolder(name foldername) bool {
 
 func (m *MaildirStore) UpdateFolderList() error {
 	m.folders = make([]*Mailfolder, 0)
+	// Not yet created by a dry run
+	if _, err := os.Stat(m.maildir); os.IsNotExist(err) && m.dryrun {
+		return nil
+	}
+	if !m.dryrun {
+		if err := m.removeUnlinkedMessages(); err != nil {
+			return m.e.E(err)
+		}
+	}
 	subdirs := []string{"cur", "new", "tmp"}
+	relpaths := make([]string, 0)
 	err := filepath.Walk(m.maildir, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() && !StringInSlice(filepath.Base(path), subdirs) {
 			var ok uint8 = 0
@@ -290,10 +340,12 @@ func (m *MaildirStore) UpdateFolderList() error {
 					err := fmt.Errorf("directory with name \"%s\", doesn't match configured inbox path \"%s\"", filepath.Clean(relpath), (m.config.InboxPath))
 					return m.e.E(err)
 				}
-				name := strings.Split(relpath, string(m.separator))
+				name := EscapedStorePathToFolder(relpath, m.separator)
 				// Is this path of the configured INBOX?
 				if m.isInbox(relpath) {
 					name = []string{"INBOX"}
+				} else {
+					relpaths = append(relpaths, relpath)
 				}
 				folder := &Mailfolder{
 					Name:     name,
@@ -309,6 +361,20 @@ func (m *MaildirStore) UpdateFolderList() error {
 		return m.e.E(err)
 	}
 
+	if err = m.checkEscapedNames(relpaths); err != nil {
+		return m.e.E(err)
+	}
+
+	if m.config.Subscribedonly {
+		subscribed, err := m.SubscribedFolders()
+		if err != nil {
+			return err
+		}
+		applySubscriptions(m, m.folders, subscribed)
+	}
+
+	applyFolderRoles(m, m.folders)
+
 	err = applyRegExpPatterns(m, m.folders)
 	if err != nil {
 		return m.e.E(err)
@@ -317,6 +383,32 @@ func (m *MaildirStore) UpdateFolderList() error {
 	return nil
 }
 
+// checkEscapedNames verifies, if the store was saved by an older version
+// with unescaped folder names, that no folder name contains a "%XX"
+// sequence: it would be read as a different folder. Then the folder
+// metadata dirs are renamed to their escaped names.
+func (m *MaildirStore) checkEscapedNames(relpaths []string) error {
+	if m.escapedNames {
+		return nil
+	}
+	escaped, err := hasEscapedNames(m.metadatadir)
+	if err != nil {
+		return err
+	}
+	if !escaped {
+		for _, relpath := range relpaths {
+			if hasEscapeSequence(relpath) {
+				return fmt.Errorf("the name of folder \"%s\", created by an older version, contains a \"%%XX\" sequence that is now read as an escaped character: rename it", relpath)
+			}
+		}
+		if err = escapeMetadataNames(m.metadatadir, m.dryrun); err != nil {
+			return err
+		}
+	}
+	m.escapedNames = true
+	return nil
+}
+
 func (m *MaildirStore) Separator() (rune, error) {
 	return m.separator, nil
 }
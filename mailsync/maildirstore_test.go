@@ -0,0 +1,492 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+func newTestMaildirStore(t *testing.T, storeconf *config.StoreConfig) (*config.Config, StoreManager) {
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+	maildirdir := filepath.Join(testdir, "maildirstore1")
+	os.Mkdir(maildirdir, 0777)
+
+	storeconf.Name = "store1"
+	storeconf.StoreType = "Maildir"
+	storeconf.Maildir = maildirdir
+	storeconf.UIDMapping = "files"
+
+	globalconfig := &config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{storeconf},
+		LogLevel:    "debug",
+	}
+
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return globalconfig, store
+}
+
+func TestEscapeFolderComponent(t *testing.T) {
+	tests := []struct {
+		component string
+		separator rune
+		portable  bool
+		escaped   string
+	}{
+		{"Sent", '.', false, "Sent"},
+		{"a.b", '.', false, "a%2Eb"},
+		{"a.b", '/', false, "a.b"},
+		{"a/b", '.', false, "a%2Fb"},
+		{"100%", '.', false, "100%"},
+		{"a%2E", '.', false, "a%252E"},
+		{"a:b?", '/', false, "a:b?"},
+		{"a:b?", '/', true, "a%3Ab%3F"},
+		{"ä.ö", '.', true, "ä%2Eö"},
+	}
+
+	for _, tt := range tests {
+		escaped := escapeFolderComponent(tt.component, tt.separator, tt.portable)
+		if escaped != tt.escaped {
+			t.Fatalf("Escaping %q: expected %q, found %q", tt.component, tt.escaped, escaped)
+		}
+		unescaped := unescapeFolderComponent(escaped)
+		if unescaped != tt.component {
+			t.Fatalf("Unescaping %q: expected %q, found %q", escaped, tt.component, unescaped)
+		}
+	}
+}
+
+func TestMaildirStoreEscapedFolderNames(t *testing.T) {
+	storeconf := &config.StoreConfig{
+		Separator:           '.',
+		PortableFolderNames: true,
+	}
+	globalconfig, store := newTestMaildirStore(t, storeconf)
+
+	name := foldername{"a.b", "c/d:e"}
+	if err := store.CreateFolder(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(storeconf.Maildir, "a%2Eb.c%2Fd%3Ae", "cur")); err != nil {
+		t.Fatalf("Expected escaped maildir path: %s", err)
+	}
+
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.HasFolder(name) {
+		t.Fatalf("Expected folder %v, found folders: %v", name, store.GetFolders())
+	}
+}
+
+func TestMaildirStoreUnescapedFolderNames(t *testing.T) {
+	storeconf := &config.StoreConfig{
+		Separator: '.',
+	}
+	globalconfig, store := newTestMaildirStore(t, storeconf)
+	metadatadir := store.(*MaildirStore).metadatadir
+
+	// A store saved by an older version, with a folder metadata dir
+	// containing a literal "%XX"
+	if err := os.Remove(filepath.Join(metadatadir, escapedNamesMarker)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(metadatadir, "Q%20report"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(metadatadir, folderMetadataPath(foldername{"Q%20report"}))); err != nil {
+		t.Fatalf("Expected the metadata dir renamed to its escaped name: %s", err)
+	}
+
+	// Now the names are escaped
+	name := foldername{"100%25"}
+	if err = store.CreateFolder(name); err != nil {
+		t.Fatal(err)
+	}
+	store, err = newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.HasFolder(name) {
+		t.Fatalf("Expected folder %v, found folders: %v", name, store.GetFolders())
+	}
+
+	// A maildir folder with a literal "%XX" is refused
+	storeconf = &config.StoreConfig{
+		Separator: '.',
+	}
+	globalconfig, store = newTestMaildirStore(t, storeconf)
+	metadatadir = store.(*MaildirStore).metadatadir
+	if err = os.Remove(filepath.Join(metadatadir, escapedNamesMarker)); err != nil {
+		t.Fatal(err)
+	}
+	for _, subdir := range []string{"cur", "new", "tmp"} {
+		if err = os.MkdirAll(filepath.Join(storeconf.Maildir, "Q%20report", subdir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = newStore(globalconfig, storeconf); err == nil || !strings.Contains(err.Error(), "Q%20report") {
+		t.Fatalf("Expected an error for a folder name with a literal escape sequence, got: %v", err)
+	}
+}
+
+func TestMaildirStoreCleanTmp(t *testing.T) {
+	storeconf := &config.StoreConfig{
+		Separator: '/',
+	}
+	globalconfig, store := newTestMaildirStore(t, storeconf)
+
+	name := foldername{"INBOX"}
+	if err := store.CreateFolder(name); err != nil {
+		t.Fatal(err)
+	}
+	tmpdir := filepath.Join(storeconf.Maildir, store.(*MaildirStore).maildirPath(name), "tmp")
+
+	stalefile := filepath.Join(tmpdir, "stale")
+	recentfile := filepath.Join(tmpdir, "recent")
+	for _, f := range []string{stalefile, recentfile} {
+		if err := ioutil.WriteFile(f, []byte("partial"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * maildirTmpMaxAge)
+	if err := os.Chtimes(stalefile, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newStore(globalconfig, storeconf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stalefile); !os.IsNotExist(err) {
+		t.Fatalf("Expected stale tmp file to be removed")
+	}
+	if _, err := os.Stat(recentfile); err != nil {
+		t.Fatalf("Expected recent tmp file to be kept: %s", err)
+	}
+}
+
+func TestMaildirFolderInfoSeparator(t *testing.T) {
+	storeconf := &config.StoreConfig{
+		Separator:     '/',
+		InfoSeparator: ";",
+	}
+	_, store := newTestMaildirStore(t, storeconf)
+
+	name := foldername{"INBOX"}
+	if err := store.CreateFolder(name); err != nil {
+		t.Fatal(err)
+	}
+	fm, err := store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := fm.AddMessage(0, "S", []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filenames, err := ioutil.ReadDir(filepath.Join(fm.(*MaildirFolder).maildir, "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != 1 || !strings.HasSuffix(filenames[0].Name(), ";2,S") || strings.Contains(filenames[0].Name(), ":") {
+		t.Fatalf("Wrong message filenames: %v", filenames)
+	}
+
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := fm.GetFlags(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != "S" {
+		t.Fatalf("Expected flags \"S\", found \"%s\"", flags)
+	}
+}
+
+func TestMaildirFolderCompress(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd"} {
+		storeconf := &config.StoreConfig{
+			Separator: '/',
+		}
+		_, store := newTestMaildirStore(t, storeconf)
+
+		name := foldername{"INBOX"}
+		if err := store.CreateFolder(name); err != nil {
+			t.Fatal(err)
+		}
+		fm, err := store.GetMailfolderManager(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := []byte("Subject: test\r\n\r\nMessage body\r\n")
+		olduid, err := fm.AddMessage(0, "S", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm.Close()
+
+		// Enable compression and compress the existing message
+		storeconf.Compress = compression
+		count, err := store.(*MaildirStore).CompressFolder(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("Expected 1 compressed message, found %d", count)
+		}
+
+		fm, err = store.GetMailfolderManager(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fm.UpdateMessageList(); err != nil {
+			t.Fatal(err)
+		}
+		newuid, err := fm.AddMessage(0, "", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fm.SetFlags(newuid, "FS"); err != nil {
+			t.Fatal(err)
+		}
+		if err = fm.UpdateMessageList(); err != nil {
+			t.Fatal(err)
+		}
+
+		filenames, err := ioutil.ReadDir(filepath.Join(fm.(*MaildirFolder).maildir, "cur"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filenames) != 2 {
+			t.Fatalf("Wrong message filenames: %v", filenames)
+		}
+		for _, f := range filenames {
+			if !strings.Contains(f.Name(), ",S=") || !strings.Contains(f.Name(), "Z") {
+				t.Fatalf("Wrong compressed message filename: %s", f.Name())
+			}
+			data, err := ioutil.ReadFile(filepath.Join(fm.(*MaildirFolder).maildir, "cur", f.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isCompressed(data) {
+				t.Fatalf("Message %s not compressed", f.Name())
+			}
+		}
+
+		for uid, flags := range map[uint32]string{olduid: "S", newuid: "FS"} {
+			foundflags, err := fm.GetFlags(uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if foundflags != flags {
+				t.Fatalf("Expected flags \"%s\", found \"%s\"", flags, foundflags)
+			}
+			data, err := fm.ReadMessage(uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(body) {
+				t.Fatalf("Wrong decompressed message: %q", data)
+			}
+		}
+	}
+}
+
+func TestMaildirMessageLinks(t *testing.T) {
+	storeconf := &config.StoreConfig{
+		Separator: '/',
+	}
+	_, store := newTestMaildirStore(t, storeconf)
+
+	fms := make(map[string]*MaildirFolder)
+	for _, name := range []string{"INBOX", "work", "later"} {
+		if err := store.CreateFolder(foldername{name}); err != nil {
+			t.Fatal(err)
+		}
+		fm, err := store.GetMailfolderManager(foldername{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fm.UpdateMessageList(); err != nil {
+			t.Fatal(err)
+		}
+		fms[name] = fm.(*MaildirFolder)
+	}
+
+	body := []byte("Subject: test\r\n\r\nMessage body\r\n")
+	uid, err := fms["INBOX"].AddMessage(0, "S", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fms["INBOX"].SetGlobalMessageID(uid, "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, linked, err := fms["work"].LinkMessage(0, "", "5678"); err != nil || linked {
+		t.Fatalf("Linked an unknown message: %v", err)
+	}
+	workuid, linked, err := fms["work"].LinkMessage(0, "F", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !linked {
+		t.Fatalf("Message not linked")
+	}
+	data, err := fms["work"].ReadMessage(workuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(body) {
+		t.Fatalf("Wrong linked message: %q", data)
+	}
+	if flags, _ := fms["work"].GetFlags(workuid); flags != "F" {
+		t.Fatalf("Wrong linked message flags: %q", flags)
+	}
+
+	// A message moved by the user to another folder keeps its id
+	workpath, err := fms["work"].findFilepath(fms["work"].messages[workuid])
+	if err != nil {
+		t.Fatal(err)
+	}
+	laterpath := filepath.Join(fms["later"].maildir, "cur", filepath.Base(workpath))
+	if err = os.Rename(workpath, laterpath); err != nil {
+		t.Fatal(err)
+	}
+	if err = fms["later"].UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fms["later"].GetMessages()) != 1 {
+		t.Fatalf("Moved message not found")
+	}
+	for uid := range fms["later"].GetMessages() {
+		if id := fms["later"].GlobalMessageID(uid); id != "1234" {
+			t.Fatalf("Wrong global message id: %q", id)
+		}
+	}
+	if id := fms["INBOX"].GlobalMessageID(uid); id != "1234" {
+		t.Fatalf("Wrong global message id: %q", id)
+	}
+
+	// The link is removed with the last message
+	linkpath := filepath.Join(store.(*MaildirStore).metadatadir, messageLinksDir, "1234")
+	if err = os.Remove(laterpath); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.UpdateFolderList(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(linkpath); err != nil {
+		t.Fatalf("Message link removed: %s", err)
+	}
+	if err = fms["INBOX"].DeleteMessage(uid); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.UpdateFolderList(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(linkpath); !os.IsNotExist(err) {
+		t.Fatalf("Message link not removed")
+	}
+}
+
+func TestMaildirSubscriptions(t *testing.T) {
+	storeconf := &config.StoreConfig{
+		Separator:      '.',
+		Subscribedonly: true,
+	}
+	_, store := newTestMaildirStore(t, storeconf)
+	for _, name := range []foldername{{"INBOX"}, {"work"}, {"work", "2014"}, {"later"}} {
+		if err := store.CreateFolder(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscriber := store.(FolderSubscriber)
+	tests := []struct {
+		filename string
+		content  string
+		expected string
+	}{
+		{dovecotSubscriptionsFile, "work.2014\nlater\n", "work.2014\nlater\nwork\n"},
+		{dovecotSubscriptionsFile, "V\t2\n\nwork\t2014\nlater\n", "V\t2\n\nwork\t2014\nlater\nwork\n"},
+		{courierSubscriptionsFile, "INBOX\nINBOX.work.2014\nINBOX.later\n", "INBOX\nINBOX.work.2014\nINBOX.later\nINBOX.work\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(storeconf.Maildir, tt.filename)
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.UpdateFolderList(); err != nil {
+			t.Fatal(err)
+		}
+		excluded := make(map[string]bool)
+		for _, f := range store.GetFolders() {
+			excluded[f.String()] = f.Excluded
+		}
+		expected := map[string]bool{"INBOX": false, "work": true, "work/2014": false, "later": false}
+		if !reflect.DeepEqual(excluded, expected) {
+			t.Fatalf("%s: wrong excluded folders: %v", tt.content, excluded)
+		}
+
+		if err := subscriber.SetFolderSubscribed(foldername{"work"}, true); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.expected {
+			t.Fatalf("Wrong subscriptions file: %q", data)
+		}
+		if err = subscriber.SetFolderSubscribed(foldername{"work"}, false); err != nil {
+			t.Fatal(err)
+		}
+		names, err := subscriber.SubscribedFolders()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if StrsEquals(name, foldername{"work"}) {
+				t.Fatalf("Folder not unsubscribed: %v", names)
+			}
+		}
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,152 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Maildir store keeps the folder subscriptions in the file of the IMAP
+// server using the same maildir. Dovecot uses the subscriptions file with a
+// folder per line (in the version 2 format, starting with a "V\t2" header,
+// the hierarchy separator is a tab). Courier uses the courierimapsubscribed
+// file with a folder per line named like INBOX.folder. Without any of them
+// a Dovecot one is created.
+
+const (
+	dovecotSubscriptionsFile = "subscriptions"
+	courierSubscriptionsFile = "courierimapsubscribed"
+)
+
+type subscriptionsFormat int
+
+const (
+	subscriptionsDovecot subscriptionsFormat = iota
+	subscriptionsDovecotV2
+	subscriptionsCourier
+)
+
+// readSubscriptions returns the subscriptions file path, its format and the
+// subscribed folders
+func (m *MaildirStore) readSubscriptions() (string, subscriptionsFormat, []foldername, error) {
+	names := make([]foldername, 0)
+
+	path := filepath.Join(m.maildir, courierSubscriptionsFile)
+	format := subscriptionsCourier
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path = filepath.Join(m.maildir, dovecotSubscriptionsFile)
+		format = subscriptionsDovecot
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return path, format, names, nil
+		}
+		return "", format, nil, err
+	}
+
+	lines := strings.Split(strings.Replace(string(data), "\r", "", -1), "\n")
+	if format == subscriptionsDovecot && strings.HasPrefix(lines[0], "V\t") {
+		format = subscriptionsDovecotV2
+		// Skip the header
+		for len(lines) > 0 && lines[0] != "" {
+			lines = lines[1:]
+		}
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		switch format {
+		case subscriptionsDovecot:
+			names = append(names, strings.Split(line, string(m.separator)))
+		case subscriptionsDovecotV2:
+			names = append(names, strings.Split(line, "\t"))
+		case subscriptionsCourier:
+			if line == "INBOX" {
+				names = append(names, foldername{"INBOX"})
+			} else if strings.HasPrefix(line, "INBOX.") {
+				names = append(names, strings.Split(strings.TrimPrefix(line, "INBOX."), "."))
+			}
+		}
+	}
+	return path, format, names, nil
+}
+
+// SubscribedFolders returns the folders in the subscriptions file
+func (m *MaildirStore) SubscribedFolders() ([]foldername, error) {
+	_, _, names, err := m.readSubscriptions()
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	return names, nil
+}
+
+// SetFolderSubscribed adds or removes a folder from the subscriptions file
+func (m *MaildirStore) SetFolderSubscribed(name foldername, subscribed bool) error {
+	path, format, names, err := m.readSubscriptions()
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	var data string
+	if format == subscriptionsDovecotV2 {
+		data = "V\t2\n\n"
+	}
+	found := false
+	for _, n := range names {
+		if StrsEquals(n, name) {
+			found = true
+			if !subscribed {
+				continue
+			}
+		}
+		data += formatSubscription(n, format, m.separator) + "\n"
+	}
+	if found == subscribed {
+		return nil
+	}
+	if subscribed {
+		data += formatSubscription(name, format, m.separator) + "\n"
+	}
+
+	if m.dryrun {
+		return nil
+	}
+	if err = writeFileAtomic(path, []byte(data), m.config.Fsync); err != nil {
+		return m.e.E(err)
+	}
+	return nil
+}
+
+func formatSubscription(name foldername, format subscriptionsFormat, separator rune) string {
+	switch format {
+	case subscriptionsDovecotV2:
+		return strings.Join(name, "\t")
+	case subscriptionsCourier:
+		if len(name) == 1 && name[0] == "INBOX" {
+			return "INBOX"
+		}
+		return "INBOX." + strings.Join(name, ".")
+	}
+	return FolderToStorePath(name, separator)
+}
@@ -19,9 +19,14 @@ package mailsync
 
 type foldername []string
 
+// Special-use folder roles (RFC 6154)
+var folderRoles = []string{`\Sent`, `\Drafts`, `\Trash`, `\Junk`, `\Archive`, `\All`, `\Flagged`}
+
 type Mailfolder struct {
 	Name     foldername
 	Excluded bool
+	// Special-use role (one of folderRoles) or empty
+	Role string
 }
 
 func (f Mailfolder) String() string {
@@ -63,3 +68,54 @@ type MailfolderManager interface {
 
 	Close() error
 }
+
+// FolderIdentifier is implemented by the MailfolderManagers whose uids are
+// valid only for a folder instance (like the IMAP UIDVALIDITY)
+type FolderIdentifier interface {
+	FolderID() string
+}
+
+// DownloadedMessageRemover is implemented by the MailfolderManagers that
+// can remove a message from the server once it's safely in the other store
+// (its add committed in the syncstatus)
+type DownloadedMessageRemover interface {
+	RemoveDownloadedMessage(uid uint32) error
+	// DownloadRemoved reports if a message was removed from the server
+	// after the download: it's still in the folder but cannot be read
+	DownloadRemoved(uid uint32) bool
+}
+
+// downloadRemoved reports if a message of fm cannot be read since it was
+// removed from the server after the download
+func downloadRemoved(fm MailfolderManager, uid uint32) bool {
+	r, ok := fm.(DownloadedMessageRemover)
+	return ok && r.DownloadRemoved(uid)
+}
+
+// GlobalMessageIDer is implemented by the MailfolderManagers whose messages
+// have an id shared by all the folders of the store (like the Gmail
+// X-GM-MSGID of a message with multiple labels). It returns an empty id
+// for an unknown message.
+type GlobalMessageIDer interface {
+	GlobalMessageID(uint32) string
+}
+
+// MessageLinker is implemented by the MailfolderManagers that can add a
+// message already in another folder of the store without transferring it
+// again
+type MessageLinker interface {
+	// LinkMessage adds the message with the global id and returns its uid.
+	// It returns false if the store doesn't have the message.
+	LinkMessage(srcuid uint32, flags string, id string) (uint32, bool, error)
+	// SetGlobalMessageID records the global id of a message added to the
+	// folder
+	SetGlobalMessageID(uid uint32, id string) error
+}
+
+// MessageMover is implemented by the MailfolderManagers that can move a
+// message to another folder of the same store without transferring it
+type MessageMover interface {
+	// MoveMessage moves the message to the folder and returns its new uid.
+	// It returns false if the message cannot be moved to the folder.
+	MoveMessage(uid uint32, dst MailfolderManager) (uint32, bool, error)
+}
@@ -23,9 +23,19 @@ import (
 	"strings"
 )
 
+// RegexpPattern matches the folder names with a regexp ("/regexp/") or
+// the folders with a special-use role ("\\Role")
 type RegexpPattern struct {
-	not bool
-	re  *regexp.Regexp
+	not  bool
+	re   *regexp.Regexp
+	role string
+}
+
+func (rp *RegexpPattern) match(f *Mailfolder, separator rune) bool {
+	if rp.role != "" {
+		return f.Role == rp.role
+	}
+	return rp.re.MatchString(FolderToStorePath(f.Name, separator))
 }
 
 func ValidatePattern(pattern string) bool {
@@ -36,8 +46,13 @@ func ValidatePattern(pattern string) bool {
 }
 
 func RegexpFromPattern(pattern string) (rp *RegexpPattern, err error) {
+	role := strings.TrimPrefix(pattern, "!")
+	if StringInSlice(role, folderRoles) {
+		return &RegexpPattern{not: strings.HasPrefix(pattern, "!"), role: role}, nil
+	}
+
 	if !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "!/") {
-		return nil, fmt.Errorf("pattern doesn't starts with \"/\" or \"!/\"")
+		return nil, fmt.Errorf("pattern doesn't starts with \"/\" or \"!/\" and isn't a folder role")
 	}
 
 	if !strings.HasSuffix(pattern, "/") {
@@ -0,0 +1,869 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+var (
+	mboxFromPrefix = []byte("From ")
+
+	// Headers used to save the message state. They are removed from the
+	// messages read from and added to the mbox.
+	mboxStateHeaders = []string{"status", "x-status", "x-uid"}
+
+	// Mapping between the X-Status letters and the message flags. The seen
+	// flag is saved as "R" in the Status header.
+	mboxXStatusFlags = []struct {
+		xstatus byte
+		flag    string
+	}{
+		{'A', "R"},
+		{'F', "F"},
+		{'T', "D"},
+		{'D', "T"},
+	}
+)
+
+// MboxFolder manages a mboxrd file. The message uids are saved in the X-UID
+// header, the next uid to assign is kept in the metadatadir so uids of
+// removed messages aren't reused. Messages without a valid X-UID get a
+// temporary uid like maildir messages without uid.
+//
+// The mbox is locked only while reading or writing it, so deliveries aren't
+// blocked during a sync. Its size and modification time are checked every
+// time it's locked: messages appended by others are added as new messages,
+// other changes make the operation fail. New messages are appended
+// immediately, flags changes, new uids and deletions are written on Close
+// rewriting (and compacting) the mbox.
+type MboxFolder struct {
+	folder      *Mailfolder
+	store       *MboxStore
+	mboxpath    string
+	metadatadir string
+	messages    map[uint32]*MboxMessageInfo
+	// Messages in file order
+	order       []*MboxMessageInfo
+	nextTempUID uint32
+	uidnext     uint32
+	file        *os.File
+	lock        *fileLock
+	// Size and modification time of the mbox after the last operation
+	size    int64
+	modtime time.Time
+	loaded  bool
+	dirty   bool
+	fsync   bool
+	logger  *log.Logger
+	e       *errors.Error
+	dryrun  bool
+}
+
+type MboxMessageInfo struct {
+	MessageInfo
+
+	// Offsets of the message (from line included) in the mbox file
+	Start     int64
+	End       int64
+	Temporary bool
+	Deleted   bool
+	// Flags or uid to write on next rewrite
+	Changed bool
+}
+
+func NewMboxFolder(folder *Mailfolder, mboxpath string, metadatadir string, store *MboxStore, dryrun bool) (m *MboxFolder, err error) {
+	logprefix := fmt.Sprintf("store: %s, mboxfolder: %s", store.Name(), folder)
+	errprefix := logprefix
+	logger := log.GetLogger(logprefix, store.globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	m = &MboxFolder{
+		folder:      folder,
+		store:       store,
+		mboxpath:    mboxpath,
+		metadatadir: metadatadir,
+		messages:    make(map[uint32]*MboxMessageInfo),
+		order:       make([]*MboxMessageInfo, 0),
+		nextTempUID: math.MaxUint32,
+		fsync:       store.config.Fsync,
+		logger:      logger,
+		e:           e,
+		dryrun:      dryrun,
+	}
+
+	return
+}
+
+func (m *MboxFolder) getNextTempUID() uint32 {
+	defer func() { m.nextTempUID -= 1 }()
+	return m.nextTempUID
+}
+
+func (m *MboxFolder) uidnextPath() string {
+	return filepath.Join(m.metadatadir, "uidnext")
+}
+
+func (m *MboxFolder) readUIDNext() (uint32, error) {
+	f, err := os.Open(m.uidnextPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 1, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	uidnext, err := strconv.ParseUint(scanner.Text(), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Wrong uidnext in %s: %s", m.uidnextPath(), err)
+	}
+	return uint32(uidnext), nil
+}
+
+// newUID returns the next uid saving the new uidnext before it's used
+func (m *MboxFolder) newUID() (uint32, error) {
+	uid := m.uidnext
+	if uid >= m.nextTempUID {
+		return 0, fmt.Errorf("Cannot find a free uid")
+	}
+	// The folder metadatadir is missing for mbox files not created by us
+	if err := os.MkdirAll(m.metadatadir, 0777); err != nil {
+		return 0, err
+	}
+	err := writeFileAtomic(m.uidnextPath(), []byte(strconv.FormatUint(uint64(uid+1), 10)), m.fsync)
+	if err != nil {
+		return 0, err
+	}
+	m.uidnext++
+	return uid, nil
+}
+
+func (m *MboxFolder) backupPath() string {
+	return filepath.Join(filepath.Dir(m.mboxpath), "."+filepath.Base(m.mboxpath)+".gomailsync-rewrite")
+}
+
+// lockMbox opens (if needed) and locks the mbox, a write lock also takes
+// the dotlock. If the mbox grew since the last operation the new messages
+// are parsed, if it was changed in other ways an error is returned.
+func (m *MboxFolder) lockMbox(write bool) (err error) {
+	if m.file == nil {
+		flag := os.O_RDWR
+		if m.dryrun {
+			flag = os.O_RDONLY
+		}
+		m.file, err = os.OpenFile(m.mboxpath, flag, 0)
+		if err != nil {
+			return err
+		}
+	}
+	m.lock, err = lockFile(m.file, m.mboxpath, write)
+	if err != nil {
+		return err
+	}
+	if !m.loaded {
+		return nil
+	}
+
+	fi, err := m.file.Stat()
+	if err != nil {
+		m.unlockMbox()
+		return err
+	}
+	switch {
+	case fi.Size() > m.size:
+		m.logger.Debugf("mbox %s grew from %d to %d bytes", m.mboxpath, m.size, fi.Size())
+		err = m.parse(m.size)
+	case fi.Size() < m.size || !fi.ModTime().Equal(m.modtime):
+		err = fmt.Errorf("mbox %s was modified by someone else", m.mboxpath)
+	}
+	if err != nil {
+		m.unlockMbox()
+		return err
+	}
+	return nil
+}
+
+// unlockMbox saves the mbox size and modification time and unlocks it
+func (m *MboxFolder) unlockMbox() (err error) {
+	if fi, serr := m.file.Stat(); serr == nil {
+		m.size = fi.Size()
+		m.modtime = fi.ModTime()
+	} else {
+		err = serr
+	}
+	if uerr := m.lock.Unlock(); err == nil {
+		err = uerr
+	}
+	m.lock = nil
+	return err
+}
+
+func isBlankLine(line []byte) bool {
+	return len(line) == 1 && line[0] == '\n' || len(line) == 2 && line[0] == '\r' && line[1] == '\n'
+}
+
+// parse reads the message offsets and their state headers starting from
+// offset. A new message starts with a "From " line at the beginning of the
+// file or after an empty line.
+func (m *MboxFolder) parse(offset int64) error {
+	if _, err := m.file.Seek(offset, 0); err != nil {
+		return err
+	}
+	r := bufio.NewReader(m.file)
+
+	var cur *MboxMessageInfo
+	var status, xstatus, xuid string
+	var lastheader *string
+	prevblank := true
+	inheaders := false
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if prevblank && bytes.HasPrefix(line, mboxFromPrefix) {
+				if cur != nil {
+					cur.End = offset
+					m.registerMessage(cur, status, xstatus, xuid)
+				}
+				cur = &MboxMessageInfo{Start: offset}
+				status, xstatus, xuid = "", "", ""
+				lastheader = nil
+				inheaders = true
+			} else if cur == nil {
+				return fmt.Errorf("%s is not a mbox file (no \"From \" line at offset %d)", m.mboxpath, offset)
+			} else if inheaders {
+				if isBlankLine(line) {
+					inheaders = false
+				} else if line[0] == ' ' || line[0] == '\t' {
+					// Continuation line
+					if lastheader != nil {
+						*lastheader += strings.TrimSpace(string(line))
+					}
+				} else {
+					lastheader = nil
+					if i := bytes.IndexByte(line, ':'); i > 0 {
+						value := strings.TrimSpace(string(line[i+1:]))
+						switch strings.ToLower(string(line[:i])) {
+						case "status":
+							status = value
+							lastheader = &status
+						case "x-status":
+							xstatus = value
+							lastheader = &xstatus
+						case "x-uid":
+							xuid = value
+							lastheader = &xuid
+						}
+					}
+				}
+			}
+			prevblank = isBlankLine(line)
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cur != nil {
+		cur.End = offset
+		m.registerMessage(cur, status, xstatus, xuid)
+	}
+	return nil
+}
+
+func (m *MboxFolder) registerMessage(message *MboxMessageInfo, status string, xstatus string, xuid string) {
+	message.Flags = mboxHeadersToFlags(status, xstatus)
+
+	uid, err := strconv.ParseUint(xuid, 10, 32)
+	switch {
+	case xuid == "":
+		m.logger.Debugf("Assuming as new message the message at offset %d", message.Start)
+		message.Temporary = true
+	case err != nil || uint32(uid) >= m.uidnext:
+		m.logger.Debugf("Message at offset %d has an unknown X-UID: \"%s\". Assuming as new message", message.Start, xuid)
+		message.Temporary = true
+	case m.HasUID(uint32(uid)):
+		m.logger.Warningf("Message at offset %d has X-UID %d already existent! Assuming as new message", message.Start, uid)
+		message.Temporary = true
+	}
+
+	if message.Temporary {
+		message.UID = m.getNextTempUID()
+	} else {
+		message.UID = uint32(uid)
+	}
+	m.messages[message.UID] = message
+	m.order = append(m.order, message)
+}
+
+func (m *MboxFolder) UpdateMessageList() (err error) {
+	if m.dryrun && !m.store.HasFolder(m.folder.Name) {
+		m.messages = make(map[uint32]*MboxMessageInfo)
+		m.order = make([]*MboxMessageInfo, 0)
+		m.loaded = true
+		return nil
+	}
+
+	// Don't lose the pending changes
+	if m.dirty && !m.dryrun {
+		if err = m.flush(); err != nil {
+			return m.e.E(err)
+		}
+	}
+
+	m.loaded = false
+	if err = m.lockMbox(!m.dryrun); err != nil {
+		return m.e.E(err)
+	}
+	defer func() {
+		if uerr := m.unlockMbox(); err == nil {
+			err = m.e.E(uerr)
+		}
+	}()
+
+	if !m.dryrun {
+		os.Remove(m.backupPath() + ".tmp")
+		if _, err := os.Stat(m.backupPath()); err == nil {
+			m.logger.Errorf("Found an interrupted rewrite of %s. Restoring it from %s", m.mboxpath, m.backupPath())
+			if err = m.copyBack(); err != nil {
+				return m.e.E(err)
+			}
+		}
+	}
+
+	m.uidnext, err = m.readUIDNext()
+	if err != nil {
+		return m.e.E(err)
+	}
+	m.messages = make(map[uint32]*MboxMessageInfo)
+	m.order = make([]*MboxMessageInfo, 0)
+	m.nextTempUID = math.MaxUint32
+	m.dirty = false
+
+	if err = m.parse(0); err != nil {
+		return m.e.E(err)
+	}
+	m.loaded = true
+	return nil
+}
+
+func (m *MboxFolder) HasUID(uid uint32) bool {
+	if _, ok := m.messages[uid]; ok {
+		return true
+	}
+	return false
+}
+
+func (m *MboxFolder) IsIgnored(uid uint32) bool {
+	if m, ok := m.messages[uid]; ok {
+		if m.Ignore {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MboxFolder) GetFlags(uid uint32) (flags string, err error) {
+	if message, ok := m.messages[uid]; ok {
+		return message.Flags, nil
+	}
+
+	err = fmt.Errorf("Cannot find message with uid: %d", uid)
+	return "", m.e.E(err)
+}
+
+func (m *MboxFolder) SetFlags(uid uint32, flags string) (err error) {
+	message, ok := m.messages[uid]
+	if !ok {
+		err = fmt.Errorf("Cannot find message with uid: %d", uid)
+		return m.e.E(err)
+	}
+
+	message.Flags = flags
+	message.Changed = true
+	m.dirty = true
+	return
+}
+
+func (m *MboxFolder) readRaw(message *MboxMessageInfo) ([]byte, error) {
+	raw := make([]byte, message.End-message.Start)
+	if _, err := m.file.ReadAt(raw, message.Start); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (m *MboxFolder) ReadMessage(uid uint32) (body []byte, err error) {
+	message, ok := m.messages[uid]
+	if !ok {
+		err := fmt.Errorf("Cannot find message with uid: %d", uid)
+		return nil, m.e.E(err)
+	}
+
+	if err = m.lockMbox(false); err != nil {
+		return nil, m.e.E(err)
+	}
+	raw, err := m.readRaw(message)
+	if uerr := m.unlockMbox(); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+
+	_, header, text := mboxSplitMessage(raw)
+	// Remove the empty line separating the messages
+	text = bytes.TrimSuffix(text, []byte("\n"))
+	if len(text) > 0 && !bytes.HasSuffix(text, []byte("\n")) {
+		text = append(text, '\n')
+	}
+
+	var buf bytes.Buffer
+	buf.Write(mboxFilterHeaders(header))
+	buf.Write(mboxUnquote(text))
+	return buf.Bytes(), nil
+}
+
+func (m *MboxFolder) AddMessage(srcuid uint32, flags string, body []byte) (uid uint32, err error) {
+	if !m.loaded {
+		if err := m.UpdateMessageList(); err != nil {
+			return 0, err
+		}
+	}
+
+	uid, err = m.newUID()
+	if err != nil {
+		return 0, m.e.E(err)
+	}
+
+	if err = m.lockMbox(true); err != nil {
+		return 0, m.e.E(err)
+	}
+	defer func() {
+		if uerr := m.unlockMbox(); err == nil && uerr != nil {
+			err = m.e.E(uerr)
+		}
+	}()
+
+	size, err := m.file.Seek(0, 2)
+	if err != nil {
+		return 0, m.e.E(err)
+	}
+
+	var buf bytes.Buffer
+	// Keep a blank line between the last message and the new one
+	if size > 0 {
+		tail := make([]byte, 2)
+		if size == 1 {
+			tail = tail[1:]
+		}
+		if _, err = m.file.ReadAt(tail, size-int64(len(tail))); err != nil {
+			return 0, m.e.E(err)
+		}
+		if !bytes.HasSuffix(tail, []byte("\n")) {
+			buf.WriteString("\n\n")
+		} else if !bytes.Equal(tail, []byte("\n\n")) {
+			buf.WriteString("\n")
+		}
+	}
+	start := size + int64(buf.Len())
+	buf.Write(mboxNewMessage(body, flags, uid))
+
+	if _, err = m.file.Write(buf.Bytes()); err != nil {
+		// Remove the partially written message
+		m.file.Truncate(size)
+		return 0, m.e.E(err)
+	}
+	if m.fsync {
+		if err = m.file.Sync(); err != nil {
+			return 0, m.e.E(err)
+		}
+	}
+
+	// The previous message now includes the added blank lines
+	if n := len(m.order); n > 0 && m.order[n-1].End == size {
+		m.order[n-1].End = start
+	}
+	message := &MboxMessageInfo{
+		MessageInfo: MessageInfo{UID: uid, Flags: flags},
+		Start:       start,
+		End:         size + int64(buf.Len()),
+	}
+	m.messages[uid] = message
+	m.order = append(m.order, message)
+
+	return uid, nil
+}
+
+func (m *MboxFolder) DeleteMessage(uid uint32) (err error) {
+	message, ok := m.messages[uid]
+	if !ok {
+		err = fmt.Errorf("Cannot find message with uid: %d", uid)
+		return m.e.E(err)
+	}
+
+	message.Deleted = true
+	m.dirty = true
+	delete(m.messages, uid)
+	return
+}
+
+func (m *MboxFolder) Update(srcuid uint32) (outsrcuid uint32, err error) {
+	outsrcuid = srcuid
+	message, ok := m.messages[srcuid]
+	if !ok {
+		err = fmt.Errorf("Cannot find message with uid: %d", srcuid)
+		return 0, m.e.E(err)
+	}
+
+	// Generate a new uid. Do not use temporary uid.
+	if message.Temporary {
+		outsrcuid, err = m.newUID()
+		if err != nil {
+			return 0, m.e.E(err)
+		}
+		delete(m.messages, srcuid)
+		message.UID = outsrcuid
+		message.Temporary = false
+		message.Changed = true
+		m.messages[outsrcuid] = message
+		m.dirty = true
+	}
+	return
+}
+
+func (m *MboxFolder) GetMessages() map[uint32]*MessageInfo {
+	messages := make(map[uint32]*MessageInfo, 0)
+
+	for _, message := range m.messages {
+		messages[message.UID] = &message.MessageInfo
+	}
+	return messages
+}
+
+func (m *MboxFolder) GetIgnoredMessages() []uint32 {
+	messages := make([]uint32, 0)
+
+	for _, message := range m.messages {
+		if message.Ignore {
+			messages = append(messages, message.UID)
+		}
+	}
+	return messages
+}
+
+// flush locks the mbox and writes the pending changes
+func (m *MboxFolder) flush() (err error) {
+	if err = m.lockMbox(true); err != nil {
+		return err
+	}
+	err = m.rewrite()
+	if uerr := m.unlockMbox(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// rewrite writes the mbox without the deleted messages and with the
+// changed state headers. The new content is first written and synced to a
+// hidden copy and then written over the mbox (the mbox isn't replaced since
+// others may be waiting on its lock). If the copy over is interrupted the
+// mbox will be restored from the copy when opened again.
+func (m *MboxFolder) rewrite() (err error) {
+	tmppath := m.backupPath() + ".tmp"
+	f, err := os.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmppath)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	order := make([]*MboxMessageInfo, 0, len(m.order))
+	offsets := make([][2]int64, 0, len(m.order))
+	var offset int64
+	for _, message := range m.order {
+		if message.Deleted {
+			continue
+		}
+		raw, err := m.readRaw(message)
+		if err != nil {
+			return err
+		}
+		if message.Changed {
+			uid := message.UID
+			if message.Temporary {
+				uid = 0
+			}
+			raw = mboxSetStateHeaders(raw, message.Flags, uid)
+		}
+		if _, err = w.Write(raw); err != nil {
+			return err
+		}
+		order = append(order, message)
+		offsets = append(offsets, [2]int64{offset, offset + int64(len(raw))})
+		offset += int64(len(raw))
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmppath, m.backupPath()); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(tmppath)); err != nil {
+		return err
+	}
+
+	if err = m.copyBack(); err != nil {
+		return err
+	}
+
+	for i, message := range order {
+		message.Start = offsets[i][0]
+		message.End = offsets[i][1]
+		message.Changed = false
+	}
+	m.order = order
+	m.dirty = false
+	return nil
+}
+
+// copyBack writes the content of the rewrite copy over the mbox and
+// removes the copy
+func (m *MboxFolder) copyBack() error {
+	f, err := os.Open(m.backupPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = m.file.Seek(0, 0); err != nil {
+		return err
+	}
+	n, err := io.Copy(m.file, f)
+	if err != nil {
+		return err
+	}
+	if err = m.file.Truncate(n); err != nil {
+		return err
+	}
+	if err = m.file.Sync(); err != nil {
+		return err
+	}
+	if err = os.Remove(m.backupPath()); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(m.mboxpath))
+}
+
+func (m *MboxFolder) Close() (err error) {
+	if m.file == nil {
+		return nil
+	}
+	if m.dirty && !m.dryrun {
+		err = m.flush()
+	}
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	m.file = nil
+	return m.e.E(err)
+}
+
+func mboxHeadersToFlags(status string, xstatus string) string {
+	flags := ""
+	if strings.Contains(status, "R") {
+		flags += "S"
+	}
+	for _, f := range mboxXStatusFlags {
+		if strings.IndexByte(xstatus, f.xstatus) >= 0 {
+			flags += f.flag
+		}
+	}
+	return CleanFlags(flags)
+}
+
+func mboxFlagsToHeaders(flags string) (status string, xstatus string) {
+	status = "O"
+	if strings.Contains(flags, "S") {
+		status = "RO"
+	}
+	for _, f := range mboxXStatusFlags {
+		if strings.Contains(flags, f.flag) {
+			xstatus += string(f.xstatus)
+		}
+	}
+	return
+}
+
+// mboxSplitMessage splits a raw mbox message in its from line, its header
+// (including the final newline) and its body (starting with the empty line
+// after the header)
+func mboxSplitMessage(raw []byte) (fromline []byte, header []byte, body []byte) {
+	if bytes.HasPrefix(raw, mboxFromPrefix) {
+		i := bytes.IndexByte(raw, '\n') + 1
+		if i == 0 {
+			return raw, nil, nil
+		}
+		fromline, raw = raw[:i], raw[i:]
+	}
+	if bytes.HasPrefix(raw, []byte("\n")) {
+		return fromline, nil, raw
+	}
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		return fromline, raw[:i+1], raw[i+1:]
+	}
+	return fromline, raw, nil
+}
+
+// mboxFilterHeaders removes the state headers (with their continuation
+// lines) from header
+func mboxFilterHeaders(header []byte) []byte {
+	var buf bytes.Buffer
+	skip := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			skip = false
+			if i := bytes.IndexByte(line, ':'); i > 0 {
+				skip = StringInSlice(strings.ToLower(string(line[:i])), mboxStateHeaders)
+			}
+		}
+		if !skip {
+			buf.Write(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+// mboxSetStateHeaders replaces the state headers of a raw mbox message. The
+// X-UID header isn't added if uid is 0 (uids start from 1)
+func mboxSetStateHeaders(raw []byte, flags string, uid uint32) []byte {
+	fromline, header, body := mboxSplitMessage(raw)
+	if body == nil {
+		body = []byte("\n")
+	}
+	if len(header) > 0 && !bytes.HasSuffix(header, []byte("\n")) {
+		header = append(header, '\n')
+	}
+
+	status, xstatus := mboxFlagsToHeaders(flags)
+
+	var buf bytes.Buffer
+	buf.Write(fromline)
+	buf.Write(mboxFilterHeaders(header))
+	fmt.Fprintf(&buf, "Status: %s\n", status)
+	if xstatus != "" {
+		fmt.Fprintf(&buf, "X-Status: %s\n", xstatus)
+	}
+	if uid != 0 {
+		fmt.Fprintf(&buf, "X-UID: %d\n", uid)
+	}
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// mboxFromLine returns the from line for a message using the Return-Path
+// header as envelope sender
+func mboxFromLine(header []byte) string {
+	sender := "MAILER-DAEMON"
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		if i := bytes.IndexByte(line, ':'); i > 0 && strings.ToLower(string(line[:i])) == "return-path" {
+			s := strings.Trim(strings.TrimSpace(string(line[i+1:])), "<>")
+			if s != "" && !strings.ContainsAny(s, " \t") {
+				sender = s
+			}
+			break
+		}
+	}
+	return fmt.Sprintf("From %s %s\n", sender, time.Now().Format(time.ANSIC))
+}
+
+// mboxNewMessage converts a message to its mboxrd format: line endings are
+// converted to LF, lines of the body matching /^>*From / are quoted adding
+// another ">" and an empty line is added at the end
+func mboxNewMessage(body []byte, flags string, uid uint32) []byte {
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	_, header, text := mboxSplitMessage(body)
+
+	var buf bytes.Buffer
+	buf.WriteString(mboxFromLine(header))
+	buf.Write(header)
+	buf.Write(mboxQuote(text))
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return mboxSetStateHeaders(buf.Bytes(), flags, uid)
+}
+
+func isMboxFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxFromPrefix)
+}
+
+func mboxQuote(body []byte) []byte {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if isMboxFromLine(line) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
+
+func mboxUnquote(body []byte) []byte {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if len(line) > 0 && line[0] == '>' && isMboxFromLine(line) {
+			line = line[1:]
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
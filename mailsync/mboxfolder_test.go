@@ -0,0 +1,242 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+func newTestMboxStore(t *testing.T) (*config.Config, StoreManager) {
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+	mboxdir := filepath.Join(testdir, "mboxstore1")
+	os.Mkdir(mboxdir, 0777)
+
+	storeconf := &config.StoreConfig{
+		Name:      "store1",
+		StoreType: "mbox",
+		Mboxdir:   mboxdir,
+		Separator: '/',
+		InboxPath: "INBOX",
+		Fsync:     true,
+	}
+
+	globalconfig := &config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{storeconf},
+		LogLevel:    "debug",
+	}
+
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return globalconfig, store
+}
+
+func TestMboxQuoting(t *testing.T) {
+	body := "Subject: test\n\nFrom the start\n>From quoted\nnot From\n>>From twice\n"
+	raw := mboxNewMessage([]byte(body), "S", 1)
+
+	if !strings.Contains(string(raw), "\n>From the start\n>>From quoted\nnot From\n>>>From twice\n") {
+		t.Fatalf("Wrong quoting: %q", raw)
+	}
+	_, header, text := mboxSplitMessage(raw)
+	if string(mboxFilterHeaders(header)) != "Subject: test\n" {
+		t.Fatalf("Wrong headers: %q", header)
+	}
+	if string(mboxUnquote(text)) != "\nFrom the start\n>From quoted\nnot From\n>>From twice\n\n" {
+		t.Fatalf("Wrong unquoting: %q", mboxUnquote(text))
+	}
+}
+
+func TestMboxFolder(t *testing.T) {
+	globalconfig, store := newTestMboxStore(t)
+	mboxdir := store.Config().Mboxdir
+
+	// A mbox written by someone else
+	existing := "From someone@example.com Mon Jan  2 15:04:05 2006\n" +
+		"Subject: one\n" +
+		"Status: RO\n" +
+		"X-Status: AF\n" +
+		"\n" +
+		">From quoted line\n" +
+		"\n" +
+		"From someone@example.com Mon Jan  2 15:04:06 2006\n" +
+		"Subject: two\n" +
+		"\n" +
+		"body two\n"
+	if err := os.MkdirAll(filepath.Join(mboxdir, "dir01"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mboxdir, "dir01", "child01"), []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateFolderList(); err != nil {
+		t.Fatal(err)
+	}
+	name := foldername{"dir01", "child01"}
+	if !store.HasFolder(name) {
+		t.Fatalf("Expected folder %v, found folders: %v", name, store.GetFolders())
+	}
+
+	fm, err := store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	messages := fm.GetMessages()
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, found %d", len(messages))
+	}
+
+	// Assign real uids to the messages and add a new one
+	uids := make(map[string]uint32)
+	for uid := range messages {
+		body, err := fm.ReadMessage(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags, _ := fm.GetFlags(uid)
+		switch string(body) {
+		case "Subject: one\n\nFrom quoted line\n":
+			if flags != "FRS" {
+				t.Fatalf("Expected flags \"FRS\", found \"%s\"", flags)
+			}
+		case "Subject: two\n\nbody two\n":
+			if flags != "" {
+				t.Fatalf("Expected flags \"\", found \"%s\"", flags)
+			}
+		default:
+			t.Fatalf("Wrong message: %q", body)
+		}
+		newuid, err := fm.Update(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids[string(body)] = newuid
+	}
+	added, err := fm.AddMessage(0, "S", []byte("Subject: three\r\n\r\nFrom me\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.SetFlags(uids["Subject: two\n\nbody two\n"], "T"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DeleteMessage(uids["Subject: one\n\nFrom quoted line\n"]); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(mboxdir, "dir01", "child01.lock")); err == nil {
+		t.Fatalf("Dotlock not removed")
+	}
+
+	// Reopen the store and verify the rewritten mbox
+	store, err = newStore(globalconfig, store.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[uint32]struct {
+		flags string
+		body  string
+	}{
+		uids["Subject: two\n\nbody two\n"]: {"T", "Subject: two\n\nbody two\n"},
+		added:                              {"S", "Subject: three\n\nFrom me\n"},
+	}
+	messages = fm.GetMessages()
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, found %d", len(expected), len(messages))
+	}
+	for uid, e := range expected {
+		if !fm.HasUID(uid) {
+			t.Fatalf("Missing message with uid %d", uid)
+		}
+		flags, _ := fm.GetFlags(uid)
+		if flags != e.flags {
+			t.Fatalf("Expected flags \"%s\", found \"%s\"", e.flags, flags)
+		}
+		body, err := fm.ReadMessage(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != e.body {
+			t.Fatalf("Expected message %q, found %q", e.body, body)
+		}
+	}
+}
+
+func TestMboxVerify(t *testing.T) {
+	globalconfig, store := newTestMboxStore(t)
+	mboxconf := store.Config()
+	mboxconf.Name = "store2"
+	memoryconf := &config.StoreConfig{Name: "store1", StoreType: "Memory"}
+	syncgroupconf := &config.SyncgroupConfig{
+		Name:       "syncgroup1",
+		Stores:     []string{"store1", "store2"},
+		Deletemode: "expunge",
+	}
+	globalconfig.Stores = []*config.StoreConfig{memoryconf, mboxconf}
+	globalconfig.Syncgroups = []*config.SyncgroupConfig{syncgroupconf}
+	globalconfig.LogLevel = "error"
+	syncgroup, err := NewSyncgroup(globalconfig, syncgroupconf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend1 := syncgroup.stores[Store1].(*MemoryStore).Backend()
+	backend1.CreateFolder(memoryTestFolder.Name)
+	for _, store := range syncgroup.stores {
+		if err = store.UpdateFolderList(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The mbox store changes the line endings, the state headers and the
+	// final newline of the message
+	backend1.AddMessage(memoryTestFolder.Name, "S", []byte("Message-ID: <1@example.com>\r\nStatus: O\r\n\r\nFrom here\r\nno final newline"))
+	if err = syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	problems, verified, err := syncgroup.VerifyFolder(memoryTestFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 || verified != 2 {
+		t.Fatalf("Wrong verify result: %v, %d verified messages", problems, verified)
+	}
+}
@@ -0,0 +1,636 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/sgotti/gomailsync/config"
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// The memory stores content. Stores with the same metadatadir share the
+// same backend, so the content survives the creation of a new store (like
+// a syncgroup does) inside the same process.
+var (
+	memoryBackends     = make(map[string]*MemoryBackend)
+	memoryBackendsLock sync.Mutex
+)
+
+type memoryMessage struct {
+	flags string
+	body  []byte
+}
+
+type memoryFolder struct {
+	name        foldername
+	uidvalidity uint32
+	uidnext     uint32
+	messages    map[uint32]*memoryMessage
+}
+
+// MemoryBackend keeps the folders of a memory store. Its exported fields
+// inject faults in the store operations.
+type MemoryBackend struct {
+	sync.Mutex
+	folders    map[string]*memoryFolder
+	subscribed map[string]foldername
+
+	addMessageCalls int
+
+	// Fail the Nth (starting from 1) AddMessage call. 0 to disable
+	FailAddMessage int
+	// Accept the flags of AddMessage and SetFlags without saving them
+	DropFlags bool
+}
+
+func getMemoryBackend(key string) *MemoryBackend {
+	memoryBackendsLock.Lock()
+	defer memoryBackendsLock.Unlock()
+	b, ok := memoryBackends[key]
+	if !ok {
+		b = &MemoryBackend{folders: make(map[string]*memoryFolder), subscribed: make(map[string]foldername)}
+		memoryBackends[key] = b
+	}
+	return b
+}
+
+func memoryFolderKey(name foldername) string {
+	return FolderToStorePath(name, 0)
+}
+
+// getFolder must be called with the backend locked
+func (b *MemoryBackend) getFolder(name foldername) (*memoryFolder, error) {
+	f, ok := b.folders[memoryFolderKey(name)]
+	if !ok {
+		return nil, fmt.Errorf("Folder %s doesn't exist", name)
+	}
+	return f, nil
+}
+
+func (b *MemoryBackend) CreateFolder(name foldername) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.folders[memoryFolderKey(name)]; ok {
+		return
+	}
+	b.folders[memoryFolderKey(name)] = &memoryFolder{
+		name:        name,
+		uidvalidity: 1,
+		uidnext:     1,
+		messages:    make(map[uint32]*memoryMessage),
+	}
+}
+
+// Subscribe subscribes or unsubscribes a folder
+func (b *MemoryBackend) Subscribe(name foldername, subscribed bool) {
+	b.Lock()
+	defer b.Unlock()
+	if subscribed {
+		b.subscribed[memoryFolderKey(name)] = name
+	} else {
+		delete(b.subscribed, memoryFolderKey(name))
+	}
+}
+
+// Subscribed returns the subscribed folders sorted by name
+func (b *MemoryBackend) Subscribed() []foldername {
+	b.Lock()
+	defer b.Unlock()
+	keys := make([]string, 0, len(b.subscribed))
+	for key := range b.subscribed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	names := make([]foldername, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, b.subscribed[key])
+	}
+	return names
+}
+
+// AddMessage adds a message to a folder (created if missing) without
+// counting it as an AddMessage call
+func (b *MemoryBackend) AddMessage(name foldername, flags string, body []byte) uint32 {
+	b.CreateFolder(name)
+	b.Lock()
+	defer b.Unlock()
+	f, _ := b.getFolder(name)
+	uid := f.uidnext
+	f.uidnext++
+	f.messages[uid] = &memoryMessage{flags: flags, body: body}
+	return uid
+}
+
+func (b *MemoryBackend) SetFlags(name foldername, uid uint32, flags string) error {
+	b.Lock()
+	defer b.Unlock()
+	f, err := b.getFolder(name)
+	if err != nil {
+		return err
+	}
+	message, ok := f.messages[uid]
+	if !ok {
+		return fmt.Errorf("Cannot find message with uid: %d", uid)
+	}
+	message.flags = flags
+	return nil
+}
+
+func (b *MemoryBackend) DeleteMessage(name foldername, uid uint32) error {
+	b.Lock()
+	defer b.Unlock()
+	f, err := b.getFolder(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.messages[uid]; !ok {
+		return fmt.Errorf("Cannot find message with uid: %d", uid)
+	}
+	delete(f.messages, uid)
+	return nil
+}
+
+// MoveMessage moves a message to another folder (created if missing) and
+// returns its new uid
+func (b *MemoryBackend) MoveMessage(name foldername, uid uint32, dstname foldername) (uint32, error) {
+	b.CreateFolder(dstname)
+	b.Lock()
+	defer b.Unlock()
+	f, err := b.getFolder(name)
+	if err != nil {
+		return 0, err
+	}
+	message, ok := f.messages[uid]
+	if !ok {
+		return 0, fmt.Errorf("Cannot find message with uid: %d", uid)
+	}
+	dst, _ := b.getFolder(dstname)
+	newuid := dst.uidnext
+	dst.uidnext++
+	dst.messages[newuid] = message
+	delete(f.messages, uid)
+	return newuid, nil
+}
+
+// Messages returns the flags of the folder messages by uid
+func (b *MemoryBackend) Messages(name foldername) map[uint32]string {
+	b.Lock()
+	defer b.Unlock()
+	messages := make(map[uint32]string)
+	f, err := b.getFolder(name)
+	if err != nil {
+		return messages
+	}
+	for uid, message := range f.messages {
+		messages[uid] = message.flags
+	}
+	return messages
+}
+
+// Bodies returns the sorted bodies of the folder messages
+func (b *MemoryBackend) Bodies(name foldername) []string {
+	b.Lock()
+	defer b.Unlock()
+	bodies := make([]string, 0)
+	f, err := b.getFolder(name)
+	if err != nil {
+		return bodies
+	}
+	for _, message := range f.messages {
+		bodies = append(bodies, string(message.body))
+	}
+	sort.Strings(bodies)
+	return bodies
+}
+
+// ChangeUIDValidity changes the folder uidvalidity giving new uids to all
+// its messages (like an IMAP server rebuilding its index)
+func (b *MemoryBackend) ChangeUIDValidity(name foldername) error {
+	b.Lock()
+	defer b.Unlock()
+	f, err := b.getFolder(name)
+	if err != nil {
+		return err
+	}
+	uids := make([]uint32, 0, len(f.messages))
+	for uid := range f.messages {
+		uids = append(uids, uid)
+	}
+	sort.Sort(Uint32Slice(uids))
+
+	messages := make(map[uint32]*memoryMessage, len(f.messages))
+	f.uidnext = 1
+	for _, uid := range uids {
+		messages[f.uidnext] = f.messages[uid]
+		f.uidnext++
+	}
+	f.messages = messages
+	f.uidvalidity++
+	return nil
+}
+
+// MemoryStore is a store keeping its messages in memory. Mainly useful for
+// tests (see MemoryBackend for the fault injection).
+type MemoryStore struct {
+	globalconfig *config.Config
+	config       *config.StoreConfig
+	name         string
+	metadatadir  string
+	backend      *MemoryBackend
+	folders      []*Mailfolder
+	logger       *log.Logger
+	e            *errors.Error
+	dryrun       bool
+}
+
+func NewMemoryStore(globalconfig *config.Config, config *config.StoreConfig, basemetadatadir string, dryrun bool) (m *MemoryStore, err error) {
+	name := config.Name
+	logprefix := fmt.Sprintf("memorystore: %s", name)
+	errprefix := fmt.Sprintf("memorystore: %s", name)
+	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	metadatadir := filepath.Join(basemetadatadir, name)
+
+	if !dryrun {
+		err = os.MkdirAll(metadatadir, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m = &MemoryStore{
+		globalconfig: globalconfig,
+		config:       config,
+		name:         name,
+		metadatadir:  metadatadir,
+		backend:      getMemoryBackend(metadatadir),
+		folders:      make([]*Mailfolder, 0),
+		logger:       logger,
+		e:            e,
+		dryrun:       dryrun,
+	}
+
+	err = m.UpdateFolderList()
+	return
+}
+
+// Backend returns the store content
+func (m *MemoryStore) Backend() *MemoryBackend {
+	return m.backend
+}
+
+func (m *MemoryStore) CreateFolder(name foldername) (err error) {
+	m.backend.CreateFolder(name)
+
+	err = os.MkdirAll(filepath.Join(m.metadatadir, folderMetadataPath(name)), 0777)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	// Add folder to the list
+	m.folders = append(m.folders, &Mailfolder{Name: name, Excluded: false})
+	return nil
+}
+
+func (m *MemoryStore) SetFolderExcluded(name foldername, excluded bool) error {
+	if f := m.getFolder(name); f != nil {
+		f.Excluded = excluded
+		return nil
+	}
+	return m.e.E(fmt.Errorf("Folder %s, doesn't exists", name))
+}
+
+func (m *MemoryStore) getFolder(name foldername) *Mailfolder {
+	for _, f := range m.folders {
+		if StrsEquals(name, f.Name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) HasFolder(name foldername) bool {
+	if f := m.getFolder(name); f != nil {
+		return true
+	}
+	return false
+}
+
+func (m *MemoryStore) UpdateFolderList() error {
+	m.backend.Lock()
+	keys := make([]string, 0, len(m.backend.folders))
+	for key := range m.backend.folders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	m.folders = make([]*Mailfolder, 0, len(keys))
+	for _, key := range keys {
+		m.folders = append(m.folders, &Mailfolder{Name: m.backend.folders[key].name, Excluded: false})
+	}
+	m.backend.Unlock()
+
+	if m.config.Subscribedonly {
+		applySubscriptions(m, m.folders, m.backend.Subscribed())
+	}
+
+	err := applyRegExpPatterns(m, m.folders)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) SubscribedFolders() ([]foldername, error) {
+	return m.backend.Subscribed(), nil
+}
+
+func (m *MemoryStore) SetFolderSubscribed(name foldername, subscribed bool) error {
+	if !m.dryrun {
+		m.backend.Subscribe(name, subscribed)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Separator() (rune, error) {
+	return '/', nil
+}
+
+func (m *MemoryStore) GetFolders() []Mailfolder {
+	folders := make([]Mailfolder, len(m.folders))
+	for i, f := range m.folders {
+		folders[i] = *f
+	}
+	return folders
+}
+
+// checkUIDValidity verifies the folder uidvalidity like the IMAP store does
+func (m *MemoryStore) checkUIDValidity(name foldername) (uint32, error) {
+	m.backend.Lock()
+	f, err := m.backend.getFolder(name)
+	if err != nil {
+		m.backend.Unlock()
+		return 0, err
+	}
+	uidvalidity := f.uidvalidity
+	m.backend.Unlock()
+
+	uidvaliditypath := filepath.Join(m.metadatadir, folderMetadataPath(name), "uidvalidity")
+	file, err := os.Open(uidvaliditypath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+		if m.dryrun {
+			return uidvalidity, nil
+		}
+		return uidvalidity, writeFileAtomic(uidvaliditypath, []byte(strconv.FormatUint(uint64(uidvalidity), 10)), m.config.Fsync)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+	mduidvalidity, err := strconv.ParseUint(scanner.Text(), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Wrong uidvalidity %s. Something strange happened", scanner.Text())
+	}
+	if uint32(mduidvalidity) != uidvalidity {
+		return 0, fmt.Errorf("Folder uidvalidity %d doesn't match saved uidvalidity %d", uidvalidity, mduidvalidity)
+	}
+	return uidvalidity, nil
+}
+
+func (m *MemoryStore) GetMailfolderManager(name foldername) (manager MailfolderManager, err error) {
+	if !m.HasFolder(name) && !m.dryrun {
+		err = m.CreateFolder(name)
+		if err != nil {
+			return nil, m.e.E(err)
+		}
+	}
+
+	folder := m.getFolder(name)
+	if folder == nil {
+		return nil, m.e.E(fmt.Errorf("Cannot get folder %s", name))
+	}
+
+	if !m.dryrun {
+		err = os.MkdirAll(filepath.Join(m.metadatadir, folderMetadataPath(name)), 0777)
+		if err != nil {
+			return nil, m.e.E(err)
+		}
+	}
+	uidvalidity, err := m.checkUIDValidity(name)
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+
+	manager, err = NewMemoryFolder(folder, m, uidvalidity, m.dryrun)
+
+	return
+}
+
+func (m *MemoryStore) Name() string {
+	return m.name
+}
+
+func (m *MemoryStore) Config() *config.StoreConfig {
+	return m.config
+}
+
+type MemoryFolder struct {
+	folder      *Mailfolder
+	store       *MemoryStore
+	backend     *MemoryBackend
+	uidvalidity uint32
+	messages    map[uint32]*MessageInfo
+	logger      *log.Logger
+	e           *errors.Error
+	dryrun      bool
+}
+
+func NewMemoryFolder(folder *Mailfolder, store *MemoryStore, uidvalidity uint32, dryrun bool) (m *MemoryFolder, err error) {
+	logprefix := fmt.Sprintf("store: %s, memoryfolder: %s", store.Name(), folder)
+	errprefix := fmt.Sprintf("store: %s, memoryfolder: %s", store.Name(), folder)
+	logger := log.GetLogger(logprefix, store.globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	m = &MemoryFolder{
+		folder:      folder,
+		store:       store,
+		backend:     store.backend,
+		uidvalidity: uidvalidity,
+		messages:    make(map[uint32]*MessageInfo),
+		logger:      logger,
+		e:           e,
+		dryrun:      dryrun,
+	}
+	return m, nil
+}
+
+func (m *MemoryFolder) UpdateMessageList() error {
+	m.messages = make(map[uint32]*MessageInfo)
+	for uid, flags := range m.backend.Messages(m.folder.Name) {
+		m.messages[uid] = &MessageInfo{uid, flags, false}
+	}
+	return nil
+}
+
+func (m *MemoryFolder) HasUID(uid uint32) bool {
+	if _, ok := m.messages[uid]; ok {
+		return true
+	}
+	return false
+}
+
+func (m *MemoryFolder) IsIgnored(uid uint32) bool {
+	if m, ok := m.messages[uid]; ok {
+		if m.Ignore {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryFolder) GetFlags(uid uint32) (flags string, err error) {
+	if message, ok := m.messages[uid]; ok {
+		return message.Flags, nil
+	}
+
+	err = fmt.Errorf("Cannot find message with uid: %d", uid)
+	return "", m.e.E(err)
+}
+
+func (m *MemoryFolder) SetFlags(uid uint32, flags string) (err error) {
+	message, ok := m.messages[uid]
+	if !ok {
+		err = fmt.Errorf("Cannot find message with uid: %d", uid)
+		return m.e.E(err)
+	}
+	m.backend.Lock()
+	dropflags := m.backend.DropFlags
+	m.backend.Unlock()
+	if !dropflags {
+		if err = m.backend.SetFlags(m.folder.Name, uid, flags); err != nil {
+			return m.e.E(err)
+		}
+	}
+	message.Flags = flags
+	return nil
+}
+
+func (m *MemoryFolder) ReadMessage(uid uint32) ([]byte, error) {
+	m.backend.Lock()
+	defer m.backend.Unlock()
+	f, err := m.backend.getFolder(m.folder.Name)
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	message, ok := f.messages[uid]
+	if !ok {
+		return nil, m.e.E(fmt.Errorf("Cannot find message with uid: %d", uid))
+	}
+	return append([]byte{}, message.body...), nil
+}
+
+func (m *MemoryFolder) AddMessage(srcuid uint32, flags string, body []byte) (uint32, error) {
+	m.backend.Lock()
+	m.backend.addMessageCalls++
+	fail := m.backend.FailAddMessage != 0 && m.backend.addMessageCalls == m.backend.FailAddMessage
+	dropflags := m.backend.DropFlags
+	m.backend.Unlock()
+	if fail {
+		return 0, m.e.E(fmt.Errorf("Injected AddMessage failure"))
+	}
+
+	storedflags := flags
+	if dropflags {
+		storedflags = ""
+	}
+	uid := m.backend.AddMessage(m.folder.Name, storedflags, append([]byte{}, body...))
+	m.messages[uid] = &MessageInfo{uid, flags, false}
+	return uid, nil
+}
+
+func (m *MemoryFolder) DeleteMessage(uid uint32) error {
+	if !m.HasUID(uid) {
+		return m.e.E(fmt.Errorf("Cannot find message with uid: %d", uid))
+	}
+	if err := m.backend.DeleteMessage(m.folder.Name, uid); err != nil {
+		return m.e.E(err)
+	}
+	delete(m.messages, uid)
+	return nil
+}
+
+func (m *MemoryFolder) MoveMessage(uid uint32, dst MailfolderManager) (uint32, bool, error) {
+	dstfolder, ok := dst.(*MemoryFolder)
+	if !ok || dstfolder.backend != m.backend {
+		return 0, false, nil
+	}
+	message, ok := m.messages[uid]
+	if !ok {
+		return 0, false, m.e.E(fmt.Errorf("Cannot find message with uid: %d", uid))
+	}
+	newuid, err := m.backend.MoveMessage(m.folder.Name, uid, dstfolder.folder.Name)
+	if err != nil {
+		return 0, false, m.e.E(err)
+	}
+	delete(m.messages, uid)
+	dstfolder.messages[newuid] = &MessageInfo{newuid, message.Flags, false}
+	return newuid, true, nil
+}
+
+func (m *MemoryFolder) Update(srcuid uint32) (uint32, error) {
+	return srcuid, nil
+}
+
+func (m *MemoryFolder) GetMessages() map[uint32]*MessageInfo {
+	messages := make(map[uint32]*MessageInfo, len(m.messages))
+	for uid, message := range m.messages {
+		messages[uid] = message
+	}
+	return messages
+}
+
+func (m *MemoryFolder) GetIgnoredMessages() []uint32 {
+	messages := make([]uint32, 0)
+
+	for _, message := range m.messages {
+		if message.Ignore {
+			messages = append(messages, message.UID)
+		}
+	}
+	return messages
+}
+
+// FolderID returns the folder uidvalidity
+func (m *MemoryFolder) FolderID() string {
+	return strconv.FormatUint(uint64(m.uidvalidity), 10)
+}
+
+func (m *MemoryFolder) Close() (err error) {
+	return
+}
@@ -0,0 +1,485 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+var memoryTestFolder = Mailfolder{Name: foldername{"INBOX"}}
+
+func newTestMemorySyncgroup(t *testing.T, deletemode string) (*Syncgroup, *MemoryBackend, *MemoryBackend) {
+	testdir, err := ioutil.TempDir("", "gomailsync-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	store1conf := &config.StoreConfig{Name: "store1", StoreType: "Memory"}
+	store2conf := &config.StoreConfig{Name: "store2", StoreType: "Memory"}
+	syncgroupconf := &config.SyncgroupConfig{
+		Name:       "syncgroup1",
+		Stores:     []string{"store1", "store2"},
+		Deletemode: deletemode,
+	}
+	globalconfig := &config.Config{
+		Metadatadir: metadatadir,
+		Syncgroups:  []*config.SyncgroupConfig{syncgroupconf},
+		Stores:      []*config.StoreConfig{store1conf, store2conf},
+		LogLevel:    "error",
+	}
+
+	syncgroup, err := NewSyncgroup(globalconfig, syncgroupconf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend1 := syncgroup.stores[0].(*MemoryStore).Backend()
+	backend2 := syncgroup.stores[1].(*MemoryStore).Backend()
+	backend1.CreateFolder(memoryTestFolder.Name)
+	backend2.CreateFolder(memoryTestFolder.Name)
+	for _, store := range syncgroup.stores {
+		if err = store.UpdateFolderList(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return syncgroup, backend1, backend2
+}
+
+// memoryFolderContent returns the flags of the folder messages by body
+func memoryFolderContent(t *testing.T, backend *MemoryBackend) map[string]string {
+	content := make(map[string]string)
+	messages := backend.Messages(memoryTestFolder.Name)
+	backend.Lock()
+	defer backend.Unlock()
+	f, err := backend.getFolder(memoryTestFolder.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uid, flags := range messages {
+		body := string(f.messages[uid].body)
+		if _, ok := content[body]; ok {
+			t.Fatalf("Duplicated message %q", body)
+		}
+		content[body] = flags
+	}
+	return content
+}
+
+func memoryMessageBody(backend *MemoryBackend, uid uint32) string {
+	backend.Lock()
+	defer backend.Unlock()
+	f, _ := backend.getFolder(memoryTestFolder.Name)
+	if message, ok := f.messages[uid]; ok {
+		return string(message.body)
+	}
+	return ""
+}
+
+func verifyMemorySync(t *testing.T, backend1 *MemoryBackend, backend2 *MemoryBackend) {
+	content1 := memoryFolderContent(t, backend1)
+	content2 := memoryFolderContent(t, backend2)
+	if !reflect.DeepEqual(content1, content2) {
+		t.Fatalf("Stores not in sync. store1: %v, store2: %v", content1, content2)
+	}
+}
+
+func TestMemorySyncRandom(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	r := rand.New(rand.NewSource(1))
+	allflags := []string{"", "S", "SR", "F", "DS", "FRS"}
+
+	n := 0
+	for round := 0; round < 50; round++ {
+		// A message deleted from both stores in the same round makes the
+		// sync fail, so every message is changed only in one store
+		touched := make(map[string]bool)
+		for _, backend := range []*MemoryBackend{backend1, backend2} {
+			for op := 0; op < 5; op++ {
+				uids := make([]uint32, 0)
+				for uid := range backend.Messages(memoryTestFolder.Name) {
+					if !touched[memoryMessageBody(backend, uid)] {
+						uids = append(uids, uid)
+					}
+				}
+				sort.Sort(Uint32Slice(uids))
+				switch r.Intn(3) {
+				case 0:
+					n++
+					body := []byte(fmt.Sprintf("Subject: %d\r\n\r\n", n))
+					backend.AddMessage(memoryTestFolder.Name, allflags[r.Intn(len(allflags))], body)
+				case 1:
+					if len(uids) > 0 {
+						uid := uids[r.Intn(len(uids))]
+						touched[memoryMessageBody(backend, uid)] = true
+						backend.DeleteMessage(memoryTestFolder.Name, uid)
+					}
+				case 2:
+					if len(uids) > 0 {
+						uid := uids[r.Intn(len(uids))]
+						touched[memoryMessageBody(backend, uid)] = true
+						backend.SetFlags(memoryTestFolder.Name, uid, allflags[r.Intn(len(allflags))])
+					}
+				}
+			}
+		}
+
+		if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+			t.Fatal(err)
+		}
+		verifyMemorySync(t, backend1, backend2)
+	}
+}
+
+func TestMemoryFailAddMessage(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	for i := 0; i < 3; i++ {
+		backend1.AddMessage(memoryTestFolder.Name, "S", []byte(fmt.Sprintf("Subject: %d\r\n\r\n", i)))
+	}
+
+	backend2.FailAddMessage = 2
+	if err := syncgroup.SyncFolder(memoryTestFolder); err == nil {
+		t.Fatal("Expected an AddMessage error")
+	}
+	if len(backend2.Messages(memoryTestFolder.Name)) != 1 {
+		t.Fatalf("Expected 1 message, found: %v", backend2.Messages(memoryTestFolder.Name))
+	}
+
+	// The next sync adds only the missing messages
+	backend2.FailAddMessage = 0
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+}
+
+func TestMemoryDropFlags(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	uid := backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 1\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	backend2.DropFlags = true
+	backend1.SetFlags(memoryTestFolder.Name, uid, "FS")
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range backend2.Messages(memoryTestFolder.Name) {
+		if flags != "" {
+			t.Fatalf("Expected dropped flags, found: %q", flags)
+		}
+	}
+
+	// The dropped flags are seen as a change of store2
+	backend2.DropFlags = false
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+}
+
+func TestMemoryChangeUIDValidity(t *testing.T) {
+	syncgroup, backend1, _ := newTestMemorySyncgroup(t, "expunge")
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 1\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend1.ChangeUIDValidity(memoryTestFolder.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncgroup.SyncFolder(memoryTestFolder); err == nil {
+		t.Fatal("Expected an uidvalidity error")
+	}
+}
+
+func TestMemorySyncOps(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	// One way backup from store1 to store2
+	syncgroup.ops[Store2] = newSyncOps([]string{"none"})
+	uid1 := backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 1\r\n\r\n"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 2\r\n\r\n"))
+	backend2.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 3\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend1.Messages(memoryTestFolder.Name)) != 2 || len(backend2.Messages(memoryTestFolder.Name)) != 3 {
+		t.Fatalf("Wrong messages. store1: %v, store2: %v", backend1.Messages(memoryTestFolder.Name), backend2.Messages(memoryTestFolder.Name))
+	}
+
+	// The store2 deletions and flags aren't propagated
+	for uid := range backend2.Messages(memoryTestFolder.Name) {
+		if memoryMessageBody(backend2, uid) == "Subject: 1\r\n\r\n" {
+			backend2.DeleteMessage(memoryTestFolder.Name, uid)
+		} else {
+			backend2.SetFlags(memoryTestFolder.Name, uid, "F")
+		}
+	}
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	content := memoryFolderContent(t, backend1)
+	if len(content) != 2 || content["Subject: 1\r\n\r\n"] != "" || content["Subject: 2\r\n\r\n"] != "" {
+		t.Fatalf("Wrong store1 content: %v", content)
+	}
+
+	// Flags but not deletions from store1
+	syncgroup.ops[Store1] = newSyncOps([]string{"flags"})
+	backend1.SetFlags(memoryTestFolder.Name, uid1, "S")
+	for uid := range backend1.Messages(memoryTestFolder.Name) {
+		if uid != uid1 {
+			backend1.DeleteMessage(memoryTestFolder.Name, uid)
+		}
+	}
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	content = memoryFolderContent(t, backend2)
+	if len(content) != 2 || content["Subject: 2\r\n\r\n"] != "F" {
+		t.Fatalf("Wrong store2 content: %v", content)
+	}
+
+	// A message deleted from store1 while its deletions weren't
+	// propagated and then deleted from store2 is removed from the
+	// syncstatus
+	syncgroup.ops[Store2] = newSyncOps([]string{"delete"})
+	for uid := range backend2.Messages(memoryTestFolder.Name) {
+		if memoryMessageBody(backend2, uid) == "Subject: 2\r\n\r\n" {
+			backend2.DeleteMessage(memoryTestFolder.Name, uid)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := readSyncstatus(syncgroup.config, syncgroup.metadatadir, memoryTestFolder.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 || len(backend1.Messages(memoryTestFolder.Name)) != 0 {
+		t.Fatalf("Wrong syncstatus entries: %v, store1 messages: %v", entries, backend1.Messages(memoryTestFolder.Name))
+	}
+
+	// Folder creation disabled
+	syncgroup.ops[Store1] = newSyncOps([]string{"new"})
+	backend1.AddMessage(foldername{"work"}, "", []byte("Subject: 4\r\n\r\n"))
+	syncgroup.stores[0].UpdateFolderList()
+	if err := syncgroup.SyncFolder(Mailfolder{Name: foldername{"work"}}); err != nil {
+		t.Fatal(err)
+	}
+	syncgroup.stores[1].UpdateFolderList()
+	if syncgroup.stores[1].HasFolder(foldername{"work"}) {
+		t.Fatalf("Folder created with folder creation disabled")
+	}
+}
+
+func TestMemorySyncSubscriptions(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	syncgroup.stores[1].Config().Subscribedonly = true
+	backend1.AddMessage(foldername{"work"}, "", []byte("Subject: 1\r\n\r\n"))
+	backend1.Subscribe(foldername{"work"}, true)
+	backend2.Subscribe(foldername{"later"}, true)
+	for _, store := range syncgroup.stores {
+		store.UpdateFolderList()
+	}
+
+	checkSubscribed := func(backend *MemoryBackend, expected []foldername) {
+		if subscribed := backend.Subscribed(); !reflect.DeepEqual(subscribed, expected) {
+			t.Fatalf("Expected subscribed folders %v, found %v", expected, subscribed)
+		}
+	}
+
+	// A dry run only prints the changes
+	dryrunsyncgroup, buf := newTestDryrunSyncgroup(t, syncgroup)
+	if err := dryrunsyncgroup.syncSubscriptions(); err != nil {
+		t.Fatal(err)
+	}
+	checkPlan(t, buf, []string{
+		"syncgroup1: store1: later: subscribe folder",
+		"syncgroup1: store2: work: subscribe folder",
+	})
+	checkSubscribed(backend2, []foldername{{"later"}})
+
+	if err := syncgroup.syncSubscriptions(); err != nil {
+		t.Fatal(err)
+	}
+	checkSubscribed(backend1, []foldername{{"later"}, {"work"}})
+	checkSubscribed(backend2, []foldername{{"later"}, {"work"}})
+	for _, f := range syncgroup.stores[1].GetFolders() {
+		if f.Excluded {
+			t.Fatalf("Subscribed folder %s excluded", f)
+		}
+	}
+
+	// Unsubscriptions
+	backend2.Subscribe(foldername{"work"}, false)
+	if err := syncgroup.syncSubscriptions(); err != nil {
+		t.Fatal(err)
+	}
+	checkSubscribed(backend1, []foldername{{"later"}})
+	checkSubscribed(backend2, []foldername{{"later"}})
+}
+
+func TestMemorySyncMoves(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	archive := Mailfolder{Name: foldername{"Archive"}}
+	backend1.AddMessage(memoryTestFolder.Name, "S", []byte("Message-ID: <1@example.com>\r\n\r\n1"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Message-ID: <2@example.com>\r\n\r\n2"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 3\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move two messages to a new folder, the one without Message-ID is
+	// transferred again
+	for uid := uint32(1); uid <= 3; uid++ {
+		if _, err := backend1.MoveMessage(memoryTestFolder.Name, uid, archive.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, store := range syncgroup.stores {
+		store.UpdateFolderList()
+	}
+	folders := []Mailfolder{archive, memoryTestFolder}
+
+	// A dry run prints the moves and ignores the moved messages
+	dryrunsyncgroup, buf := newTestDryrunSyncgroup(t, syncgroup)
+	if err := dryrunsyncgroup.syncMoves(folders); err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range folders {
+		if err := dryrunsyncgroup.SyncFolder(folder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkPlan(t, buf, []string{
+		"syncgroup1: store2: Archive: create folder",
+		"syncgroup1: store2: INBOX: move message with uid 1 to folder Archive",
+		"syncgroup1: store2: INBOX: move message with uid 2 to folder Archive",
+		`syncgroup1: store2: Archive: add message with srcuid 3 (14 bytes) and flags ""`,
+		`syncgroup1: store2: INBOX: delete message with uid 3 and flags ""`,
+	})
+
+	backend2.Lock()
+	addcalls := backend2.addMessageCalls
+	backend2.Unlock()
+	if err := syncgroup.syncMoves(folders); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend2.Messages(memoryTestFolder.Name)) != 1 || len(backend2.Messages(archive.Name)) != 2 {
+		t.Fatalf("Messages not moved. INBOX: %v, Archive: %v", backend2.Messages(memoryTestFolder.Name), backend2.Messages(archive.Name))
+	}
+
+	// The flags changed after the move are synced
+	for uid := range backend1.Messages(archive.Name) {
+		backend1.SetFlags(archive.Name, uid, "F")
+	}
+	for _, folder := range folders {
+		if err := syncgroup.SyncFolder(folder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend2.Lock()
+	addcalls = backend2.addMessageCalls - addcalls
+	backend2.Unlock()
+	if addcalls != 1 {
+		t.Fatalf("Expected 1 transferred message, found %d", addcalls)
+	}
+	if len(backend2.Messages(memoryTestFolder.Name)) != 0 {
+		t.Fatalf("Wrong INBOX messages: %v", backend2.Messages(memoryTestFolder.Name))
+	}
+	if bodies := backend2.Bodies(archive.Name); !reflect.DeepEqual(bodies, backend1.Bodies(archive.Name)) {
+		t.Fatalf("Wrong Archive messages: %q", bodies)
+	}
+	for uid, flags := range backend2.Messages(archive.Name) {
+		if flags != "F" {
+			t.Fatalf("Wrong flags of message with uid %d: %q", uid, flags)
+		}
+	}
+}
+
+func TestMemoryVerify(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Message-ID: <1@example.com>\r\n\r\n1"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Message-ID: <2@example.com>\r\n\r\n2"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 3\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readSyncstatus(syncgroup.config, syncgroup.metadatadir, memoryTestFolder.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.hash == "" || entry.size == 0 || entry.synctime == 0 {
+			t.Fatalf("Message identity not recorded: %#v", entry)
+		}
+	}
+
+	problems, verified, err := syncgroup.VerifyFolder(memoryTestFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 || verified != 6 {
+		t.Fatalf("Wrong verify result: %d problems, %d verified messages", len(problems), verified)
+	}
+
+	// Change the messages of store2 behind the syncstatus
+	backend2.Lock()
+	f, _ := backend2.getFolder(memoryTestFolder.Name)
+	for _, message := range f.messages {
+		switch string(message.body) {
+		case "Message-ID: <1@example.com>\r\n\r\n1":
+			message.body = []byte("Message-ID: <4@example.com>\r\n\r\n4")
+		case "Message-ID: <2@example.com>\r\n\r\n2":
+			message.body = []byte("Message-ID: <2@example.com>\r\n\r\n2 changed")
+		}
+	}
+	backend2.Unlock()
+
+	problems, verified, err = syncgroup.VerifyFolder(memoryTestFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 || verified != 6 {
+		t.Fatalf("Wrong verify result: %d problems, %d verified messages", len(problems), verified)
+	}
+	kinds := make(map[string]bool)
+	for _, problem := range problems {
+		if problem.Store != "store2" || !StrsEquals(problem.Folder, memoryTestFolder.Name) {
+			t.Fatalf("Wrong problem: %#v", problem)
+		}
+		kinds[strings.SplitN(problem.Problem, ":", 2)[0]] = true
+	}
+	if !kinds["uid reused by another message"] || !kinds["message changed"] {
+		t.Fatalf("Wrong problems: %s, %s", problems[0].Problem, problems[1].Problem)
+	}
+}
@@ -0,0 +1,187 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"sort"
+)
+
+type syncstatusEntry struct {
+	uids  [2]uint32
+	flags string
+	// Empty if unknown
+	messageIdentity
+}
+
+// memorySyncstatus is an in memory Syncstatus. It's used by the dry run and
+// to plan the sync on a copy of the real one.
+type memorySyncstatus struct {
+	entries  []syncstatusEntry
+	saved    []syncstatusEntry
+	srcstore Storenumber
+}
+
+func newMemorySyncstatus(entries []syncstatusEntry) *memorySyncstatus {
+	return &memorySyncstatus{entries: entries}
+}
+
+// getEntries returns a copy of the syncstatus entries
+func (u *memorySyncstatus) getEntries() ([]syncstatusEntry, error) {
+	return append([]syncstatusEntry{}, u.entries...), nil
+}
+
+func (u *memorySyncstatus) SetSrcstore(store Storenumber) {
+	u.srcstore = store
+}
+
+func (u *memorySyncstatus) src() int {
+	return int(u.srcstore)
+}
+
+func (u *memorySyncstatus) dst() int {
+	return 1 - int(u.srcstore)
+}
+
+func (u *memorySyncstatus) GetSrcstoreCol() (string, error) {
+	return fmt.Sprintf("uidstore%d", u.src()+1), nil
+}
+
+func (u *memorySyncstatus) GetDststoreCol() (string, error) {
+	return fmt.Sprintf("uidstore%d", u.dst()+1), nil
+}
+
+func (u *memorySyncstatus) GetDststoreUID(srcuid uint32) (dstuid uint32, err error) {
+	for _, entry := range u.entries {
+		if entry.uids[u.src()] == srcuid {
+			return entry.uids[u.dst()], nil
+		}
+	}
+	return 0, nil
+}
+
+func (u *memorySyncstatus) HasUID(uid uint32) (bool, error) {
+	for _, entry := range u.entries {
+		if entry.uids[u.src()] == uid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (u *memorySyncstatus) UpdateSyncstatus() error {
+	return nil
+}
+
+func (u *memorySyncstatus) BeginTx() (err error) {
+	u.saved = append([]syncstatusEntry{}, u.entries...)
+	return
+}
+
+func (u *memorySyncstatus) Commit() (err error) {
+	u.saved = nil
+	return
+}
+
+func (u *memorySyncstatus) Rollback() (err error) {
+	u.entries = u.saved
+	u.saved = nil
+	return
+}
+
+func (u *memorySyncstatus) Update(srcuid uint32, dstuid uint32, flags string) (err error) {
+	for i, entry := range u.entries {
+		if entry.uids[u.src()] == srcuid && entry.uids[u.dst()] == dstuid {
+			u.entries[i].flags = flags
+			return
+		}
+	}
+	var entry syncstatusEntry
+	entry.uids[u.src()] = srcuid
+	entry.uids[u.dst()] = dstuid
+	entry.flags = flags
+	u.entries = append(u.entries, entry)
+	return
+}
+
+func (u *memorySyncstatus) Delete(uid uint32) (err error) {
+	entries := make([]syncstatusEntry, 0, len(u.entries))
+	for _, entry := range u.entries {
+		if entry.uids[u.src()] != uid {
+			entries = append(entries, entry)
+		}
+	}
+	u.entries = entries
+	return
+}
+
+func (u *memorySyncstatus) SetMessageIdentity(srcuid uint32, identity messageIdentity) (err error) {
+	for i, entry := range u.entries {
+		if entry.uids[u.src()] == srcuid {
+			u.entries[i].messageIdentity = identity
+		}
+	}
+	return
+}
+
+func (u *memorySyncstatus) GetNewMessages(folder MailfolderManager) ([]uint32, error) {
+	messages := folder.GetMessages()
+	for _, entry := range u.entries {
+		delete(messages, entry.uids[u.src()])
+	}
+
+	newMessages := make([]uint32, 0)
+	for uid := range messages {
+		newMessages = append(newMessages, uid)
+	}
+	sort.Sort(Uint32Slice(newMessages))
+	return newMessages, nil
+}
+
+func (u *memorySyncstatus) GetDeletedMessages(folder MailfolderManager) ([]uint32, error) {
+	deletedMessages := make([]uint32, 0)
+	for _, entry := range u.entries {
+		if !folder.HasUID(entry.uids[u.src()]) {
+			deletedMessages = append(deletedMessages, entry.uids[u.src()])
+		}
+	}
+	sort.Sort(Uint32Slice(deletedMessages))
+	return deletedMessages, nil
+}
+
+func (u *memorySyncstatus) GetChangedMessages(folder MailfolderManager) ([]uint32, error) {
+	changedMessages := make([]uint32, 0)
+	for _, entry := range u.entries {
+		uid := entry.uids[u.src()]
+		if folder.HasUID(uid) {
+			flags, err := folder.GetFlags(uid)
+			if err != nil {
+				return nil, err
+			}
+			if flags != entry.flags {
+				changedMessages = append(changedMessages, uid)
+			}
+		}
+	}
+	sort.Sort(Uint32Slice(changedMessages))
+	return changedMessages, nil
+}
+
+func (u *memorySyncstatus) Close() (err error) {
+	return
+}
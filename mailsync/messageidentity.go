@@ -0,0 +1,97 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// messageIdentity identifies the content of a synced message. It's
+// recorded in the syncstatus when the message is transferred and used to
+// match the moved messages and to verify that the syncstatus entries still
+// point to the same messages. The stores can change the messages (like
+// the line endings) so the size and the hash are of their canonical form.
+type messageIdentity struct {
+	// Message-ID (empty if missing)
+	messageid string
+	// Size of the canonical form
+	size int
+	// canonicalHashPrefix and the hex encoded sha256 of the canonical form
+	hash string
+	// Unix time of the sync
+	synctime int64
+}
+
+// The hashes recorded by older versions are of the messages as read from
+// the source store and have no prefix
+const canonicalHashPrefix = "c1:"
+
+func newMessageIdentity(body []byte) messageIdentity {
+	canonical := canonicalMessage(body)
+	sum := sha256.Sum256(canonical)
+	return messageIdentity{
+		messageid: messageID(body),
+		size:      len(canonical),
+		hash:      canonicalHashPrefix + hex.EncodeToString(sum[:]),
+		synctime:  time.Now().Unix(),
+	}
+}
+
+// canonicalMessage returns a message without the changes done by the
+// stores: the line endings are converted to LF, the mbox state headers are
+// removed and the trailing newlines are removed. The mbox From quoting
+// isn't handled as the mbox store removes it when reading a message.
+func canonicalMessage(body []byte) []byte {
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	_, header, text := mboxSplitMessage(body)
+
+	var buf bytes.Buffer
+	buf.Write(mboxFilterHeaders(header))
+	buf.Write(text)
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+// messageID returns the Message-ID of a message (empty if missing)
+func messageID(body []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(msg.Header.Get("Message-Id"))
+}
+
+// canonical reports if the size and the hash are of the canonical form
+func (id messageIdentity) canonical() bool {
+	return strings.HasPrefix(id.hash, canonicalHashPrefix)
+}
+
+// sameContent reports if a message has the recorded identity. The
+// identities recorded by older versions (without hash or with the hash of
+// the source message) are compared only by Message-ID: their size and hash
+// can differ between the stores.
+func (id messageIdentity) sameContent(other messageIdentity) bool {
+	if id.canonical() && other.canonical() {
+		return id.hash == other.hash
+	}
+	return id.messageid == other.messageid
+}
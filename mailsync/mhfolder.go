@@ -0,0 +1,526 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+const mhSequencesFile = ".mh_sequences"
+
+// Mapping between the MH public sequences and the message flags. A message
+// is seen when it's not in the unseen sequence.
+var mhSequenceFlags = []struct {
+	sequence string
+	flag     string
+	inverted bool
+}{
+	{"unseen", "S", true},
+	{"flagged", "F", false},
+	{"replied", "R", false},
+}
+
+// MHFolder manages a MH folder. The message numbers are used as uids. New
+// messages get a number greater than the ones of the existing messages and
+// of the messages added before (saved in the metadatadir). Like rmm does,
+// deleted messages are renamed with a "," prefix.
+//
+// The .mh_sequences file is locked (fcntl and dotlock) while reading and
+// writing it. The flags changes are written on Close.
+type MHFolder struct {
+	folder      *Mailfolder
+	store       *MHStore
+	folderdir   string
+	metadatadir string
+	messages    map[uint32]*MessageInfo
+	// Messages deleted since the last sequences write
+	deleted map[uint32]bool
+	uidnext uint32
+	loaded  bool
+	dirty   bool
+	fsync   bool
+	logger  *log.Logger
+	e       *errors.Error
+	dryrun  bool
+}
+
+func NewMHFolder(folder *Mailfolder, folderdir string, metadatadir string, store *MHStore, dryrun bool) (m *MHFolder, err error) {
+	logprefix := fmt.Sprintf("store: %s, mhfolder: %s", store.Name(), folder)
+	errprefix := logprefix
+	logger := log.GetLogger(logprefix, store.globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	m = &MHFolder{
+		folder:      folder,
+		store:       store,
+		folderdir:   folderdir,
+		metadatadir: metadatadir,
+		messages:    make(map[uint32]*MessageInfo),
+		deleted:     make(map[uint32]bool),
+		fsync:       store.config.Fsync,
+		logger:      logger,
+		e:           e,
+		dryrun:      dryrun,
+	}
+
+	return
+}
+
+func (m *MHFolder) messagePath(uid uint32) string {
+	return filepath.Join(m.folderdir, strconv.FormatUint(uint64(uid), 10))
+}
+
+func (m *MHFolder) uidnextPath() string {
+	return filepath.Join(m.metadatadir, "uidnext")
+}
+
+func (m *MHFolder) readUIDNext() (uint32, error) {
+	f, err := os.Open(m.uidnextPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 1, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	uidnext, err := strconv.ParseUint(scanner.Text(), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Wrong uidnext in %s: %s", m.uidnextPath(), err)
+	}
+	return uint32(uidnext), nil
+}
+
+func (m *MHFolder) writeUIDNext() error {
+	if err := os.MkdirAll(m.metadatadir, 0777); err != nil {
+		return err
+	}
+	return writeFileAtomic(m.uidnextPath(), []byte(strconv.FormatUint(uint64(m.uidnext), 10)), m.fsync)
+}
+
+// mhSequences contains the lines of a .mh_sequences file
+type mhSequences struct {
+	names  []string
+	values map[string]string
+}
+
+func parseMHSequences(data []byte) *mhSequences {
+	s := &mhSequences{values: make(map[string]string)}
+	last := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		// Continuation line
+		if (line[0] == ' ' || line[0] == '\t') && last != "" {
+			s.values[last] += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		last = strings.TrimSpace(line[:i])
+		if _, ok := s.values[last]; !ok {
+			s.names = append(s.names, last)
+		}
+		s.values[last] = strings.TrimSpace(line[i+1:])
+	}
+	return s
+}
+
+// get returns the message numbers of a sequence
+func (s *mhSequences) get(name string) map[uint32]bool {
+	set := make(map[uint32]bool)
+	for _, r := range strings.Fields(s.values[name]) {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 32)
+			if err != nil || last < first {
+				continue
+			}
+		}
+		for n := first; n <= last; n++ {
+			set[uint32(n)] = true
+		}
+	}
+	return set
+}
+
+// set replaces a sequence. Empty sequences are removed.
+func (s *mhSequences) set(name string, set map[uint32]bool) {
+	uids := make([]int, 0, len(set))
+	for uid := range set {
+		uids = append(uids, int(uid))
+	}
+	sort.Ints(uids)
+
+	ranges := make([]string, 0)
+	for i := 0; i < len(uids); {
+		j := i
+		for j+1 < len(uids) && uids[j+1] == uids[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(uids[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", uids[i], uids[j]))
+		}
+		i = j + 1
+	}
+
+	if _, ok := s.values[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.values[name] = strings.Join(ranges, " ")
+}
+
+func (s *mhSequences) bytes() []byte {
+	var buf bytes.Buffer
+	for _, name := range s.names {
+		if s.values[name] == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", name, s.values[name])
+	}
+	return buf.Bytes()
+}
+
+func (m *MHFolder) readSequences() (*mhSequences, error) {
+	path := filepath.Join(m.folderdir, mhSequencesFile)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return parseMHSequences(nil), nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	lock, err := lockFile(f, path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return parseMHSequences(data), nil
+}
+
+// writeSequences updates the flags sequences of the known messages keeping
+// the other sequences and the messages added by others (like inc)
+func (m *MHFolder) writeSequences() (err error) {
+	path := filepath.Join(m.folderdir, mhSequencesFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lock, err := lockFile(f, path, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	sequences := parseMHSequences(data)
+	for _, sf := range mhSequenceFlags {
+		set := sequences.get(sf.sequence)
+		for uid := range m.deleted {
+			delete(set, uid)
+		}
+		for uid, message := range m.messages {
+			if strings.Contains(message.Flags, sf.flag) != sf.inverted {
+				set[uid] = true
+			} else {
+				delete(set, uid)
+			}
+		}
+		sequences.set(sf.sequence, set)
+	}
+
+	if _, err = f.Seek(0, 0); err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = f.Write(sequences.bytes()); err != nil {
+		return err
+	}
+	if m.fsync {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	m.deleted = make(map[uint32]bool)
+	m.dirty = false
+	return nil
+}
+
+func (m *MHFolder) UpdateMessageList() (err error) {
+	m.messages = make(map[uint32]*MessageInfo)
+
+	if m.dryrun && !m.store.HasFolder(m.folder.Name) {
+		return nil
+	}
+
+	// Don't lose the pending changes
+	if m.dirty && !m.dryrun {
+		if err = m.writeSequences(); err != nil {
+			return m.e.E(err)
+		}
+	}
+
+	m.uidnext, err = m.readUIDNext()
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	fis, err := ioutil.ReadDir(m.folderdir)
+	if err != nil {
+		return m.e.E(err)
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		uid, err := strconv.ParseUint(fi.Name(), 10, 32)
+		if err != nil || uid == 0 {
+			continue
+		}
+		m.messages[uint32(uid)] = &MessageInfo{UID: uint32(uid)}
+		if uint32(uid) >= m.uidnext {
+			m.uidnext = uint32(uid) + 1
+		}
+	}
+
+	sequences, err := m.readSequences()
+	if err != nil {
+		return m.e.E(err)
+	}
+	for _, sf := range mhSequenceFlags {
+		set := sequences.get(sf.sequence)
+		for uid, message := range m.messages {
+			if set[uid] != sf.inverted {
+				message.Flags += sf.flag
+			}
+		}
+	}
+	for _, message := range m.messages {
+		message.Flags = CleanFlags(message.Flags)
+	}
+
+	m.loaded = true
+	return nil
+}
+
+func (m *MHFolder) HasUID(uid uint32) bool {
+	if _, ok := m.messages[uid]; ok {
+		return true
+	}
+	return false
+}
+
+func (m *MHFolder) IsIgnored(uid uint32) bool {
+	if m, ok := m.messages[uid]; ok {
+		if m.Ignore {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MHFolder) GetFlags(uid uint32) (flags string, err error) {
+	if message, ok := m.messages[uid]; ok {
+		return message.Flags, nil
+	}
+
+	err = fmt.Errorf("Cannot find message with uid: %d", uid)
+	return "", m.e.E(err)
+}
+
+func (m *MHFolder) SetFlags(uid uint32, flags string) (err error) {
+	message, ok := m.messages[uid]
+	if !ok {
+		err = fmt.Errorf("Cannot find message with uid: %d", uid)
+		return m.e.E(err)
+	}
+
+	message.Flags = flags
+	m.dirty = true
+	return
+}
+
+func (m *MHFolder) ReadMessage(uid uint32) ([]byte, error) {
+	if _, ok := m.messages[uid]; !ok {
+		err := fmt.Errorf("Cannot find message with uid: %d", uid)
+		return nil, m.e.E(err)
+	}
+
+	buf, err := ioutil.ReadFile(m.messagePath(uid))
+	return buf, m.e.E(err)
+}
+
+// AddMessage writes the message to a temporary file and links it to the
+// first free message number, so a message delivered in the meantime by
+// inc is never overwritten
+func (m *MHFolder) AddMessage(srcuid uint32, flags string, body []byte) (uint32, error) {
+	if !m.loaded {
+		if err := m.UpdateMessageList(); err != nil {
+			return 0, err
+		}
+	}
+
+	tmpfilepath := filepath.Join(m.folderdir, fmt.Sprintf(".gomailsync-tmp-%d", os.Getpid()))
+	fo, err := os.OpenFile(tmpfilepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, m.e.E(err)
+	}
+	defer os.Remove(tmpfilepath)
+
+	if _, err = fo.Write(body); err != nil {
+		fo.Close()
+		return 0, m.e.E(err)
+	}
+	if m.fsync {
+		if err = fo.Sync(); err != nil {
+			fo.Close()
+			return 0, m.e.E(err)
+		}
+	}
+	if err = fo.Close(); err != nil {
+		return 0, m.e.E(err)
+	}
+
+	uid := m.uidnext
+	for {
+		if uid == 0 {
+			return 0, m.e.E(fmt.Errorf("Cannot find a free uid"))
+		}
+		err = os.Link(tmpfilepath, m.messagePath(uid))
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return 0, m.e.E(err)
+		}
+		uid++
+	}
+	if m.fsync {
+		if err = syncDir(m.folderdir); err != nil {
+			return 0, m.e.E(err)
+		}
+	}
+
+	m.uidnext = uid + 1
+	if err = m.writeUIDNext(); err != nil {
+		return 0, m.e.E(err)
+	}
+
+	m.messages[uid] = &MessageInfo{UID: uid, Flags: flags}
+	delete(m.deleted, uid)
+	m.dirty = true
+
+	return uid, nil
+}
+
+func (m *MHFolder) DeleteMessage(uid uint32) (err error) {
+	if _, ok := m.messages[uid]; !ok {
+		err = fmt.Errorf("Cannot find message with uid: %d", uid)
+		return m.e.E(err)
+	}
+
+	// Like rmm, keep a backup of the message prefixing its name with ","
+	messagepath := m.messagePath(uid)
+	backuppath := filepath.Join(m.folderdir, ","+filepath.Base(messagepath))
+	if err = os.Rename(messagepath, backuppath); err != nil {
+		// Ignore if file does not exists
+		m.logger.Debugf("rename failed: %s. Ignoring ", err)
+	} else if m.fsync {
+		if err = syncDir(m.folderdir); err != nil {
+			return m.e.E(err)
+		}
+	}
+
+	delete(m.messages, uid)
+	m.deleted[uid] = true
+	m.dirty = true
+	return nil
+}
+
+func (m *MHFolder) Update(srcuid uint32) (uint32, error) {
+	return srcuid, nil
+}
+
+func (m *MHFolder) GetMessages() map[uint32]*MessageInfo {
+	messages := make(map[uint32]*MessageInfo, 0)
+
+	for uid, message := range m.messages {
+		messages[uid] = message
+	}
+	return messages
+}
+
+func (m *MHFolder) GetIgnoredMessages() []uint32 {
+	messages := make([]uint32, 0)
+
+	for _, message := range m.messages {
+		if message.Ignore {
+			messages = append(messages, message.UID)
+		}
+	}
+	return messages
+}
+
+func (m *MHFolder) Close() (err error) {
+	if m.dirty && !m.dryrun {
+		err = m.writeSequences()
+	}
+	return m.e.E(err)
+}
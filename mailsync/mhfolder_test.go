@@ -0,0 +1,159 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+func TestMHSequences(t *testing.T) {
+	s := parseMHSequences([]byte("cur: 3\nunseen: 1-3 5\n 7\nflagged: 2\n"))
+
+	unseen := s.get("unseen")
+	for _, uid := range []uint32{1, 2, 3, 5, 7} {
+		if !unseen[uid] {
+			t.Fatalf("Expected %d in unseen sequence: %v", uid, unseen)
+		}
+	}
+	if len(unseen) != 5 {
+		t.Fatalf("Wrong unseen sequence: %v", unseen)
+	}
+
+	unseen[4] = true
+	delete(unseen, 7)
+	s.set("unseen", unseen)
+	s.set("flagged", map[uint32]bool{})
+	s.set("replied", map[uint32]bool{9: true})
+
+	expected := "cur: 3\nunseen: 1-5\nreplied: 9\n"
+	if string(s.bytes()) != expected {
+		t.Fatalf("Expected sequences %q, found %q", expected, s.bytes())
+	}
+}
+
+func TestMHFolder(t *testing.T) {
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+	mhdir := filepath.Join(testdir, "mhstore1")
+
+	storeconf := &config.StoreConfig{
+		Name:      "store1",
+		StoreType: "MH",
+		MHdir:     mhdir,
+		Separator: '/',
+		InboxPath: "inbox",
+	}
+	globalconfig := &config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{storeconf},
+		LogLevel:    "debug",
+	}
+
+	// A folder with messages delivered by inc
+	folderdir := filepath.Join(mhdir, "inbox")
+	os.MkdirAll(folderdir, 0777)
+	for _, n := range []string{"1", "2", "5"} {
+		if err := ioutil.WriteFile(filepath.Join(folderdir, n), []byte("Subject: "+n+"\n\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(folderdir, mhSequencesFile), []byte("unseen: 2 5\nreplied: 1\ncur: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := foldername{"INBOX"}
+	if !store.HasFolder(name) {
+		t.Fatalf("Expected folder %v, found folders: %v", name, store.GetFolders())
+	}
+	fm, err := store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+
+	for uid, flags := range map[uint32]string{1: "RS", 2: "", 5: ""} {
+		found, err := fm.GetFlags(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != flags {
+			t.Fatalf("Message %d: expected flags \"%s\", found \"%s\"", uid, flags, found)
+		}
+	}
+
+	uid, err := fm.AddMessage(0, "F", []byte("Subject: new\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != 6 {
+		t.Fatalf("Expected uid 6, found %d", uid)
+	}
+	if err = fm.SetFlags(2, "S"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DeleteMessage(5); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(folderdir, ",5")); err != nil {
+		t.Fatalf("Expected deleted message backup: %s", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(folderdir, mhSequencesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "unseen: 6\nreplied: 1\ncur: 1\nflagged: 6\n"
+	if string(data) != expected {
+		t.Fatalf("Expected sequences %q, found %q", expected, data)
+	}
+
+	// The number of a deleted message is never reused
+	if err = os.Remove(filepath.Join(folderdir, "6")); err != nil {
+		t.Fatal(err)
+	}
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	uid, err = fm.AddMessage(0, "", []byte("Subject: new\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != 7 {
+		t.Fatalf("Expected uid 7, found %d", uid)
+	}
+}
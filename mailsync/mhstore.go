@@ -0,0 +1,242 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sgotti/gomailsync/config"
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// MHStore is a store made of MH folders: every directory under the mhdir is
+// a folder containing the messages as numbered files.
+type MHStore struct {
+	globalconfig *config.Config
+	config       *config.StoreConfig
+	name         string
+	mhdir        string
+	metadatadir  string
+	separator    rune
+	folders      []*Mailfolder
+	logger       *log.Logger
+	e            *errors.Error
+	dryrun       bool
+}
+
+func (m *MHStore) isInbox(relpath string) bool {
+	if filepath.Clean(relpath) == filepath.Clean(m.config.InboxPath) {
+		return true
+	}
+	return false
+}
+
+func (m *MHStore) folderPath(name foldername) string {
+	folderpath := FolderToEscapedStorePath(name, m.separator, m.config.PortableFolderNames)
+	if StrsEquals(name, []string{"INBOX"}) {
+		folderpath = filepath.Clean(m.config.InboxPath)
+	}
+	return folderpath
+}
+
+func NewMHStore(globalconfig *config.Config, config *config.StoreConfig, basemetadatadir string, dryrun bool) (m *MHStore, err error) {
+	name := config.Name
+	logprefix := fmt.Sprintf("mhstore: %s", name)
+	errprefix := fmt.Sprintf("mhstore: %s", name)
+	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	metadatadir := filepath.Join(basemetadatadir, name)
+	mhdir := config.MHdir
+
+	// A dry run doesn't create the store directories
+	if !dryrun {
+		err = os.MkdirAll(metadatadir, 0777)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(mhdir, 0777)
+		if err != nil {
+			logger.Error("Error:", err)
+			return
+		}
+	}
+
+	m = &MHStore{
+		globalconfig: globalconfig,
+		config:       config,
+		name:         name,
+		mhdir:        mhdir,
+		metadatadir:  metadatadir,
+		separator:    config.Separator,
+		folders:      make([]*Mailfolder, 0),
+		logger:       logger,
+		e:            e,
+		dryrun:       dryrun,
+	}
+
+	err = m.UpdateFolderList()
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (m *MHStore) CreateFolder(name foldername) (err error) {
+	folderdir := filepath.Join(m.mhdir, m.folderPath(name))
+
+	err = os.MkdirAll(folderdir, 0777)
+	if err != nil {
+		return m.e.E(err)
+	}
+	if m.config.Fsync {
+		if err = syncDir(filepath.Dir(folderdir)); err != nil {
+			return m.e.E(err)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Join(m.metadatadir, folderMetadataPath(name)), 0777)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	// Add folder to the list
+	m.folders = append(m.folders, &Mailfolder{Name: name, Excluded: false})
+	return nil
+}
+
+func (m *MHStore) SetFolderExcluded(name foldername, excluded bool) error {
+	if f := m.getFolder(name); f != nil {
+		f.Excluded = excluded
+		return nil
+	}
+	return m.e.E(fmt.Errorf("Folder %s, doesn't exists", name))
+}
+
+func (m *MHStore) getFolder(name foldername) *Mailfolder {
+	for _, f := range m.folders {
+		if StrsEquals(name, f.Name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *MHStore) HasFolder(name foldername) bool {
+	if f := m.getFolder(name); f != nil {
+		return true
+	}
+	return false
+}
+
+func (m *MHStore) UpdateFolderList() error {
+	m.folders = make([]*Mailfolder, 0)
+	// Not yet created by a dry run
+	if _, err := os.Stat(m.mhdir); os.IsNotExist(err) && m.dryrun {
+		return nil
+	}
+	err := filepath.Walk(m.mhdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return m.e.E(err)
+		}
+		if !info.IsDir() || path == m.mhdir {
+			return nil
+		}
+		if strings.HasPrefix(filepath.Base(path), ".") {
+			return filepath.SkipDir
+		}
+
+		relpath, err := filepath.Rel(m.mhdir, path)
+		if err != nil {
+			return m.e.E(err)
+		}
+
+		// Verify that the if relpath is inbox (case insensitive) then its the configured inbox
+		if strings.ToLower(filepath.Clean(relpath)) == "inbox" && !m.isInbox(relpath) {
+			err := fmt.Errorf("directory with name \"%s\", doesn't match configured inbox path \"%s\"", filepath.Clean(relpath), (m.config.InboxPath))
+			return m.e.E(err)
+		}
+		name := EscapedStorePathToFolder(relpath, m.separator)
+		// Is this path of the configured INBOX?
+		if m.isInbox(relpath) {
+			name = []string{"INBOX"}
+		}
+		folder := &Mailfolder{
+			Name:     name,
+			Excluded: false,
+		}
+		m.folders = append(m.folders, folder)
+		m.logger.Debug("mh folder:", folder)
+		return nil
+	})
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	err = applyRegExpPatterns(m, m.folders)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	return nil
+}
+
+func (m *MHStore) Separator() (rune, error) {
+	return m.separator, nil
+}
+
+func (m *MHStore) GetFolders() []Mailfolder {
+	folders := make([]Mailfolder, len(m.folders))
+	for i, f := range m.folders {
+		folders[i] = *f
+	}
+	return folders
+}
+
+func (m *MHStore) GetMailfolderManager(name foldername) (manager MailfolderManager, err error) {
+	folderdir := filepath.Join(m.mhdir, m.folderPath(name))
+
+	if !m.HasFolder(name) && !m.dryrun {
+		err = m.CreateFolder(name)
+		if err != nil {
+			return nil, m.e.E(err)
+		}
+	}
+
+	folder := m.getFolder(name)
+	if folder == nil {
+		return nil, m.e.E(fmt.Errorf("Cannot get folder %s", name))
+	}
+	foldermetadatadir := filepath.Join(m.metadatadir, folderMetadataPath(name))
+	manager, err = NewMHFolder(folder, folderdir, foldermetadatadir, m, m.dryrun)
+
+	return
+}
+
+func (m *MHStore) Name() string {
+	return m.name
+}
+
+func (m *MHStore) Config() *config.StoreConfig {
+	return m.config
+}
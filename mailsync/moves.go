@@ -0,0 +1,333 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sgotti/gomailsync/log"
+)
+
+// A message moved between two folders of a store is seen by the folder
+// syncs as deleted from a folder and new in another one: it would be
+// deleted from the other store and transferred again. With detectmoves,
+// before every round of folder syncs, the messages deleted from a folder
+// are matched with the new messages of the other folders by the
+// Message-ID and the identity recorded in the syncstatus, and moved also on
+// the other store (see MessageMover) updating the syncstatus of both
+// folders. The plans don't contain moves: a plan records the messages
+// that the moves would change and cannot be applied.
+
+// movedMessage is a message deleted from a folder of the source store
+// that is still in the other store
+type movedMessage struct {
+	folder Mailfolder
+	entry  syncstatusEntry
+}
+
+// messageMove is the move of a message found as new in a folder
+type messageMove struct {
+	from   *movedMessage
+	srcuid uint32
+}
+
+// movedKey is the key of the messages moved by a dry run. Their folders
+// syncs ignore them.
+func movedKey(name foldername, src Storenumber, uid uint32) string {
+	return fmt.Sprintf("%s %d %d", memoryFolderKey(name), src, uid)
+}
+
+// removeMovedMessages removes the messages moved by a dry run
+func (s *Syncgroup) removeMovedMessages(messages []uint32, name foldername, src Storenumber) []uint32 {
+	if len(s.moved) == 0 {
+		return messages
+	}
+	filteredmessages := make([]uint32, 0)
+	for _, uid := range messages {
+		if !s.moved[movedKey(name, src, uid)] {
+			filteredmessages = append(filteredmessages, uid)
+		}
+	}
+	return filteredmessages
+}
+
+// movesRoundCompleted reports if all the folders were synced at least
+// round times
+func movesRoundCompleted(countmap map[int]int, folders int, round int) bool {
+	for i := 0; i < folders; i++ {
+		if countmap[i] < round {
+			return false
+		}
+	}
+	return true
+}
+
+// movesEnabled reports if the moves from the source store are propagated
+// to the other store
+func (s *Syncgroup) movesEnabled(src Storenumber) bool {
+	dst := 1 - src
+	// A move is a deletion and a new message
+	if !s.ops[src].new || !s.ops[src].delete {
+		return false
+	}
+	if d, ok := s.stores[dst].(DownloadOnlyStore); ok && d.DownloadOnly() {
+		return false
+	}
+	return true
+}
+
+// syncMoves detects the messages moved between the folders of a store and
+// moves them also on the other one. It must not run with the folder syncs.
+func (s *Syncgroup) syncMoves(folders []Mailfolder) error {
+	for src := Store1; src <= Store2; src++ {
+		if !s.movesEnabled(src) {
+			continue
+		}
+		if err := s.syncMovesFrom(folders, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syncgroup) syncMovesFrom(folders []Mailfolder, src Storenumber) error {
+	dst := 1 - src
+	logprefix := fmt.Sprintf("%s %s %s -> %s", "syncgroup", s.name, s.stores[src].Name(), s.stores[dst].Name())
+	logger := log.GetLogger(logprefix, s.globalconfig.LogLevel)
+
+	deleted, newfolders, err := s.deletedMessages(folders, src)
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	for _, folder := range newfolders {
+		if err := s.moveMessagesTo(folder, src, deleted, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingMoves returns, by folder, the number of messages that syncMoves
+// would move from or to the folder
+func (s *Syncgroup) pendingMoves(folders []Mailfolder) (map[string]int, error) {
+	pending := make(map[string]int)
+	for src := Store1; src <= Store2; src++ {
+		if !s.movesEnabled(src) {
+			continue
+		}
+		deleted, newfolders, err := s.deletedMessages(folders, src)
+		if err != nil {
+			return nil, err
+		}
+		if len(deleted) == 0 {
+			continue
+		}
+		for _, folder := range newfolders {
+			f, err := s.openFolder(folder, false)
+			if err != nil {
+				return nil, err
+			}
+			moves, movefolders, err := s.matchMoves(f, folder, src, deleted)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			for _, from := range movefolders {
+				pending[folder.String()] += len(moves[from.String()])
+				pending[from.String()] += len(moves[from.String()])
+			}
+		}
+	}
+	return pending, nil
+}
+
+// deletedMessages returns the messages deleted from the folders of the
+// source store, by Message-ID, and the folders with new messages
+func (s *Syncgroup) deletedMessages(folders []Mailfolder, src Storenumber) (map[string][]*movedMessage, []Mailfolder, error) {
+	dst := 1 - src
+	deleted := make(map[string][]*movedMessage)
+	newfolders := make([]Mailfolder, 0)
+	for _, folder := range folders {
+		f, err := s.openFolder(folder, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		es, ok := f.syncstatus.(entriesSyncstatus)
+		if !ok {
+			f.Close()
+			return nil, nil, fmt.Errorf("Cannot copy syncstatus %T", f.syncstatus)
+		}
+		entries, err := es.getEntries()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			if entry.messageid == "" || f.folders[src].HasUID(entry.uids[src]) || !f.folders[dst].HasUID(entry.uids[dst]) {
+				continue
+			}
+			deleted[entry.messageid] = append(deleted[entry.messageid], &movedMessage{folder: folder, entry: entry})
+		}
+
+		f.syncstatus.SetSrcstore(src)
+		newMessages, err := f.syncstatus.GetNewMessages(f.folders[src])
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(newMessages) > 0 {
+			newfolders = append(newfolders, folder)
+		}
+	}
+	return deleted, newfolders, nil
+}
+
+// matchMoves matches the new messages of an opened folder with the deleted
+// ones (removing them from deleted) and returns the moves by source folder
+func (s *Syncgroup) matchMoves(f *folderSync, folder Mailfolder, src Storenumber, deleted map[string][]*movedMessage) (map[string][]*messageMove, []Mailfolder, error) {
+	f.syncstatus.SetSrcstore(src)
+	newMessages, err := f.syncstatus.GetNewMessages(f.folders[src])
+	if err != nil {
+		return nil, nil, err
+	}
+	newMessages = removeIgnoredMessages(newMessages, f.folders[src])
+
+	moves := make(map[string][]*messageMove)
+	movefolders := make([]Mailfolder, 0)
+	for _, uid := range newMessages {
+		body, err := f.folders[src].ReadMessage(uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		identity := newMessageIdentity(body)
+		if identity.messageid == "" {
+			continue
+		}
+		key := identity.messageid
+		for i, from := range deleted[key] {
+			if from.folder.Equals(&folder) || !from.entry.sameContent(identity) {
+				continue
+			}
+			deleted[key] = append(deleted[key][:i], deleted[key][i+1:]...)
+			name := from.folder.String()
+			if _, ok := moves[name]; !ok {
+				movefolders = append(movefolders, from.folder)
+			}
+			moves[name] = append(moves[name], &messageMove{from: from, srcuid: uid})
+			break
+		}
+	}
+	return moves, movefolders, nil
+}
+
+// moveMessagesTo matches the new messages of a folder with the deleted ones
+// and moves them
+func (s *Syncgroup) moveMessagesTo(folder Mailfolder, src Storenumber, deleted map[string][]*movedMessage, logger *log.Logger) error {
+	f, err := s.openFolder(folder, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	moves, movefolders, err := s.matchMoves(f, folder, src, deleted)
+	if err != nil {
+		return err
+	}
+
+	for _, from := range movefolders {
+		if err := s.moveMessages(from, f, folder, src, moves[from.String()], logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveMessages moves the messages from a folder to the opened one on the
+// destination store
+func (s *Syncgroup) moveMessages(from Mailfolder, f *folderSync, folder Mailfolder, src Storenumber, moves []*messageMove, logger *log.Logger) error {
+	dst := 1 - src
+	fromf, err := s.openFolder(from, false)
+	if err != nil {
+		return err
+	}
+	defer fromf.Close()
+
+	mover, ok := fromf.folders[dst].(MessageMover)
+	if !ok {
+		logger.Debugf("Store %s cannot move messages", s.stores[dst].Name())
+		return nil
+	}
+
+	for _, move := range moves {
+		entry := move.from.entry
+		dstuid, moved, err := mover.MoveMessage(entry.uids[dst], f.folders[dst])
+		if err != nil {
+			return err
+		}
+		if !moved {
+			logger.Debugf("Cannot move messages from folder %s to folder %s", from, folder)
+			return nil
+		}
+		logger.Infof("Moved message with dstuid %d from folder %s to folder %s", entry.uids[dst], from, folder)
+
+		srcuid, err := f.folders[src].Update(move.srcuid)
+		if err != nil {
+			return err
+		}
+
+		// The message is removed from the syncstatus of the old folder
+		// before adding it to the new one: an interruption can only
+		// duplicate it
+		fromf.syncstatus.SetSrcstore(src)
+		fromf.syncstatus.BeginTx()
+		if err = fromf.syncstatus.Delete(entry.uids[src]); err != nil {
+			fromf.syncstatus.Rollback()
+			return err
+		}
+		if err = fromf.syncstatus.Commit(); err != nil {
+			return err
+		}
+
+		// The old flags are recorded: the flags changed on the source
+		// store are synced by the folder sync
+		identity := entry.messageIdentity
+		identity.synctime = time.Now().Unix()
+		f.syncstatus.SetSrcstore(src)
+		f.syncstatus.BeginTx()
+		if err = f.syncstatus.Update(srcuid, dstuid, entry.flags); err == nil {
+			err = f.syncstatus.SetMessageIdentity(srcuid, identity)
+		}
+		if err != nil {
+			f.syncstatus.Rollback()
+			return err
+		}
+		if err = f.syncstatus.Commit(); err != nil {
+			return err
+		}
+
+		if s.dryrun {
+			s.moved[movedKey(from.Name, src, entry.uids[src])] = true
+			s.moved[movedKey(folder.Name, src, srcuid)] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Mapping between message flags and notmuch tags (the same used by notmuch
+// for its maildir flags synchronization plus "deleted" for the T flag). A
+// message is seen when it doesn't have the unread tag.
+var notmuchFlagTags = []struct {
+	flag     string
+	tag      string
+	inverted bool
+}{
+	{"D", "draft", false},
+	{"F", "flagged", false},
+	{"P", "passed", false},
+	{"R", "replied", false},
+	{"S", "unread", true},
+	{"T", "deleted", false},
+}
+
+func notmuchTagsToFlags(tags []string) string {
+	flags := ""
+	for _, ft := range notmuchFlagTags {
+		if StringInSlice(ft.tag, tags) != ft.inverted {
+			flags += ft.flag
+		}
+	}
+	return CleanFlags(flags)
+}
+
+// notmuchTagOps returns the notmuch tag operations (like "+flagged -unread")
+// to apply the message flags
+func notmuchTagOps(flags string) string {
+	ops := make([]string, 0, len(notmuchFlagTags))
+	for _, ft := range notmuchFlagTags {
+		if strings.Contains(flags, ft.flag) != ft.inverted {
+			ops = append(ops, "+"+ft.tag)
+		} else {
+			ops = append(ops, "-"+ft.tag)
+		}
+	}
+	return strings.Join(ops, " ")
+}
+
+// notmuchMessageID returns the id used by notmuch for a message: its
+// Message-ID or, if missing, the sha1 of the file content
+func notmuchMessageID(data []byte) string {
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		id := strings.TrimSpace(msg.Header.Get("Message-Id"))
+		id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+		if id != "" {
+			return id
+		}
+	}
+	return fmt.Sprintf("notmuch-sha1-%x", sha1.Sum(data))
+}
+
+func notmuchQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+type notmuchMessage struct {
+	ID        string
+	Filenames []string
+	Tags      []string
+}
+
+// parseNotmuchShow extracts the messages from the output of "notmuch show
+// --format=json". The output is a nested list of threads and replies, so
+// every object with an id is considered a message.
+func parseNotmuchShow(data []byte) ([]*notmuchMessage, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	messages := make([]*notmuchMessage, 0)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]interface{}:
+			id, ok := v["id"].(string)
+			if !ok {
+				return
+			}
+			message := &notmuchMessage{ID: id}
+			// filename is a string in old output formats
+			switch f := v["filename"].(type) {
+			case string:
+				message.Filenames = append(message.Filenames, f)
+			case []interface{}:
+				for _, s := range f {
+					if s, ok := s.(string); ok {
+						message.Filenames = append(message.Filenames, s)
+					}
+				}
+			}
+			if tags, ok := v["tags"].([]interface{}); ok {
+				for _, t := range tags {
+					if t, ok := t.(string); ok {
+						message.Tags = append(message.Tags, t)
+					}
+				}
+			}
+			messages = append(messages, message)
+		}
+	}
+	walk(v)
+	return messages, nil
+}
+
+// notmuchDB runs the notmuch command on a notmuch database
+type notmuchDB struct {
+	command string
+	config  string
+	dbpath  string
+	sync.Mutex
+}
+
+func newNotmuchDB(command string, config string) *notmuchDB {
+	if command == "" {
+		command = "notmuch"
+	}
+	return &notmuchDB{command: command, config: config}
+}
+
+func (n *notmuchDB) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(n.command, args...)
+	if n.config != "" {
+		cmd.Env = append(os.Environ(), "NOTMUCH_CONFIG="+n.config)
+	}
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("notmuch %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (n *notmuchDB) DatabasePath() (string, error) {
+	n.Lock()
+	defer n.Unlock()
+	if n.dbpath == "" {
+		out, err := n.run(nil, "config", "get", "database.path")
+		if err != nil {
+			return "", err
+		}
+		n.dbpath = strings.TrimSpace(string(out))
+	}
+	return n.dbpath, nil
+}
+
+// Lastmod returns the database uuid and its last modification revision
+func (n *notmuchDB) Lastmod() (uuid string, lastmod uint64, err error) {
+	out, err := n.run(nil, "count", "--lastmod", "*")
+	if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 {
+		return "", 0, fmt.Errorf("Wrong notmuch count output: %q", out)
+	}
+	lastmod, err = strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("Wrong notmuch count output: %q", out)
+	}
+	return fields[1], lastmod, nil
+}
+
+// ChangedMessages returns the messages matching query modified in the
+// revisions from..to
+func (n *notmuchDB) ChangedMessages(query string, from uint64, to uint64) ([]*notmuchMessage, error) {
+	q := fmt.Sprintf("lastmod:%d..%d", from, to)
+	if query != "" {
+		q += " and " + query
+	}
+	out, err := n.run(nil, "show", "--format=json", "--body=false", "--entire-thread=false", q)
+	if err != nil {
+		return nil, err
+	}
+	return parseNotmuchShow(out)
+}
+
+func (n *notmuchDB) New() error {
+	n.Lock()
+	defer n.Unlock()
+	_, err := n.run(nil, "new", "--no-hooks", "--quiet")
+	return err
+}
+
+// Tag applies the tag operations to the messages with the given ids
+func (n *notmuchDB) Tag(ops map[string]string) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for id, op := range ops {
+		fmt.Fprintf(&buf, "%s -- id:%s\n", op, notmuchQuote(id))
+	}
+	n.Lock()
+	defer n.Unlock()
+	_, err := n.run(buf.Bytes(), "tag", "--batch")
+	return err
+}
+
+func (m *MaildirFolder) notmuchLastmodPath() string {
+	return filepath.Join(m.metadatadir, folderMetadataPath(m.folder.Name), "notmuch-lastmod")
+}
+
+func (m *MaildirFolder) readNotmuchLastmod() (uuid string, lastmod uint64, err error) {
+	f, err := os.Open(m.notmuchLastmodPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", 0, nil
+		}
+		return "", 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	fields := strings.Fields(scanner.Text())
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("Wrong notmuch lastmod file: %s", m.notmuchLastmodPath())
+	}
+	lastmod, err = strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("Wrong notmuch lastmod file: %s", m.notmuchLastmodPath())
+	}
+	return fields[0], lastmod, nil
+}
+
+func (m *MaildirFolder) writeNotmuchLastmod(uuid string, lastmod uint64) error {
+	return writeFileAtomic(m.notmuchLastmodPath(), []byte(fmt.Sprintf("%s %d", uuid, lastmod)), m.fsync)
+}
+
+// notmuchFolderQuery returns the query matching the messages of the folder
+func (m *MaildirFolder) notmuchFolderQuery() string {
+	dbpath, err := m.store.notmuch.DatabasePath()
+	if err != nil {
+		return ""
+	}
+	relpath, err := filepath.Rel(dbpath, m.maildir)
+	if err != nil || strings.HasPrefix(relpath, "..") {
+		return ""
+	}
+	if relpath == "." {
+		relpath = ""
+	}
+	return "folder:" + notmuchQuote(relpath)
+}
+
+// notmuchPull applies to the folder messages the tags changed in notmuch
+// since the last sync. The first time only the current revision is saved.
+func (m *MaildirFolder) notmuchPull() error {
+	uuid, lastmod, err := m.store.notmuch.Lastmod()
+	if err != nil {
+		return err
+	}
+	saveduuid, savedlastmod, err := m.readNotmuchLastmod()
+	if err != nil {
+		return err
+	}
+	if saveduuid != uuid {
+		m.logger.Infof("No previous notmuch revision for this database. Not importing notmuch tags")
+		return m.writeNotmuchLastmod(uuid, lastmod)
+	}
+	if savedlastmod >= lastmod {
+		return nil
+	}
+
+	nmmessages, err := m.store.notmuch.ChangedMessages(m.notmuchFolderQuery(), savedlastmod+1, lastmod)
+	if err != nil {
+		return err
+	}
+
+	filenames := make(map[string]*MaildirMessageInfo, len(m.messages))
+	for _, message := range m.messages {
+		filenames[message.Filename] = message
+	}
+	for _, nmmessage := range nmmessages {
+		flags := notmuchTagsToFlags(nmmessage.Tags)
+		for _, p := range nmmessage.Filenames {
+			if filepath.Dir(filepath.Dir(p)) != filepath.Clean(m.maildir) {
+				continue
+			}
+			filename, _, err := m.splitFilename(filepath.Base(p))
+			if err != nil {
+				filename = filepath.Base(p)
+			}
+			message, ok := filenames[filename]
+			if !ok || message.Ignore || message.Flags == flags {
+				continue
+			}
+			m.logger.Debugf("notmuch tags changed for message uid %d: flags \"%s\" -> \"%s\"", message.UID, message.Flags, flags)
+			if err = m.SetFlags(message.UID, flags); err != nil {
+				return err
+			}
+		}
+	}
+	return m.writeNotmuchLastmod(uuid, lastmod)
+}
+
+// notmuchPush indexes the files changed by the sync and sets the tags of
+// their messages from their flags
+func (m *MaildirFolder) notmuchPush() error {
+	if err := m.store.notmuch.New(); err != nil {
+		return err
+	}
+
+	ops := make(map[string]string)
+	for message := range m.notmuchChanged {
+		p, err := m.findFilepath(message)
+		if err != nil || p == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		ops[notmuchMessageID(data)] = notmuchTagOps(message.Flags)
+	}
+	if err := m.store.notmuch.Tag(ops); err != nil {
+		return err
+	}
+	m.notmuchChanged = make(map[*MaildirMessageInfo]bool)
+
+	// Don't import the changes done by us on next sync
+	uuid, lastmod, err := m.store.notmuch.Lastmod()
+	if err != nil {
+		return err
+	}
+	return m.writeNotmuchLastmod(uuid, lastmod)
+}
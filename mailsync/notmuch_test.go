@@ -0,0 +1,173 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+func TestNotmuchFlagsMapping(t *testing.T) {
+	tests := []struct {
+		tags  []string
+		flags string
+		ops   string
+	}{
+		{[]string{"inbox", "unread"}, "", "-draft -flagged -passed -replied +unread -deleted"},
+		{[]string{"inbox", "replied", "flagged"}, "FRS", "-draft +flagged -passed +replied -unread -deleted"},
+		{[]string{"deleted", "draft", "passed"}, "DPST", "+draft -flagged +passed -replied -unread +deleted"},
+	}
+
+	for _, tt := range tests {
+		flags := notmuchTagsToFlags(tt.tags)
+		if flags != tt.flags {
+			t.Fatalf("Tags %v: expected flags \"%s\", found \"%s\"", tt.tags, tt.flags, flags)
+		}
+		ops := notmuchTagOps(flags)
+		if ops != tt.ops {
+			t.Fatalf("Flags \"%s\": expected ops \"%s\", found \"%s\"", flags, tt.ops, ops)
+		}
+	}
+}
+
+func TestNotmuchMessageID(t *testing.T) {
+	id := notmuchMessageID([]byte("Message-ID: <abc@example.com>\nSubject: test\n\nbody\n"))
+	if id != "abc@example.com" {
+		t.Fatalf("Wrong message id: %s", id)
+	}
+	data := []byte("Subject: test\n\nbody\n")
+	id = notmuchMessageID(data)
+	if id != fmt.Sprintf("notmuch-sha1-%x", sha1.Sum(data)) {
+		t.Fatalf("Wrong message id: %s", id)
+	}
+	if notmuchQuote(`a"b`) != `"a""b"` {
+		t.Fatalf("Wrong quoting: %s", notmuchQuote(`a"b`))
+	}
+}
+
+func TestParseNotmuchShow(t *testing.T) {
+	out := `[[[{"id": "1@example.com", "match": true, "filename": ["/mail/INBOX/cur/a:2,S", "/mail/Other/cur/b:2,"], "tags": ["inbox", "replied"], "headers": {}}, [[{"id": "2@example.com", "filename": "/mail/INBOX/new/c", "tags": ["unread"]}, []]]]]]`
+
+	messages, err := parseNotmuchShow([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, found %d", len(messages))
+	}
+	if messages[0].ID != "1@example.com" || len(messages[0].Filenames) != 2 || !StrsEquals(messages[0].Tags, []string{"inbox", "replied"}) {
+		t.Fatalf("Wrong message: %v", messages[0])
+	}
+	if messages[1].ID != "2@example.com" || !StrsEquals(messages[1].Filenames, []string{"/mail/INBOX/new/c"}) {
+		t.Fatalf("Wrong message: %v", messages[1])
+	}
+}
+
+func TestNotmuchSync(t *testing.T) {
+	if _, err := exec.LookPath("notmuch"); err != nil {
+		t.Skip("notmuch not available")
+	}
+
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+	maildir := filepath.Join(testdir, "maildir")
+	os.Mkdir(maildir, 0777)
+
+	notmuchconfig := filepath.Join(testdir, "notmuch-config")
+	conf := fmt.Sprintf("[database]\npath=%s\n[maildir]\nsynchronize_flags=true\n", maildir)
+	if err := ioutil.WriteFile(notmuchconfig, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nm := newNotmuchDB("", notmuchconfig)
+	if _, err := nm.run(nil, "new", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+
+	storeconf := &config.StoreConfig{
+		Name:          "store1",
+		StoreType:     "Maildir",
+		Maildir:       maildir,
+		Separator:     '/',
+		InboxPath:     "INBOX",
+		UIDMapping:    "files",
+		InfoSeparator: ":",
+		Notmuch:       true,
+		NotmuchConfig: notmuchconfig,
+	}
+	globalconfig := &config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{storeconf},
+		LogLevel:    "debug",
+	}
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := foldername{"INBOX"}
+
+	fm, err := store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	uid, err := fm.AddMessage(0, "F", []byte("Message-ID: <1@example.com>\nSubject: test\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := nm.run(nil, "search", "--output=tags", "id:1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := string(out); tags != "flagged\nunread\n" {
+		t.Fatalf("Wrong notmuch tags: %q", tags)
+	}
+
+	// Tag changes are imported as flag changes
+	if _, err = nm.run(nil, "tag", "-unread", "+replied", "--", "id:1@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := fm.GetFlags(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != "FRS" {
+		t.Fatalf("Expected flags \"FRS\", found \"%s\"", flags)
+	}
+}
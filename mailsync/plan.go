@@ -0,0 +1,768 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// The sync of a folder is done in two phases: planFolder computes all the
+// actions on a copy of the folders and of the syncstatus, applyFolderPlan
+// executes them on the real ones. A plan can be saved and applied later if
+// the folders didn't change.
+
+// Plan actions
+const (
+	// Add the message to the destination store
+	PlanActionNew = "new"
+	// Delete the message from the destination store (deletemode expunge)
+	PlanActionDelete = "delete"
+	// Set the deleted flag on the destination store (deletemode trash)
+	PlanActionTrash = "trash"
+	// Set the flags of the destination store message
+	PlanActionFlags = "flags"
+	// Remove from the syncstatus a message deleted from both the stores
+	PlanActionForget = "forget"
+)
+
+// SyncPlan is a plan of the sync of the folders of some syncgroups
+type SyncPlan struct {
+	Folders []*FolderPlan `json:"folders"`
+}
+
+// FolderPlan are the actions of the sync of a syncgroup folder
+type FolderPlan struct {
+	Syncgroup string             `json:"syncgroup"`
+	Folder    foldername         `json:"folder"`
+	Stores    []*PlanFolderState `json:"stores"`
+	Actions   []*PlanAction      `json:"actions"`
+	// The messages that detectmoves would move from or to the folder
+	// instead of deleting and transferring them again
+	Moves int `json:"moves,omitempty"`
+}
+
+// PlanFolderState is the state of a store folder when the plan was made
+type PlanFolderState struct {
+	Store  string `json:"store"`
+	Exists bool   `json:"exists"`
+	// UIDVALIDITY, folderUID etc... (see FolderIdentifier)
+	FolderID string `json:"folderid,omitempty"`
+	// The flags of the messages by uid
+	Messages map[uint32]string `json:"messages"`
+}
+
+type PlanAction struct {
+	Action string `json:"action"`
+	// The store the message comes from (0 or 1), the action is done on the
+	// other one
+	Src      Storenumber `json:"src"`
+	SrcUID   uint32      `json:"srcuid"`
+	DstUID   uint32      `json:"dstuid,omitempty"`
+	Flags    string      `json:"flags"`
+	OldFlags string      `json:"oldflags,omitempty"`
+	Size     int         `json:"size,omitempty"`
+}
+
+// folderSync are the syncstatus and the managers of a folder being synced
+type folderSync struct {
+	syncstatus Syncstatus
+	folders    [2]MailfolderManager
+	exists     [2]bool
+}
+
+func (f *folderSync) Close() {
+	for _, folder := range f.folders {
+		if folder != nil {
+			folder.Close()
+		}
+	}
+	if f.syncstatus != nil {
+		f.syncstatus.Close()
+	}
+}
+
+// openFolder opens the syncstatus and the managers of a folder and updates
+// their message list. If create is false (or the folder creation isn't
+// propagated to the store) a missing folder is replaced by an empty one.
+func (s *Syncgroup) openFolder(folder Mailfolder, create bool) (_ *folderSync, err error) {
+	f := &folderSync{}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	if s.dryrun {
+		entries, err := readSyncstatus(s.config, s.metadatadir, folder.Name)
+		if err != nil {
+			return nil, err
+		}
+		f.syncstatus = newMemorySyncstatus(entries)
+	} else {
+		statusbackend, err := s.getSyncstatusBackend()
+		if err != nil {
+			return nil, err
+		}
+		f.syncstatus, err = statusbackend.OpenFolder(folder.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f.syncstatus.UpdateSyncstatus()
+
+	mapping := s.getFolderMapping()
+	for i, store := range s.stores {
+		name := mapping.storeFolderName(folder.Name, Storenumber(i))
+		f.exists[i] = store.HasFolder(name)
+		// The folder is created only if the other store propagates it
+		if !f.exists[i] && (!create || !s.ops[1-i].create) {
+			f.folders[i] = newDryrunFolder(nil, name, nil)
+			continue
+		}
+		f.folders[i], err = store.GetMailfolderManager(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fm := range f.folders {
+		err = fm.UpdateMessageList()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// entriesSyncstatus is implemented by the Syncstatus that can be copied to
+// plan the sync
+type entriesSyncstatus interface {
+	getEntries() ([]syncstatusEntry, error)
+}
+
+func folderID(fm MailfolderManager) string {
+	if f, ok := fm.(FolderIdentifier); ok {
+		return f.FolderID()
+	}
+	return ""
+}
+
+func folderMessagesFlags(fm MailfolderManager) map[uint32]string {
+	messages := make(map[uint32]string)
+	for uid, message := range fm.GetMessages() {
+		messages[uid] = message.Flags
+	}
+	return messages
+}
+
+// planFolder computes the actions of the sync of a folder. The sync is done
+// on copies of the folders and of the syncstatus: the actions of the second
+// direction are computed after the ones of the first. With sizes the new
+// messages are read to get their size.
+func (s *Syncgroup) planFolder(folder Mailfolder, f *folderSync, sizes bool) (*FolderPlan, error) {
+	es, ok := f.syncstatus.(entriesSyncstatus)
+	if !ok {
+		return nil, fmt.Errorf("Cannot copy syncstatus %T", f.syncstatus)
+	}
+	entries, err := es.getEntries()
+	if err != nil {
+		return nil, err
+	}
+	syncstatus := newMemorySyncstatus(entries)
+
+	plan := &FolderPlan{
+		Syncgroup: s.name,
+		Folder:    folder.Name,
+		Stores:    make([]*PlanFolderState, 0, 2),
+		Actions:   make([]*PlanAction, 0),
+	}
+
+	for i, store := range s.stores {
+		plan.Stores = append(plan.Stores, &PlanFolderState{
+			Store:    store.Name(),
+			Exists:   f.exists[i],
+			FolderID: folderID(f.folders[i]),
+			Messages: folderMessagesFlags(f.folders[i]),
+		})
+	}
+
+	// Without a folder nothing can be synced: its messages would be seen
+	// as deleted
+	for i, store := range s.stores {
+		if !f.exists[i] && !s.ops[1-i].create {
+			logger := log.GetLogger(fmt.Sprintf("%s %s %s", "syncgroup", s.name, folder), s.globalconfig.LogLevel)
+			logger.Infof("Folder missing on store %s and its creation is disabled. Skipping folder", store.Name())
+			return plan, nil
+		}
+	}
+
+	var folders [2]*dryrunFolder
+	for i := range s.stores {
+		folders[i] = newDryrunFolder(nil, folder.Name, f.folders[i])
+		folders[i].load()
+		// The uids of the simulated new messages must not be the ones of
+		// messages removed from the folder but still in the syncstatus
+		for _, entry := range entries {
+			if entry.uids[i] >= folders[i].uidnext {
+				folders[i].uidnext = entry.uids[i] + 1
+			}
+		}
+	}
+
+	for src := Store1; src <= Store2; src++ {
+		dst := 1 - src
+		srcfolder := folders[src]
+		dstfolder := folders[dst]
+		srcstore := s.stores[src]
+		dststore := s.stores[dst]
+		syncstatus.SetSrcstore(src)
+
+		logprefix := fmt.Sprintf("%s %s %s -> %s %s", "syncgroup", s.name, srcstore.Name(), dststore.Name(), folder)
+		logger := log.GetLogger(logprefix, s.globalconfig.LogLevel)
+
+		newMessages, err := syncstatus.GetNewMessages(srcfolder)
+		if err != nil {
+			return nil, err
+		}
+		// Remove ignored messages
+		newMessages = removeIgnoredMessages(newMessages, srcfolder)
+		newMessages = s.removeMovedMessages(newMessages, folder.Name, src)
+		logger.Infof("There are %d new messages", len(newMessages))
+		if d, ok := dststore.(DownloadOnlyStore); ok && d.DownloadOnly() && len(newMessages) > 0 {
+			logger.Infof("Destination store is download only. Not adding the new messages")
+			newMessages = nil
+		}
+
+		deletedMessages, err := syncstatus.GetDeletedMessages(srcfolder)
+		if err != nil {
+			return nil, err
+		}
+		// Remove ignored messages
+		deletedMessages = removeIgnoredMessages(deletedMessages, srcfolder)
+		deletedMessages = s.removeMovedMessages(deletedMessages, folder.Name, src)
+		// The messages deleted also from the destination store (for
+		// example while the deletions propagation was disabled) are only
+		// removed from the syncstatus
+		deletedMessages, err = forgetDeletedMessages(plan, deletedMessages, src, syncstatus, dstfolder)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("There are %d deleted messages", len(deletedMessages))
+
+		changedMessages, err := syncstatus.GetChangedMessages(srcfolder)
+		if err != nil {
+			return nil, err
+		}
+		// Remove ignored messages
+		changedMessages = removeIgnoredMessages(changedMessages, srcfolder)
+		logger.Infof("There are %d changed messages", len(changedMessages))
+
+		ops := s.ops[src]
+		if !ops.new && len(newMessages) > 0 {
+			logger.Infof("New messages propagation disabled. Not adding the new messages")
+			newMessages = nil
+		}
+		if !ops.delete && len(deletedMessages) > 0 {
+			logger.Infof("Deletions propagation disabled. Not deleting the deleted messages")
+			deletedMessages = nil
+		}
+		if !ops.flags && len(changedMessages) > 0 {
+			logger.Infof("Flags propagation disabled. Not updating the changed messages")
+			changedMessages = nil
+		}
+
+		for _, srcuid := range newMessages {
+			flags, err := srcfolder.GetFlags(srcuid)
+			if err != nil {
+				return nil, err
+			}
+			action := &PlanAction{Action: PlanActionNew, Src: src, SrcUID: srcuid, Flags: flags}
+			if sizes {
+				body, err := f.folders[src].ReadMessage(srcuid)
+				if err != nil {
+					return nil, err
+				}
+				action.Size = len(body)
+			}
+			plan.Actions = append(plan.Actions, action)
+
+			dstuid, err := dstfolder.AddMessage(srcuid, flags, nil)
+			if err != nil {
+				return nil, err
+			}
+			syncstatus.Update(srcuid, dstuid, flags)
+		}
+
+		if s.config.Deletemode == "none" {
+			logger.Info("deletemode is none. Skipping message deletion")
+			deletedMessages = nil
+		}
+		for _, srcuid := range deletedMessages {
+			dstuid, err := syncstatus.GetDststoreUID(srcuid)
+			if err != nil {
+				return nil, err
+			}
+			flags, err := dstfolder.GetFlags(dstuid)
+			if err != nil {
+				return nil, fmt.Errorf("Delete error: %s", err)
+			}
+
+			switch s.config.Deletemode {
+			case "expunge":
+				plan.Actions = append(plan.Actions, &PlanAction{Action: PlanActionDelete, Src: src, SrcUID: srcuid, DstUID: dstuid, Flags: flags})
+				err = dstfolder.DeleteMessage(dstuid)
+			case "trash":
+				newflags := addFlags(flags, "T")
+				plan.Actions = append(plan.Actions, &PlanAction{Action: PlanActionTrash, Src: src, SrcUID: srcuid, DstUID: dstuid, Flags: newflags, OldFlags: flags})
+				err = dstfolder.SetFlags(dstuid, newflags)
+			default:
+				err = fmt.Errorf("Bad syncgroup deletemode(This should never happen!!!): \"%s\"", s.config.Deletemode)
+			}
+			if err != nil {
+				return nil, err
+			}
+			syncstatus.Delete(srcuid)
+		}
+
+		for _, srcuid := range changedMessages {
+			dstuid, err := syncstatus.GetDststoreUID(srcuid)
+			if err != nil {
+				return nil, err
+			}
+			// Deleted in the destination store
+			if !dstfolder.HasUID(dstuid) {
+				continue
+			}
+			flags, err := srcfolder.GetFlags(srcuid)
+			if err != nil {
+				return nil, err
+			}
+			oldflags, err := dstfolder.GetFlags(dstuid)
+			if err != nil {
+				return nil, err
+			}
+			plan.Actions = append(plan.Actions, &PlanAction{Action: PlanActionFlags, Src: src, SrcUID: srcuid, DstUID: dstuid, Flags: flags, OldFlags: oldflags})
+			if err = dstfolder.SetFlags(dstuid, flags); err != nil {
+				return nil, err
+			}
+			syncstatus.Update(srcuid, dstuid, flags)
+		}
+	}
+	return plan, nil
+}
+
+// forgetDeletedMessages adds a forget action for every deleted message
+// missing also in the destination folder and returns the other ones
+func forgetDeletedMessages(plan *FolderPlan, deletedMessages []uint32, src Storenumber, syncstatus Syncstatus, dstfolder MailfolderManager) ([]uint32, error) {
+	deleted := make([]uint32, 0, len(deletedMessages))
+	for _, srcuid := range deletedMessages {
+		dstuid, err := syncstatus.GetDststoreUID(srcuid)
+		if err != nil {
+			return nil, err
+		}
+		if dstfolder.HasUID(dstuid) {
+			deleted = append(deleted, srcuid)
+			continue
+		}
+		plan.Actions = append(plan.Actions, &PlanAction{Action: PlanActionForget, Src: src, SrcUID: srcuid, DstUID: dstuid})
+		syncstatus.Delete(srcuid)
+	}
+	return deleted, nil
+}
+
+// checkMassDelete returns an error if the plan deletes from a store more
+// messages than the syncgroup maxdeletecount or maxdeletepercent of the
+// synced ones
+func (s *Syncgroup) checkMassDelete(plan *FolderPlan, f *folderSync) error {
+	if s.allowmassdelete || (s.config.Maxdeletecount == 0 && s.config.Maxdeletepercent == 0) {
+		return nil
+	}
+	var deletions [2]uint
+	for _, action := range plan.Actions {
+		if (action.Action == PlanActionDelete || action.Action == PlanActionTrash) && (action.Src == Store1 || action.Src == Store2) {
+			deletions[1-action.Src]++
+		}
+	}
+	if deletions[Store1] == 0 && deletions[Store2] == 0 {
+		return nil
+	}
+
+	es, ok := f.syncstatus.(entriesSyncstatus)
+	if !ok {
+		return fmt.Errorf("Cannot copy syncstatus %T", f.syncstatus)
+	}
+	entries, err := es.getEntries()
+	if err != nil {
+		return err
+	}
+	synced := uint(len(entries))
+
+	for i, store := range s.stores {
+		if s.config.Maxdeletecount > 0 && deletions[i] > s.config.Maxdeletecount {
+			return fmt.Errorf("Refusing to delete %d of %d synced messages from store %s: more than maxdeletecount (%d). Use --allow-mass-delete to allow it", deletions[i], synced, store.Name(), s.config.Maxdeletecount)
+		}
+		if s.config.Maxdeletepercent > 0 && deletions[i]*100 > uint(s.config.Maxdeletepercent)*synced {
+			return fmt.Errorf("Refusing to delete %d of %d synced messages from store %s: more than maxdeletepercent (%d%%). Use --allow-mass-delete to allow it", deletions[i], synced, store.Name(), s.config.Maxdeletepercent)
+		}
+	}
+	return nil
+}
+
+// transferMessage copies a new message to the destination folder and
+// returns its uid and body. A message with a global id is linked, without
+// reading it (the body is nil), if the destination store already has it,
+// else the id is recorded after adding it.
+func transferMessage(srcfolder MailfolderManager, dstfolder MailfolderManager, action *PlanAction) (uint32, []byte, error) {
+	var id string
+	if ider, ok := srcfolder.(GlobalMessageIDer); ok {
+		id = ider.GlobalMessageID(action.SrcUID)
+	}
+	linker, ok := dstfolder.(MessageLinker)
+	if id != "" && ok {
+		dstuid, linked, err := linker.LinkMessage(action.SrcUID, action.Flags, id)
+		if err != nil {
+			return 0, nil, fmt.Errorf("LinkMessage error: %s", err)
+		}
+		if linked {
+			return dstuid, nil, nil
+		}
+	}
+
+	body, err := srcfolder.ReadMessage(action.SrcUID)
+	if err != nil {
+		return 0, nil, err
+	}
+	dstuid, err := dstfolder.AddMessage(action.SrcUID, action.Flags, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("AddMessage error: %s", err)
+	}
+	if id != "" && ok {
+		if err = linker.SetGlobalMessageID(dstuid, id); err != nil {
+			return 0, nil, err
+		}
+	}
+	return dstuid, body, nil
+}
+
+// applyFolderPlan executes the plan actions updating the syncstatus after
+// every one of them. Before any action the plan deletions are checked
+// against the mass deletion limits.
+func (s *Syncgroup) applyFolderPlan(plan *FolderPlan, f *folderSync) (err error) {
+	syncstatus := f.syncstatus
+
+	if err = s.checkMassDelete(plan, f); err != nil {
+		return err
+	}
+
+	mapping := s.getFolderMapping()
+	for _, action := range plan.Actions {
+		src := action.Src
+		dst := 1 - src
+		if src != Store1 && src != Store2 {
+			return fmt.Errorf("Wrong action source store: %d", src)
+		}
+		srcfolder := f.folders[src]
+		dstfolder := f.folders[dst]
+		dststore := s.stores[dst]
+
+		logprefix := fmt.Sprintf("%s %s %s -> %s %s", "syncgroup", s.name, s.stores[src].Name(), dststore.Name(), FolderToStorePath(plan.Folder, '/'))
+		errprefix := logprefix
+		logger := log.GetLogger(logprefix, s.globalconfig.LogLevel)
+		e := errors.New(errprefix)
+
+		syncstatus.SetSrcstore(src)
+		syncstatus.BeginTx()
+
+		// The uid of the source message added to the destination store
+		var downloaded uint32
+
+		switch action.Action {
+		case PlanActionNew:
+			logger.Infof("Adding message with srcuid: %d to destination store: %s", action.SrcUID, dststore.Name())
+
+			dstuid, body, err := transferMessage(srcfolder, dstfolder, action)
+			if err != nil {
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+			logger.Debug("Received dstuid: ", dstuid)
+
+			// Ask srcfolder if it wants to update its message
+			srcuid, err := srcfolder.Update(action.SrcUID)
+			if err != nil {
+				// TODO remove message from dstfolder if srcfolder.Update() failed?
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+			err = syncstatus.Update(srcuid, dstuid, action.Flags)
+			if err != nil {
+				logger.Errorf("error: %s", err)
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+			// Used to detect the moves of the message and to verify
+			// the syncstatus
+			if body != nil {
+				if err = syncstatus.SetMessageIdentity(srcuid, newMessageIdentity(body)); err != nil {
+					syncstatus.Rollback()
+					return e.E(err)
+				}
+			}
+			downloaded = srcuid
+
+		case PlanActionDelete, PlanActionTrash:
+			logger.Debugf("Deleting message with dstuid: %d from destination store: %s", action.DstUID, dststore.Name())
+
+			if action.Action == PlanActionDelete {
+				// A message removed from the server after the
+				// download cannot be read
+				if s.config.Quarantine && !s.dryrun && !downloadRemoved(dstfolder, action.DstUID) {
+					logger.Debug("Quarantining message")
+					var body []byte
+					body, err = dstfolder.ReadMessage(action.DstUID)
+					if err == nil {
+						err = s.quarantineMessage(plan.Folder, mapping.storeFolderName(plan.Folder, dst), dst, action.DstUID, action.SrcUID, action.Flags, body)
+					}
+					if err != nil {
+						err := fmt.Errorf("Quarantine error: %s", err)
+						syncstatus.Rollback()
+						return e.E(err)
+					}
+				}
+				logger.Debug("Real deleting message")
+				err = dstfolder.DeleteMessage(action.DstUID)
+			} else {
+				logger.Debug("Marking message ad Deleted")
+				err = dstfolder.SetFlags(action.DstUID, action.Flags)
+			}
+			if err != nil {
+				err := fmt.Errorf("Delete error: %s", err)
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+			err = syncstatus.Delete(action.SrcUID)
+			if err != nil {
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+
+		case PlanActionForget:
+			logger.Debugf("Removing message with srcuid %d deleted from both the stores from the syncstatus", action.SrcUID)
+			if err = syncstatus.Delete(action.SrcUID); err != nil {
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+
+		case PlanActionFlags:
+			logger.Debugf("Updating message flags to message with dstuid %d in destination store %s to flags: \"%s\"", action.DstUID, dststore.Name(), action.Flags)
+
+			err = dstfolder.SetFlags(action.DstUID, action.Flags)
+			if err != nil {
+				err := fmt.Errorf("dstfolder.SetFlags error: %s", err)
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+			err = syncstatus.Update(action.SrcUID, action.DstUID, action.Flags)
+			if err != nil {
+				syncstatus.Rollback()
+				return e.E(err)
+			}
+
+		default:
+			syncstatus.Rollback()
+			return e.E(fmt.Errorf("Wrong plan action: %q", action.Action))
+		}
+
+		err = syncstatus.Commit()
+		if err != nil {
+			return e.E(err)
+		}
+
+		// Only now the message can be removed from the source server
+		if r, ok := srcfolder.(DownloadedMessageRemover); ok && downloaded != 0 {
+			if err = r.RemoveDownloadedMessage(downloaded); err != nil {
+				return e.E(err)
+			}
+		}
+	}
+	return nil
+}
+
+// pendingSyncMoves returns the pending moves of the syncgroup folders if
+// detectmoves is enabled
+func (s *Syncgroup) pendingSyncMoves() (map[string]int, error) {
+	if !s.config.Detectmoves {
+		return nil, nil
+	}
+	folders, err := s.getSyncFolders()
+	if err != nil {
+		return nil, err
+	}
+	return s.pendingMoves(folders)
+}
+
+// PlanFolder returns the plan of the sync of a folder without changing the
+// stores
+func (s *Syncgroup) PlanFolder(folder Mailfolder) (plan *FolderPlan, err error) {
+	pending, err := s.pendingSyncMoves()
+	if err != nil {
+		return nil, s.e.E(err)
+	}
+	return s.planFolderMoves(folder, pending)
+}
+
+// planFolderMoves returns the plan of the sync of a folder with its pending
+// moves
+func (s *Syncgroup) planFolderMoves(folder Mailfolder, pending map[string]int) (plan *FolderPlan, err error) {
+	logprefix := fmt.Sprintf("%s %s %s", "syncgroup", s.name, folder)
+	e := errors.New(logprefix)
+
+	f, err := s.openFolder(folder, false)
+	if err != nil {
+		return nil, e.E(err)
+	}
+	defer f.Close()
+
+	plan, err = s.planFolder(folder, f, true)
+	if err != nil {
+		return nil, e.E(err)
+	}
+	plan.Moves = pending[folder.String()]
+	return plan, nil
+}
+
+// Plan returns the plans of the sync of all the syncgroup folders
+func (s *Syncgroup) Plan() ([]*FolderPlan, error) {
+	folders, err := s.getSyncFolders()
+	if err != nil {
+		return nil, s.e.E(err)
+	}
+
+	pending, err := s.pendingSyncMoves()
+	if err != nil {
+		return nil, s.e.E(err)
+	}
+
+	plans := make([]*FolderPlan, 0, len(folders))
+	for _, folder := range folders {
+		plan, err := s.planFolderMoves(folder, pending)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// checkFolderPlan returns an error if the plan isn't of the syncgroup
+// stores, if it would delete and transfer again moved messages or if the
+// folder was created or removed on a store after the plan
+func (s *Syncgroup) checkFolderPlan(plan *FolderPlan) error {
+	if plan.Syncgroup != s.name {
+		return fmt.Errorf("Plan of syncgroup %s", plan.Syncgroup)
+	}
+	if plan.Moves > 0 && s.config.Detectmoves {
+		return fmt.Errorf("Plan deletes and transfers again %d moved messages: sync the syncgroup to move them", plan.Moves)
+	}
+	if len(plan.Stores) != len(s.stores) {
+		return fmt.Errorf("Wrong number of stores in plan: %d", len(plan.Stores))
+	}
+	mapping := s.getFolderMapping()
+	for i, store := range s.stores {
+		state := plan.Stores[i]
+		if state.Store != store.Name() {
+			return fmt.Errorf("Plan store %s doesn't match store %s", state.Store, store.Name())
+		}
+		if state.Exists != store.HasFolder(mapping.storeFolderName(plan.Folder, Storenumber(i))) {
+			return fmt.Errorf("Folder was created or removed on store %s after the plan", store.Name())
+		}
+	}
+	return nil
+}
+
+// checkFolderPlanMessages returns an error if the id or the messages of
+// the opened folders changed after the plan
+func (s *Syncgroup) checkFolderPlanMessages(plan *FolderPlan, f *folderSync) error {
+	for i, store := range s.stores {
+		state := plan.Stores[i]
+		if id := folderID(f.folders[i]); state.Exists && id != state.FolderID {
+			return fmt.Errorf("Folder id changed on store %s after the plan: %q, plan: %q", store.Name(), id, state.FolderID)
+		}
+		messages := folderMessagesFlags(f.folders[i])
+		if len(messages) != 0 || len(state.Messages) != 0 {
+			if !reflect.DeepEqual(messages, state.Messages) {
+				return fmt.Errorf("Messages changed on store %s after the plan", store.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// CheckFolderPlan returns an error if the folders changed after the plan
+// was made or if the plan exceeds the mass deletion limits. Check all the
+// plans before applying any of them.
+func (s *Syncgroup) CheckFolderPlan(plan *FolderPlan) (err error) {
+	folder := Mailfolder{Name: plan.Folder}
+	logprefix := fmt.Sprintf("%s %s %s", "syncgroup", s.name, folder)
+	e := errors.New(logprefix)
+
+	if err = s.checkFolderPlan(plan); err != nil {
+		return e.E(err)
+	}
+	f, err := s.openFolder(folder, false)
+	if err != nil {
+		return e.E(err)
+	}
+	defer f.Close()
+	if err = s.checkFolderPlanMessages(plan, f); err != nil {
+		return e.E(err)
+	}
+	return e.E(s.checkMassDelete(plan, f))
+}
+
+// ApplyFolderPlan executes a plan made by PlanFolder. It fails if the
+// folders changed after the plan was made.
+func (s *Syncgroup) ApplyFolderPlan(plan *FolderPlan) (err error) {
+	folder := Mailfolder{Name: plan.Folder}
+	logprefix := fmt.Sprintf("%s %s %s", "syncgroup", s.name, folder)
+	e := errors.New(logprefix)
+
+	if err = s.checkFolderPlan(plan); err != nil {
+		return e.E(err)
+	}
+
+	f, err := s.openFolder(folder, true)
+	if err != nil {
+		return e.E(err)
+	}
+	defer f.Close()
+
+	if err = s.checkFolderPlanMessages(plan, f); err != nil {
+		return e.E(err)
+	}
+
+	err = s.applyFolderPlan(plan, f)
+	if err != nil {
+		return e.E(err)
+	}
+	return nil
+}
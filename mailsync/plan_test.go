@@ -0,0 +1,195 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testPlanFolder returns the plan of the folder saved and loaded again
+func testPlanFolder(t *testing.T, syncgroup *Syncgroup, folder Mailfolder) *FolderPlan {
+	dryrunsyncgroup, _ := newTestDryrunSyncgroup(t, syncgroup)
+	plan, err := dryrunsyncgroup.PlanFolder(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&SyncPlan{Folders: []*FolderPlan{plan}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncplan := &SyncPlan{}
+	if err = json.Unmarshal(data, syncplan); err != nil {
+		t.Fatal(err)
+	}
+	return syncplan.Folders[0]
+}
+
+func TestPlanApply(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	uid1 := backend1.AddMessage(memoryTestFolder.Name, "S", []byte("Subject: 1\r\n\r\n"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 22\r\n\r\n"))
+
+	plan := testPlanFolder(t, syncgroup, memoryTestFolder)
+	expected := []*PlanAction{
+		{Action: PlanActionNew, Src: Store1, SrcUID: 1, Flags: "S", Size: 14},
+		{Action: PlanActionNew, Src: Store1, SrcUID: 2, Flags: "", Size: 15},
+	}
+	if !reflect.DeepEqual(plan.Actions, expected) {
+		t.Fatalf("Wrong plan actions: %v", plan.Actions)
+	}
+	if !plan.Stores[0].Exists || plan.Stores[0].FolderID != "1" || len(plan.Stores[0].Messages) != 2 {
+		t.Fatalf("Wrong plan store state: %v", plan.Stores[0])
+	}
+	if len(backend2.Messages(memoryTestFolder.Name)) != 0 {
+		t.Fatalf("The plan changed the store")
+	}
+
+	if err := syncgroup.CheckFolderPlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncgroup.ApplyFolderPlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+
+	// Changes after the plan
+	backend1.SetFlags(memoryTestFolder.Name, uid1, "FS")
+	plan = testPlanFolder(t, syncgroup, memoryTestFolder)
+	expected = []*PlanAction{
+		{Action: PlanActionFlags, Src: Store1, SrcUID: 1, DstUID: 1, Flags: "FS", OldFlags: "S"},
+	}
+	if !reflect.DeepEqual(plan.Actions, expected) {
+		t.Fatalf("Wrong plan actions: %v", plan.Actions)
+	}
+	backend2.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 3\r\n\r\n"))
+	if err := syncgroup.CheckFolderPlan(plan); err == nil {
+		t.Fatalf("Expected an error checking the plan of a changed folder")
+	}
+	if err := syncgroup.ApplyFolderPlan(plan); err == nil {
+		t.Fatalf("Expected an error applying the plan of a changed folder")
+	}
+	if flags := backend2.Messages(memoryTestFolder.Name)[1]; flags != "S" {
+		t.Fatalf("The refused plan changed the store: %q", flags)
+	}
+
+	// A folder created after the plan
+	plan = testPlanFolder(t, syncgroup, Mailfolder{Name: foldername{"work"}})
+	backend1.CreateFolder(foldername{"work"})
+	syncgroup.stores[0].UpdateFolderList()
+	if err := syncgroup.ApplyFolderPlan(plan); err == nil {
+		t.Fatalf("Expected an error applying the plan of a created folder")
+	}
+}
+
+func TestMassDeleteGuard(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	uids := make([]uint32, 0)
+	for i := 0; i < 4; i++ {
+		uids = append(uids, backend1.AddMessage(memoryTestFolder.Name, "", []byte(fmt.Sprintf("Subject: %d\r\n\r\n", i))))
+	}
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	backend1.DeleteMessage(memoryTestFolder.Name, uids[0])
+	backend1.DeleteMessage(memoryTestFolder.Name, uids[1])
+	backend1.DeleteMessage(memoryTestFolder.Name, uids[2])
+	for _, limits := range [][2]uint{{2, 0}, {0, 50}} {
+		syncgroup.config.Maxdeletecount = limits[0]
+		syncgroup.config.Maxdeletepercent = uint8(limits[1])
+		if err := syncgroup.SyncFolder(memoryTestFolder); err == nil {
+			t.Fatalf("Expected a mass deletion error with limits %v", limits)
+		}
+		if len(backend2.Messages(memoryTestFolder.Name)) != 4 {
+			t.Fatalf("Messages deleted with limits %v", limits)
+		}
+	}
+
+	syncgroup.config.Maxdeletepercent = 75
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+
+	syncgroup.config.Maxdeletecount = 1
+	syncgroup.config.Maxdeletepercent = 0
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 5\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	for uid := range backend2.Messages(memoryTestFolder.Name) {
+		backend2.DeleteMessage(memoryTestFolder.Name, uid)
+	}
+	if err := syncgroup.SyncFolder(memoryTestFolder); err == nil {
+		t.Fatal("Expected a mass deletion error")
+	}
+	syncgroup.SetAllowMassDelete(true)
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+}
+
+func TestPlanMoves(t *testing.T) {
+	syncgroup, backend1, _ := newTestMemorySyncgroup(t, "expunge")
+	syncgroup.config.Detectmoves = true
+	archive := Mailfolder{Name: foldername{"Archive"}}
+	uid1 := backend1.AddMessage(memoryTestFolder.Name, "", []byte("Message-ID: <1@example.com>\r\n\r\n1"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 2\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend1.MoveMessage(memoryTestFolder.Name, uid1, archive.Name); err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range syncgroup.stores {
+		store.UpdateFolderList()
+	}
+
+	// The plans of both the folders would delete and transfer again the
+	// moved message
+	for _, folder := range []Mailfolder{memoryTestFolder, archive} {
+		plan := testPlanFolder(t, syncgroup, folder)
+		if plan.Moves != 1 {
+			t.Fatalf("Expected 1 move in folder %s plan, found: %d", folder, plan.Moves)
+		}
+		if err := syncgroup.CheckFolderPlan(plan); err == nil {
+			t.Fatalf("Expected an error checking a plan with moves")
+		}
+		if err := syncgroup.ApplyFolderPlan(plan); err == nil {
+			t.Fatalf("Expected an error applying a plan with moves")
+		}
+	}
+
+	// After the moves the plans can be applied
+	if err := syncgroup.syncMoves([]Mailfolder{archive, memoryTestFolder}); err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []Mailfolder{memoryTestFolder, archive} {
+		plan := testPlanFolder(t, syncgroup, folder)
+		if plan.Moves != 0 {
+			t.Fatalf("Expected no moves in folder %s plan, found: %d", folder, plan.Moves)
+		}
+		if err := syncgroup.ApplyFolderPlan(plan); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pop3Timeout = 5 * time.Minute
+
+var pop3TimestampRe = regexp.MustCompile(`<[^<>]+@[^<>]+>`)
+
+// pop3Client is a minimal POP3 (RFC 1939) client
+type pop3Client struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	timestamp string
+}
+
+func dialPOP3(addr string, usetls bool, tlsconfig *tls.Config) (*pop3Client, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: pop3Timeout}
+	if usetls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsconfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pop3Client{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.response()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The APOP timestamp
+	c.timestamp = pop3TimestampRe.FindString(greeting)
+	return c, nil
+}
+
+func (c *pop3Client) readLine() (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(pop3Timeout))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// response reads a single line response returning its text without the
+// status indicator
+func (c *pop3Client) response() (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(line[3:]), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", fmt.Errorf("POP3 error: %s", strings.TrimSpace(line[4:]))
+	}
+	return "", fmt.Errorf("Wrong POP3 response: %q", line)
+}
+
+// multiline reads the lines of a multiline response until the terminating
+// "." removing the byte stuffing
+func (c *pop3Client) multiline() ([]string, error) {
+	lines := make([]string, 0)
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "." {
+			return lines, nil
+		}
+		if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (c *pop3Client) Cmd(format string, args ...interface{}) (string, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(pop3Timeout))
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+func (c *pop3Client) StartTLS(tlsconfig *tls.Config, host string) error {
+	if _, err := c.Cmd("STLS"); err != nil {
+		return err
+	}
+	if tlsconfig == nil {
+		tlsconfig = &tls.Config{}
+	}
+	if tlsconfig.ServerName == "" {
+		tlsconfig = tlsconfig.Clone()
+		tlsconfig.ServerName = host
+	}
+	tlsconn := tls.Client(c.conn, tlsconfig)
+	if err := tlsconn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsconn
+	c.r = bufio.NewReader(tlsconn)
+	return nil
+}
+
+// Login authenticates with APOP if apop is true, else with USER/PASS
+func (c *pop3Client) Login(username string, password string, apop bool) error {
+	if apop {
+		if c.timestamp == "" {
+			return fmt.Errorf("Server doesn't support APOP")
+		}
+		digest := fmt.Sprintf("%x", md5.Sum([]byte(c.timestamp+password)))
+		_, err := c.Cmd("APOP %s %s", username, digest)
+		return err
+	}
+	if _, err := c.Cmd("USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.Cmd("PASS %s", password)
+	return err
+}
+
+// Uidl returns the unique id of every message by message number
+func (c *pop3Client) Uidl() (map[int]string, error) {
+	if _, err := c.Cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := c.multiline()
+	if err != nil {
+		return nil, err
+	}
+	uidls := make(map[int]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Wrong UIDL line: %q", line)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Wrong UIDL line: %q", line)
+		}
+		uidls[n] = fields[1]
+	}
+	return uidls, nil
+}
+
+func (c *pop3Client) Retr(n int) ([]byte, error) {
+	if _, err := c.Cmd("RETR %d", n); err != nil {
+		return nil, err
+	}
+	lines, err := c.multiline()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *pop3Client) Dele(n int) error {
+	_, err := c.Cmd("DELE %d", n)
+	return err
+}
+
+// Quit ends the session. The messages marked as deleted are removed by the
+// server only if it succeeds.
+func (c *pop3Client) Quit() error {
+	_, err := c.Cmd("QUIT")
+	c.conn.Close()
+	return err
+}
+
+func (c *pop3Client) Close() error {
+	return c.conn.Close()
+}
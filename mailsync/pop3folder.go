@@ -0,0 +1,400 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// The "uidl" file in the folder metadatadir contains the next uid and a line
+// with uid, UIDL, state (0, 1 if deleted or 2 if downloaded) and flags for
+// every message. Messages are marked as deleted before the DELE command,
+// since the server really removes them only after a successful QUIT they
+// are deleted again in the next session if still there. The downloaded
+// messages (see the deleteafterdownload option) are removed from the server
+// in the same way but are kept as present in the store until they are
+// deleted.
+const pop3UIDLFile = "uidl"
+
+type POP3Folder struct {
+	folder      *Mailfolder
+	store       *POP3Store
+	metadatadir string
+	client      *pop3Client
+	messages    map[uint32]*POP3MessageInfo
+	uids        map[string]uint32
+	uidnext     uint32
+	logger      *log.Logger
+	e           *errors.Error
+	dryrun      bool
+}
+
+type POP3MessageInfo struct {
+	MessageInfo
+
+	UIDL    string
+	Number  int
+	Deleted bool
+	// Removed from the server after being added to the other store
+	Downloaded bool
+}
+
+func NewPOP3Folder(folder *Mailfolder, metadatadir string, store *POP3Store, dryrun bool) (m *POP3Folder, err error) {
+	logprefix := fmt.Sprintf("store: %s, pop3folder: %s", store.Name(), folder)
+	errprefix := fmt.Sprintf("store: %s, pop3folder: %s", store.Name(), folder)
+	logger := log.GetLogger(logprefix, store.globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	m = &POP3Folder{
+		folder:      folder,
+		store:       store,
+		metadatadir: metadatadir,
+		messages:    make(map[uint32]*POP3MessageInfo),
+		uids:        make(map[string]uint32),
+		uidnext:     1,
+		logger:      logger,
+		e:           e,
+		dryrun:      dryrun,
+	}
+
+	return m, nil
+}
+
+func (m *POP3Folder) registerMessage(uid uint32, uidl string, flags string, deleted bool, downloaded bool) {
+	m.messages[uid] = &POP3MessageInfo{MessageInfo{uid, flags, false}, uidl, 0, deleted, downloaded}
+	m.uids[uidl] = uid
+	if uid >= m.uidnext {
+		m.uidnext = uid + 1
+	}
+}
+
+func (m *POP3Folder) load() error {
+	m.messages = make(map[uint32]*POP3MessageInfo)
+	m.uids = make(map[string]uint32)
+	m.uidnext = 1
+
+	f, err := os.Open(filepath.Join(m.metadatadir, pop3UIDLFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "uidnext" && len(fields) == 2 {
+			uidnext, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return fmt.Errorf("Wrong uidnext in %s: %s", f.Name(), fields[1])
+			}
+			if uint32(uidnext) > m.uidnext {
+				m.uidnext = uint32(uidnext)
+			}
+			continue
+		}
+		if len(fields) != 3 && len(fields) != 4 {
+			return fmt.Errorf("Wrong line in %s: %q", f.Name(), scanner.Text())
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || uid == 0 {
+			return fmt.Errorf("Wrong uid in %s: %s", f.Name(), fields[0])
+		}
+		flags := ""
+		if len(fields) == 4 {
+			flags = fields[3]
+		}
+		m.registerMessage(uint32(uid), fields[1], flags, fields[2] == "1", fields[2] == "2")
+	}
+	return scanner.Err()
+}
+
+func (m *POP3Folder) save() error {
+	uids := make([]uint32, 0, len(m.messages))
+	for uid := range m.messages {
+		uids = append(uids, uid)
+	}
+	sort.Sort(Uint32Slice(uids))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "uidnext %d\n", m.uidnext)
+	for _, uid := range uids {
+		message := m.messages[uid]
+		state := 0
+		if message.Deleted {
+			state = 1
+		} else if message.Downloaded {
+			state = 2
+		}
+		fmt.Fprintf(&buf, "%d %s %d %s\n", uid, message.UIDL, state, message.Flags)
+	}
+	return writeFileAtomic(filepath.Join(m.metadatadir, pop3UIDLFile), buf.Bytes(), m.store.config.Fsync)
+}
+
+func (m *POP3Folder) getPOP3Client() (*pop3Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+	client, err := m.store.newPOP3Client()
+	if err != nil {
+		return nil, err
+	}
+	m.client = client
+	return client, nil
+}
+
+func (m *POP3Folder) UpdateMessageList() error {
+	if err := m.load(); err != nil {
+		return m.e.E(err)
+	}
+
+	client, err := m.getPOP3Client()
+	if err != nil {
+		return m.e.E(err)
+	}
+	uidls, err := client.Uidl()
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	numbers := make([]int, 0, len(uidls))
+	for n := range uidls {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	found := make(map[uint32]bool, len(uidls))
+	for _, n := range numbers {
+		uidl := uidls[n]
+		uid, ok := m.uids[uidl]
+		if !ok {
+			uid = m.uidnext
+			m.registerMessage(uid, uidl, "", false, false)
+		}
+		message := m.messages[uid]
+		message.Number = n
+		found[uid] = true
+
+		// Not removed by a previous session
+		if (message.Deleted || message.Downloaded) && !m.dryrun {
+			m.logger.Debugf("Deleting again message with uid %d", uid)
+			if err = client.Dele(n); err != nil {
+				return m.e.E(err)
+			}
+		}
+	}
+
+	// Forget the messages removed from the server, except the downloaded
+	// ones
+	for uid, message := range m.messages {
+		if !found[uid] && !message.Downloaded {
+			delete(m.uids, message.UIDL)
+			delete(m.messages, uid)
+		}
+	}
+
+	if m.dryrun {
+		return nil
+	}
+	if err = m.save(); err != nil {
+		return m.e.E(err)
+	}
+	return nil
+}
+
+func (m *POP3Folder) getMessage(uid uint32) (*POP3MessageInfo, error) {
+	if message, ok := m.messages[uid]; ok && !message.Deleted {
+		return message, nil
+	}
+	return nil, fmt.Errorf("Cannot find message with uid: %d", uid)
+}
+
+func (m *POP3Folder) HasUID(uid uint32) bool {
+	_, err := m.getMessage(uid)
+	return err == nil
+}
+
+func (m *POP3Folder) IsIgnored(uid uint32) bool {
+	if message, err := m.getMessage(uid); err == nil {
+		return message.Ignore
+	}
+	return false
+}
+
+func (m *POP3Folder) GetFlags(uid uint32) (flags string, err error) {
+	message, err := m.getMessage(uid)
+	if err != nil {
+		return "", m.e.E(err)
+	}
+	return message.Flags, nil
+}
+
+// SetFlags only saves the flags in the metadatadir since POP3 doesn't have
+// them
+func (m *POP3Folder) SetFlags(uid uint32, flags string) (err error) {
+	message, err := m.getMessage(uid)
+	if err != nil {
+		return m.e.E(err)
+	}
+	message.Flags = flags
+	if err = m.save(); err != nil {
+		return m.e.E(err)
+	}
+	return nil
+}
+
+func (m *POP3Folder) ReadMessage(uid uint32) ([]byte, error) {
+	message, err := m.getMessage(uid)
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	if message.Downloaded {
+		return nil, m.e.E(fmt.Errorf("Message with uid %d was removed from the server after the download", uid))
+	}
+	client, err := m.getPOP3Client()
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	body, err := client.Retr(message.Number)
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	return body, nil
+}
+
+func (m *POP3Folder) AddMessage(srcuid uint32, flags string, body []byte) (uint32, error) {
+	return 0, m.e.E(fmt.Errorf("Cannot add messages to a POP3 store"))
+}
+
+func (m *POP3Folder) DeleteMessage(uid uint32) error {
+	message, err := m.getMessage(uid)
+	if err != nil {
+		return m.e.E(err)
+	}
+	// Already removed from the server (or by the next session)
+	if message.Downloaded {
+		message.Downloaded = false
+		message.Deleted = true
+		if err = m.save(); err != nil {
+			return m.e.E(err)
+		}
+		return nil
+	}
+	client, err := m.getPOP3Client()
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	message.Deleted = true
+	if err = m.save(); err != nil {
+		return m.e.E(err)
+	}
+	if err = client.Dele(message.Number); err != nil {
+		return m.e.E(err)
+	}
+	return nil
+}
+
+// RemoveDownloadedMessage deletes from the server a message added to the
+// other store if the deleteafterdownload option is enabled
+func (m *POP3Folder) RemoveDownloadedMessage(uid uint32) error {
+	if !m.store.config.Deleteafterdownload || m.dryrun {
+		return nil
+	}
+	message, err := m.getMessage(uid)
+	if err != nil {
+		return m.e.E(err)
+	}
+	if message.Downloaded {
+		return nil
+	}
+	client, err := m.getPOP3Client()
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	m.logger.Debugf("Deleting downloaded message with uid %d from the server", uid)
+	message.Downloaded = true
+	if err = m.save(); err != nil {
+		return m.e.E(err)
+	}
+	if err = client.Dele(message.Number); err != nil {
+		return m.e.E(err)
+	}
+	return nil
+}
+
+func (m *POP3Folder) DownloadRemoved(uid uint32) bool {
+	message, err := m.getMessage(uid)
+	return err == nil && message.Downloaded
+}
+
+func (m *POP3Folder) Update(srcuid uint32) (uint32, error) {
+	return srcuid, nil
+}
+
+func (m *POP3Folder) GetMessages() map[uint32]*MessageInfo {
+	messages := make(map[uint32]*MessageInfo, 0)
+
+	for uid, message := range m.messages {
+		if !message.Deleted {
+			messages[uid] = &message.MessageInfo
+		}
+	}
+
+	return messages
+}
+
+func (m *POP3Folder) GetIgnoredMessages() []uint32 {
+	messages := make([]uint32, 0)
+
+	for _, message := range m.messages {
+		if message.Ignore && !message.Deleted {
+			messages = append(messages, message.UID)
+		}
+	}
+	return messages
+}
+
+// Close ends the POP3 session, the server removes the deleted messages
+func (m *POP3Folder) Close() (err error) {
+	if m.client == nil {
+		return
+	}
+	err = m.client.Quit()
+	m.client = nil
+	if err != nil {
+		return m.e.E(err)
+	}
+	return
+}
@@ -0,0 +1,335 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sgotti/gomailsync/config"
+	"github.com/sgotti/gomailsync/tests/pop3mock"
+)
+
+func newTestPOP3StoreConfig(server *pop3mock.Server) (*config.Config, *config.StoreConfig) {
+	shost, sportstr, _ := net.SplitHostPort(server.GetServerAddress().String())
+	sport, _ := strconv.ParseUint(sportstr, 10, 16)
+	testdir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	metadatadir := filepath.Join(testdir, "metadatadir")
+	os.Mkdir(metadatadir, 0777)
+
+	storeconf := &config.StoreConfig{
+		Name:      "store1",
+		StoreType: "POP3",
+		Host:      shost,
+		Port:      uint16(sport),
+		Username:  "user",
+		Password:  "password",
+	}
+	globalconfig := &config.Config{
+		Metadatadir: metadatadir,
+		Stores:      []*config.StoreConfig{storeconf},
+		LogLevel:    "debug",
+	}
+	return globalconfig, storeconf
+}
+
+func TestPOP3Folder(t *testing.T) {
+	server := pop3mock.NewMockPOP3Server(t, "user", "password", false)
+	defer server.Close()
+	server.AddMessage("u1", []byte("Subject: 1\r\n\r\nbody\r\n"))
+	server.AddMessage("u2", []byte("Subject: 2\r\n\r\n.dot line\r\n"))
+	server.AddMessage("u3", []byte("Subject: 3\r\n\r\n"))
+
+	globalconfig, storeconf := newTestPOP3StoreConfig(server)
+	storeconf.Starttls = true
+	storeconf.Validateservercert = false
+
+	store, err := newStore(globalconfig, storeconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := foldername{"INBOX"}
+	if folders := store.GetFolders(); len(folders) != 1 || !StrsEquals(folders[0].Name, name) {
+		t.Fatalf("Expected only the INBOX folder, found folders: %v", folders)
+	}
+
+	fm, err := store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fm.GetMessages()) != 3 {
+		t.Fatalf("Expected 3 messages, found: %v", fm.GetMessages())
+	}
+	body, err := fm.ReadMessage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Subject: 2\r\n\r\n.dot line\r\n" {
+		t.Fatalf("Wrong message body: %q", body)
+	}
+	if _, err = fm.AddMessage(0, "", []byte("Subject: new\r\n\r\n")); err == nil {
+		t.Fatalf("Expected error adding a message to a POP3 store")
+	}
+	if err = fm.SetFlags(1, "S"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DeleteMessage(3); err != nil {
+		t.Fatal(err)
+	}
+	if fm.HasUID(3) {
+		t.Fatalf("Deleted message uid 3 still present")
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Messages()) != 2 {
+		t.Fatalf("Expected 2 messages on the server, found %d", len(server.Messages()))
+	}
+
+	// A deletion not committed by QUIT is done again in the next session
+	server.AddMessage("u4", []byte("Subject: 4\r\n\r\n"))
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ := fm.GetFlags(1); flags != "S" {
+		t.Fatalf("Expected flags \"S\" for message 1, found \"%s\"", flags)
+	}
+	if !fm.HasUID(4) || fm.HasUID(3) {
+		t.Fatalf("Wrong messages: %v", fm.GetMessages())
+	}
+	if err = fm.DeleteMessage(2); err != nil {
+		t.Fatal(err)
+	}
+	fm.(*POP3Folder).client.Close()
+	fm.(*POP3Folder).client = nil
+	if len(server.Messages()) != 3 {
+		t.Fatalf("Expected 3 messages on the server, found %d", len(server.Messages()))
+	}
+
+	fm, err = store.GetMailfolderManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	if fm.HasUID(2) {
+		t.Fatalf("Deleted message uid 2 still present")
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Messages()) != 2 {
+		t.Fatalf("Expected 2 messages on the server, found %d", len(server.Messages()))
+	}
+}
+
+func TestPOP3StoreAPOPTLS(t *testing.T) {
+	server := pop3mock.NewMockPOP3Server(t, "user", "password", true)
+	defer server.Close()
+
+	globalconfig, storeconf := newTestPOP3StoreConfig(server)
+	storeconf.Tls = true
+	storeconf.Apop = true
+	storeconf.Validateservercert = false
+
+	if _, err := newStore(globalconfig, storeconf); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range server.Commands {
+		if cmd == "USER user" {
+			t.Fatalf("Expected APOP authentication, found commands: %v", server.Commands)
+		}
+	}
+
+	storeconf.Password = "wrong"
+	if _, err := newStore(globalconfig, storeconf); err == nil {
+		t.Fatalf("Expected authentication error")
+	}
+}
+
+func TestPOP3Sync(t *testing.T) {
+	server := pop3mock.NewMockPOP3Server(t, "user", "password", false)
+	defer server.Close()
+	server.AddMessage("u1", []byte("Subject: 1\r\n\r\n"))
+	server.AddMessage("u2", []byte("Subject: 2\r\n\r\n"))
+
+	globalconfig, _ := newTestPOP3StoreConfig(server)
+	store2conf := &config.StoreConfig{
+		Name:          "store2",
+		StoreType:     "Maildir",
+		Maildir:       filepath.Join(globalconfig.Metadatadir, "..", "maildir"),
+		Separator:     '/',
+		InboxPath:     "INBOX",
+		UIDMapping:    "files",
+		InfoSeparator: ":",
+	}
+	syncgroupconf := &config.SyncgroupConfig{
+		Name:       "syncgroup1",
+		Stores:     []string{"store1", "store2"},
+		Deletemode: "expunge",
+	}
+	globalconfig.Stores = append(globalconfig.Stores, store2conf)
+	globalconfig.Syncgroups = []*config.SyncgroupConfig{syncgroupconf}
+
+	syncgroup, err := NewSyncgroup(globalconfig, syncgroupconf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := Mailfolder{Name: foldername{"INBOX"}}
+	if err = syncgroup.SyncFolder(folder); err != nil {
+		t.Fatal(err)
+	}
+
+	fm, err := syncgroup.stores[1].GetMailfolderManager(folder.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+	messages := fm.GetMessages()
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, found: %v", messages)
+	}
+
+	// New messages aren't added to the POP3 store, deleted ones are
+	// removed from the server
+	if _, err = fm.AddMessage(0, "", []byte("Subject: local\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for uid := range messages {
+		if err = fm.DeleteMessage(uid); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	fm.Close()
+
+	if err = syncgroup.SyncFolder(folder); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Messages()) != 1 {
+		t.Fatalf("Expected 1 message on the server, found %d", len(server.Messages()))
+	}
+}
+
+func TestPOP3SyncDeleteAfterDownload(t *testing.T) {
+	server := pop3mock.NewMockPOP3Server(t, "user", "password", false)
+	defer server.Close()
+	server.AddMessage("u1", []byte("Subject: 1\r\n\r\n"))
+	server.AddMessage("u2", []byte("Subject: 2\r\n\r\n"))
+
+	globalconfig, storeconf := newTestPOP3StoreConfig(server)
+	storeconf.Deleteafterdownload = true
+	store2conf := &config.StoreConfig{
+		Name:          "store2",
+		StoreType:     "Maildir",
+		Maildir:       filepath.Join(globalconfig.Metadatadir, "..", "maildir"),
+		Separator:     '/',
+		InboxPath:     "INBOX",
+		UIDMapping:    "files",
+		InfoSeparator: ":",
+	}
+	syncgroupconf := &config.SyncgroupConfig{
+		Name:              "syncgroup1",
+		Stores:            []string{"store1", "store2"},
+		Deletemode:        "expunge",
+		Syncstatusbackend: "file",
+	}
+	globalconfig.Stores = append(globalconfig.Stores, store2conf)
+	globalconfig.Syncgroups = []*config.SyncgroupConfig{syncgroupconf}
+
+	syncgroup, err := NewSyncgroup(globalconfig, syncgroupconf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syncgroup.Close()
+	folder := Mailfolder{Name: foldername{"INBOX"}}
+	dele := func() int {
+		n := 0
+		for _, cmd := range server.Commands {
+			if strings.HasPrefix(cmd, "DELE ") {
+				n++
+			}
+		}
+		return n
+	}
+	maildirMessages := func() int {
+		fm, err := syncgroup.stores[1].GetMailfolderManager(folder.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fm.Close()
+		if err = fm.UpdateMessageList(); err != nil {
+			t.Fatal(err)
+		}
+		return len(fm.GetMessages())
+	}
+
+	// A message isn't deleted from the server if its add isn't committed
+	// in the syncstatus
+	statusbackend, err := syncgroup.getSyncstatusBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filebackend := statusbackend.(*FileSyncstatusBackend)
+	write := filebackend.write
+	filebackend.write = func(data []byte) (int, error) {
+		return 0, fmt.Errorf("injected write error")
+	}
+	if err = syncgroup.SyncFolder(folder); err == nil {
+		t.Fatal("Expected a sync error")
+	}
+	if dele() != 0 || len(server.Messages()) != 2 {
+		t.Fatalf("Messages deleted before the syncstatus commit, commands: %v", server.Commands)
+	}
+
+	filebackend.write = write
+	if err = syncgroup.SyncFolder(folder); err != nil {
+		t.Fatal(err)
+	}
+	if dele() != 2 || len(server.Messages()) != 0 {
+		t.Fatalf("Downloaded messages not deleted from the server, commands: %v", server.Commands)
+	}
+	synced := maildirMessages()
+	if synced < 2 {
+		t.Fatalf("Expected at least 2 synced messages, found %d", synced)
+	}
+
+	// The removal from the server isn't synced as a deletion
+	if err = syncgroup.SyncFolder(folder); err != nil {
+		t.Fatal(err)
+	}
+	if n := maildirMessages(); n != synced {
+		t.Fatalf("Expected %d messages, found %d", synced, n)
+	}
+}
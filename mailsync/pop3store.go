@@ -0,0 +1,202 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sgotti/gomailsync/config"
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// POP3Store is a download only store with only the INBOX folder. Messages
+// can be deleted but not added, flags are only kept in the metadatadir.
+type POP3Store struct {
+	globalconfig *config.Config
+	config       *config.StoreConfig
+	name         string
+	metadatadir  string
+	folders      []*Mailfolder
+	logger       *log.Logger
+	e            *errors.Error
+	dryrun       bool
+}
+
+func NewPOP3Store(globalconfig *config.Config, config *config.StoreConfig, basemetadatadir string, dryrun bool) (m *POP3Store, err error) {
+	name := config.Name
+	logprefix := fmt.Sprintf("pop3store: %s", name)
+	errprefix := fmt.Sprintf("pop3store: %s", name)
+	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	metadatadir := filepath.Join(basemetadatadir, name)
+
+	if !dryrun {
+		err = os.MkdirAll(metadatadir, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m = &POP3Store{
+		globalconfig: globalconfig,
+		config:       config,
+		name:         name,
+		metadatadir:  metadatadir,
+		folders:      make([]*Mailfolder, 0),
+		logger:       logger,
+		e:            e,
+		dryrun:       dryrun,
+	}
+
+	// Verify the connection and the credentials
+	client, err := m.newPOP3Client()
+	if err != nil {
+		return nil, m.e.E(err)
+	}
+	if err = client.Quit(); err != nil {
+		return nil, m.e.E(err)
+	}
+
+	err = m.UpdateFolderList()
+	return
+}
+
+func (m *POP3Store) newPOP3Client() (*pop3Client, error) {
+	port := m.config.Port
+	if port == 0 {
+		port = 110
+		if m.config.Tls {
+			port = 995
+		}
+	}
+	addr := net.JoinHostPort(m.config.Host, strconv.FormatUint(uint64(port), 10))
+
+	var tlsconfig *tls.Config
+	if !m.config.Validateservercert {
+		tlsconfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client, err := dialPOP3(addr, m.config.Tls, tlsconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.config.Starttls {
+		if err = client.StartTLS(tlsconfig, m.config.Host); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if err = client.Login(m.config.Username, m.config.Password, m.config.Apop); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (m *POP3Store) CreateFolder(name foldername) (err error) {
+	return m.e.E(fmt.Errorf("Cannot create folder %s: a POP3 store only has the INBOX", name))
+}
+
+func (m *POP3Store) SetFolderExcluded(name foldername, excluded bool) error {
+	if f := m.getFolder(name); f != nil {
+		f.Excluded = excluded
+		return nil
+	}
+	return m.e.E(fmt.Errorf("Folder %s, doesn't exists", name))
+}
+
+func (m *POP3Store) getFolder(name foldername) *Mailfolder {
+	for _, f := range m.folders {
+		if StrsEquals(name, f.Name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *POP3Store) HasFolder(name foldername) bool {
+	if f := m.getFolder(name); f != nil {
+		return true
+	}
+	return false
+}
+
+func (m *POP3Store) UpdateFolderList() error {
+	m.folders = []*Mailfolder{{Name: foldername{"INBOX"}, Excluded: false}}
+
+	err := applyRegExpPatterns(m, m.folders)
+	if err != nil {
+		return m.e.E(err)
+	}
+
+	return nil
+}
+
+func (m *POP3Store) Separator() (rune, error) {
+	return '/', nil
+}
+
+func (m *POP3Store) GetFolders() []Mailfolder {
+	folders := make([]Mailfolder, len(m.folders))
+	for i, f := range m.folders {
+		folders[i] = *f
+	}
+	return folders
+}
+
+func (m *POP3Store) GetMailfolderManager(name foldername) (manager MailfolderManager, err error) {
+	folder := m.getFolder(name)
+	if folder == nil {
+		return nil, m.e.E(fmt.Errorf("Cannot get folder %s: a POP3 store only has the INBOX", name))
+	}
+
+	foldermetadatadir := filepath.Join(m.metadatadir, folderMetadataPath(name))
+	if !m.dryrun {
+		err = os.MkdirAll(foldermetadatadir, 0777)
+		if err != nil {
+			return nil, m.e.E(err)
+		}
+	}
+
+	manager, err = NewPOP3Folder(folder, foldermetadatadir, m, m.dryrun)
+
+	return
+}
+
+// DownloadOnly reports that messages cannot be added to this store
+func (m *POP3Store) DownloadOnly() bool {
+	return true
+}
+
+func (m *POP3Store) Name() string {
+	return m.name
+}
+
+func (m *POP3Store) Config() *config.StoreConfig {
+	return m.config
+}
@@ -0,0 +1,261 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With the syncgroup quarantine option, before being expunged a message is
+// copied in the quarantine dir of the syncgroup metadatadir. Every entry
+// is made of two files: ID.eml with the message and ID.json with its
+// QuarantineEntry (written last, an entry without it is ignored).
+//
+// Only the messages expunged by the folder sync are quarantined: the
+// messages moved to another folder (detectmoves option) and the Gmail labels
+// removed from a message (gmail option) remain in the store.
+
+const (
+	quarantineDir = "quarantine"
+	// The quarantine is expired at most once in this interval
+	quarantineExpireInterval = time.Hour
+)
+
+// QuarantineEntry describes a quarantined message
+type QuarantineEntry struct {
+	ID        string     `json:"id"`
+	Syncgroup string     `json:"syncgroup"`
+	Store     string     `json:"store"`
+	Folder    foldername `json:"folder"`
+	// The folder name in the store: the syncgroup folder name can change
+	// with the folder mapping
+	StoreFolder foldername `json:"storefolder"`
+	// The uid of the deleted message and of the message of the other store
+	// (whose deletion caused it)
+	UID    uint32    `json:"uid"`
+	SrcUID uint32    `json:"srcuid"`
+	Flags  string    `json:"flags"`
+	Time   time.Time `json:"time"`
+}
+
+type quarantineEntrySlice []*QuarantineEntry
+
+func (s quarantineEntrySlice) Len() int           { return len(s) }
+func (s quarantineEntrySlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s quarantineEntrySlice) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+func (s *Syncgroup) quarantinePath(id string, ext string) string {
+	return filepath.Join(s.metadatadir, quarantineDir, id+ext)
+}
+
+// quarantineMessage saves a message that will be deleted from a store
+func (s *Syncgroup) quarantineMessage(folder foldername, storefolder foldername, store Storenumber, uid uint32, srcuid uint32, flags string, body []byte) error {
+	dir := filepath.Join(s.metadatadir, quarantineDir)
+	if err := MkdirIfNotExists(dir); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := &QuarantineEntry{
+		ID:          fmt.Sprintf("%d.%d.%d", now.UnixNano(), store, uid),
+		Syncgroup:   s.name,
+		Store:       s.stores[store].Name(),
+		Folder:      folder,
+		StoreFolder: storefolder,
+		UID:         uid,
+		SrcUID:      srcuid,
+		Flags:       flags,
+		Time:        now,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	dosync := s.stores[store].Config().Fsync
+	if err = writeFileAtomic(s.quarantinePath(entry.ID, ".eml"), body, dosync); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.quarantinePath(entry.ID, ".json"), data, dosync)
+}
+
+func (s *Syncgroup) readQuarantineEntry(id string) (*QuarantineEntry, error) {
+	data, err := ioutil.ReadFile(s.quarantinePath(id, ".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Cannot find quarantined message %s", id)
+		}
+		return nil, err
+	}
+	entry := &QuarantineEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("Wrong quarantine entry %s: %s", id, err)
+	}
+	return entry, nil
+}
+
+func (s *Syncgroup) removeQuarantineEntry(id string) error {
+	// Remove the entry first so a partial removal leaves only an ignored
+	// message file
+	for _, ext := range []string{".json", ".eml"} {
+		if err := os.Remove(s.quarantinePath(id, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantined returns the quarantined messages, oldest first
+func (s *Syncgroup) Quarantined() ([]*QuarantineEntry, error) {
+	entries := make([]*QuarantineEntry, 0)
+	filenames, err := filepath.Glob(filepath.Join(s.metadatadir, quarantineDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range filenames {
+		entry, err := s.readQuarantineEntry(strings.TrimSuffix(filepath.Base(filename), ".json"))
+		if err != nil {
+			// Removed by a concurrent expire
+			if _, serr := os.Stat(filename); os.IsNotExist(serr) {
+				continue
+			}
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Sort(quarantineEntrySlice(entries))
+	return entries, nil
+}
+
+// ExpireQuarantine removes the quarantined messages older than the
+// syncgroup quarantineretention. A zero retention keeps them forever.
+func (s *Syncgroup) ExpireQuarantine() error {
+	retention := s.config.Quarantineretention.Duration
+	if retention <= 0 {
+		return nil
+	}
+	entries, err := s.Quarantined()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if time.Since(entry.Time) <= retention {
+			break
+		}
+		s.logger.Debugf("Removing expired quarantined message %s", entry.ID)
+		if err = s.removeQuarantineEntry(entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireQuarantine calls ExpireQuarantine if it wasn't done in the last
+// quarantineExpireInterval
+func (s *Syncgroup) expireQuarantine() {
+	if !s.config.Quarantine || s.dryrun {
+		return
+	}
+	s.quarantinelock.Lock()
+	defer s.quarantinelock.Unlock()
+	if time.Since(s.quarantineexpired) < quarantineExpireInterval {
+		return
+	}
+	s.quarantineexpired = time.Now()
+	if err := s.ExpireQuarantine(); err != nil {
+		s.logger.Errorf("Error expiring the quarantine: %s", err)
+	}
+}
+
+// Restore adds a quarantined message back to the folder of its store. If
+// the message of the other store still exists they are linked again in
+// the syncstatus, else the next sync copies the message to the other
+// store.
+func (s *Syncgroup) Restore(id string) (err error) {
+	if s.dryrun {
+		return s.e.E(fmt.Errorf("Cannot restore messages in a dry run"))
+	}
+
+	entry, err := s.readQuarantineEntry(id)
+	if err != nil {
+		return s.e.E(err)
+	}
+	body, err := ioutil.ReadFile(s.quarantinePath(id, ".eml"))
+	if err != nil {
+		return s.e.E(err)
+	}
+
+	dst := Storenumber(-1)
+	for i, store := range s.stores {
+		if store.Name() == entry.Store {
+			dst = Storenumber(i)
+		}
+	}
+	if dst < 0 {
+		return s.e.E(fmt.Errorf("Store %s of quarantined message %s isn't in the syncgroup", entry.Store, id))
+	}
+	src := 1 - dst
+
+	folder := Mailfolder{Name: entry.Folder}
+	// The entries written before the storefolder field have only the
+	// syncgroup folder name
+	if entry.StoreFolder != nil {
+		folder.Name = s.getFolderMapping().syncFolderName(entry.StoreFolder, dst)
+	}
+	f, err := s.openFolder(folder, true)
+	if err != nil {
+		return s.e.E(err)
+	}
+	defer f.Close()
+
+	dstuid, err := f.folders[dst].AddMessage(entry.SrcUID, entry.Flags, body)
+	if err != nil {
+		return s.e.E(err)
+	}
+	s.logger.Infof("Restored message %s in store %s folder %s with uid %d", id, entry.Store, folder, dstuid)
+
+	if f.folders[src].HasUID(entry.SrcUID) {
+		f.syncstatus.SetSrcstore(src)
+		hasuid, err := f.syncstatus.HasUID(entry.SrcUID)
+		if err != nil {
+			return s.e.E(err)
+		}
+		if !hasuid {
+			f.syncstatus.BeginTx()
+			if err = f.syncstatus.Update(entry.SrcUID, dstuid, entry.Flags); err != nil {
+				f.syncstatus.Rollback()
+				return s.e.E(err)
+			}
+			if err = f.syncstatus.Commit(); err != nil {
+				return s.e.E(err)
+			}
+		}
+	}
+
+	if err = s.removeQuarantineEntry(id); err != nil {
+		return s.e.E(err)
+	}
+	return nil
+}
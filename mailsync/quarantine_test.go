@@ -0,0 +1,177 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuarantineRestore(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	syncgroup.config.Quarantine = true
+	uid1 := backend1.AddMessage(memoryTestFolder.Name, "S", []byte("Subject: 1\r\n\r\n"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 2\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	backend1.DeleteMessage(memoryTestFolder.Name, uid1)
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+
+	entries, err := syncgroup.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 quarantined message, found: %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Store != "store2" || entry.SrcUID != uid1 || entry.Flags != "S" || !StrsEquals(entry.Folder, memoryTestFolder.Name) {
+		t.Fatalf("Wrong quarantine entry: %v", entry)
+	}
+
+	// The message comes back in store2 and, as a new message, in store1
+	if err = syncgroup.Restore(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+	content := memoryFolderContent(t, backend1)
+	if flags, ok := content["Subject: 1\r\n\r\n"]; !ok || flags != "S" {
+		t.Fatalf("Message not restored: %v", content)
+	}
+	if entries, _ = syncgroup.Quarantined(); len(entries) != 0 {
+		t.Fatalf("Restored message still in quarantine")
+	}
+	if err = syncgroup.Restore(entry.ID); err == nil {
+		t.Fatalf("Expected an error restoring a removed entry")
+	}
+}
+
+func TestQuarantineRestoreLink(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	body := []byte("Subject: 1\r\n\r\n")
+
+	// The message of store2 caused the quarantine and still exists (like
+	// when it temporarily disappeared from the server)
+	uid2 := backend2.AddMessage(memoryTestFolder.Name, "S", body)
+	if err := syncgroup.quarantineMessage(memoryTestFolder.Name, memoryTestFolder.Name, Store1, 10, uid2, "S", body); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := syncgroup.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncgroup.Restore(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// They are linked in the syncstatus so the sync doesn't copy it again
+	if err = syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	verifyMemorySync(t, backend1, backend2)
+}
+
+func TestQuarantineExpire(t *testing.T) {
+	syncgroup, backend1, _ := newTestMemorySyncgroup(t, "expunge")
+	syncgroup.config.Quarantine = true
+	uid := backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 1\r\n\r\n"))
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+	backend1.DeleteMessage(memoryTestFolder.Name, uid)
+	if err := syncgroup.SyncFolder(memoryTestFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	syncgroup.config.Quarantineretention.Duration = time.Hour
+	if err := syncgroup.ExpireQuarantine(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := syncgroup.Quarantined(); len(entries) != 1 {
+		t.Fatalf("Expected 1 quarantined message, found: %d", len(entries))
+	}
+
+	syncgroup.config.Quarantineretention.Duration = time.Nanosecond
+	if err := syncgroup.ExpireQuarantine(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := syncgroup.Quarantined(); len(entries) != 0 {
+		t.Fatalf("Expected no quarantined messages, found: %d", len(entries))
+	}
+}
+
+func TestQuarantineRestoreMapping(t *testing.T) {
+	syncgroup, backend1, backend2 := newTestMemorySyncgroup(t, "expunge")
+	syncgroup.config.Quarantine = true
+	var err error
+	syncgroup.mapping, err = newFolderMapping([][]string{{"Sent", "[Gmail]/Sent Mail"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storefolder := foldername{"[Gmail]", "Sent Mail"}
+	uid1 := backend1.AddMessage(foldername{"Sent"}, "S", []byte("Subject: 1\r\n\r\n"))
+	backend2.CreateFolder(storefolder)
+	for _, store := range syncgroup.stores {
+		if err = store.UpdateFolderList(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folder := Mailfolder{Name: foldername{"Sent"}}
+	if err = syncgroup.SyncFolder(folder); err != nil {
+		t.Fatal(err)
+	}
+	backend1.DeleteMessage(folder.Name, uid1)
+	if err = syncgroup.SyncFolder(folder); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := syncgroup.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !StrsEquals(entries[0].StoreFolder, storefolder) {
+		t.Fatalf("Wrong quarantine entries: %v", entries)
+	}
+
+	// The message goes back in the store folder also if the mapping
+	// changed
+	syncgroup.mapping, err = newFolderMapping(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncgroup.Restore(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend2.Messages(storefolder)) != 1 {
+		t.Fatalf("Message not restored in folder %s", FolderToStorePath(storefolder, '/'))
+	}
+	if err = syncgroup.stores[Store2].UpdateFolderList(); err != nil {
+		t.Fatal(err)
+	}
+	if syncgroup.stores[Store2].HasFolder(folder.Name) {
+		t.Fatalf("Message restored in the syncgroup folder")
+	}
+}
@@ -33,3 +33,18 @@ type StoreManager interface {
 	Name() string
 	Config() *config.StoreConfig
 }
+
+// DownloadOnlyStore is implemented by the stores where messages cannot be
+// added (like POP3). New messages aren't synced to them.
+type DownloadOnlyStore interface {
+	DownloadOnly() bool
+}
+
+// FolderSubscriber is implemented by the stores keeping the folder
+// subscriptions
+type FolderSubscriber interface {
+	// SubscribedFolders returns the subscribed folders (also the not
+	// existing ones)
+	SubscribedFolders() ([]foldername, error)
+	SetFolderSubscribed(name foldername, subscribed bool) error
+}
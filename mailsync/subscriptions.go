@@ -0,0 +1,165 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// With the syncgroup syncsubscriptions option the folder subscriptions are
+// propagated between the stores before every sync. The subscribed
+// syncgroup folders of the last sync are saved in the subscriptions file of
+// the syncgroup metadatadir: a folder subscribed only in a store is
+// subscribed in the other one if it wasn't subscribed at the last sync,
+// else it's unsubscribed from the store where it's still subscribed.
+
+const subscriptionsFile = "subscriptions"
+
+// folderSubscriber returns the FolderSubscriber of a store (also of a dry
+// run one)
+func folderSubscriber(store StoreManager) (FolderSubscriber, bool) {
+	if d, ok := store.(*dryrunStore); ok {
+		store = d.StoreManager
+	}
+	fs, ok := store.(FolderSubscriber)
+	return fs, ok
+}
+
+func (s *Syncgroup) readSubscriptions() (map[string]bool, error) {
+	subscribed := make(map[string]bool)
+	data, err := ioutil.ReadFile(filepath.Join(s.metadatadir, subscriptionsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return subscribed, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0)
+	if err = json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("Wrong subscriptions file: %s", err)
+	}
+	for _, name := range names {
+		subscribed[name] = true
+	}
+	return subscribed, nil
+}
+
+// syncSubscriptions propagates the folder subscriptions changed since the
+// last sync
+func (s *Syncgroup) syncSubscriptions() error {
+	var subscribers [2]FolderSubscriber
+	for i, store := range s.stores {
+		fs, ok := folderSubscriber(store)
+		if !ok {
+			return fmt.Errorf("Store %s doesn't support folder subscriptions", store.Name())
+		}
+		subscribers[i] = fs
+	}
+
+	mapping := s.getFolderMapping()
+	var subscribed [2]map[string]foldername
+	keys := make(map[string]bool)
+	for i := Store1; i <= Store2; i++ {
+		subscribed[i] = make(map[string]foldername)
+		storenames, err := subscribers[i].SubscribedFolders()
+		if err != nil {
+			return err
+		}
+		for _, storename := range storenames {
+			name := mapping.syncFolderName(storename, i)
+			key := FolderToStorePath(name, '/')
+			subscribed[i][key] = name
+			keys[key] = true
+		}
+	}
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	last, err := s.readSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	saved := make([]string, 0)
+	var changed [2]bool
+	for _, key := range names {
+		name1, in1 := subscribed[Store1][key]
+		name2, in2 := subscribed[Store2][key]
+		if in1 == in2 {
+			saved = append(saved, key)
+			continue
+		}
+
+		name := name1
+		if in2 {
+			name = name2
+		}
+		// The subscription changed on the src store
+		src, subscribe := Store1, in1
+		if in1 == last[key] {
+			src, subscribe = Store2, in2
+		}
+		dst := 1 - src
+		dstname := mapping.storeFolderName(name, dst)
+
+		action := "unsubscribe"
+		if subscribe {
+			action = "subscribe"
+			saved = append(saved, key)
+		}
+		if s.dryrun {
+			s.plan.Printf(s.stores[dst].Name(), dstname, "%s folder", action)
+			continue
+		}
+		s.logger.Infof("Folder %s: %s on store %s", key, action, s.stores[dst].Name())
+		if err = subscribers[dst].SetFolderSubscribed(dstname, subscribe); err != nil {
+			return err
+		}
+		changed[dst] = true
+	}
+
+	if s.dryrun {
+		return nil
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	dosync := s.stores[Store1].Config().Fsync || s.stores[Store2].Config().Fsync
+	if err = writeFileAtomic(filepath.Join(s.metadatadir, subscriptionsFile), data, dosync); err != nil {
+		return err
+	}
+
+	// The subscriptions change the folders of a subscribedonly store
+	for i, store := range s.stores {
+		if changed[i] && store.Config().Subscribedonly {
+			if err = store.UpdateFolderList(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
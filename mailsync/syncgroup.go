@@ -34,10 +34,46 @@ type Syncgroup struct {
 	config       *config.SyncgroupConfig
 	name         string
 	metadatadir  string
-	stores       []StoreManager
-	logger       *log.Logger
-	e            *errors.Error
-	dryrun       bool
+	// The syncstatus of all the folders, opened by the first folder sync
+	statusbackend     SyncstatusBackend
+	statusbackendlock sync.Mutex
+	stores            []StoreManager
+	logger            *log.Logger
+	e                 *errors.Error
+	dryrun            bool
+	// Prints the actions of a dry run
+	plan *dryrunPlan
+	// Folder names mapping between the stores
+	mapping *folderMapping
+	// The operations propagated from every store (by source Storenumber)
+	ops [2]syncOps
+	// Disables the maxdeletecount and maxdeletepercent checks
+	allowmassdelete bool
+	// Last quarantine expiration
+	quarantineexpired time.Time
+	quarantinelock    sync.Mutex
+	// The messages moved by a dry run (see movedKey)
+	moved map[string]bool
+}
+
+// syncOps are the operations propagated from a store to the other one
+type syncOps struct {
+	create bool
+	new    bool
+	delete bool
+	flags  bool
+}
+
+func newSyncOps(ops []string) syncOps {
+	if len(ops) == 0 || StringInSlice("all", ops) {
+		return syncOps{create: true, new: true, delete: true, flags: true}
+	}
+	return syncOps{
+		create: StringInSlice("create", ops),
+		new:    StringInSlice("new", ops),
+		delete: StringInSlice("delete", ops),
+		flags:  StringInSlice("flags", ops),
+	}
 }
 
 func (s *Syncgroup) newStore(globalconfig *config.Config, config *config.StoreConfig) (m StoreManager, err error) {
@@ -53,6 +89,16 @@ func (s *Syncgroup) newStore(globalconfig *config.Config, config *config.StoreCo
 		m, err = NewMaildirStore(globalconfig, config, basemetadatadir, s.dryrun)
 	case "IMAP":
 		m, err = NewImapStore(globalconfig, config, basemetadatadir, s.dryrun)
+	case "JMAP":
+		m, err = NewJMAPStore(globalconfig, config, basemetadatadir, s.dryrun)
+	case "POP3":
+		m, err = NewPOP3Store(globalconfig, config, basemetadatadir, s.dryrun)
+	case "mbox":
+		m, err = NewMboxStore(globalconfig, config, basemetadatadir, s.dryrun)
+	case "MH":
+		m, err = NewMHStore(globalconfig, config, basemetadatadir, s.dryrun)
+	case "Memory":
+		m, err = NewMemoryStore(globalconfig, config, basemetadatadir, s.dryrun)
 	}
 	return m, err
 }
@@ -65,12 +111,14 @@ func mergeFolders(folders1 []Mailfolder, folders2 []Mailfolder, ignoreexcluded b
 	}
 
 	for _, f2 := range folders2 {
-		if _, ok := fm[f2.String()]; ok {
+		if f1, ok := fm[f2.String()]; ok {
 			if f2.Excluded {
-				f1 := fm[f2.String()]
 				f1.Excluded = true
-				fm[f1.String()] = f1
 			}
+			if f1.Role == "" {
+				f1.Role = f2.Role
+			}
+			fm[f1.String()] = f1
 		} else {
 			fm[f2.String()] = f2
 		}
@@ -110,14 +158,23 @@ func removeIgnoredMessages(messages []uint32, fm MailfolderManager) []uint32 {
 	return filteredmessages
 }
 
+// getFolderMapping returns the folder mapping with the current store
+// folders roles
+func (s *Syncgroup) getFolderMapping() *folderMapping {
+	return s.mapping.withRoles([2][]Mailfolder{s.stores[Store1].GetFolders(), s.stores[Store2].GetFolders()})
+}
+
 func (s *Syncgroup) getSyncFolders() (folders []Mailfolder, err error) {
 	store1 := s.stores[0]
 	store2 := s.stores[1]
 
-	folders1 := store1.GetFolders()
-	folders2 := store2.GetFolders()
+	storefolders := [2][]Mailfolder{store1.GetFolders(), store2.GetFolders()}
+	mapped, err := s.mapping.withRoles(storefolders).mapFolders(storefolders)
+	if err != nil {
+		return nil, err
+	}
 
-	folders = mergeFolders(folders1, folders2, true)
+	folders = mergeFolders(mapped[Store1], mapped[Store2], true)
 
 	return folders, nil
 }
@@ -129,11 +186,13 @@ func NewSyncgroup(globalconfig *config.Config, config *config.SyncgroupConfig, d
 	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
 	e := errors.New(errprefix)
 
-	metadatadir := filepath.Join(globalconfig.Metadatadir, "syncgroups", name)
+	metadatadir := syncgroupMetadatadir(globalconfig, name)
 
-	err = os.MkdirAll(metadatadir, 0777)
-	if err != nil {
-		return nil, e.E(err)
+	if !dryrun {
+		err = os.MkdirAll(metadatadir, 0777)
+		if err != nil {
+			return nil, e.E(err)
+		}
 	}
 
 	s = &Syncgroup{
@@ -145,6 +204,16 @@ func NewSyncgroup(globalconfig *config.Config, config *config.SyncgroupConfig, d
 		logger:       logger,
 		e:            e,
 		dryrun:       dryrun,
+		ops:          [2]syncOps{newSyncOps(config.Ops1to2), newSyncOps(config.Ops2to1)},
+		moved:        make(map[string]bool),
+	}
+	if dryrun {
+		s.plan = newDryrunPlan(os.Stdout, name)
+	}
+
+	s.mapping, err = newFolderMapping(config.Folderpairs, config.Folderrules)
+	if err != nil {
+		return nil, e.E(err)
 	}
 
 	var storenumber Storenumber = Store1
@@ -157,6 +226,9 @@ func NewSyncgroup(globalconfig *config.Config, config *config.SyncgroupConfig, d
 				if err != nil {
 					return nil, e.E(err)
 				}
+				if dryrun {
+					store = newDryrunStore(store, s.plan)
+				}
 				s.stores = append(s.stores, store)
 			}
 		}
@@ -169,19 +241,60 @@ func NewSyncgroup(globalconfig *config.Config, config *config.SyncgroupConfig, d
 	return
 }
 
+// getSyncstatusBackend returns the syncstatus backend, opening it if needed
+func (s *Syncgroup) getSyncstatusBackend() (SyncstatusBackend, error) {
+	s.statusbackendlock.Lock()
+	defer s.statusbackendlock.Unlock()
+	if s.statusbackend == nil {
+		statusbackend, err := openSyncstatusBackend(s.globalconfig, s.config, s.metadatadir)
+		if err != nil {
+			return nil, err
+		}
+		s.statusbackend = statusbackend
+	}
+	return s.statusbackend, nil
+}
+
+// Close closes the syncstatus backend
+func (s *Syncgroup) Close() (err error) {
+	s.statusbackendlock.Lock()
+	defer s.statusbackendlock.Unlock()
+	if s.statusbackend != nil {
+		err = s.statusbackend.Close()
+		s.statusbackend = nil
+	}
+	return
+}
+
+// SetAllowMassDelete enables the deletions exceeding the syncgroup
+// maxdeletecount and maxdeletepercent
+func (s *Syncgroup) SetAllowMassDelete(allow bool) {
+	s.allowmassdelete = allow
+}
+
 func (s *Syncgroup) SyncWrapper(interactions int, out chan error) {
 	err := s.Sync(interactions)
+	s.Close()
 	out <- err
 }
 
 func (s *Syncgroup) Sync(interactions int) (err error) {
 
+	if s.config.Syncsubscriptions {
+		if err = s.syncSubscriptions(); err != nil {
+			return s.e.E(err)
+		}
+	}
+
 	folders, err := s.getSyncFolders()
 	if err != nil {
 		return s.e.E(err)
 	}
 
 	s.logger.Infof("folders: %s", folders)
+	if len(folders) == 0 && interactions > 0 {
+		return nil
+	}
 	var maxconcurrentsyncs uint8
 	if int(s.config.Concurrentsyncs) > len(folders) {
 		maxconcurrentsyncs = uint8(len(folders))
@@ -200,6 +313,7 @@ func (s *Syncgroup) Sync(interactions int) (err error) {
 	var folderindex int = 0
 	syncscount := uint8(0)
 	countmap := make(map[int]int)
+	movesround := 0
 
 	sched <- true
 	for {
@@ -222,6 +336,15 @@ func (s *Syncgroup) Sync(interactions int) (err error) {
 			})
 
 		case <-sched:
+			// Detect the moves before every round of folder syncs, when
+			// no folder is being synced
+			if s.config.Detectmoves && syncscount == 0 && movesRoundCompleted(countmap, len(folders), movesround) {
+				if err := s.syncMoves(folders); err != nil {
+					s.logger.Errorf("Moves detection failed with error: %s", err)
+				}
+				movesround++
+			}
+
 			for syncscount < maxconcurrentsyncs {
 				found := false
 				for i := 0; i < len(folders); i++ {
@@ -256,7 +379,8 @@ func (s *Syncgroup) Sync(interactions int) (err error) {
 		}
 
 		if interactions > 0 {
-			finished := true
+			// Every folder must be synced
+			finished := len(countmap) == len(folders)
 			for _, c := range countmap {
 				if c < interactions {
 					finished = false
@@ -282,6 +406,8 @@ func (s *Syncgroup) SyncFolderWrapper(folder Mailfolder, folderindex int, out ch
 	out <- result
 }
 
+// SyncFolder syncs a folder. The moved messages are detected only by Sync
+// (see syncMoves): here they are deleted and transferred again.
 func (s *Syncgroup) SyncFolder(folder Mailfolder) (err error) {
 	logprefix := fmt.Sprintf("%s %s %s", "syncgroup", s.name, folder)
 	errprefix := logprefix
@@ -290,221 +416,23 @@ func (s *Syncgroup) SyncFolder(folder Mailfolder) (err error) {
 
 	logger.Debug("Syncing folder: ", folder)
 
-	store1 := s.stores[0]
-	store2 := s.stores[1]
+	s.expireQuarantine()
 
-	syncstatus, err := NewUIDMapSyncstatus(s.globalconfig, s.config, s.metadatadir, folder.Name)
+	f, err := s.openFolder(folder, true)
 	if err != nil {
 		return e.E(err)
 	}
-	defer syncstatus.Close()
-
-	syncstatus.UpdateSyncstatus()
+	defer f.Close()
 
-	folder1, err := store1.GetMailfolderManager(folder.Name)
+	plan, err := s.planFolder(folder, f, false)
 	if err != nil {
 		return e.E(err)
 	}
-	defer folder1.Close()
 
-	folder2, err := store2.GetMailfolderManager(folder.Name)
+	err = s.applyFolderPlan(plan, f)
 	if err != nil {
 		return e.E(err)
 	}
-	defer folder2.Close()
-
-	err = folder1.UpdateMessageList()
-	if err != nil {
-		return e.E(err)
-	}
-	err = folder2.UpdateMessageList()
-	if err != nil {
-		return e.E(err)
-	}
-
-	srcstore := store1
-	dststore := store2
-	srcfolder := folder1
-	dstfolder := folder2
-
-	syncstatus.SetSrcstore(Store1)
-
-	for i := 0; i < 2; i++ {
-		logprefix := fmt.Sprintf("%s %s %s -> %s %s", "syncgroup", s.name, srcstore.Name(), dststore.Name(), folder)
-		errprefix := logprefix
-		logger := log.GetLogger(logprefix, s.globalconfig.LogLevel)
-		e := errors.New(errprefix)
-
-		newMessages, err := syncstatus.GetNewMessages(srcfolder)
-		if err != nil {
-			return e.E(err)
-		}
-		// Remove ignored messages
-		newMessages = removeIgnoredMessages(newMessages, srcfolder)
-		logger.Infof("There are %d new messages", len(newMessages))
-
-		deletedMessages, err := syncstatus.GetDeletedMessages(srcfolder)
-		if err != nil {
-			return e.E(err)
-		}
-		// Remove ignored messages
-		deletedMessages = removeIgnoredMessages(deletedMessages, srcfolder)
-		logger.Infof("There are %d deleted messages", len(deletedMessages))
-
-		changedMessages, err := syncstatus.GetChangedMessages(srcfolder)
-		if err != nil {
-			return e.E(err)
-		}
-		// Remove ignored messages
-		changedMessages = removeIgnoredMessages(changedMessages, srcfolder)
-		logger.Infof("There are %d changed messages", len(changedMessages))
-
-		// logger.Debugf("New messages:")
-		// for _, u := range newMessages {
-		// 	logger.Debugf("%d", u)
-		// }
-
-		if s.dryrun {
-			continue
-		}
-
-		// Add new messages
-		for _, srcuid := range newMessages {
-			logger.Infof("Adding message with srcuid: %d to destination store: %s", srcuid, dststore.Name())
-
-			syncstatus.BeginTx()
-
-			body, err := srcfolder.ReadMessage(srcuid)
-			if err != nil {
-				syncstatus.Rollback()
-				return e.E(err)
-			}
-			flags, err := srcfolder.GetFlags(srcuid)
-			if err != nil {
-				syncstatus.Rollback()
-				return e.E(err)
-			}
-
-			dstuid, err := dstfolder.AddMessage(srcuid, flags, body)
-			if err != nil {
-				err := fmt.Errorf("AddMessage error: %s", err)
-				syncstatus.Rollback()
-				return e.E(err)
-			} else {
-				logger.Debug("Received dstuid: ", dstuid)
-
-				// Ask srcfolder if it wants to update its message
-				srcuid, err = srcfolder.Update(srcuid)
-				if err != nil {
-					// TODO remove message from dstfolder if srcfolder.Update() failed?
-					return e.E(err)
-				}
-				err = syncstatus.Update(srcuid, dstuid, flags)
-				if err != nil {
-					logger.Errorf("error: %s", err)
-					syncstatus.Rollback()
-					return e.E(err)
-				}
-			}
-			err = syncstatus.Commit()
-			if err != nil {
-				return e.E(err)
-			}
-		}
-
-		// Remove deleted messages
-		if s.config.Deletemode == "none" {
-			logger.Info("deletemode is none. Skipping message deletion")
-		} else {
-			for _, srcuid := range deletedMessages {
-				syncstatus.BeginTx()
-
-				dstuid, err := syncstatus.GetDststoreUID(srcuid)
-				if err != nil {
-					syncstatus.Rollback()
-					return e.E(err)
-				}
-
-				logger.Debugf("Deleting message with dstuid: %d from destination store: %s", dstuid, dststore.Name())
-
-				if s.config.Deletemode == "expunge" {
-					logger.Debug("Real deleting message")
-					err = dstfolder.DeleteMessage(dstuid)
-				} else if s.config.Deletemode == "trash" {
-					logger.Debug("Marking message ad Deleted")
-					flags, err := dstfolder.GetFlags(dstuid)
-					if err != nil {
-						syncstatus.Rollback()
-						return e.E(err)
-					}
-					err = dstfolder.SetFlags(dstuid, addFlags(flags, "T"))
-				} else {
-					err = fmt.Errorf("Bad syncgroup deletemode(This should never happen!!!): \"%s\"", s.config.Deletemode)
-					syncstatus.Rollback()
-					return e.E(err)
-				}
-				if err != nil {
-					err := fmt.Errorf("Delete error: %s", err)
-					syncstatus.Rollback()
-					return e.E(err)
-				} else {
-					err = syncstatus.Delete(srcuid)
-					if err != nil {
-						syncstatus.Rollback()
-						return e.E(err)
-					}
-				}
-				err = syncstatus.Commit()
-				if err != nil {
-					return e.E(err)
-				}
-			}
-		}
-
-		// Update Flags
-		for _, srcuid := range changedMessages {
-			syncstatus.BeginTx()
-
-			dstuid, err := syncstatus.GetDststoreUID(srcuid)
-			if err != nil {
-				syncstatus.Rollback()
-				return e.E(err)
-			}
-			flags, err := srcfolder.GetFlags(srcuid)
-			if err != nil {
-				syncstatus.Rollback()
-				return e.E(err)
-			}
-
-			logger.Debugf("Updating message flags to message with dstuid %d in destination store %s to flags: \"%s\"", dstuid, dststore.Name(), flags)
-
-			if dstfolder.HasUID(dstuid) {
-				logger.Debugf("Changing message with dstuid: %d", dstuid)
-				err = dstfolder.SetFlags(dstuid, flags)
-				if err != nil {
-					err := fmt.Errorf("dstfolder.SetFlags error: %s", err)
-					syncstatus.Rollback()
-					return e.E(err)
-				} else {
-					err = syncstatus.Update(srcuid, dstuid, flags)
-					if err != nil {
-						syncstatus.Rollback()
-						return e.E(err)
-					}
-				}
-			}
-			err = syncstatus.Commit()
-			if err != nil {
-				return e.E(err)
-			}
-		}
-
-		srcfolder = folder2
-		dstfolder = folder1
-		srcstore = store2
-		dststore = store1
-		syncstatus.SetSrcstore(Store2)
-	}
 	return
 }
 
@@ -512,7 +440,7 @@ func (s *Syncgroup) List() (err error) {
 	fmt.Printf("Syncgroup: %s\n", s.name)
 	for _, store := range s.stores {
 		fmt.Printf("\t")
-		fmt.Printf("Store: %s\n", store.Name())
+		fmt.Printf("Store: %s (%s)\n", store.Name(), store.Config().StoreType)
 
 		folders := store.GetFolders()
 		if err != nil {
@@ -522,6 +450,9 @@ func (s *Syncgroup) List() (err error) {
 		for _, folder := range folders {
 			fmt.Printf("\t\t")
 			fmt.Printf("%s ", folder)
+			if folder.Role != "" {
+				fmt.Printf("(%s) ", folder.Role)
+			}
 			if folder.Excluded {
 				fmt.Printf("(excluded)")
 			}
@@ -536,9 +467,14 @@ func (s *Syncgroup) List() (err error) {
 	if err != nil {
 		return s.e.E(err)
 	}
+	mapping := s.getFolderMapping()
 	for _, folder := range folders {
 		fmt.Printf("\t\t")
-		fmt.Printf("%s\n", folder)
+		fmt.Printf("%s <-> %s", FolderToStorePath(mapping.storeFolderName(folder.Name, Store1), '/'), FolderToStorePath(mapping.storeFolderName(folder.Name, Store2), '/'))
+		if folder.Role != "" {
+			fmt.Printf(" (%s)", folder.Role)
+		}
+		fmt.Printf("\n")
 	}
 
 	return
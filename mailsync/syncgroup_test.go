@@ -80,7 +80,7 @@ func SetupSyncgroupTest(t *testing.T) {
 	store1, _ := newStore(&globalconfig, &store1conf)
 	store2, _ := newStore(&globalconfig, &store2conf)
 
-	folder := Mailfolder{[]string{"dir01", "child01"}, false}
+	folder := Mailfolder{Name: []string{"dir01", "child01"}, Excluded: false}
 	store1.CreateFolder(folder.Name)
 
 	tmpfoldermanager, err := store1.GetMailfolderManager(folder.Name)
@@ -122,7 +122,7 @@ func TestSyncgroupSync(t *testing.T) {
 	store1 := syncgroup.stores[0]
 	store2 := syncgroup.stores[1]
 
-	folder := Mailfolder{[]string{"dir01", "child01"}, false}
+	folder := Mailfolder{Name: []string{"dir01", "child01"}, Excluded: false}
 	err = syncgroup.SyncFolder(folder)
 	if err != nil {
 		t.Fatal(err)
@@ -415,7 +415,11 @@ func verifySync(t *testing.T, syncgroup *Syncgroup, folder Mailfolder, expected
 	countMessages(t, store2, folder, expected)
 
 	// Verify flags
-	syncstatus, err := NewUIDMapSyncstatus(synccgrouptest.globalconfig, synccgrouptest.syncgroup1conf, syncgroup.metadatadir, folder.Name)
+	statusbackend, err := syncgroup.getSyncstatusBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncstatus, err := statusbackend.OpenFolder(folder.Name)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1,5 +1,18 @@
 package mailsync
 
+type Storenumber int
+
+const (
+	Store1 Storenumber = iota
+	Store2
+)
+
+type Uint32Slice []uint32
+
+func (p Uint32Slice) Len() int           { return len(p) }
+func (p Uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p Uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 type Syncstatus interface {
 	SetSrcstore(store Storenumber)
 	GetSrcstoreCol() (string, error)
@@ -12,9 +25,24 @@ type Syncstatus interface {
 	Rollback() (err error)
 	Update(srcuid uint32, dstuid uint32, flags string) (err error)
 	Delete(uid uint32) (err error)
+	// SetMessageIdentity records the identity of a synced message
+	SetMessageIdentity(srcuid uint32, identity messageIdentity) (err error)
 	GetNewMessages(folder MailfolderManager) ([]uint32, error)
 	GetDeletedMessages(folder MailfolderManager) ([]uint32, error)
 	GetChangedMessages(folder MailfolderManager) ([]uint32, error)
 
 	Close() (err error)
 }
+
+// SyncstatusBackend saves the syncstatus of all the folders of a syncgroup.
+// The backends are registered with registerSyncstatusBackend and selected
+// by the syncgroup syncstatusbackend.
+type SyncstatusBackend interface {
+	// OpenFolder returns the syncstatus of a folder, creating it if it's
+	// missing. A transaction of the returned Syncstatus is committed
+	// atomically and durably, or not at all.
+	OpenFolder(fname foldername) (Syncstatus, error)
+	// Folders returns the folders with a syncstatus
+	Folders() ([]foldername, error)
+	Close() (err error)
+}
@@ -0,0 +1,312 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+// The syncstatus conformance tests are run against every backend available
+// in the build
+
+func syncstatusBackendNames() []string {
+	names := make([]string, 0, len(syncstatusBackends))
+	for name := range syncstatusBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestSyncstatusConfig(name string) (*config.Config, *config.SyncgroupConfig, string) {
+	metadatadir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	syncgroupconf := &config.SyncgroupConfig{Name: "syncgroup1", Syncstatusbackend: name}
+	globalconfig := &config.Config{Metadatadir: metadatadir, LogLevel: "error"}
+	return globalconfig, syncgroupconf, metadatadir
+}
+
+func openTestSyncstatusBackend(t *testing.T, globalconfig *config.Config, syncgroupconf *config.SyncgroupConfig, metadatadir string) SyncstatusBackend {
+	backend, err := openSyncstatusBackend(globalconfig, syncgroupconf, metadatadir)
+	if err != nil {
+		t.Fatalf("%s: %v", syncgroupconf.Syncstatusbackend, err)
+	}
+	return backend
+}
+
+func testSyncstatusEntries(t *testing.T, name string, syncstatus Syncstatus, expected []syncstatusEntry) {
+	entries, err := syncstatus.(entriesSyncstatus).getEntries()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	sort.Sort(syncstatusEntriesByUID(entries))
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("%s: wrong entries: %v, expected: %v", name, entries, expected)
+	}
+}
+
+type syncstatusEntriesByUID []syncstatusEntry
+
+func (p syncstatusEntriesByUID) Len() int           { return len(p) }
+func (p syncstatusEntriesByUID) Less(i, j int) bool { return p[i].uids[0] < p[j].uids[0] }
+func (p syncstatusEntriesByUID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func TestSyncstatusBackendTransactions(t *testing.T) {
+	identity := newMessageIdentity([]byte("Message-ID: <1@test>\r\n\r\nbody"))
+	for _, name := range syncstatusBackendNames() {
+		globalconfig, syncgroupconf, metadatadir := newTestSyncstatusConfig(name)
+		defer os.RemoveAll(metadatadir)
+		fname := foldername{"INBOX", "a/b"}
+
+		backend := openTestSyncstatusBackend(t, globalconfig, syncgroupconf, metadatadir)
+		syncstatus, err := backend.OpenFolder(fname)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		syncstatus.SetSrcstore(Store1)
+		syncstatus.BeginTx()
+		syncstatus.Update(1, 10, "S")
+		syncstatus.Update(2, 20, "")
+		if err = syncstatus.Commit(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if uid, err := syncstatus.GetDststoreUID(1); err != nil || uid != 10 {
+			t.Fatalf("%s: wrong dst uid %d: %v", name, uid, err)
+		}
+		syncstatus.SetSrcstore(Store2)
+		if uid, err := syncstatus.GetDststoreUID(20); err != nil || uid != 2 {
+			t.Fatalf("%s: wrong dst uid %d: %v", name, uid, err)
+		}
+
+		// A rollbacked transaction isn't saved
+		syncstatus.SetSrcstore(Store1)
+		syncstatus.BeginTx()
+		syncstatus.Update(3, 30, "")
+		syncstatus.Delete(1)
+		if err = syncstatus.Rollback(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if has, _ := syncstatus.HasUID(3); has {
+			t.Fatalf("%s: rollbacked entry found", name)
+		}
+		if has, _ := syncstatus.HasUID(1); !has {
+			t.Fatalf("%s: rollbacked deletion done", name)
+		}
+
+		// Updating the flags keeps the identity
+		syncstatus.BeginTx()
+		syncstatus.Update(1, 10, "FS")
+		syncstatus.SetMessageIdentity(1, identity)
+		syncstatus.Update(1, 10, "F")
+		syncstatus.SetSrcstore(Store2)
+		syncstatus.Delete(20)
+		if err = syncstatus.Commit(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expected := []syncstatusEntry{{uids: [2]uint32{1, 10}, flags: "F", messageIdentity: identity}}
+		testSyncstatusEntries(t, name, syncstatus, expected)
+		syncstatus.Close()
+		if err = backend.Close(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// The committed transactions are durable
+		entries, err := readSyncstatus(syncgroupconf, metadatadir, fname)
+		if err != nil || !reflect.DeepEqual(entries, expected) {
+			t.Fatalf("%s: wrong read entries: %v: %v", name, entries, err)
+		}
+		backend = openTestSyncstatusBackend(t, globalconfig, syncgroupconf, metadatadir)
+		folders, err := backend.Folders()
+		if err != nil || !reflect.DeepEqual(folders, []foldername{fname}) {
+			t.Fatalf("%s: wrong folders: %v: %v", name, folders, err)
+		}
+		syncstatus, err = backend.OpenFolder(fname)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		testSyncstatusEntries(t, name, syncstatus, expected)
+		syncstatus.Close()
+		backend.Close()
+	}
+}
+
+func TestSyncstatusBackendMessages(t *testing.T) {
+	syncgroup, backend1, _ := newTestMemorySyncgroup(t, "expunge")
+	backend1.AddMessage(memoryTestFolder.Name, "S", []byte("Subject: 1\r\n\r\n"))
+	backend1.AddMessage(memoryTestFolder.Name, "F", []byte("Subject: 2\r\n\r\n"))
+	backend1.AddMessage(memoryTestFolder.Name, "", []byte("Subject: 3\r\n\r\n"))
+	folder, err := syncgroup.stores[0].GetMailfolderManager(memoryTestFolder.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = folder.UpdateMessageList(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range syncstatusBackendNames() {
+		globalconfig, syncgroupconf, metadatadir := newTestSyncstatusConfig(name)
+		defer os.RemoveAll(metadatadir)
+		backend := openTestSyncstatusBackend(t, globalconfig, syncgroupconf, metadatadir)
+		syncstatus, err := backend.OpenFolder(memoryTestFolder.Name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		syncstatus.SetSrcstore(Store1)
+		syncstatus.BeginTx()
+		syncstatus.Update(1, 10, "S")
+		syncstatus.Update(2, 20, "")
+		syncstatus.Update(4, 40, "")
+		if err = syncstatus.Commit(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for _, check := range []struct {
+			get      func(MailfolderManager) ([]uint32, error)
+			expected []uint32
+		}{
+			{syncstatus.GetNewMessages, []uint32{3}},
+			{syncstatus.GetDeletedMessages, []uint32{4}},
+			{syncstatus.GetChangedMessages, []uint32{2}},
+		} {
+			uids, err := check.get(folder)
+			if err != nil || !reflect.DeepEqual(uids, check.expected) {
+				t.Fatalf("%s: wrong uids %v (expected %v): %v", name, uids, check.expected, err)
+			}
+		}
+		syncstatus.Close()
+		backend.Close()
+	}
+}
+
+func TestSyncstatusBackendConcurrentFolders(t *testing.T) {
+	for _, name := range syncstatusBackendNames() {
+		globalconfig, syncgroupconf, metadatadir := newTestSyncstatusConfig(name)
+		defer os.RemoveAll(metadatadir)
+		backend := openTestSyncstatusBackend(t, globalconfig, syncgroupconf, metadatadir)
+
+		out := make(chan error)
+		for i := 0; i < 4; i++ {
+			go func(fname foldername) {
+				syncstatus, err := backend.OpenFolder(fname)
+				if err != nil {
+					out <- err
+					return
+				}
+				defer syncstatus.Close()
+				syncstatus.SetSrcstore(Store1)
+				for uid := uint32(1); uid <= 50; uid++ {
+					if err = syncstatus.BeginTx(); err == nil {
+						if err = syncstatus.Update(uid, uid+100, ""); err == nil {
+							err = syncstatus.Commit()
+						}
+					}
+					if err != nil {
+						out <- err
+						return
+					}
+				}
+				out <- nil
+			}(foldername{fmt.Sprintf("folder%d", i)})
+		}
+		for i := 0; i < 4; i++ {
+			if err := <-out; err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		backend.Close()
+
+		for i := 0; i < 4; i++ {
+			entries, err := readSyncstatus(syncgroupconf, metadatadir, foldername{fmt.Sprintf("folder%d", i)})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(entries) != 50 {
+				t.Fatalf("%s: wrong number of entries of folder%d: %d", name, i, len(entries))
+			}
+		}
+	}
+}
+
+func TestConvertSyncstatus(t *testing.T) {
+	identity := newMessageIdentity([]byte("Message-ID: <1@test>\r\n\r\nbody"))
+	expected := []syncstatusEntry{
+		{uids: [2]uint32{1, 10}, flags: "S", messageIdentity: identity},
+		{uids: [2]uint32{2, 20}, flags: ""},
+	}
+	names := syncstatusBackendNames()
+	for _, from := range names {
+		for _, to := range names {
+			if from == to {
+				continue
+			}
+			globalconfig, syncgroupconf, _ := newTestSyncstatusConfig(from)
+			defer os.RemoveAll(globalconfig.Metadatadir)
+			metadatadir := syncgroupMetadatadir(globalconfig, syncgroupconf.Name)
+
+			backend := openTestSyncstatusBackend(t, globalconfig, syncgroupconf, metadatadir)
+			for _, fname := range []foldername{{"INBOX"}, {"work"}} {
+				syncstatus, err := backend.OpenFolder(fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				syncstatus.SetSrcstore(Store1)
+				syncstatus.BeginTx()
+				syncstatus.Update(1, 10, "S")
+				syncstatus.SetMessageIdentity(1, identity)
+				syncstatus.Update(2, 20, "")
+				if err = syncstatus.Commit(); err != nil {
+					t.Fatal(err)
+				}
+				syncstatus.Close()
+			}
+			backend.Close()
+
+			folders, err := ConvertSyncstatus(globalconfig, syncgroupconf, to)
+			if err != nil || folders != 2 {
+				t.Fatalf("%s -> %s: converted %d folders: %v", from, to, folders, err)
+			}
+
+			// The configured old backend doesn't open the converted
+			// syncstatus
+			if _, err = openSyncstatusBackend(globalconfig, syncgroupconf, metadatadir); err == nil {
+				t.Fatalf("%s -> %s: the old backend was opened", from, to)
+			}
+			syncgroupconf.Syncstatusbackend = ""
+			if name, _, err := selectSyncstatusBackend(syncgroupconf, metadatadir); err != nil || name != to {
+				t.Fatalf("%s -> %s: wrong backend in use %q: %v", from, to, name, err)
+			}
+			backend = openTestSyncstatusBackend(t, globalconfig, syncgroupconf, metadatadir)
+			for _, fname := range []foldername{{"INBOX"}, {"work"}} {
+				syncstatus, err := backend.OpenFolder(fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				testSyncstatusEntries(t, from+" -> "+to, syncstatus, expected)
+				syncstatus.Close()
+			}
+			backend.Close()
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sgotti/gomailsync/config"
+)
+
+// syncstatusBackendType opens the syncstatus backends of a type
+type syncstatusBackendType struct {
+	// open opens the backend in the metadatadir of a syncgroup, creating
+	// it if it's missing
+	open func(globalconfig *config.Config, config *config.SyncgroupConfig, metadatadir string) (SyncstatusBackend, error)
+	// read reads the syncstatus of a folder without creating or changing
+	// the backend (used by the dry run). It's empty if the folder was
+	// never synced.
+	read func(metadatadir string, fname foldername) ([]syncstatusEntry, error)
+}
+
+// The available syncstatus backends by name
+var syncstatusBackends = make(map[string]*syncstatusBackendType)
+
+// The files saved by every backend (also the ones not available in this
+// build) in the syncgroup metadatadir. They tell the backend in use.
+var syncstatusBackendFiles = map[string][]string{
+	"sqlite": {"syncstatus.db", "uidmapsyncstatus"},
+	"file":   {"filesyncstatus"},
+}
+
+// The backends, in order of preference, of a syncgroup without syncstatus
+// and without a configured backend
+var defaultSyncstatusBackends = []string{"sqlite", "file"}
+
+func registerSyncstatusBackend(name string, b *syncstatusBackendType) {
+	syncstatusBackends[name] = b
+}
+
+// syncgroupMetadatadir returns the metadata dir of a syncgroup
+func syncgroupMetadatadir(globalconfig *config.Config, name string) string {
+	return filepath.Join(globalconfig.Metadatadir, "syncgroups", name)
+}
+
+// syncstatusFolderKey returns the name of a folder saved in the folders table
+func syncstatusFolderKey(fname foldername) string {
+	return FolderToEscapedStorePath(fname, '/', false)
+}
+
+// syncstatusBackendsInUse returns the backends with a syncstatus saved in
+// metadatadir
+func syncstatusBackendsInUse(metadatadir string) []string {
+	inuse := make([]string, 0)
+	for name, files := range syncstatusBackendFiles {
+		for _, file := range files {
+			if _, err := os.Stat(filepath.Join(metadatadir, file)); err == nil {
+				inuse = append(inuse, name)
+				break
+			}
+		}
+	}
+	sort.Strings(inuse)
+	return inuse
+}
+
+// selectSyncstatusBackend returns the backend of a syncgroup: the configured
+// one, else the one in use, else the first available default one. The
+// syncstatus saved by another backend has to be converted with
+// ConvertSyncstatus.
+func selectSyncstatusBackend(config *config.SyncgroupConfig, metadatadir string) (string, *syncstatusBackendType, error) {
+	inuse := syncstatusBackendsInUse(metadatadir)
+	if len(inuse) > 1 {
+		return "", nil, fmt.Errorf("The syncstatus is saved by multiple backends: %v", inuse)
+	}
+
+	name := config.Syncstatusbackend
+	switch {
+	case name != "":
+		if len(inuse) == 1 && inuse[0] != name {
+			return "", nil, fmt.Errorf("The syncstatus is saved by the %q backend: convert it to the %q backend with the convert-syncstatus command", inuse[0], name)
+		}
+	case len(inuse) == 1:
+		name = inuse[0]
+	default:
+		for _, n := range defaultSyncstatusBackends {
+			if _, ok := syncstatusBackends[n]; ok {
+				name = n
+				break
+			}
+		}
+	}
+
+	b, ok := syncstatusBackends[name]
+	if !ok {
+		return "", nil, fmt.Errorf("The syncstatus backend %q isn't available in this build (the sqlite one needs cgo)", name)
+	}
+	return name, b, nil
+}
+
+// openSyncstatusBackend opens the syncstatus backend of a syncgroup
+func openSyncstatusBackend(globalconfig *config.Config, config *config.SyncgroupConfig, metadatadir string) (SyncstatusBackend, error) {
+	_, b, err := selectSyncstatusBackend(config, metadatadir)
+	if err != nil {
+		return nil, err
+	}
+	return b.open(globalconfig, config, metadatadir)
+}
+
+// readSyncstatus reads the syncstatus of a folder without creating or
+// changing the syncgroup backend
+func readSyncstatus(config *config.SyncgroupConfig, metadatadir string, fname foldername) ([]syncstatusEntry, error) {
+	if len(syncstatusBackendsInUse(metadatadir)) == 0 {
+		return make([]syncstatusEntry, 0), nil
+	}
+	_, b, err := selectSyncstatusBackend(config, metadatadir)
+	if err != nil {
+		return nil, err
+	}
+	return b.read(metadatadir, fname)
+}
+
+// copySyncstatus copies the entries of the src syncstatus to dst in a
+// transaction
+func copySyncstatus(src Syncstatus, dst Syncstatus) (err error) {
+	es, ok := src.(entriesSyncstatus)
+	if !ok {
+		return fmt.Errorf("Cannot copy syncstatus %T", src)
+	}
+	entries, err := es.getEntries()
+	if err != nil {
+		return err
+	}
+
+	dst.SetSrcstore(Store1)
+	if err = dst.BeginTx(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = dst.Update(entry.uids[Store1], entry.uids[Store2], entry.flags); err != nil {
+			break
+		}
+		if entry.messageIdentity != (messageIdentity{}) {
+			if err = dst.SetMessageIdentity(entry.uids[Store1], entry.messageIdentity); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		dst.Rollback()
+		return err
+	}
+	return dst.Commit()
+}
+
+// ConvertSyncstatus copies the syncstatus of a syncgroup to the backend to
+// and returns the number of converted folders. The files of the old backend
+// are kept with a ".converted" suffix.
+func ConvertSyncstatus(globalconfig *config.Config, config *config.SyncgroupConfig, to string) (folders int, err error) {
+	metadatadir := syncgroupMetadatadir(globalconfig, config.Name)
+
+	inuse := syncstatusBackendsInUse(metadatadir)
+	switch {
+	case len(inuse) == 0:
+		return 0, fmt.Errorf("The syncgroup %s has no syncstatus", config.Name)
+	case len(inuse) > 1:
+		return 0, fmt.Errorf("The syncstatus is saved by multiple backends: %v", inuse)
+	case inuse[0] == to:
+		return 0, fmt.Errorf("The syncstatus is already saved by the %q backend", to)
+	}
+	from := inuse[0]
+	frombackend, ok := syncstatusBackends[from]
+	if !ok {
+		return 0, fmt.Errorf("The syncstatus backend %q isn't available in this build", from)
+	}
+	tobackend, ok := syncstatusBackends[to]
+	if !ok {
+		return 0, fmt.Errorf("The syncstatus backend %q isn't available in this build", to)
+	}
+	for _, file := range syncstatusBackendFiles[from] {
+		if _, err = os.Stat(filepath.Join(metadatadir, file+".converted")); err == nil {
+			return 0, fmt.Errorf("A converted syncstatus %s already exists", file+".converted")
+		}
+	}
+
+	src, err := frombackend.open(globalconfig, config, metadatadir)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	names, err := src.Folders()
+	if err != nil {
+		return 0, err
+	}
+
+	dst, err := tobackend.open(globalconfig, config, metadatadir)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if err = convertFolderSyncstatus(src, dst, name); err != nil {
+			break
+		}
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	// A partial conversion is removed, the old syncstatus is still used
+	if err != nil {
+		for _, file := range syncstatusBackendFiles[to] {
+			os.RemoveAll(filepath.Join(metadatadir, file))
+		}
+		return 0, err
+	}
+
+	if err = src.Close(); err != nil {
+		return 0, err
+	}
+	for _, file := range syncstatusBackendFiles[from] {
+		path := filepath.Join(metadatadir, file)
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err = os.Rename(path, path+".converted"); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), nil
+}
+
+func convertFolderSyncstatus(src SyncstatusBackend, dst SyncstatusBackend, name foldername) error {
+	srcsyncstatus, err := src.OpenFolder(name)
+	if err != nil {
+		return err
+	}
+	defer srcsyncstatus.Close()
+	dstsyncstatus, err := dst.OpenFolder(name)
+	if err != nil {
+		return err
+	}
+	defer dstsyncstatus.Close()
+	if err = copySyncstatus(srcsyncstatus, dstsyncstatus); err != nil {
+		return fmt.Errorf("Cannot convert the syncstatus of folder %s: %s", FolderToStorePath(name, '/'), err)
+	}
+	return nil
+}
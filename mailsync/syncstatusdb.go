@@ -0,0 +1,294 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+//go:build cgo
+// +build cgo
+
+package mailsync
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sgotti/gomailsync/config"
+	"github.com/sgotti/gomailsync/errors"
+	"github.com/sgotti/gomailsync/log"
+)
+
+// How long a write waits for the syncstatus db locked by the sync of another
+// folder (see the syncgroup concurrentsyncs)
+const syncstatusBusyTimeout = 60 * time.Second
+
+// SyncstatusDB is the syncstatus database of a syncgroup. It contains the
+// syncstatus of all the folders, keyed by a folder id, and it's shared by
+// the concurrent folder syncs.
+type SyncstatusDB struct {
+	globalconfig *config.Config
+	config       *config.SyncgroupConfig
+	path         string
+	db           *sql.DB
+	logger       *log.Logger
+	e            *errors.Error
+}
+
+func init() {
+	registerSyncstatusBackend("sqlite", &syncstatusBackendType{
+		open: func(globalconfig *config.Config, config *config.SyncgroupConfig, metadatadir string) (SyncstatusBackend, error) {
+			return OpenSyncstatusDB(globalconfig, config, metadatadir)
+		},
+		read: readSyncstatusDB,
+	})
+}
+
+// syncstatusDBPath returns the path of the syncstatus db of a syncgroup
+func syncstatusDBPath(metadatadir string) string {
+	return filepath.Join(metadatadir, "syncstatus.db")
+}
+
+// legacySyncstatusDir returns the dir of the per folder syncstatus dbs used
+// by the older versions
+func legacySyncstatusDir(metadatadir string) string {
+	return filepath.Join(metadatadir, "uidmapsyncstatus")
+}
+
+// sqliteURI returns the sqlite file URI of path with the query params. The
+// escaped folder names in the metadata paths can contain "%".
+func sqliteURI(path string, params string) string {
+	r := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+	return "file:" + r.Replace(path) + "?" + params
+}
+
+// OpenSyncstatusDB opens (creating or migrating it) the syncstatus db of a
+// syncgroup. The per folder syncstatus dbs of the older versions are
+// imported and their dir is renamed to uidmapsyncstatus.migrated.
+func OpenSyncstatusDB(globalconfig *config.Config, config *config.SyncgroupConfig, metadatadir string) (d *SyncstatusDB, err error) {
+	logprefix := fmt.Sprintf("%s %s", "syncstatusdb", config.Name)
+	errprefix := logprefix
+	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
+	e := errors.New(errprefix)
+
+	if err = os.MkdirAll(metadatadir, 0777); err != nil {
+		return nil, e.E(err)
+	}
+
+	path := syncstatusDBPath(metadatadir)
+	db, err := sql.Open("sqlite3", sqliteURI(path, fmt.Sprintf("_journal_mode=WAL&_busy_timeout=%d", syncstatusBusyTimeout/time.Millisecond)))
+	if err != nil {
+		return nil, e.E(err)
+	}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+
+	if err = migrateDB(db, path, syncstatusMigrations); err != nil {
+		logger.Errorf("cannot migrate the syncstatus: %s", err)
+		return nil, e.E(err)
+	}
+
+	d = &SyncstatusDB{
+		globalconfig: globalconfig,
+		config:       config,
+		path:         path,
+		db:           db,
+		logger:       logger,
+		e:            e,
+	}
+	if err = d.importLegacySyncstatus(legacySyncstatusDir(metadatadir)); err != nil {
+		return nil, e.E(err)
+	}
+	return d, nil
+}
+
+func (d *SyncstatusDB) OpenFolder(fname foldername) (Syncstatus, error) {
+	return NewUIDMapSyncstatus(d.globalconfig, d.config, d, fname)
+}
+
+func (d *SyncstatusDB) Folders() ([]foldername, error) {
+	rows, err := d.db.Query("select name from folders order by name")
+	if err != nil {
+		return nil, d.e.E(err)
+	}
+	defer rows.Close()
+	folders := make([]foldername, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, d.e.E(err)
+		}
+		folders = append(folders, EscapedStorePathToFolder(name, '/'))
+	}
+	return folders, d.e.E(rows.Err())
+}
+
+func (d *SyncstatusDB) Close() error {
+	return d.db.Close()
+}
+
+// folderID returns the id of a folder, adding it to the folders table if
+// it's missing
+func (d *SyncstatusDB) folderID(fname foldername) (id int64, err error) {
+	key := syncstatusFolderKey(fname)
+	if _, err = d.db.Exec("insert or ignore into folders(name) values (?)", key); err != nil {
+		return 0, err
+	}
+	err = d.db.QueryRow("select id from folders where name = ?", key).Scan(&id)
+	return id, err
+}
+
+// importLegacySyncstatus copies the per folder syncstatus dbs in dir to the
+// syncstatus db. All the folders are imported in a transaction, then dir is
+// renamed, so an interrupted import is done again from the start.
+func (d *SyncstatusDB) importLegacySyncstatus(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	folders := make(map[string][]syncstatusEntry)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "syncstatus.db" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if err = migrateFolderSyncstatusDB(path); err != nil {
+			return err
+		}
+		entries, err := readFolderSyncstatusDB(path)
+		if err != nil {
+			return err
+		}
+		// The older versions saved the folder names unescaped
+		folders[syncstatusFolderKey(strings.Split(rel, string(os.PathSeparator)))] = entries
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, entries := range folders {
+		d.logger.Infof("importing the syncstatus of folder %s (%d entries)", key, len(entries))
+		if err = importFolderEntries(tx, key, entries); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("import of the syncstatus of folder %s failed: %s", key, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return os.Rename(dir, dir+".migrated")
+}
+
+// importFolderEntries replaces the entries of a folder with entries
+func importFolderEntries(tx *sql.Tx, key string, entries []syncstatusEntry) error {
+	if _, err := tx.Exec("insert or ignore into folders(name) values (?)", key); err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("select id from folders where name = ?", key).Scan(&id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from syncstatus where folderid = ?", id); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("insert into syncstatus(folderid, uidstore1, uidstore2, flags, messageid, size, hash, synctime) values (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, entry := range entries {
+		if _, err = stmt.Exec(id, entry.uids[0], entry.uids[1], entry.flags, entry.messageid, entry.size, entry.hash, entry.synctime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSyncstatusDB reads the syncstatus of a folder without creating or
+// changing the syncstatus db. The per folder db of the older versions is
+// read if the syncgroup was never synced by this version. It's empty if the
+// folder was never synced.
+func readSyncstatusDB(metadatadir string, fname foldername) ([]syncstatusEntry, error) {
+	path := syncstatusDBPath(metadatadir)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return readFolderSyncstatusDB(filepath.Join(legacySyncstatusDir(metadatadir), FolderToStorePath(fname, os.PathSeparator), "syncstatus.db"))
+	}
+
+	db, err := sql.Open("sqlite3", sqliteURI(path, "mode=ro"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if _, err = dbVersion(db, path, len(syncstatusMigrations)); err != nil {
+		return nil, err
+	}
+	var id int64
+	err = db.QueryRow("select id from folders where name = ?", syncstatusFolderKey(fname)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return make([]syncstatusEntry, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readSyncstatusEntries(db, "where folderid = ?", id)
+}
+
+// migrateFolderSyncstatusDB migrates a per folder syncstatus db of the older
+// versions to the last folderSyncstatusMigrations (the db is backed up by
+// migrateDB)
+func migrateFolderSyncstatusDB(path string) error {
+	db, err := sql.Open("sqlite3", sqliteURI(path, "mode=rw"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrateDB(db, path, folderSyncstatusMigrations)
+}
+
+// readFolderSyncstatusDB reads the entries of a per folder syncstatus db of
+// the older versions. It's empty if the db doesn't exist.
+func readFolderSyncstatusDB(path string) ([]syncstatusEntry, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return make([]syncstatusEntry, 0), nil
+	}
+
+	db, err := sql.Open("sqlite3", sqliteURI(path, "mode=ro"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if _, err = dbVersion(db, path, len(folderSyncstatusMigrations)); err != nil {
+		return nil, err
+	}
+	return readSyncstatusEntries(db, "")
+}
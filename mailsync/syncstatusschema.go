@@ -0,0 +1,181 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+//go:build cgo
+// +build cgo
+
+package mailsync
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// dbMigration changes the schema of a db from the previous version to the
+// next one
+type dbMigration func(tx *sql.Tx) error
+
+// folderSyncstatusMigrations are the ordered schema migrations of the per
+// folder syncstatus dbs of the older versions. The schema version, saved as
+// the sqlite user_version, is the number of applied migrations. They're
+// frozen: the per folder dbs are only migrated to be imported in the
+// syncstatus db.
+var folderSyncstatusMigrations = []dbMigration{
+	// 1: the uid mappings and the flags
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`create table if not exists syncstatus (uidstore1 integer not null, uidstore2 integer not null, flags text, primary key (uidstore1, uidstore2))`)
+		return err
+	},
+	// 2: the message identity. The columns were added to some dbs before
+	// the schema was versioned, so only the missing ones are added.
+	func(tx *sql.Tx) error {
+		return addColumns(tx, "syncstatus", "messageid text", "size integer", "hash text", "synctime integer")
+	},
+}
+
+// syncstatusMigrations are the ordered schema migrations of the syncstatus
+// db of a syncgroup. Its versions follow the ones of the per folder dbs, so
+// the first ones do nothing. Released migrations must never be changed, new
+// ones are only appended.
+var syncstatusMigrations = []dbMigration{
+	// 1, 2: the per folder dbs (see folderSyncstatusMigrations)
+	noMigration,
+	noMigration,
+	// 3: the folders with their uid mappings, flags and message identity
+	func(tx *sql.Tx) error {
+		for _, query := range []string{
+			`create table folders (id integer primary key, name text not null unique)`,
+			`create table syncstatus (folderid integer not null references folders(id), uidstore1 integer not null, uidstore2 integer not null, flags text, messageid text, size integer, hash text, synctime integer, primary key (folderid, uidstore1, uidstore2))`,
+			`create index syncstatus_uidstore2 on syncstatus (folderid, uidstore2)`,
+		} {
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func noMigration(tx *sql.Tx) error {
+	return nil
+}
+
+// queryer is implemented by sql.DB and sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// tableColumns returns the columns of a table
+func tableColumns(q queryer, table string) (map[string]bool, error) {
+	columns := make(map[string]bool)
+	rows, err := q.Query(fmt.Sprintf("pragma table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// addColumns adds to table the columns (defined as "name type") it doesn't
+// already have
+func addColumns(tx *sql.Tx, table string, columns ...string) error {
+	existing, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if existing[strings.Fields(column)[0]] {
+			continue
+		}
+		if _, err = tx.Exec(fmt.Sprintf("alter table %s add column %s", table, column)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbVersion returns the schema version of db and an error if it's newer
+// than the latest supported one
+func dbVersion(db *sql.DB, dbpath string, latest int) (int, error) {
+	var version int
+	if err := db.QueryRow("pragma user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > latest {
+		return 0, fmt.Errorf("database %s has schema version %d but the latest supported version is %d: it was written by a newer gomailsync", dbpath, version, latest)
+	}
+	return version, nil
+}
+
+// migrateDB applies to db the migrations after its schema version, all in a
+// transaction. The db file of an older version is first backed up to
+// dbpath.v<version>.bak.
+func migrateDB(db *sql.DB, dbpath string, migrations []dbMigration) error {
+	version, err := dbVersion(db, dbpath, len(migrations))
+	if err != nil {
+		return err
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	var tables int
+	if err = db.QueryRow("select count(*) from sqlite_master").Scan(&tables); err != nil {
+		return err
+	}
+	// A new db has nothing to backup
+	if tables > 0 {
+		// Moves the WAL content to the db file
+		if _, err = db.Exec("pragma wal_checkpoint(truncate)"); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(dbpath)
+		if err != nil {
+			return err
+		}
+		if err = writeFileAtomic(fmt.Sprintf("%s.v%d.bak", dbpath, version), data, true); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		if err = migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration of %s to schema version %d failed: %s", dbpath, i+1, err)
+		}
+	}
+	if _, err = tx.Exec(fmt.Sprintf("pragma user_version = %d", len(migrations))); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
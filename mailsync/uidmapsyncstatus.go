@@ -15,83 +15,111 @@
 // with this program; if not, write to the Free Software Foundation, Inc.,
 // 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
 
+//go:build cgo
+// +build cgo
+
 package mailsync
 
 import (
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
-	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/sgotti/gomailsync/config"
 	"github.com/sgotti/gomailsync/errors"
 	"github.com/sgotti/gomailsync/log"
-	"os"
 )
 
+// UIDMapSyncstatus is the syncstatus of a folder saved in the syncstatus db
+// of its syncgroup
 type UIDMapSyncstatus struct {
-	metadatadir string
-	fname       foldername
-	StatusDB    *sql.DB
-	activeTx    *sql.Tx
-	srcstore    Storenumber
-	logger      *log.Logger
-	e           *errors.Error
+	folderid int64
+	fname    foldername
+	// Shared by all the folders of the syncgroup
+	StatusDB *sql.DB
+	activeTx *sql.Tx
+	srcstore Storenumber
+	logger   *log.Logger
+	e        *errors.Error
 }
 
-type Storenumber int
-
-const (
-	Store1 Storenumber = iota
-	Store2
-)
-
-type Uint32Slice []uint32
-
-func (p Uint32Slice) Len() int           { return len(p) }
-func (p Uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
-func (p Uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-
-func NewUIDMapSyncstatus(globalconfig *config.Config, config *config.SyncgroupConfig, basemetadatadir string, fname foldername) (u Syncstatus, err error) {
+func NewUIDMapSyncstatus(globalconfig *config.Config, config *config.SyncgroupConfig, statusdb *SyncstatusDB, fname foldername) (u Syncstatus, err error) {
 	logprefix := fmt.Sprintf("%s %s %s", "uidmapsyncstatus", config.Name, fname)
 	errprefix := logprefix
 	logger := log.GetLogger(logprefix, globalconfig.LogLevel)
 	e := errors.New(errprefix)
 
-	metadatadir := filepath.Join(basemetadatadir, "uidmapsyncstatus", FolderToStorePath(fname, os.PathSeparator))
-	err = os.MkdirAll(metadatadir, 0777)
+	folderid, err := statusdb.folderID(fname)
 	if err != nil {
 		return nil, e.E(err)
 	}
 
-	statusdbfilepath := filepath.Join(metadatadir, "syncstatus.db")
+	u = &UIDMapSyncstatus{
+		folderid: folderid,
+		fname:    fname,
+		StatusDB: statusdb.db,
+		logger:   logger,
+		e:        e,
+	}
+
+	return
+}
 
-	db, err := sql.Open("sqlite3", statusdbfilepath)
+// readSyncstatusEntries reads the entries of the syncstatus table matching
+// the where clause. The identity of the entries written by the older
+// versions without it is empty.
+func readSyncstatusEntries(db *sql.DB, where string, args ...interface{}) ([]syncstatusEntry, error) {
+	columns, err := tableColumns(db, "syncstatus")
 	if err != nil {
-		return nil, e.E(err)
+		return nil, err
 	}
+	identitycolumns := make([]string, 0, 4)
+	for _, column := range []string{"messageid", "size", "hash", "synctime"} {
+		empty := "''"
+		if column == "size" || column == "synctime" {
+			empty = "0"
+		}
+		if columns[column] {
+			identitycolumns = append(identitycolumns, fmt.Sprintf("coalesce(%s, %s)", column, empty))
+		} else {
+			identitycolumns = append(identitycolumns, empty)
+		}
+	}
+	query := fmt.Sprintf("select uidstore1, uidstore2, flags, %s from syncstatus %s", strings.Join(identitycolumns, ", "), where)
 
-	sql := `create table if not exists syncstatus (uidstore1 integer not null, uidstore2 integer not null, flags text, primary key (uidstore1, uidstore2));`
-
-	_, err = db.Exec(sql)
+	entries := make([]syncstatusEntry, 0)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		logger.Printf("%q: %s\n", err, sql)
-		return nil, e.E(err)
+		return nil, err
 	}
-	u = &UIDMapSyncstatus{
-		metadatadir: metadatadir,
-		fname:       fname,
-		StatusDB:    db,
-		logger:      logger,
-		e:           e,
+	defer rows.Close()
+	for rows.Next() {
+		var entry syncstatusEntry
+		if err = rows.Scan(&entry.uids[0], &entry.uids[1], &entry.flags, &entry.messageid, &entry.size, &entry.hash, &entry.synctime); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
 	}
+	return entries, rows.Err()
+}
 
-	return
+// getEntries returns all the syncstatus entries
+func (u *UIDMapSyncstatus) getEntries() ([]syncstatusEntry, error) {
+	entries, err := readSyncstatusEntries(u.StatusDB, "where folderid = ?", u.folderid)
+	if err != nil {
+		return nil, u.e.E(err)
+	}
+	return entries, nil
 }
 
+// Close rollbacks the active transaction. The syncstatus db is closed by the
+// syncgroup.
 func (u *UIDMapSyncstatus) Close() (err error) {
-	u.StatusDB.Close()
+	if u.activeTx != nil {
+		err = u.Rollback()
+	}
 	return
 }
 
@@ -132,10 +160,10 @@ func (u *UIDMapSyncstatus) GetDststoreUID(srcuid uint32) (dstuid uint32, err err
 
 	db := u.StatusDB
 
-	query := fmt.Sprintf("select %s from syncstatus where %s = %d", dstuidcol, srcuidcol, srcuid)
+	query := fmt.Sprintf("select %s from syncstatus where folderid = ? and %s = ?", dstuidcol, srcuidcol)
 
 	//u.log.Debug("query:", query)
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, u.folderid, srcuid)
 	if err != nil {
 		return 0, u.e.E(err)
 	}
@@ -157,9 +185,9 @@ func (u *UIDMapSyncstatus) HasUID(uid uint32) (bool, error) {
 
 	db := u.StatusDB
 
-	query := fmt.Sprintf("select %s, flags from syncstatus where %s = %d", uidcol, uidcol, uid)
+	query := fmt.Sprintf("select %s, flags from syncstatus where folderid = ? and %s = ?", uidcol, uidcol)
 	//u.log.Debug("query:", query)
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, u.folderid, uid)
 	if err != nil {
 		return false, u.e.E(err)
 	}
@@ -216,7 +244,17 @@ func (u *UIDMapSyncstatus) Update(srcuid uint32, dstuid uint32, flags string) (e
 		return u.e.E(err)
 	}
 
-	query := fmt.Sprintf("insert or replace into syncstatus(%s, %s, flags) values (?, ?, ?)", srcuidcol, dstuidcol)
+	// Update the flags keeping the other columns of an existing entry
+	query := fmt.Sprintf("update syncstatus set flags = ? where folderid = ? and %s = ? and %s = ?", srcuidcol, dstuidcol)
+	res, err := u.activeTx.Exec(query, flags, u.folderid, srcuid, dstuid)
+	if err != nil {
+		return u.e.E(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return u.e.E(err)
+	}
+
+	query = fmt.Sprintf("insert into syncstatus(folderid, %s, %s, flags) values (?, ?, ?, ?)", srcuidcol, dstuidcol)
 	//u.log.Debug("query:", query)
 
 	stmt, err := u.activeTx.Prepare(query)
@@ -225,7 +263,7 @@ func (u *UIDMapSyncstatus) Update(srcuid uint32, dstuid uint32, flags string) (e
 	}
 
 	defer stmt.Close()
-	_, err = stmt.Exec(srcuid, dstuid, flags)
+	_, err = stmt.Exec(u.folderid, srcuid, dstuid, flags)
 	if err != nil {
 		return u.e.E(err)
 	}
@@ -233,20 +271,33 @@ func (u *UIDMapSyncstatus) Update(srcuid uint32, dstuid uint32, flags string) (e
 	return u.e.E(err)
 }
 
+func (u *UIDMapSyncstatus) SetMessageIdentity(srcuid uint32, identity messageIdentity) (err error) {
+	srcuidcol, err := u.GetSrcstoreCol()
+	if err != nil {
+		return u.e.E(err)
+	}
+
+	query := fmt.Sprintf("update syncstatus set messageid = ?, size = ?, hash = ?, synctime = ? where folderid = ? and %s = ?", srcuidcol)
+	if _, err = u.activeTx.Exec(query, identity.messageid, identity.size, identity.hash, identity.synctime, u.folderid, srcuid); err != nil {
+		return u.e.E(err)
+	}
+	return
+}
+
 func (u *UIDMapSyncstatus) Delete(uid uint32) (err error) {
 	srcuidcol, err := u.GetSrcstoreCol()
 	if err != nil {
 		return u.e.E(err)
 	}
 
-	query := fmt.Sprintf("delete from syncstatus where %s = ?", srcuidcol)
+	query := fmt.Sprintf("delete from syncstatus where folderid = ? and %s = ?", srcuidcol)
 	//u.log.Debug("query:", query)
 	stmt, err := u.activeTx.Prepare(query)
 	if err != nil {
 		return u.e.E(err)
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(uid)
+	_, err = stmt.Exec(u.folderid, uid)
 	if err != nil {
 		return u.e.E(err)
 	}
@@ -265,8 +316,8 @@ func (u *UIDMapSyncstatus) GetNewMessages(folder MailfolderManager) ([]uint32, e
 		return nil, u.e.E(err)
 	}
 
-	query := fmt.Sprintf("select %s, flags from syncstatus", dstuidcol)
-	rows, err := db.Query(query)
+	query := fmt.Sprintf("select %s, flags from syncstatus where folderid = ?", dstuidcol)
+	rows, err := db.Query(query, u.folderid)
 	if err != nil {
 		return nil, u.e.E(err)
 	}
@@ -298,8 +349,8 @@ func (u *UIDMapSyncstatus) GetDeletedMessages(folder MailfolderManager) ([]uint3
 		return nil, u.e.E(err)
 	}
 
-	query := fmt.Sprintf("select %s, flags from syncstatus", dstuidcol)
-	rows, err := db.Query(query)
+	query := fmt.Sprintf("select %s, flags from syncstatus where folderid = ?", dstuidcol)
+	rows, err := db.Query(query, u.folderid)
 	if err != nil {
 		return nil, u.e.E(err)
 	}
@@ -330,8 +381,8 @@ func (u *UIDMapSyncstatus) GetChangedMessages(folder MailfolderManager) ([]uint3
 		return nil, err
 	}
 
-	query := fmt.Sprintf("select %s, flags from syncstatus", dstuidcol)
-	rows, err := db.Query(query)
+	query := fmt.Sprintf("select %s, flags from syncstatus where folderid = ?", dstuidcol)
+	rows, err := db.Query(query, u.folderid)
 	if err != nil {
 		return nil, u.e.E(err)
 	}
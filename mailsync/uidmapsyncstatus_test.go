@@ -0,0 +1,192 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+//go:build cgo
+// +build cgo
+
+package mailsync
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncstatusDBImport(t *testing.T) {
+	SetupSyncgroupTest(t)
+
+	metadatadir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	defer os.RemoveAll(metadatadir)
+
+	// The per folder syncstatus of the older versions, the first one
+	// written before the message identity was added. The folder names were
+	// saved unescaped
+	legacy := []struct {
+		fname  foldername
+		schema string
+	}{
+		{foldername{"INBOX"}, `create table syncstatus (uidstore1 integer not null, uidstore2 integer not null, flags text, primary key (uidstore1, uidstore2)); insert into syncstatus values (1, 10, 'S');`},
+		{foldername{"INBOX", "Q%20report"}, `create table syncstatus (uidstore1 integer not null, uidstore2 integer not null, flags text, messageid text, size integer, hash text, synctime integer, primary key (uidstore1, uidstore2)); insert into syncstatus values (2, 20, 'F', '<2@test>', 10, 'hash', 1); pragma user_version = 2;`},
+	}
+	for _, l := range legacy {
+		dbdir := filepath.Join(legacySyncstatusDir(metadatadir), FolderToStorePath(l.fname, os.PathSeparator))
+		os.MkdirAll(dbdir, 0777)
+		db, err := sql.Open("sqlite3", filepath.Join(dbdir, "syncstatus.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(l.schema)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The dry run reads the syncstatus not yet imported
+	entries, err := readSyncstatusDB(metadatadir, legacy[1].fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].uids != [2]uint32{2, 20} {
+		t.Fatalf("Wrong legacy entries: %v", entries)
+	}
+
+	statusdb, err := OpenSyncstatusDB(synccgrouptest.globalconfig, synccgrouptest.syncgroup1conf, metadatadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(legacySyncstatusDir(metadatadir)); !os.IsNotExist(err) {
+		t.Fatalf("The legacy syncstatus dir wasn't renamed: %v", err)
+	}
+	// The unversioned db was migrated before the import
+	backup := filepath.Join(legacySyncstatusDir(metadatadir)+".migrated", FolderToStorePath(legacy[0].fname, os.PathSeparator), "syncstatus.db.v0.bak")
+	if _, err = os.Stat(backup); err != nil {
+		t.Fatalf("No backup of the old syncstatus: %v", err)
+	}
+
+	for i, l := range legacy {
+		syncstatus, err := NewUIDMapSyncstatus(synccgrouptest.globalconfig, synccgrouptest.syncgroup1conf, statusdb, l.fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syncstatus.SetSrcstore(Store1)
+		uid, err := syncstatus.GetDststoreUID(uint32(i + 1))
+		if err != nil || uid != uint32(i+1)*10 {
+			t.Fatalf("Wrong imported uid %d for folder %v: %v", uid, l.fname, err)
+		}
+		syncstatus.Close()
+	}
+	statusdb.Close()
+
+	entries, err = readSyncstatusDB(metadatadir, legacy[1].fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].messageid != "<2@test>" || entries[0].flags != "F" {
+		t.Fatalf("Wrong imported entries: %v", entries)
+	}
+
+	// A syncstatus written by a newer version
+	db, _ := sql.Open("sqlite3", syncstatusDBPath(metadatadir))
+	_, err = db.Exec(fmt.Sprintf("pragma user_version = %d", len(syncstatusMigrations)+1))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenSyncstatusDB(synccgrouptest.globalconfig, synccgrouptest.syncgroup1conf, metadatadir); err == nil {
+		t.Fatal("A syncstatus with a newer schema version was opened")
+	}
+	if _, err = readSyncstatusDB(metadatadir, legacy[0].fname); err == nil {
+		t.Fatal("A syncstatus with a newer schema version was read")
+	}
+}
+
+func TestSyncstatusDBMigrate(t *testing.T) {
+	SetupSyncgroupTest(t)
+
+	metadatadir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	defer os.RemoveAll(metadatadir)
+
+	// A new db gets the latest schema without the per folder one
+	statusdb, err := OpenSyncstatusDB(synccgrouptest.globalconfig, synccgrouptest.syncgroup1conf, metadatadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err = statusdb.db.QueryRow("pragma user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(syncstatusMigrations) {
+		t.Fatalf("Expected schema version %d, found %d", len(syncstatusMigrations), version)
+	}
+	columns, err := tableColumns(statusdb.db, "syncstatus")
+	if err != nil || !columns["folderid"] {
+		t.Fatalf("Wrong syncstatus columns: %v, %v", columns, err)
+	}
+	statusdb.Close()
+	backups, err := filepath.Glob(syncstatusDBPath(metadatadir) + ".v*.bak")
+	if err != nil || len(backups) != 0 {
+		t.Fatalf("Unexpected backups of a new syncstatus: %v, %v", backups, err)
+	}
+
+	// A per folder db is migrated to the last per folder schema
+	path := filepath.Join(metadatadir, "folder.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`create table syncstatus (uidstore1 integer not null, uidstore2 integer not null, flags text, primary key (uidstore1, uidstore2)); insert into syncstatus values (1, 10, 'S');`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateFolderSyncstatusDB(path); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readFolderSyncstatusDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].uids != [2]uint32{1, 10} {
+		t.Fatalf("Wrong migrated entries: %v", entries)
+	}
+	if _, err = os.Stat(path + ".v0.bak"); err != nil {
+		t.Fatalf("No backup of the old syncstatus: %v", err)
+	}
+}
+
+func TestSyncstatusDBJournalMode(t *testing.T) {
+	SetupSyncgroupTest(t)
+
+	metadatadir, _ := ioutil.TempDir("", "gomailsync-tests-")
+	defer os.RemoveAll(metadatadir)
+
+	statusdb, err := OpenSyncstatusDB(synccgrouptest.globalconfig, synccgrouptest.syncgroup1conf, metadatadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statusdb.Close()
+
+	// The concurrent folder syncs need the WAL mode
+	var mode string
+	if err = statusdb.db.QueryRow("pragma journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("Wrong journal mode %q: %v", mode, err)
+	}
+}
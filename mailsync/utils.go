@@ -18,8 +18,12 @@
 package mailsync
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -45,11 +49,159 @@ func StrsEquals(a, b []string) bool {
 }
 
 func FolderToStorePath(name foldername, separator rune) string {
-	// TODO Escape possible(?) os path separator in folder name
 	path := strings.Join(name, string(separator))
 	return path
 }
 
+// Characters rejected by non POSIX filesystems (exFAT, FAT, SMB shares)
+const nonPortableChars = `\:*?"<>|`
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// escapeFolderComponent escapes a folder name component so it can be used
+// as a single path element. The separator, the os path separator and, if
+// portable is true, characters rejected by non POSIX filesystems are
+// replaced with "%XX" (XX is the hex value of every byte of the character).
+// A "%" is escaped only when followed by two hex digits, so names that
+// don't need escaping are left untouched.
+func escapeFolderComponent(c string, separator rune, portable bool) string {
+	var out []byte
+	for i, r := range c {
+		escape := false
+		switch {
+		case r == separator || r == os.PathSeparator || r == '/':
+			escape = true
+		case r == '%':
+			escape = i+2 < len(c) && isHexDigit(c[i+1]) && isHexDigit(c[i+2])
+		case portable:
+			escape = r < 0x20 || r == 0x7f || strings.ContainsRune(nonPortableChars, r)
+		}
+		if !escape {
+			out = append(out, string(r)...)
+			continue
+		}
+		for _, b := range []byte(string(r)) {
+			out = append(out, fmt.Sprintf("%%%02X", b)...)
+		}
+	}
+	return string(out)
+}
+
+// unescapeFolderComponent reverts escapeFolderComponent
+func unescapeFolderComponent(c string) string {
+	var out []byte
+	for i := 0; i < len(c); i++ {
+		if c[i] == '%' && i+2 < len(c) && isHexDigit(c[i+1]) && isHexDigit(c[i+2]) {
+			b, _ := strconv.ParseUint(c[i+1:i+3], 16, 8)
+			out = append(out, byte(b))
+			i += 2
+			continue
+		}
+		out = append(out, c[i])
+	}
+	return string(out)
+}
+
+// FolderToEscapedStorePath is like FolderToStorePath but every name
+// component is escaped, so a component containing the separator cannot be
+// confused with a subfolder. Use it to build filesystem paths.
+func FolderToEscapedStorePath(name foldername, separator rune, portable bool) string {
+	components := make([]string, len(name))
+	for i, c := range name {
+		components[i] = escapeFolderComponent(c, separator, portable)
+	}
+	return strings.Join(components, string(separator))
+}
+
+// EscapedStorePathToFolder reverts FolderToEscapedStorePath
+func EscapedStorePathToFolder(path string, separator rune) foldername {
+	components := strings.Split(path, string(separator))
+	name := make(foldername, len(components))
+	for i, c := range components {
+		name[i] = unescapeFolderComponent(c)
+	}
+	return name
+}
+
+// hasEscapeSequence reports if path contains a "%XX" sequence that
+// EscapedStorePathToFolder reads as an escaped character
+func hasEscapeSequence(path string) bool {
+	for i := 0; i+2 < len(path); i++ {
+		if path[i] == '%' && isHexDigit(path[i+1]) && isHexDigit(path[i+2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapedNamesMarker is created in a store metadata dir when the folder
+// names in it are escaped. Older versions saved them unescaped.
+const escapedNamesMarker = "escapednames"
+
+// hasEscapedNames reports if the folder names in the store metadatadir are
+// escaped
+func hasEscapedNames(metadatadir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(metadatadir, escapedNamesMarker))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// escapeMetadataNames renames the folder metadata dirs saved unescaped by
+// an older version in the store metadatadir to their folderMetadataPath,
+// then creates escapedNamesMarker. Nothing is done if the marker exists.
+func escapeMetadataNames(metadatadir string, dryrun bool) error {
+	escaped, err := hasEscapedNames(metadatadir)
+	if err != nil || escaped {
+		return err
+	}
+	if _, err = os.Stat(metadatadir); os.IsNotExist(err) && dryrun {
+		return nil
+	}
+
+	var dirs []string
+	err = filepath.Walk(metadatadir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != metadatadir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The subdirs are renamed before their parent
+	for i := len(dirs) - 1; i >= 0; i-- {
+		base := filepath.Base(dirs[i])
+		escapedbase := escapeFolderComponent(base, os.PathSeparator, false)
+		if escapedbase == base {
+			continue
+		}
+		if dryrun {
+			return fmt.Errorf("the folder metadata dir \"%s\" must be renamed to its escaped name, sync without dryrun to rename it", dirs[i])
+		}
+		if err = os.Rename(dirs[i], filepath.Join(filepath.Dir(dirs[i]), escapedbase)); err != nil {
+			return err
+		}
+	}
+	if dryrun {
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(metadatadir, escapedNamesMarker), nil, true)
+}
+
+// folderMetadataPath returns the path, relative to a metadata dir, where
+// the metadata of folder name are saved
+func folderMetadataPath(name foldername) string {
+	return FolderToEscapedStorePath(name, os.PathSeparator, false)
+}
+
 func MkdirIfNotExists(name string) (err error) {
 	if _, err = os.Stat(name); os.IsNotExist(err) {
 		err = os.Mkdir(name, 0777)
@@ -57,6 +209,60 @@ func MkdirIfNotExists(name string) (err error) {
 	return
 }
 
+// syncDir fsyncs a directory so new, renamed or removed entries are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory of
+// path and then renames it to path. If dosync is true the file and its
+// directory are fsynced, so after a crash path contains the old or the new
+// data but never a partial write.
+func writeFileAtomic(path string, data []byte, dosync bool) (err error) {
+	dir := filepath.Dir(path)
+	fo, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmppath := fo.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmppath)
+		}
+	}()
+
+	if _, err = fo.Write(data); err != nil {
+		fo.Close()
+		return err
+	}
+	if dosync {
+		if err = fo.Sync(); err != nil {
+			fo.Close()
+			return err
+		}
+	}
+	if err = fo.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmppath, path); err != nil {
+		return err
+	}
+	if dosync {
+		if err = syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type runeSlice []rune
 
 func (s runeSlice) Len() int           { return len(s) }
@@ -92,6 +298,34 @@ func removeFlags(flags string, newflags string) string {
 	return CleanFlags(outflags)
 }
 
+// applyFolderRoles sets the roles of the folders declared in the store
+// config
+func applyFolderRoles(store StoreManager, folders []*Mailfolder) {
+	for _, folderrole := range store.Config().Folderroles {
+		for _, f := range folders {
+			if FolderToStorePath(f.Name, '/') == folderrole[0] {
+				f.Role = folderrole[1]
+			}
+		}
+	}
+}
+
+// applySubscriptions excludes the folders not subscribed (but INBOX)
+func applySubscriptions(store StoreManager, folders []*Mailfolder, subscribed []foldername) {
+next:
+	for _, f := range folders {
+		if len(f.Name) == 1 && f.Name[0] == "INBOX" {
+			continue
+		}
+		for _, name := range subscribed {
+			if StrsEquals(name, f.Name) {
+				continue next
+			}
+		}
+		store.SetFolderExcluded(f.Name, true)
+	}
+}
+
 func applyRegExpPatterns(store StoreManager, folders []*Mailfolder) error {
 	rps := make([]*RegexpPattern, 0)
 	for _, p := range store.Config().RegexpPatterns {
@@ -116,12 +350,12 @@ next:
 		}
 		for _, rp := range rps {
 			if rp.not == false {
-				if !rp.re.MatchString(FolderToStorePath(f.Name, separator)) {
+				if !rp.match(f, separator) {
 					store.SetFolderExcluded(f.Name, true)
 					continue next
 				}
 			} else {
-				if rp.re.MatchString(FolderToStorePath(f.Name, separator)) {
+				if rp.match(f, separator) {
 					store.SetFolderExcluded(f.Name, true)
 					continue next
 				}
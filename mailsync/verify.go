@@ -0,0 +1,143 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package mailsync
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sgotti/gomailsync/errors"
+)
+
+// VerifyProblem is a syncstatus entry not matching the store messages
+type VerifyProblem struct {
+	// The store folder name
+	Folder  foldername
+	Store   string
+	UID     uint32
+	Problem string
+}
+
+// VerifyFolder reads the synced messages of a folder and compares them
+// with the identity recorded in the syncstatus, finding the uids reused by
+// other messages and the changed messages. It also finds the uids in
+// multiple syncstatus entries. The messages deleted since the last sync,
+// the entries synced by older versions (without identity) and the POP3
+// messages removed from the server after the download are skipped.
+// It returns the problems and the number of verified messages.
+func (s *Syncgroup) VerifyFolder(folder Mailfolder) ([]*VerifyProblem, int, error) {
+	logprefix := fmt.Sprintf("%s %s %s", "syncgroup", s.name, folder)
+	e := errors.New(logprefix)
+
+	f, err := s.openFolder(folder, false)
+	if err != nil {
+		return nil, 0, e.E(err)
+	}
+	defer f.Close()
+
+	es, ok := f.syncstatus.(entriesSyncstatus)
+	if !ok {
+		return nil, 0, e.E(fmt.Errorf("Cannot copy syncstatus %T", f.syncstatus))
+	}
+	entries, err := es.getEntries()
+	if err != nil {
+		return nil, 0, e.E(err)
+	}
+
+	mapping := s.getFolderMapping()
+	problems := make([]*VerifyProblem, 0)
+	addProblem := func(i int, uid uint32, format string, args ...interface{}) {
+		problems = append(problems, &VerifyProblem{
+			Folder:  mapping.storeFolderName(folder.Name, Storenumber(i)),
+			Store:   s.stores[i].Name(),
+			UID:     uid,
+			Problem: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for i := range s.stores {
+		count := make(map[uint32]int)
+		for _, entry := range entries {
+			count[entry.uids[i]]++
+		}
+		uids := make([]uint32, 0)
+		for uid, n := range count {
+			if n > 1 {
+				uids = append(uids, uid)
+			}
+		}
+		sort.Sort(Uint32Slice(uids))
+		for _, uid := range uids {
+			addProblem(i, uid, "uid in %d syncstatus entries", count[uid])
+		}
+	}
+
+	verified := 0
+	for _, entry := range entries {
+		if entry.messageid == "" && entry.hash == "" {
+			continue
+		}
+		for i := range s.stores {
+			uid := entry.uids[i]
+			if !f.folders[i].HasUID(uid) || downloadRemoved(f.folders[i], uid) {
+				continue
+			}
+			body, err := f.folders[i].ReadMessage(uid)
+			if err != nil {
+				return nil, 0, e.E(err)
+			}
+			verified++
+			identity := newMessageIdentity(body)
+			switch {
+			case identity.messageid != entry.messageid:
+				addProblem(i, uid, "uid reused by another message: Message-ID %q, synced %q", identity.messageid, entry.messageid)
+			case !entry.sameContent(identity):
+				addProblem(i, uid, "message changed: %d bytes, synced %d bytes", identity.size, entry.size)
+			}
+		}
+	}
+	return problems, verified, nil
+}
+
+// Verify verifies all the syncgroup folders (see VerifyFolder)
+func (s *Syncgroup) Verify() ([]*VerifyProblem, int, error) {
+	folders, err := s.getSyncFolders()
+	if err != nil {
+		return nil, 0, s.e.E(err)
+	}
+	// Verify the folders sorted by name
+	byname := make(map[string]Mailfolder, len(folders))
+	names := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		byname[folder.String()] = folder
+		names = append(names, folder.String())
+	}
+	sort.Strings(names)
+
+	problems := make([]*VerifyProblem, 0)
+	verified := 0
+	for _, name := range names {
+		folderproblems, n, err := s.VerifyFolder(byname[name])
+		if err != nil {
+			return nil, 0, err
+		}
+		problems = append(problems, folderproblems...)
+		verified += n
+	}
+	return problems, verified, nil
+}
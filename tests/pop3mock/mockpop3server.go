@@ -0,0 +1,351 @@
+// GOMailSync
+// Copyright (C) 2014 Simone Gotti <simone.gotti@gmail.com>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+// A POP3 server with an in memory maildrop to test POP3 clients
+package pop3mock
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const timestamp = "<1896.697170952@pop3mock.example.com>"
+
+type Message struct {
+	UIDL string
+	Body []byte
+}
+
+type Server struct {
+	*testing.T
+	sync.Mutex
+
+	l         net.Listener
+	tlsconfig *tls.Config
+	username  string
+	password  string
+	messages  []*Message
+	locked    bool
+
+	// Received commands (passwords excluded)
+	Commands []string
+}
+
+func newLocalListener() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic(fmt.Sprintf("mockpop3server: failed to listen on a port: %v", err))
+		}
+	}
+	return l
+}
+
+// newTLSConfig returns a config with a self signed certificate
+func newTLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pop3mock"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// NewMockPOP3Server starts a POP3 server (supporting STLS) accepting the
+// given credentials with USER/PASS and APOP. If usetls is true the
+// connections are TLS from the start (like on port 995).
+func NewMockPOP3Server(T *testing.T, username string, password string, usetls bool) *Server {
+	s := &Server{
+		T:         T,
+		l:         newLocalListener(),
+		tlsconfig: newTLSConfig(),
+		username:  username,
+		password:  password,
+		messages:  make([]*Message, 0),
+	}
+	if usetls {
+		s.l = tls.NewListener(s.l, s.tlsconfig)
+	}
+	go s.serve()
+	return s
+}
+
+func (s *Server) GetServerAddress() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *Server) Close() error {
+	return s.l.Close()
+}
+
+func (s *Server) AddMessage(uidl string, body []byte) {
+	s.Lock()
+	defer s.Unlock()
+	s.messages = append(s.messages, &Message{UIDL: uidl, Body: body})
+}
+
+// Messages returns the messages in the maildrop
+func (s *Server) Messages() []*Message {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*Message{}, s.messages...)
+}
+
+func (s *Server) logCommand(cmd string) {
+	s.Lock()
+	defer s.Unlock()
+	s.Commands = append(s.Commands, cmd)
+}
+
+func (s *Server) serve() {
+	for {
+		cn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(cn)
+	}
+}
+
+type session struct {
+	s        *Server
+	cn       net.Conn
+	rw       *bufio.ReadWriter
+	user     string
+	auth     bool
+	messages []*Message
+	deleted  map[int]bool
+}
+
+func (c *session) writeLine(format string, args ...interface{}) {
+	fmt.Fprintf(c.rw, format+"\r\n", args...)
+	c.rw.Flush()
+}
+
+func (c *session) message(arg string) (int, *Message, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(c.messages) || c.deleted[n] {
+		c.writeLine("-ERR no such message")
+		return 0, nil, false
+	}
+	return n, c.messages[n-1], true
+}
+
+func (s *Server) handle(cn net.Conn) {
+	c := &session{s: s, cn: cn, rw: bufio.NewReadWriter(bufio.NewReader(cn), bufio.NewWriter(cn)), deleted: make(map[int]bool)}
+	defer func() {
+		if c.auth {
+			s.Lock()
+			s.locked = false
+			s.Unlock()
+		}
+		c.cn.Close()
+	}()
+
+	c.writeLine("+OK POP3 server ready %s", timestamp)
+	for {
+		line, err := c.rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+		if len(fields) == 0 {
+			c.writeLine("-ERR empty command")
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		args := fields[1:]
+		if cmd == "PASS" {
+			s.logCommand("PASS")
+		} else {
+			s.logCommand(strings.Join(append([]string{cmd}, args...), " "))
+		}
+
+		if !c.auth {
+			switch cmd {
+			case "CAPA":
+				c.writeLine("+OK")
+				c.writeLine("UIDL")
+				c.writeLine("USER")
+				c.writeLine("STLS")
+				c.writeLine(".")
+			case "STLS":
+				c.writeLine("+OK begin TLS negotiation")
+				tlscn := tls.Server(c.cn, s.tlsconfig)
+				if err := tlscn.Handshake(); err != nil {
+					return
+				}
+				c.cn = tlscn
+				c.rw = bufio.NewReadWriter(bufio.NewReader(tlscn), bufio.NewWriter(tlscn))
+			case "USER":
+				if len(args) != 1 {
+					c.writeLine("-ERR wrong arguments")
+					continue
+				}
+				c.user = args[0]
+				c.writeLine("+OK")
+			case "PASS":
+				c.login(c.user == s.username && len(args) == 1 && args[0] == s.password)
+			case "APOP":
+				digest := fmt.Sprintf("%x", md5.Sum([]byte(timestamp+s.password)))
+				c.login(len(args) == 2 && args[0] == s.username && args[1] == digest)
+			case "QUIT":
+				c.writeLine("+OK bye")
+				return
+			default:
+				c.writeLine("-ERR unknown command")
+			}
+			continue
+		}
+
+		switch cmd {
+		case "STAT":
+			count, size := 0, 0
+			for i, m := range c.messages {
+				if !c.deleted[i+1] {
+					count++
+					size += len(m.Body)
+				}
+			}
+			c.writeLine("+OK %d %d", count, size)
+		case "LIST", "UIDL":
+			if len(args) == 1 {
+				n, m, ok := c.message(args[0])
+				if !ok {
+					continue
+				}
+				if cmd == "LIST" {
+					c.writeLine("+OK %d %d", n, len(m.Body))
+				} else {
+					c.writeLine("+OK %d %s", n, m.UIDL)
+				}
+				continue
+			}
+			c.writeLine("+OK")
+			for i, m := range c.messages {
+				if c.deleted[i+1] {
+					continue
+				}
+				if cmd == "LIST" {
+					c.writeLine("%d %d", i+1, len(m.Body))
+				} else {
+					c.writeLine("%d %s", i+1, m.UIDL)
+				}
+			}
+			c.writeLine(".")
+		case "RETR":
+			if len(args) != 1 {
+				c.writeLine("-ERR wrong arguments")
+				continue
+			}
+			_, m, ok := c.message(args[0])
+			if !ok {
+				continue
+			}
+			c.writeLine("+OK %d octets", len(m.Body))
+			for _, l := range strings.SplitAfter(string(m.Body), "\n") {
+				if l == "" {
+					continue
+				}
+				l = strings.TrimRight(l, "\r\n")
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				c.writeLine("%s", l)
+			}
+			c.writeLine(".")
+		case "DELE":
+			if len(args) != 1 {
+				c.writeLine("-ERR wrong arguments")
+				continue
+			}
+			n, _, ok := c.message(args[0])
+			if !ok {
+				continue
+			}
+			c.deleted[n] = true
+			c.writeLine("+OK message %d deleted", n)
+		case "RSET":
+			c.deleted = make(map[int]bool)
+			c.writeLine("+OK")
+		case "NOOP":
+			c.writeLine("+OK")
+		case "QUIT":
+			// Enter the UPDATE state
+			s.Lock()
+			messages := make([]*Message, 0)
+			for _, m := range s.messages {
+				deleted := false
+				for n := range c.deleted {
+					if c.messages[n-1] == m {
+						deleted = true
+					}
+				}
+				if !deleted {
+					messages = append(messages, m)
+				}
+			}
+			s.messages = messages
+			s.Unlock()
+			c.writeLine("+OK bye")
+			return
+		default:
+			c.writeLine("-ERR unknown command")
+		}
+	}
+}
+
+func (c *session) login(ok bool) {
+	if !ok {
+		c.writeLine("-ERR authentication failed")
+		return
+	}
+	c.s.Lock()
+	defer c.s.Unlock()
+	if c.s.locked {
+		c.writeLine("-ERR maildrop already locked")
+		return
+	}
+	c.s.locked = true
+	c.auth = true
+	c.messages = append([]*Message{}, c.s.messages...)
+	c.writeLine("+OK maildrop locked and ready")
+}